@@ -0,0 +1,304 @@
+package main
+
+import (
+	"github.com/hardboiledalex/go-tools/lib/logging"
+	"github.com/hardboiledalex/go-tools/lib/ssh"
+	"github.com/hardboiledalex/go-tools/lib/utils"
+	"fmt"
+	"github.com/melbahja/goph"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Backs up the jobs given by --job or all configured jobs into their repositories, each between its pre and post hooks
+// A failed job does not stop the others, the command fails if any job failed
+func runBackup(config *Config, args []string) error {
+	flags := newFlagSet("backup", "")
+	var jobNames stringList
+	var options backupOptions
+	flags.Var(&jobNames, "job", "name of the job to run, may be repeated, all jobs by default")
+	flags.StringVar(&options.backupType, "type", backupFull, "type of the backup: full, incremental or differential")
+	flags.BoolVar(&options.checksum, "checksum", false, "detect changed files by their checksum besides size, time and mode")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return newUsageError("backup: unexpected arguments %v", flags.Args())
+	}
+	if err := validateBackupType(options.backupType); err != nil {
+		return err
+	}
+
+	jobs, err := config.selectJobs(jobNames)
+	if err != nil {
+		return err
+	}
+	if len(jobs) == 0 {
+		return newUsageError("no jobs configured")
+	}
+	repos := make(map[string]*repository)
+	for _, job := range jobs {
+		root := config.jobRepository(job)
+		if repos[root] != nil {
+			continue
+		}
+		repo, err := createRepository(root)
+		if err != nil {
+			return err
+		}
+		unlock, err := repo.lock(false)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+		repos[root] = repo
+	}
+
+	options.storage = config.Storage
+	keys := newKeyStore(config)
+	failed := 0
+	for _, job := range jobs {
+		repo := repos[config.jobRepository(job)]
+		err := runWithHooks(job, func() error {
+			_, err := backupJob(repo, keys, job, options)
+			return err
+		})
+		if err != nil {
+			logging.LogErrorf("Backup of job %s failed: %v", job.Name, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d jobs failed", failed, len(jobs))
+	}
+	return nil
+}
+
+// Options of a backup run
+type backupOptions struct {
+	backupType string
+	checksum   bool
+	storage    string
+}
+
+// Packs all paths of all hosts of the job into a new backup
+// Incremental or differential backup without a base to compare with is made as full backup.
+// The backup is committed only if every archive was written
+// Returns manifest of the backup and error if happened
+func backupJob(repo *repository, keys *keyStore, job Job, options backupOptions) (*manifest, error) {
+	compression, err := parseCompression(job.Compression)
+	if err != nil {
+		return nil, err
+	}
+	checksumKey, err := keys.jobKey(job.Name, job.Encryption.Mode, true)
+	if err != nil {
+		return nil, err
+	}
+	checksum := ""
+	if checksumKey != nil {
+		checksum = checksumKeyed
+	}
+	base, err := findBase(repo, job.Name, options.backupType)
+	if err != nil {
+		return nil, err
+	}
+	if base != nil && !base.hasChecksum(checksum) {
+		logging.LogInfof("Checksums of base %s cannot be compared since the encryption of job %s changed", base.ID, job.Name)
+		base = nil
+	}
+	backupType := options.backupType
+	if base == nil && backupType != backupFull {
+		logging.LogInfof("No base for %s backup of job %s, making full backup", backupType, job.Name)
+		backupType = backupFull
+	}
+
+	started := time.Now().UTC()
+	id, err := repo.create(job.Name, started)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create backup: %v", err)
+	}
+	m := &manifest{ID: id, Job: job.Name, Type: backupType, ToolVersion: version, Started: started}
+	if base != nil {
+		m.Base = base.ID
+		logging.LogInfof("Starting %s backup %s based on %s", backupType, id, base.ID)
+	} else {
+		logging.LogInfof("Starting backup %s", id)
+	}
+
+	for _, host := range job.sources() {
+		archives, err := backupHost(repo, keys, checksumKey, m, base, job, host, compression, options)
+		if err != nil {
+			repo.discard(id)
+			return nil, fmt.Errorf("%s: %v", host.Address, err)
+		}
+		m.Hosts = append(m.Hosts, host.Address)
+		m.Archives = append(m.Archives, archives...)
+	}
+	m.Finished = time.Now().UTC()
+	if err := writeManifest(repo.partialPath(id, manifestFileName), m); err != nil {
+		repo.discard(id)
+		return nil, err
+	}
+	if err := repo.commit(id); err != nil {
+		repo.discard(id)
+		return nil, err
+	}
+	logging.LogSuccessf("Backup %s completed: %d archives, %d files, %s", id, len(m.Archives), m.files(), utils.BytesToString(int(m.size())))
+	return m, nil
+}
+
+// Packs the paths of the host, only the changes since the archive of the base if it has one for the path
+// Chunked archives are packed uncompressed as their chunks are compressed one by one.
+// Entry checksums are keyed with checksumKey unless it is nil
+func backupHost(repo *repository, keys *keyStore, checksumKey *jobKey, m *manifest, base *manifest, job Job, host Host, compression ssh.ArchiveCompression, options backupOptions) ([]archive, error) {
+	client, err := connect(host)
+	if err != nil {
+		return nil, err
+	}
+	defer ssh.SafeCloseClient(client)
+
+	if err := os.Mkdir(repo.partialPath(m.ID, host.Address), 0700); err != nil {
+		return nil, err
+	}
+	var store *chunkStore
+	if options.storage == storageChunks {
+		store = repo.chunks()
+		compression = ssh.CompressionNone
+	}
+	var archives []archive
+	for i, sourcePath := range job.Paths {
+		tarOptions := ssh.TarOptions{Compression: compression, Exclude: job.Exclude}
+		var changes *changeSet
+		var reference *archive
+		if base != nil {
+			reference = base.findArchive(host.Address, sourcePath)
+		}
+		if reference != nil {
+			if changes, err = findChanges(client, sourcePath, job.Exclude, reference, options.checksum, checksumKey); err != nil {
+				return nil, fmt.Errorf("cannot compare %s with %s: %v", sourcePath, base.ID, err)
+			}
+			tarOptions.Files = changes.files
+		}
+
+		// Chunks are encrypted with the job key, the archive key encrypts whole archives only
+		var key *archiveKey
+		if store == nil {
+			if key, err = keys.newArchiveKey(job); err != nil {
+				return nil, err
+			}
+		}
+		file := filepath.Join(host.Address, fmt.Sprintf("%02d%s", i, archiveExtension(compression, key != nil, store != nil)))
+		logging.LogInfof("Packing %s:%s", host.Address, sourcePath)
+		size, entries, err := packArchive(client, sourcePath, repo.partialPath(m.ID, file), key, checksumKey, store, tarOptions)
+		if err != nil {
+			return nil, fmt.Errorf("cannot pack %s: %v", sourcePath, err)
+		}
+		a := archive{
+			Host:        host.Address,
+			Path:        sourcePath,
+			File:        file,
+			Compression: compressionName(compression),
+			Encryption:  job.Encryption.Mode,
+			Storage:     options.storage,
+			Size:        size,
+			Entries:     entries,
+		}
+		if checksumKey != nil {
+			a.Checksum = checksumKeyed
+		}
+		if changes != nil {
+			a.Base = base.ID
+			a.Entries = append(a.Entries, changes.inherited...)
+			a.Deleted = changes.deleted
+			logging.LogInfof("%s:%s: %d entries changed, %d unchanged, %d deleted", host.Address, sourcePath,
+				len(entries), len(changes.inherited), len(changes.deleted))
+		}
+		archives = append(archives, a)
+	}
+	return archives, nil
+}
+
+// Writes the directory as archive file, encrypted with the key unless it is nil, and flushes it to the disk
+// Entry checksums are keyed with checksumKey unless it is nil
+// With the chunk store the archive is split into chunks and the file is its chunk list.
+// The archive stream is indexed while it is written, so files are hashed exactly as they were archived
+// Returns size of the archive, its entries and error if happened
+func packArchive(client *goph.Client, directory string, archivePath string, key *archiveKey, checksumKey *jobKey, store *chunkStore, options ssh.TarOptions) (int64, []fileEntry, error) {
+	file, err := os.OpenFile(archivePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer file.Close()
+
+	pipeReader, pipeWriter := io.Pipe()
+	type indexResult struct {
+		entries []fileEntry
+		err     error
+	}
+	indexed := make(chan indexResult, 1)
+	go func() {
+		entries, err := indexArchive(pipeReader, options.Compression, checksumKey)
+		pipeReader.CloseWithError(err)
+		indexed <- indexResult{entries, err}
+	}()
+
+	var target io.Writer = file
+	var encryptor *encryptWriter
+	var chunker *chunkWriter
+	if store != nil {
+		chunker = newChunkWriter(store, file, checksumKey)
+		target = chunker
+	} else if key != nil {
+		if encryptor, err = newEncryptWriter(file, key); err != nil {
+			return 0, nil, err
+		}
+		target = encryptor
+	}
+
+	_, err = ssh.PackDirectory(client, directory, io.MultiWriter(target, pipeWriter), options)
+	pipeWriter.CloseWithError(err)
+	result := <-indexed
+	if result.err != nil {
+		return 0, nil, fmt.Errorf("cannot index archive: %v", result.err)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	if encryptor != nil {
+		if err := encryptor.Close(); err != nil {
+			return 0, nil, err
+		}
+	}
+	if chunker != nil {
+		if err := chunker.Close(); err != nil {
+			return 0, nil, err
+		}
+		logging.LogInfof("Stored %s of new chunks for %s", utils.BytesToString(int(chunker.stored)), utils.BytesToString(int(chunker.size)))
+	}
+	if err := file.Sync(); err != nil {
+		return 0, nil, err
+	}
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return 0, nil, err
+	}
+	size := fileInfo.Size()
+	if chunker != nil {
+		size = chunker.size
+	}
+	return size, result.entries, file.Close()
+}
+
+// Flag which may be given several times
+type stringList []string
+
+func (list *stringList) String() string {
+	return fmt.Sprint(*list)
+}
+
+func (list *stringList) Set(value string) error {
+	*list = append(*list, value)
+	return nil
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Creates a small tree with nested directory, symlink and a file to be excluded
+func createSourceTree(t *testing.T) string {
+	source := filepath.Join(t.TempDir(), "source")
+	require.NoError(t, os.MkdirAll(filepath.Join(source, "conf", "nested"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(source, "conf", "app.yaml"), []byte("key: value\n"), 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(source, "conf", "nested", "extra.yaml"), []byte("extra: true\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(source, "conf", "app.tmp"), []byte("temporary"), 0644))
+	require.NoError(t, os.Symlink("conf/app.yaml", filepath.Join(source, "current.yaml")))
+	return source
+}
+
+func newTestConfig(t *testing.T, source string) *Config {
+	return &Config{
+		Repository: filepath.Join(t.TempDir(), "repository"),
+		Jobs: []Job{{
+			Name:    "local",
+			Paths:   []string{source},
+			Exclude: []string{"*.tmp"},
+		}},
+	}
+}
+
+func TestBackupRestore(t *testing.T) {
+	source := createSourceTree(t)
+	config := newTestConfig(t, source)
+	require.NoError(t, runBackup(config, nil))
+
+	repo, err := openRepository(config.Repository)
+	require.NoError(t, err)
+	backups, err := repo.backups()
+	require.NoError(t, err)
+	require.Len(t, backups, 1)
+	m := backups[0]
+	assert.Equal(t, "local", m.Job)
+	require.Len(t, m.Archives, 1)
+	assert.Equal(t, localHostAddress, m.Archives[0].Host)
+	assert.Equal(t, source, m.Archives[0].Path)
+	assert.Equal(t, []string{localHostAddress}, m.Hosts)
+	assert.Equal(t, version, m.ToolVersion)
+	assert.False(t, m.Finished.Before(m.Started))
+	assert.NoError(t, runVerify(config, nil))
+
+	// Manifest describes every archived file with its checksum
+	var appEntry *fileEntry
+	for i, entry := range m.Archives[0].Entries {
+		assert.NotEqual(t, "conf/app.tmp", entry.Path, "Excluded file must not be in the manifest")
+		if entry.Path == "conf/app.yaml" {
+			appEntry = &m.Archives[0].Entries[i]
+		}
+	}
+	require.NotNil(t, appEntry)
+	assert.Equal(t, entryFile, appEntry.Type)
+	assert.Equal(t, int64(11), appEntry.Size)
+	assert.Equal(t, "0600", appEntry.Mode)
+	assert.Equal(t, os.Getuid(), appEntry.UID)
+	assert.Equal(t, fmt.Sprintf("%x", sha256.Sum256([]byte("key: value\n"))), appEntry.SHA256)
+	assert.Equal(t, 2, m.files(), "Directories and symlinks are not counted as files")
+
+	target := t.TempDir()
+	require.NoError(t, runRestore(config, []string{"--target", target, m.ID}))
+	restored := filepath.Join(target, localHostAddress, source)
+	content, err := ioutil.ReadFile(filepath.Join(restored, "conf", "app.yaml"))
+	require.NoError(t, err)
+	assert.Equal(t, "key: value\n", string(content))
+	fileInfo, err := os.Stat(filepath.Join(restored, "conf", "app.yaml"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), fileInfo.Mode().Perm())
+	assert.FileExists(t, filepath.Join(restored, "conf", "nested", "extra.yaml"))
+	linkTarget, err := os.Readlink(filepath.Join(restored, "current.yaml"))
+	require.NoError(t, err)
+	assert.Equal(t, "conf/app.yaml", linkTarget)
+	assert.NoFileExists(t, filepath.Join(restored, "conf", "app.tmp"), "Excluded file must not be backed up")
+}
+
+func TestBackupFailureLeavesNoBackup(t *testing.T) {
+	config := newTestConfig(t, createSourceTree(t))
+	config.Jobs[0].Paths = append(config.Jobs[0].Paths, filepath.Join(t.TempDir(), "missing"))
+
+	assert.Error(t, runBackup(config, nil))
+	entries, err := ioutil.ReadDir(config.Repository)
+	require.NoError(t, err)
+	require.Len(t, entries, 1, "Failed backup must be removed completely")
+	assert.Equal(t, lockFileName, entries[0].Name())
+}
+
+func TestJobRepositories(t *testing.T) {
+	source := createSourceTree(t)
+	config := newTestConfig(t, source)
+	config.Jobs = append(config.Jobs, Job{Name: "own", Repository: filepath.Join(t.TempDir(), "own"), Paths: []string{source}})
+	require.NoError(t, runBackup(config, nil))
+	require.NoError(t, runBackup(config, []string{"--job", "own"}))
+
+	backupsOf := func(root string) []*manifest {
+		repo, err := openRepository(root)
+		require.NoError(t, err)
+		backups, err := repo.backups()
+		require.NoError(t, err)
+		return backups
+	}
+	shared, own := backupsOf(config.Repository), backupsOf(config.Jobs[1].Repository)
+	require.Len(t, shared, 1)
+	assert.Equal(t, "local", shared[0].Job)
+	require.Len(t, own, 2, "Job with its own repository must be stored there")
+	assert.Equal(t, "own", own[0].Job)
+
+	// Commands reading backups find them in every repository
+	assert.NoError(t, runList(config, nil))
+	assert.NoError(t, runCheck(config, nil))
+	_, report := verifyJSON(t, config)
+	assert.Equal(t, 3, report.Passed)
+	target := t.TempDir()
+	require.NoError(t, runRestore(config, []string{"--target", target, own[1].ID}))
+	assert.FileExists(t, filepath.Join(target, localHostAddress, source, "conf", "app.yaml"))
+
+	require.NoError(t, runPrune(config, []string{"--keep-last", "1"}))
+	assert.Len(t, backupsOf(config.Jobs[1].Repository), 1, "Prune must apply to the repository of the job")
+	assert.Len(t, backupsOf(config.Repository), 1)
+}
+
+func TestVerifyDetectsCorruption(t *testing.T) {
+	config := newTestConfig(t, createSourceTree(t))
+	require.NoError(t, runBackup(config, nil))
+	repo, err := openRepository(config.Repository)
+	require.NoError(t, err)
+	backups, err := repo.backups()
+	require.NoError(t, err)
+	archivePath := repo.path(backups[0].ID, backups[0].Archives[0].File)
+
+	// Same size, damaged content must fail the gzip checksum
+	data, err := ioutil.ReadFile(archivePath)
+	require.NoError(t, err)
+	data[len(data)/2] ^= 0xff
+	require.NoError(t, ioutil.WriteFile(archivePath, data, 0600))
+	assert.Equal(t, errVerificationFailed, runVerify(config, nil))
+
+	// Truncated archive must fail as well
+	require.NoError(t, ioutil.WriteFile(archivePath, data[:len(data)/2], 0600))
+	assert.Equal(t, errVerificationFailed, runVerify(config, []string{backups[0].ID}))
+	assert.Equal(t, exitVerificationFailed, exitCode(errVerificationFailed))
+}
+
+func TestVerifyDetectsManifestMismatch(t *testing.T) {
+	config := newTestConfig(t, createSourceTree(t))
+	require.NoError(t, runBackup(config, nil))
+	repo, err := openRepository(config.Repository)
+	require.NoError(t, err)
+	backups, err := repo.backups()
+	require.NoError(t, err)
+	m := backups[0]
+
+	// Intact archive whose content does not match the recorded checksum must fail
+	for i, entry := range m.Archives[0].Entries {
+		if entry.Type == entryFile {
+			m.Archives[0].Entries[i].SHA256 = strings.Repeat("0", 64)
+			break
+		}
+	}
+	require.NoError(t, writeManifest(repo.path(m.ID, manifestFileName), m))
+	assert.Equal(t, errVerificationFailed, runVerify(config, nil))
+}
+
+func TestLoadConfig(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, ioutil.WriteFile(configPath, []byte(`
+repository: /var/backups/cdf
+jobs:
+  - name: cdf
+    hosts:
+      - address: node1.example.com
+        port: 2222
+    paths: [/opt/arcsight/kubernetes/cfg]
+    compression: none
+  - name: db
+    repository: /var/backups/db
+    paths: [/var/lib/db]
+`), 0600))
+	config, err := loadConfig(configPath, true)
+	require.NoError(t, err)
+	assert.Equal(t, "/var/backups/cdf", config.Repository)
+	assert.Equal(t, "/var/backups/cdf", config.jobRepository(config.Jobs[0]), "Job without a repository must use the global one")
+	assert.Equal(t, "/var/backups/db", config.jobRepository(config.Jobs[1]))
+	assert.Equal(t, []string{"/var/backups/cdf", "/var/backups/db"}, config.repositories())
+	assert.Equal(t, uint(2222), config.findHost("cdf", "node1.example.com").Port)
+
+	_, err = loadConfig(filepath.Join(t.TempDir(), "missing.yaml"), true)
+	assert.Error(t, err, "Explicitly given configuration must exist")
+	config, err = loadConfig(filepath.Join(t.TempDir(), "missing.yaml"), false)
+	require.NoError(t, err)
+	assert.Empty(t, config.Jobs)
+
+	require.NoError(t, ioutil.WriteFile(configPath, []byte("jobs:\n  - name: bad/name\n    paths: [/etc]\n"), 0600))
+	_, err = loadConfig(configPath, true)
+	assert.Error(t, err, "Job name with a slash must be rejected")
+}
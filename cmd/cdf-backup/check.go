@@ -0,0 +1,182 @@
+package main
+
+import (
+	"github.com/hardboiledalex/go-tools/lib/logging"
+	"github.com/hardboiledalex/go-tools/lib/utils"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// Checks consistency of the repositories: every manifest is readable, every archive file and chunk it refers to exists
+// With --read-data every chunk is read and its hash checked. Unreferenced chunks and leftovers of interrupted
+// backups are reported but are not errors, the command fails with the verification exit code on any problem
+func runCheck(config *Config, args []string) error {
+	flags := newFlagSet("check", "")
+	readData := flags.Bool("read-data", false, "read every chunk and check its content against its hash")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return newUsageError("check: unexpected arguments %v", flags.Args())
+	}
+	repos, err := openRepositories(config)
+	if err != nil {
+		return err
+	}
+	keys := newKeyStore(config)
+	problems := 0
+	for _, repo := range repos {
+		repoProblems, err := checkRepository(repo, keys, *readData)
+		if err != nil {
+			return err
+		}
+		problems += repoProblems
+	}
+	if problems > 0 {
+		logging.LogErrorf("Repository check found %d problems", problems)
+		return errVerificationFailed
+	}
+	return nil
+}
+
+// Checks the backups and the chunk store of the repository
+// Returns number of problems found and error if the check could not be done
+func checkRepository(repo *repository, keys *keyStore, readData bool) (int, error) {
+	problems := 0
+	report := func(format string, params ...interface{}) {
+		logging.LogErrorf(format, params...)
+		problems++
+	}
+
+	entries, err := ioutil.ReadDir(repo.root)
+	if err != nil {
+		return 0, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && strings.HasSuffix(entry.Name(), partialSuffix) {
+			logging.LogWarnf("%s is left over from an interrupted backup or removal", entry.Name())
+		}
+	}
+
+	ids, err := repo.ids()
+	if err != nil {
+		return 0, err
+	}
+	store := repo.chunks()
+	checked := make(map[string]bool)
+	for _, id := range ids {
+		m, err := repo.load(id)
+		if err != nil {
+			report("%s: %v", id, err)
+			continue
+		}
+		for _, a := range m.Archives {
+			if a.Storage != storageChunks {
+				fileInfo, err := os.Stat(repo.path(id, a.File))
+				if err != nil {
+					report("%s: %v", id, err)
+				} else if fileInfo.Size() != a.Size {
+					report("%s: %s is %d bytes, manifest records %d", id, a.File, fileInfo.Size(), a.Size)
+				}
+				continue
+			}
+			chunks, err := readChunkList(repo.path(id, a.File))
+			if err != nil {
+				report("%s: %v", id, err)
+				continue
+			}
+			var key *jobKey
+			if readData {
+				if key, err = keys.jobKey(m.Job, a.Encryption, false); err != nil {
+					report("%s: %s: %v", id, a.File, err)
+					continue
+				}
+			}
+			for _, chunk := range chunks {
+				if checked[chunk.hash] {
+					continue
+				}
+				checked[chunk.hash] = true
+				if readData {
+					_, err = store.get(chunk, key)
+				} else {
+					_, err = os.Stat(store.path(chunk.hash))
+				}
+				if err != nil {
+					report("%s: %s: %v", id, a.File, err)
+				}
+			}
+		}
+	}
+
+	referenced, err := repo.referencedChunks()
+	if err != nil {
+		report("%v", err)
+	}
+	unreferenced := 0
+	var unreferencedSize int64
+	err = store.walk(func(name string, filePath string, fileInfo os.FileInfo) error {
+		if referenced != nil && !referenced[name] {
+			unreferenced++
+			unreferencedSize += fileInfo.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return problems, err
+	}
+	if unreferenced > 0 {
+		logging.LogInfof("%d unreferenced chunks take %s, gc removes them", unreferenced, utils.BytesToString(int(unreferencedSize)))
+	}
+
+	if problems == 0 {
+		logging.LogSuccessf("Repository %s is consistent: %d backups, %d chunks", repo.root, len(ids), len(checked))
+	}
+	return problems, nil
+}
+
+// Removes chunks no backup refers to from the repositories
+func runGC(config *Config, args []string) error {
+	flags := newFlagSet("gc", "")
+	dryRun := flags.Bool("dry-run", false, "only report what would be removed")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return newUsageError("gc: unexpected arguments %v", flags.Args())
+	}
+	repos, err := openRepositories(config)
+	if err != nil {
+		return err
+	}
+	for _, repo := range repos {
+		if err := collectRepositoryGarbage(repo, *dryRun); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func collectRepositoryGarbage(repo *repository, dryRun bool) error {
+	unlock, err := repo.lock(!dryRun)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return removeUnreferencedChunks(repo, time.Now().Add(-chunkGracePeriod), dryRun)
+}
+
+func removeUnreferencedChunks(repo *repository, olderThan time.Time, dryRun bool) error {
+	removed, freed, err := collectGarbage(repo, olderThan, dryRun)
+	if err != nil {
+		return err
+	}
+	if dryRun {
+		logging.LogInfof("Would remove %d unreferenced chunks, %s", removed, utils.BytesToString(int(freed)))
+	} else if removed > 0 {
+		logging.LogInfof("Removed %d unreferenced chunks, %s", removed, utils.BytesToString(int(freed)))
+	}
+	return nil
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Storage formats of the archives, chunks splits the tar stream into content-defined chunks
+// stored once per content in the chunk store of the repository and keeps only the chunk list in the backup
+const (
+	storageArchives = "archives"
+	storageChunks   = "chunks"
+)
+
+// Chunk boundaries are found with a gear rolling hash over the last 64 bytes,
+// so identical content produces identical chunks wherever it is in the stream
+const (
+	minimumChunkSize   = 256 * 1024
+	averageChunkBits   = 20
+	maximumChunkSize   = 4 * 1024 * 1024
+	chunkDirectory     = "chunks"
+	chunkListExtension = ".chunks"
+	chunkTempPrefix    = ".tmp-"
+)
+
+// Chunks younger than this are never collected as they may belong to a backup being written
+const chunkGracePeriod = time.Hour
+
+var gearTable = newGearTable()
+
+// The table must never change, otherwise new chunks would not match the stored ones
+func newGearTable() [256]uint64 {
+	var table [256]uint64
+	state := uint64(0x6364662d6261636b)
+	for i := range table {
+		// splitmix64
+		state += 0x9e3779b97f4a7c15
+		value := state
+		value = (value ^ (value >> 30)) * 0xbf58476d1ce4e5b9
+		value = (value ^ (value >> 27)) * 0x94d049bb133111eb
+		table[i] = value ^ (value >> 31)
+	}
+	return table
+}
+
+func validateStorage(storage string) error {
+	switch storage {
+	case "", storageArchives, storageChunks:
+		return nil
+	}
+	return fmt.Errorf("unknown storage %q, expected %s or %s", storage, storageArchives, storageChunks)
+}
+
+// Directory of chunks named by SHA-256 of their content, spread over subdirectories by the first two hex digits
+// Every chunk is stored gzip compressed. Chunks of encrypted jobs are named by the keyed hash of the job key
+// and encrypted after the compression, see jobKey.sealChunk
+type chunkStore struct {
+	root string
+}
+
+func (repo *repository) chunks() *chunkStore {
+	return &chunkStore{root: filepath.Join(repo.root, chunkDirectory)}
+}
+
+func (store *chunkStore) path(hash string) string {
+	return filepath.Join(store.root, hash[:2], hash)
+}
+
+// Stores the chunk unless the store has it already, an existing chunk gets its time refreshed
+// so the garbage collection does not remove it while the backup referring to it is being written.
+// The chunk is encrypted with the key unless it is nil
+// Returns number of bytes written to the store and error if happened
+func (store *chunkStore) put(hash string, data []byte, key *jobKey) (int64, error) {
+	chunkPath := store.path(hash)
+	now := time.Now()
+	if err := os.Chtimes(chunkPath, now, now); err == nil {
+		return 0, nil
+	} else if !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(chunkPath), 0700); err != nil {
+		return 0, err
+	}
+	var compressed bytes.Buffer
+	gzipWriter := gzip.NewWriter(&compressed)
+	if _, err := gzipWriter.Write(data); err != nil {
+		return 0, err
+	}
+	if err := gzipWriter.Close(); err != nil {
+		return 0, err
+	}
+	content := compressed.Bytes()
+	if key != nil {
+		var err error
+		if content, err = key.sealChunk(hash, content); err != nil {
+			return 0, err
+		}
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(chunkPath), chunkTempPrefix)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	if _, err := file.Write(content); err != nil {
+		return 0, err
+	}
+	if err := file.Sync(); err != nil {
+		return 0, err
+	}
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if err := file.Close(); err != nil {
+		return 0, err
+	}
+	return fileInfo.Size(), os.Rename(file.Name(), chunkPath)
+}
+
+// Reads the chunk, decrypting it with the key unless it is nil, and checks its size and hash
+// Returns content of the chunk and error if happened
+func (store *chunkStore) get(chunk chunkRef, key *jobKey) ([]byte, error) {
+	content, err := ioutil.ReadFile(store.path(chunk.hash))
+	if err != nil {
+		return nil, err
+	}
+	if key != nil {
+		if content, err = key.openChunk(chunk.hash, content); err != nil {
+			return nil, fmt.Errorf("chunk %s: %v", chunk.hash, err)
+		}
+	}
+	gzipReader, err := gzip.NewReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, fmt.Errorf("chunk %s is damaged: %v", chunk.hash, err)
+	}
+	data, err := ioutil.ReadAll(gzipReader)
+	if err != nil {
+		return nil, fmt.Errorf("chunk %s is damaged: %v", chunk.hash, err)
+	}
+	if int64(len(data)) != chunk.size || key.chunkHash(data) != chunk.hash {
+		return nil, fmt.Errorf("chunk %s is damaged: content does not match its hash", chunk.hash)
+	}
+	return data, nil
+}
+
+// Calls fn for every file of the store with its name and path, missing store has no chunks
+func (store *chunkStore) walk(fn func(name string, filePath string, fileInfo os.FileInfo) error) error {
+	directories, err := ioutil.ReadDir(store.root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, directory := range directories {
+		if !directory.IsDir() {
+			continue
+		}
+		files, err := ioutil.ReadDir(filepath.Join(store.root, directory.Name()))
+		if err != nil {
+			return err
+		}
+		for _, fileInfo := range files {
+			filePath := filepath.Join(store.root, directory.Name(), fileInfo.Name())
+			if err := fn(fileInfo.Name(), filePath, fileInfo); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Chunk of an archive, size is the size of the uncompressed content
+type chunkRef struct {
+	hash string
+	size int64
+}
+
+// Chunk list has one line per chunk with its hash and size
+func readChunkList(listPath string) ([]chunkRef, error) {
+	file, err := os.Open(listPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var chunks []chunkRef
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || len(fields[0]) != sha256.Size*2 {
+			return nil, fmt.Errorf("%s:%d: invalid chunk reference", listPath, line)
+		}
+		if _, err := hex.DecodeString(fields[0]); err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid chunk hash", listPath, line)
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil || size <= 0 || size > maximumChunkSize {
+			return nil, fmt.Errorf("%s:%d: invalid chunk size", listPath, line)
+		}
+		chunks = append(chunks, chunkRef{hash: fields[0], size: size})
+	}
+	return chunks, scanner.Err()
+}
+
+// Splits the written stream into chunks, stores them encrypted with the key unless it is nil and writes the chunk list
+// Close stores the last chunk and must not be skipped
+type chunkWriter struct {
+	store  *chunkStore
+	key    *jobKey
+	list   io.Writer
+	buffer []byte
+	hash   uint64
+	// Size of the stream and bytes added to the store
+	size   int64
+	stored int64
+}
+
+func newChunkWriter(store *chunkStore, list io.Writer, key *jobKey) *chunkWriter {
+	return &chunkWriter{store: store, key: key, list: list, buffer: make([]byte, 0, maximumChunkSize)}
+}
+
+func (writer *chunkWriter) Write(data []byte) (int, error) {
+	written := 0
+	for len(data) > 0 {
+		boundary := writer.findBoundary(data)
+		if boundary < 0 {
+			writer.buffer = append(writer.buffer, data...)
+			return written + len(data), nil
+		}
+		writer.buffer = append(writer.buffer, data[:boundary]...)
+		data = data[boundary:]
+		written += boundary
+		if err := writer.flush(); err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// Returns number of bytes of data which complete the current chunk, -1 if the chunk continues past data
+// Hashing starts at the minimum size, the chunk ends where the top bits of the hash are zero
+func (writer *chunkWriter) findBoundary(data []byte) int {
+	for i, value := range data {
+		size := len(writer.buffer) + i + 1
+		if size < minimumChunkSize {
+			continue
+		}
+		writer.hash = writer.hash<<1 + gearTable[value]
+		if writer.hash>>(64-averageChunkBits) == 0 || size >= maximumChunkSize {
+			return i + 1
+		}
+	}
+	return -1
+}
+
+func (writer *chunkWriter) flush() error {
+	if len(writer.buffer) == 0 {
+		return nil
+	}
+	hash := writer.key.chunkHash(writer.buffer)
+	stored, err := writer.store.put(hash, writer.buffer, writer.key)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(writer.list, "%s %d\n", hash, len(writer.buffer)); err != nil {
+		return err
+	}
+	writer.size += int64(len(writer.buffer))
+	writer.stored += stored
+	writer.buffer = writer.buffer[:0]
+	writer.hash = 0
+	return nil
+}
+
+func (writer *chunkWriter) Close() error {
+	return writer.flush()
+}
+
+// Concatenates the chunks of a list, every chunk is checked before its content is returned
+type chunkReader struct {
+	store  *chunkStore
+	key    *jobKey
+	chunks []chunkRef
+	data   []byte
+}
+
+func (reader *chunkReader) Read(data []byte) (int, error) {
+	for len(reader.data) == 0 {
+		if len(reader.chunks) == 0 {
+			return 0, io.EOF
+		}
+		chunk, err := reader.store.get(reader.chunks[0], reader.key)
+		if err != nil {
+			return 0, err
+		}
+		reader.data = chunk
+		reader.chunks = reader.chunks[1:]
+	}
+	n := copy(data, reader.data)
+	reader.data = reader.data[n:]
+	return n, nil
+}
+
+func (reader *chunkReader) Close() error {
+	return nil
+}
+
+// Opens chunked archive, the chunk list must add up to the size recorded in the manifest
+// Chunks are decrypted with the key unless it is nil
+func (repo *repository) openChunkedArchive(m *manifest, a archive, key *jobKey) (io.ReadCloser, error) {
+	chunks, err := readChunkList(repo.path(m.ID, a.File))
+	if err != nil {
+		return nil, err
+	}
+	var size int64
+	for _, chunk := range chunks {
+		size += chunk.size
+	}
+	if size != a.Size {
+		return nil, fmt.Errorf("chunks add up to %d bytes, manifest records %d", size, a.Size)
+	}
+	return &chunkReader{store: repo.chunks(), key: key, chunks: chunks}, nil
+}
+
+// Chunk lists of all backups in the repository including those being written
+// Returns set of referenced chunk hashes and error if happened, unreadable chunk list is an error
+func (repo *repository) referencedChunks() (map[string]bool, error) {
+	lists, err := filepath.Glob(filepath.Join(repo.root, "*", "*", "*"+chunkListExtension))
+	if err != nil {
+		return nil, err
+	}
+	referenced := make(map[string]bool)
+	for _, list := range lists {
+		chunks, err := readChunkList(list)
+		if err != nil {
+			return nil, err
+		}
+		for _, chunk := range chunks {
+			referenced[chunk.hash] = true
+		}
+	}
+	return referenced, nil
+}
+
+// Removes chunks no backup refers to, chunks and leftover temporary files modified after olderThan are kept
+// The caller holds the repository lock exclusively, so no backup refreshes a chunk between the listing and the removal
+// Returns number of removed chunks, bytes freed and error if happened
+func collectGarbage(repo *repository, olderThan time.Time, dryRun bool) (int, int64, error) {
+	referenced, err := repo.referencedChunks()
+	if err != nil {
+		return 0, 0, fmt.Errorf("cannot collect garbage: %v", err)
+	}
+	removed := 0
+	var freed int64
+	err = repo.chunks().walk(func(name string, filePath string, fileInfo os.FileInfo) error {
+		if referenced[name] || !fileInfo.ModTime().Before(olderThan) {
+			return nil
+		}
+		if !dryRun {
+			if err := os.Remove(filePath); err != nil {
+				return err
+			}
+		}
+		removed++
+		freed += fileInfo.Size()
+		return nil
+	})
+	return removed, freed, err
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func randomData(seed int64, size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func writeChunks(t *testing.T, store *chunkStore, data []byte) []chunkRef {
+	listPath := filepath.Join(t.TempDir(), "list"+chunkListExtension)
+	list, err := os.Create(listPath)
+	require.NoError(t, err)
+	writer := newChunkWriter(store, list, nil)
+	_, err = writer.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+	require.NoError(t, list.Close())
+	assert.Equal(t, int64(len(data)), writer.size)
+
+	chunks, err := readChunkList(listPath)
+	require.NoError(t, err)
+	return chunks
+}
+
+func TestChunkWriterIsContentDefined(t *testing.T) {
+	store := &chunkStore{root: t.TempDir()}
+	data := randomData(1, 12*1024*1024)
+	chunks := writeChunks(t, store, data)
+	require.True(t, len(chunks) > 3, "Data must be split into several chunks")
+	for i, chunk := range chunks {
+		assert.True(t, chunk.size <= maximumChunkSize)
+		assert.True(t, chunk.size >= minimumChunkSize || i == len(chunks)-1)
+	}
+
+	restored, err := ioutil.ReadAll(&chunkReader{store: store, chunks: chunks})
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(data, restored), "Chunks must join into the original data")
+
+	// Inserted bytes change only the chunks around them
+	shifted := writeChunks(t, store, append(randomData(2, 1000), data...))
+	hashes := make(map[string]bool)
+	for _, chunk := range shifted {
+		hashes[chunk.hash] = true
+	}
+	shared := 0
+	for _, chunk := range chunks {
+		if hashes[chunk.hash] {
+			shared++
+		}
+	}
+	assert.True(t, shared >= len(chunks)-2, "%d of %d chunks must be shared", shared, len(chunks))
+}
+
+func countChunks(t *testing.T, repo *repository) int {
+	count := 0
+	require.NoError(t, repo.chunks().walk(func(name string, filePath string, fileInfo os.FileInfo) error {
+		count++
+		return nil
+	}))
+	return count
+}
+
+func TestChunkedBackup(t *testing.T) {
+	source := createSourceTree(t)
+	large := randomData(3, 6*1024*1024)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(source, "large.bin"), large, 0644))
+	config := newTestConfig(t, source)
+	config.Storage = storageChunks
+	require.NoError(t, runBackup(config, nil))
+
+	repo, err := openRepository(config.Repository)
+	require.NoError(t, err)
+	chunkCount := countChunks(t, repo)
+	require.True(t, chunkCount > 1)
+	require.NoError(t, runBackup(config, nil))
+	assert.Equal(t, chunkCount, countChunks(t, repo), "Unchanged data must not add chunks")
+
+	backups, err := repo.backups()
+	require.NoError(t, err)
+	require.Len(t, backups, 2)
+	a := backups[1].Archives[0]
+	assert.Equal(t, storageChunks, a.Storage)
+	assert.Equal(t, chunkListExtension, filepath.Ext(a.File))
+	assert.True(t, a.Size > int64(len(large)), "Size of chunked archive is the size of the tar stream")
+	assert.NoError(t, runVerify(config, nil))
+	assert.NoError(t, runCheck(config, []string{"--read-data"}))
+
+	target := t.TempDir()
+	require.NoError(t, runRestore(config, []string{"--target", target, backups[1].ID}))
+	restored, err := ioutil.ReadFile(filepath.Join(target, localHostAddress, source, "large.bin"))
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(large, restored))
+
+	// Chunks of pruned backups stay within the grace period and are collected after it
+	require.NoError(t, ioutil.WriteFile(filepath.Join(source, "large.bin"), randomData(4, len(large)), 0644))
+	require.NoError(t, runBackup(config, nil))
+	require.NoError(t, runPrune(config, []string{"--keep-last", "1"}))
+	assert.True(t, countChunks(t, repo) > chunkCount)
+	removed, _, err := collectGarbage(repo, time.Now().Add(time.Hour), false)
+	require.NoError(t, err)
+	assert.True(t, removed > 0)
+	assert.NoError(t, runCheck(config, []string{"--read-data"}))
+	assert.NoError(t, runVerify(config, nil))
+
+	// Damaged chunk is found by reading the data, missing chunk by the quick check
+	backups, err = repo.backups()
+	require.NoError(t, err)
+	chunks, err := readChunkList(repo.path(backups[0].ID, backups[0].Archives[0].File))
+	require.NoError(t, err)
+	chunkPath := repo.chunks().path(chunks[0].hash)
+	compressed, err := ioutil.ReadFile(chunkPath)
+	require.NoError(t, err)
+	compressed[len(compressed)/2] ^= 1
+	require.NoError(t, ioutil.WriteFile(chunkPath, compressed, 0600))
+	assert.NoError(t, runCheck(config, nil))
+	assert.Equal(t, errVerificationFailed, runCheck(config, []string{"--read-data"}))
+	assert.Equal(t, errVerificationFailed, runVerify(config, nil))
+	require.NoError(t, os.Remove(chunkPath))
+	assert.Equal(t, errVerificationFailed, runCheck(config, nil))
+}
+
+func TestEncryptedChunkedBackup(t *testing.T) {
+	source := createSourceTree(t)
+	large := randomData(5, 2*1024*1024)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(source, "large.bin"), large, 0644))
+	config := newTestConfig(t, source)
+	config.Storage = storageChunks
+	passphraseFile := filepath.Join(t.TempDir(), "passphrase")
+	require.NoError(t, ioutil.WriteFile(passphraseFile, []byte("passphrase\n"), 0600))
+	config.Jobs[0].Encryption = Encryption{Mode: encryptionPassphrase, PassphraseFile: passphraseFile}
+	require.NoError(t, config.validate())
+	require.NoError(t, runBackup(config, nil))
+
+	repo, err := openRepository(config.Repository)
+	require.NoError(t, err)
+	chunkCount := countChunks(t, repo)
+	require.NoError(t, runBackup(config, nil))
+	assert.Equal(t, chunkCount, countChunks(t, repo), "Unchanged data must not add chunks")
+
+	// Chunks are neither named by the plain hash nor readable without the key
+	backups, err := repo.backups()
+	require.NoError(t, err)
+	chunks, err := readChunkList(repo.path(backups[0].ID, backups[0].Archives[0].File))
+	require.NoError(t, err)
+	content, err := repo.chunks().get(chunks[0], nil)
+	assert.Error(t, err)
+	assert.Nil(t, content)
+	key, err := newKeyStore(config).jobKey("local", encryptionPassphrase, false)
+	require.NoError(t, err)
+	data, err := repo.chunks().get(chunks[0], key)
+	require.NoError(t, err)
+	assert.NotEqual(t, (*jobKey)(nil).chunkHash(data), chunks[0].hash)
+
+	assert.NoError(t, runCheck(config, []string{"--read-data"}))
+	assert.NoError(t, runVerify(config, []string{"--restore-test"}))
+	target := t.TempDir()
+	require.NoError(t, runRestore(config, []string{"--target", target, backups[1].ID}))
+	restored, err := ioutil.ReadFile(filepath.Join(target, localHostAddress, source, "large.bin"))
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(large, restored))
+
+	// Chunk swapped for another one of the job fails authentication
+	require.True(t, len(chunks) > 1)
+	other, err := ioutil.ReadFile(repo.chunks().path(chunks[1].hash))
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(repo.chunks().path(chunks[0].hash), other, 0600))
+	assert.Equal(t, errVerificationFailed, runCheck(config, []string{"--read-data"}))
+	assert.Equal(t, errVerificationFailed, runVerify(config, nil))
+}
+
+func TestRepositoryLock(t *testing.T) {
+	repo, err := createRepository(filepath.Join(t.TempDir(), "repository"))
+	require.NoError(t, err)
+
+	// Backups share the lock, removal waits until all of them are done
+	unlockFirst, err := repo.lock(false)
+	require.NoError(t, err)
+	unlockSecond, err := repo.lock(false)
+	require.NoError(t, err)
+	locked := make(chan func())
+	go func() {
+		unlock, err := repo.lock(true)
+		assert.NoError(t, err)
+		locked <- unlock
+	}()
+
+	unlockFirst()
+	select {
+	case <-locked:
+		t.Fatal("Exclusive lock must wait for every shared one")
+	case <-time.After(100 * time.Millisecond):
+	}
+	unlockSecond()
+	select {
+	case unlock := <-locked:
+		unlock()
+	case <-time.After(5 * time.Second):
+		t.Fatal("Exclusive lock must be granted once the shared ones are released")
+	}
+	ids, err := repo.ids()
+	require.NoError(t, err)
+	assert.Empty(t, ids, "Lock file is not a backup")
+}
+
+func TestRecipientEncryptedChunkedBackup(t *testing.T) {
+	source := createSourceTree(t)
+	large := randomData(6, 2*1024*1024)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(source, "large.bin"), large, 0644))
+	secretPath := filepath.Join(t.TempDir(), "backup.key")
+	require.NoError(t, runKeygen(&Config{}, []string{secretPath}))
+	config := newTestConfig(t, source)
+	config.Storage = storageChunks
+	config.Jobs[0].Encryption = Encryption{Mode: encryptionRecipient, Recipient: secretPath + ".pub"}
+	require.NoError(t, config.validate())
+	require.NoError(t, runBackup(config, nil))
+
+	repo, err := openRepository(config.Repository)
+	require.NoError(t, err)
+	chunkCount := countChunks(t, repo)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(source, "conf", "app.yaml"), []byte("key: changed\n"), 0644))
+	require.NoError(t, runBackup(config, nil))
+	assert.True(t, countChunks(t, repo) < 2*chunkCount, "Unchanged data must be deduplicated across runs")
+
+	// The public key is enough to write the backups but not to read them
+	backups, err := repo.backups()
+	require.NoError(t, err)
+	require.Len(t, backups, 2)
+	assert.Error(t, runRestore(config, []string{"--target", t.TempDir(), backups[1].ID}))
+	assert.Equal(t, errVerificationFailed, runCheck(config, []string{"--read-data"}))
+	chunks, err := readChunkList(repo.path(backups[1].ID, backups[1].Archives[0].File))
+	require.NoError(t, err)
+	key, err := newKeyStore(config).jobKey("local", encryptionRecipient, false)
+	require.NoError(t, err)
+	_, err = repo.chunks().get(chunks[0], key)
+	assert.Error(t, err)
+
+	// Chunks of both runs open with the secret key
+	config.identity = secretPath
+	assert.NoError(t, runCheck(config, []string{"--read-data"}))
+	target := t.TempDir()
+	require.NoError(t, runRestore(config, []string{"--target", target, backups[1].ID}))
+	restored, err := ioutil.ReadFile(filepath.Join(target, localHostAddress, source, "large.bin"))
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(large, restored))
+	content, err := ioutil.ReadFile(filepath.Join(target, localHostAddress, source, "conf", "app.yaml"))
+	require.NoError(t, err)
+	assert.Equal(t, "key: changed\n", string(content))
+}
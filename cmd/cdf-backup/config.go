@@ -0,0 +1,225 @@
+package main
+
+import (
+	"github.com/hardboiledalex/go-tools/lib/logging"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+)
+
+// Configuration of the backup jobs and the repository they are stored in, jobs may name their own repository
+// Storage chunks keeps archives in the deduplicating chunk store of the repository, encrypted with the job key for encrypted jobs
+type Config struct {
+	Repository string `yaml:"repository"`
+	Storage    string `yaml:"storage"`
+	Jobs       []Job  `yaml:"jobs"`
+
+	// Secret key given by --identity, used instead of the identities of the jobs
+	identity string
+	// File the configuration was read from
+	path string
+}
+
+// Set of paths backed up together from one or more hosts
+// Job without hosts backs up the local machine
+type Job struct {
+	Name        string     `yaml:"name"`
+	Repository  string     `yaml:"repository"`
+	Hosts       []Host     `yaml:"hosts"`
+	Paths       []string   `yaml:"paths"`
+	Exclude     []string   `yaml:"exclude"`
+	Compression string     `yaml:"compression"`
+	Encryption  Encryption `yaml:"encryption"`
+	Retention   Retention  `yaml:"retention"`
+	Hooks       Hooks      `yaml:"hooks"`
+}
+
+// Connection parameters of a source host, empty key means the default key of lib/ssh
+type Host struct {
+	Address string `yaml:"address"`
+	User    string `yaml:"user"`
+	Port    uint   `yaml:"port"`
+	Key     string `yaml:"key"`
+}
+
+// Job names are part of backup IDs and must be safe as file names
+var jobNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// Reads the configuration file, missing file is an error only if its path was given explicitly
+// Problems of an existing file are returned together as configError with their positions
+// Returns configuration and error if happened
+func loadConfig(configPath string, required bool) (*Config, error) {
+	config := &Config{path: configPath}
+	data, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		if os.IsNotExist(err) && !required {
+			return config, nil
+		}
+		return nil, fmt.Errorf("cannot read configuration: %v", err)
+	}
+	if err := parseConfig(data, config); err != nil {
+		if errs, found := err.(fieldErrors); found {
+			return nil, &configError{path: configPath, errors: errs}
+		}
+		return nil, fmt.Errorf("cannot parse configuration %s: %v", configPath, err)
+	}
+	return config, nil
+}
+
+func (config *Config) validate() error {
+	return config.check().err()
+}
+
+// Returns all problems of the configuration with the fields they are about
+func (config *Config) check() fieldErrors {
+	var errs fieldErrors
+	if err := validateStorage(config.Storage); err != nil {
+		errs.add("storage", "%v", err)
+	}
+	names := make(map[string]bool)
+	for i, job := range config.Jobs {
+		field := fmt.Sprintf("jobs[%d]", i)
+		if !jobNamePattern.MatchString(job.Name) {
+			errs.add(field+".name", "name %q must consist of letters, digits, '.', '_' and '-'", job.Name)
+		} else if names[job.Name] {
+			errs.add(field+".name", "job %s is defined more than once", job.Name)
+		}
+		names[job.Name] = true
+		if len(job.Paths) == 0 {
+			errs.add(field+".paths", "no paths to back up")
+		}
+		for j, jobPath := range job.Paths {
+			if !path.IsAbs(jobPath) {
+				errs.add(fmt.Sprintf("%s.paths[%d]", field, j), "path %s is not absolute", jobPath)
+			}
+		}
+		if _, err := parseCompression(job.Compression); err != nil {
+			errs.add(field+".compression", "%v", err)
+		}
+		job.Encryption.check(field+".encryption", &errs)
+		job.Retention.check(field+".retention", &errs)
+		for j, host := range job.Hosts {
+			if host.Address == "" {
+				errs.add(fmt.Sprintf("%s.hosts[%d].address", field, j), "host without address")
+			}
+		}
+		job.Hooks.check(job, field+".hooks", &errs)
+	}
+	return errs
+}
+
+// Returns the job with the given name or nil
+func (config *Config) findJob(name string) *Job {
+	for i := range config.Jobs {
+		if config.Jobs[i].Name == name {
+			return &config.Jobs[i]
+		}
+	}
+	return nil
+}
+
+// Returns repository of the job, the repository of the configuration if the job has none
+func (config *Config) jobRepository(job Job) string {
+	if job.Repository != "" {
+		return job.Repository
+	}
+	return config.Repository
+}
+
+// Returns repositories of the configuration and of its jobs, each once
+func (config *Config) repositories() []string {
+	var roots []string
+	seen := make(map[string]bool)
+	add := func(root string) {
+		if !seen[filepath.Clean(root)] {
+			seen[filepath.Clean(root)] = true
+			roots = append(roots, root)
+		}
+	}
+	if config.Repository != "" || len(config.Jobs) == 0 {
+		add(config.Repository)
+	}
+	for _, job := range config.Jobs {
+		add(config.jobRepository(job))
+	}
+	return roots
+}
+
+// Returns jobs with the given names, all jobs if no names are given
+func (config *Config) selectJobs(names []string) ([]Job, error) {
+	if len(names) == 0 {
+		return config.Jobs, nil
+	}
+	var jobs []Job
+	for _, name := range names {
+		job := config.findJob(name)
+		if job == nil {
+			return nil, newUsageError("job %s is not configured", name)
+		}
+		jobs = append(jobs, *job)
+	}
+	return jobs, nil
+}
+
+// Returns connection parameters of the host as configured in the job
+// Hosts no longer in the configuration are connected with default parameters
+func (config *Config) findHost(jobName string, address string) Host {
+	if job := config.findJob(jobName); job != nil {
+		for _, host := range job.Hosts {
+			if host.Address == address {
+				return host
+			}
+		}
+	}
+	return Host{Address: address}
+}
+
+// Sources of the job, the local machine if no hosts are configured
+func (job Job) sources() []Host {
+	if len(job.Hosts) == 0 {
+		return []Host{{Address: localHostAddress}}
+	}
+	return job.Hosts
+}
+
+// Checks the configuration file given as argument or by --config and reports all its problems
+func runConfig(config *Config, args []string) error {
+	if len(args) == 0 || args[0] != "validate" {
+		return newUsageError("config: expected subcommand validate")
+	}
+	flags := newFlagSet("config validate", "[file]")
+	if err := parseFlags(flags, args[1:]); err != nil {
+		return err
+	}
+	if flags.NArg() > 1 {
+		return newUsageError("config validate: expected at most one file, got %v", flags.Args())
+	}
+	configPath := config.path
+	if flags.NArg() == 1 {
+		configPath = flags.Arg(0)
+	}
+
+	checked, err := loadConfig(configPath, true)
+	if err != nil {
+		return newUsageError("%v", err)
+	}
+	hosts := 0
+	for _, job := range checked.Jobs {
+		hosts += len(job.Hosts)
+	}
+	if checked.Repository == "" {
+		for _, job := range checked.Jobs {
+			if job.Repository == "" {
+				logging.LogWarnf("Repository of job %s is not configured, it must be given with --repository", job.Name)
+			}
+		}
+		if len(checked.Jobs) == 0 {
+			logging.LogWarnf("Repository is not configured, it must be given with --repository")
+		}
+	}
+	logging.LogSuccessf("Configuration %s is valid: %d jobs, %d hosts", configPath, len(checked.Jobs), hosts)
+	return nil
+}
@@ -0,0 +1,531 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// Encrypted archive starts with a header naming the key derivation, followed by AES-256-GCM chunks.
+// Every chunk holds encryptionChunkSize bytes of plaintext except the last one, which is shorter or empty
+// and sealed with the final flag in its nonce, so a truncated archive fails to decrypt.
+// The nonce is the chunk counter, which is safe because every archive gets its own key.
+// The header is authenticated as additional data of every chunk
+const (
+	encryptionMagic     = "CDFBAK\x00\x01"
+	encryptionChunkSize = 64 * 1024
+
+	keyTypePassphrase byte = 1
+	keyTypeRecipient  byte = 2
+
+	scryptLogN      = 15
+	scryptR         = 8
+	scryptP         = 1
+	maximumScryptN  = 22
+	scryptSaltSize  = 16
+	archiveKeySize  = 32
+	x25519KeySize   = 32
+	recipientKeyTag = "cdf-backup archive key"
+	jobKeyTag       = "cdf-backup job key"
+	checksumKeyTag  = "cdf-backup entry checksums"
+	chunkIDKeyTag   = "cdf-backup chunk ids"
+	chunkKeyTag     = "cdf-backup chunk content"
+	chunkNonceSize  = 12
+
+	recipientHeaderSize = len(encryptionMagic) + 1 + x25519KeySize
+	wrappedChunkKeySize = recipientHeaderSize + archiveKeySize + aesGCMTagSize
+)
+
+// Names of the encryption modes in the configuration and the manifest
+const (
+	encryptionPassphrase = "passphrase"
+	encryptionRecipient  = "recipient"
+)
+
+var errDecryptionFailed = errors.New("archive cannot be decrypted: wrong key, or the archive was damaged or tampered with")
+
+// Key of a single archive together with the header telling how to derive it again
+type archiveKey struct {
+	header []byte
+	aead   cipher.AEAD
+}
+
+// Derives a new archive key from the passphrase with a random salt
+func newPassphraseKey(passphrase string) (*archiveKey, error) {
+	salt := make([]byte, scryptSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	header := append([]byte(encryptionMagic), keyTypePassphrase, scryptLogN, scryptR, scryptP)
+	header = append(header, salt...)
+	key, err := scrypt.Key([]byte(passphrase), salt, 1<<scryptLogN, scryptR, scryptP, archiveKeySize)
+	if err != nil {
+		return nil, err
+	}
+	return newArchiveKey(header, key)
+}
+
+// Creates a new archive key which only the owner of the secret key of the recipient can derive
+// The key comes from X25519 agreement between an ephemeral key stored in the header and the recipient key
+func newRecipientKey(recipient []byte) (*archiveKey, error) {
+	ephemeral := make([]byte, x25519KeySize)
+	if _, err := rand.Read(ephemeral); err != nil {
+		return nil, err
+	}
+	ephemeralPublic, err := curve25519.X25519(ephemeral, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := curve25519.X25519(ephemeral, recipient)
+	if err != nil {
+		return nil, err
+	}
+	header := append([]byte(encryptionMagic), keyTypeRecipient)
+	header = append(header, ephemeralPublic...)
+	key, err := recipientArchiveKey(shared, ephemeralPublic, recipient)
+	if err != nil {
+		return nil, err
+	}
+	return newArchiveKey(header, key)
+}
+
+func recipientArchiveKey(shared []byte, ephemeralPublic []byte, recipient []byte) ([]byte, error) {
+	salt := append(append([]byte{}, ephemeralPublic...), recipient...)
+	key := make([]byte, archiveKeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte(recipientKeyTag)), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Derives the archive key of the recipient header with the secret key of the recipient
+func openRecipientKey(header []byte, secret []byte) (*archiveKey, error) {
+	ephemeralPublic := header[len(encryptionMagic)+1:]
+	recipient, err := curve25519.X25519(secret, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := curve25519.X25519(secret, ephemeralPublic)
+	if err != nil {
+		return nil, errDecryptionFailed
+	}
+	key, err := recipientArchiveKey(shared, ephemeralPublic, recipient)
+	if err != nil {
+		return nil, err
+	}
+	return newArchiveKey(header, key)
+}
+
+func newArchiveKey(header []byte, key []byte) (*archiveKey, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return &archiveKey{header: header, aead: aead}, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Secret of an encrypted job which stays the same across its backups, unlike the archive keys
+// It keys the checksums of the manifest entries and the chunk IDs, so the repository does not allow confirming
+// guessed file contents, and encrypts the chunks. Chunks of the job are deduplicated only among its own backups.
+// Passphrase jobs derive it from the passphrase. Recipient jobs derive it from the public key of the recipient,
+// which is kept with the configuration and not in the repository, so it protects the checksums and chunk IDs
+// only from those who do not have the public key. Their chunks are encrypted with a random key of every run
+// wrapped to the recipient like an archive key instead, see sealChunk
+type jobKey struct {
+	checksum []byte
+	chunkID  []byte
+	chunks   cipher.AEAD
+	// Recipient jobs only: the public key, the secret key when reading and the chunk keys met by their wrapped form
+	recipient []byte
+	identity  func() ([]byte, error)
+	wrapped   []byte
+	opened    map[string]cipher.AEAD
+}
+
+// Derives the key of the job from its passphrase, the salt is fixed per job so every backup gets the same key
+func newPassphraseJobKey(job string, passphrase string) (*jobKey, error) {
+	salt := sha256.Sum256([]byte(jobKeyTag + "\x00" + job))
+	secret, err := scrypt.Key([]byte(passphrase), salt[:], 1<<scryptLogN, scryptR, scryptP, archiveKeySize)
+	if err != nil {
+		return nil, err
+	}
+	return newJobKey(secret)
+}
+
+// Derives the key of the job from the public key of the recipient, identity gives the secret key
+// when a chunk has to be opened. The checksum and chunk ID keys are known to anyone having the public key,
+// keying them by a secret wrapped to the recipient would need the secret key on every backup
+func newRecipientJobKey(job string, recipient []byte, identity func() ([]byte, error)) (*jobKey, error) {
+	secret := make([]byte, archiveKeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, recipient, []byte(job), []byte(jobKeyTag)), secret); err != nil {
+		return nil, err
+	}
+	key, err := newJobKey(secret)
+	if err != nil {
+		return nil, err
+	}
+	key.chunks = nil
+	key.recipient = recipient
+	key.identity = identity
+	key.opened = make(map[string]cipher.AEAD)
+	return key, nil
+}
+
+func newJobKey(secret []byte) (*jobKey, error) {
+	subkeys := make(map[string][]byte)
+	for _, tag := range []string{checksumKeyTag, chunkIDKeyTag, chunkKeyTag} {
+		subkeys[tag] = make([]byte, archiveKeySize)
+		if _, err := io.ReadFull(hkdf.New(sha256.New, secret, nil, []byte(tag)), subkeys[tag]); err != nil {
+			return nil, err
+		}
+	}
+	aead, err := newGCM(subkeys[chunkKeyTag])
+	if err != nil {
+		return nil, err
+	}
+	return &jobKey{checksum: subkeys[checksumKeyTag], chunkID: subkeys[chunkIDKeyTag], chunks: aead}, nil
+}
+
+// Turns hex SHA-256 of a file into HMAC-SHA256 of it, nil key and empty checksum are returned unchanged
+// Keying the digest rather than the content lets the checksum be computed on the remote machine
+func (key *jobKey) keyChecksum(checksum string) string {
+	if key == nil || checksum == "" {
+		return checksum
+	}
+	digest, err := hex.DecodeString(checksum)
+	if err != nil {
+		digest = []byte(checksum)
+	}
+	mac := hmac.New(sha256.New, key.checksum)
+	mac.Write(digest)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Returns ID of the chunk content, HMAC-SHA256 with the key and SHA-256 if the key is nil
+func (key *jobKey) chunkHash(data []byte) string {
+	if key == nil {
+		sum := sha256.Sum256(data)
+		return hex.EncodeToString(sum[:])
+	}
+	mac := hmac.New(sha256.New, key.chunkID)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Encrypts the stored form of the chunk with a random nonce prepended, the chunk ID is authenticated with it
+// so a chunk cannot be passed off as another one. Chunks of recipient jobs start with the wrapped chunk key
+// of the run, as deduplicated chunks of one backup may come from runs with different keys
+func (key *jobKey) sealChunk(hash string, data []byte) ([]byte, error) {
+	if key.recipient != nil && key.chunks == nil {
+		if err := key.newChunkKey(); err != nil {
+			return nil, err
+		}
+	}
+	nonce := make([]byte, chunkNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := append(append([]byte{}, key.wrapped...), nonce...)
+	return key.chunks.Seal(sealed, nonce, data, []byte(hash)), nil
+}
+
+func (key *jobKey) openChunk(hash string, sealed []byte) ([]byte, error) {
+	aead := key.chunks
+	if key.recipient != nil {
+		if len(sealed) < wrappedChunkKeySize {
+			return nil, errDecryptionFailed
+		}
+		var err error
+		if aead, err = key.openChunkKey(sealed[:wrappedChunkKeySize]); err != nil {
+			return nil, err
+		}
+		sealed = sealed[wrappedChunkKeySize:]
+	}
+	if len(sealed) < chunkNonceSize {
+		return nil, errDecryptionFailed
+	}
+	data, err := aead.Open(nil, sealed[:chunkNonceSize], sealed[chunkNonceSize:], []byte(hash))
+	if err != nil {
+		return nil, errDecryptionFailed
+	}
+	return data, nil
+}
+
+// Creates random chunk key for the run of a recipient job and wraps it to the recipient
+func (key *jobKey) newChunkKey() error {
+	secret := make([]byte, archiveKeySize)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+	wrapping, err := newRecipientKey(key.recipient)
+	if err != nil {
+		return err
+	}
+	aead, err := newGCM(secret)
+	if err != nil {
+		return err
+	}
+	key.wrapped = wrapping.aead.Seal(append([]byte{}, wrapping.header...), chunkNonce(0, true), secret, wrapping.header)
+	key.chunks = aead
+	return nil
+}
+
+// Unwraps chunk key of a recipient job with the secret key of the recipient
+func (key *jobKey) openChunkKey(wrapped []byte) (cipher.AEAD, error) {
+	if aead, found := key.opened[string(wrapped)]; found {
+		return aead, nil
+	}
+	header := wrapped[:recipientHeaderSize]
+	if string(header[:len(encryptionMagic)]) != encryptionMagic || header[len(encryptionMagic)] != keyTypeRecipient {
+		return nil, errDecryptionFailed
+	}
+	identity, err := key.identity()
+	if err != nil {
+		return nil, err
+	}
+	wrapping, err := openRecipientKey(header, identity)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := wrapping.aead.Open(nil, chunkNonce(0, true), wrapped[recipientHeaderSize:], header)
+	if err != nil {
+		return nil, errDecryptionFailed
+	}
+	aead, err := newGCM(secret)
+	if err != nil {
+		return nil, err
+	}
+	key.opened[string(wrapped)] = aead
+	return aead, nil
+}
+
+// Reads the header of an encrypted archive and derives its key
+// Passphrase or secret key is taken from the key store only when the header needs it
+func readArchiveKey(reader io.Reader, job string, keys *keyStore) (*archiveKey, error) {
+	header := make([]byte, len(encryptionMagic)+1)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, fmt.Errorf("cannot read encryption header: %v", err)
+	}
+	if string(header[:len(encryptionMagic)]) != encryptionMagic {
+		return nil, errors.New("archive is not encrypted or has unsupported format")
+	}
+
+	switch header[len(encryptionMagic)] {
+	case keyTypePassphrase:
+		parameters := make([]byte, 3+scryptSaltSize)
+		if _, err := io.ReadFull(reader, parameters); err != nil {
+			return nil, fmt.Errorf("cannot read encryption header: %v", err)
+		}
+		header = append(header, parameters...)
+		logN, r, p, salt := parameters[0], int(parameters[1]), int(parameters[2]), parameters[3:]
+		if logN > maximumScryptN || r == 0 || p == 0 {
+			return nil, errors.New("invalid key derivation parameters in encryption header")
+		}
+		passphrase, err := keys.passphrase(job, false)
+		if err != nil {
+			return nil, err
+		}
+		key, err := scrypt.Key([]byte(passphrase), salt, 1<<logN, r, p, archiveKeySize)
+		if err != nil {
+			return nil, err
+		}
+		return newArchiveKey(header, key)
+
+	case keyTypeRecipient:
+		ephemeralPublic := make([]byte, x25519KeySize)
+		if _, err := io.ReadFull(reader, ephemeralPublic); err != nil {
+			return nil, fmt.Errorf("cannot read encryption header: %v", err)
+		}
+		header = append(header, ephemeralPublic...)
+		secret, err := keys.identity(job)
+		if err != nil {
+			return nil, err
+		}
+		return openRecipientKey(header, secret)
+	}
+	return nil, fmt.Errorf("unsupported key type %d in encryption header", header[len(encryptionMagic)])
+}
+
+func chunkNonce(counter uint64, final bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], counter)
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// Encrypts everything written to it, Close seals the final chunk and must not be skipped
+type encryptWriter struct {
+	target  io.Writer
+	key     *archiveKey
+	buffer  []byte
+	counter uint64
+	closed  bool
+}
+
+// Writes the header of the key and returns writer encrypting into the target
+func newEncryptWriter(target io.Writer, key *archiveKey) (*encryptWriter, error) {
+	if _, err := target.Write(key.header); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{target: target, key: key, buffer: make([]byte, 0, encryptionChunkSize)}, nil
+}
+
+func (writer *encryptWriter) Write(data []byte) (int, error) {
+	if writer.closed {
+		return 0, errors.New("write to closed encrypted archive")
+	}
+	written := 0
+	for len(data) > 0 {
+		n := copy(writer.buffer[len(writer.buffer):cap(writer.buffer)], data)
+		writer.buffer = writer.buffer[:len(writer.buffer)+n]
+		data = data[n:]
+		written += n
+		if len(writer.buffer) == encryptionChunkSize {
+			if err := writer.seal(false); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (writer *encryptWriter) Close() error {
+	if writer.closed {
+		return nil
+	}
+	writer.closed = true
+	return writer.seal(true)
+}
+
+func (writer *encryptWriter) seal(final bool) error {
+	sealed := writer.key.aead.Seal(nil, chunkNonce(writer.counter, final), writer.buffer, writer.key.header)
+	writer.counter++
+	writer.buffer = writer.buffer[:0]
+	_, err := writer.target.Write(sealed)
+	return err
+}
+
+// Decrypts and authenticates the chunks, the data of a chunk is returned only after its tag was checked
+type decryptReader struct {
+	source  *bufio.Reader
+	key     *archiveKey
+	chunk   []byte
+	plain   []byte
+	counter uint64
+	done    bool
+}
+
+// Reads the header from the source and returns reader of the plaintext
+func newDecryptReader(source io.Reader, job string, keys *keyStore) (io.Reader, error) {
+	bufferedSource := bufio.NewReaderSize(source, encryptionChunkSize+aesGCMTagSize)
+	key, err := readArchiveKey(bufferedSource, job, keys)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{source: bufferedSource, key: key, chunk: make([]byte, encryptionChunkSize+aesGCMTagSize)}, nil
+}
+
+const aesGCMTagSize = 16
+
+func (reader *decryptReader) Read(data []byte) (int, error) {
+	for len(reader.plain) == 0 {
+		if reader.done {
+			return 0, io.EOF
+		}
+		if err := reader.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(data, reader.plain)
+	reader.plain = reader.plain[n:]
+	return n, nil
+}
+
+func (reader *decryptReader) open() error {
+	n, err := io.ReadFull(reader.source, reader.chunk)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	// Only the final chunk is shorter than a full one, a full chunk followed by nothing means truncation
+	final := n < len(reader.chunk)
+	plain, err := reader.key.aead.Open(reader.chunk[:0], chunkNonce(reader.counter, final), reader.chunk[:n], reader.key.header)
+	if err != nil {
+		if final {
+			return fmt.Errorf("%v (it may be truncated)", errDecryptionFailed)
+		}
+		return errDecryptionFailed
+	}
+	reader.counter++
+	reader.plain = plain
+	reader.done = final
+	return nil
+}
+
+// Prefixes of the key files written by keygen
+const (
+	secretKeyPrefix = "cdf-backup-secret-key:"
+	publicKeyPrefix = "cdf-backup-public-key:"
+)
+
+// Generates X25519 key pair for recipient encryption
+// Returns secret and public key and error if happened
+func generateRecipientKeyPair() ([]byte, []byte, error) {
+	secret := make([]byte, x25519KeySize)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, nil, err
+	}
+	public, err := curve25519.X25519(secret, curve25519.Basepoint)
+	if err != nil {
+		return nil, nil, err
+	}
+	return secret, public, nil
+}
+
+func encodeKey(prefix string, key []byte) []byte {
+	return []byte(prefix + base64.StdEncoding.EncodeToString(key) + "\n")
+}
+
+// Reads key file written by keygen, the prefix tells secret and public key apart
+func readKeyFile(keyPath string, prefix string) ([]byte, error) {
+	data, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	text := string(bytes.TrimSpace(data))
+	if !strings.HasPrefix(text, prefix) {
+		return nil, fmt.Errorf("%s is not a %s", keyPath, strings.TrimSuffix(prefix, ":"))
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(text, prefix))
+	if err != nil || len(key) != x25519KeySize {
+		return nil, fmt.Errorf("%s contains invalid key", keyPath)
+	}
+	return key, nil
+}
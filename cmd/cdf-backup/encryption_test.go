@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func encryptTestData(t *testing.T, key *archiveKey, data []byte) []byte {
+	var encrypted bytes.Buffer
+	writer, err := newEncryptWriter(&encrypted, key)
+	require.NoError(t, err)
+	// Odd write sizes must not change the chunking
+	for len(data) > 0 {
+		n := 1000
+		if n > len(data) {
+			n = len(data)
+		}
+		_, err := writer.Write(data[:n])
+		require.NoError(t, err)
+		data = data[n:]
+	}
+	require.NoError(t, writer.Close())
+	return encrypted.Bytes()
+}
+
+func decryptTestData(encrypted []byte, keys *keyStore) ([]byte, error) {
+	reader, err := newDecryptReader(bytes.NewReader(encrypted), "cdf", keys)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(reader)
+}
+
+func TestPassphraseEncryption(t *testing.T) {
+	passphraseFile := filepath.Join(t.TempDir(), "passphrase")
+	require.NoError(t, ioutil.WriteFile(passphraseFile, []byte("correct horse\n"), 0600))
+	keys := newKeyStore(&Config{Jobs: []Job{{Name: "cdf", Encryption: Encryption{Mode: encryptionPassphrase, PassphraseFile: passphraseFile}}}})
+
+	for _, size := range []int{0, 1, encryptionChunkSize, encryptionChunkSize + 1, 3 * encryptionChunkSize} {
+		data := make([]byte, size)
+		_, err := rand.Read(data)
+		require.NoError(t, err)
+		key, err := keys.newArchiveKey(keys.config.Jobs[0])
+		require.NoError(t, err)
+		encrypted := encryptTestData(t, key, data)
+		assert.False(t, size > 16 && bytes.Contains(encrypted, data[:16]), "Plaintext must not appear in the archive")
+
+		decrypted, err := decryptTestData(encrypted, keys)
+		require.NoError(t, err, "size %d", size)
+		assert.True(t, bytes.Equal(data, decrypted), "Decrypted data must match, size %d", size)
+	}
+
+	wrongKeys := newKeyStore(&Config{})
+	wrongKeys.passphrases["cdf"] = "wrong horse"
+	key, err := keys.newArchiveKey(keys.config.Jobs[0])
+	require.NoError(t, err)
+	_, err = decryptTestData(encryptTestData(t, key, []byte("secret")), wrongKeys)
+	assert.Error(t, err, "Wrong passphrase must be detected")
+}
+
+func TestEncryptionDetectsTampering(t *testing.T) {
+	keys := newKeyStore(&Config{})
+	keys.passphrases["cdf"] = "passphrase"
+	key, err := newPassphraseKey("passphrase")
+	require.NoError(t, err)
+	data := make([]byte, 2*encryptionChunkSize+100)
+	encrypted := encryptTestData(t, key, data)
+	headerSize := len(key.header)
+	fullChunk := encryptionChunkSize + aesGCMTagSize
+
+	flipped := append([]byte{}, encrypted...)
+	flipped[headerSize+fullChunk+10] ^= 1
+	_, err = decryptTestData(flipped, keys)
+	assert.Error(t, err, "Modified chunk must be detected")
+
+	_, err = decryptTestData(encrypted[:headerSize+2*fullChunk], keys)
+	assert.Error(t, err, "Archive truncated at a chunk boundary must be detected")
+
+	swapped := append([]byte{}, encrypted[:headerSize]...)
+	swapped = append(swapped, encrypted[headerSize+fullChunk:headerSize+2*fullChunk]...)
+	swapped = append(swapped, encrypted[headerSize:headerSize+fullChunk]...)
+	swapped = append(swapped, encrypted[headerSize+2*fullChunk:]...)
+	_, err = decryptTestData(swapped, keys)
+	assert.Error(t, err, "Reordered chunks must be detected")
+
+	modifiedHeader := append([]byte{}, encrypted...)
+	modifiedHeader[len(encryptionMagic)+1] = scryptLogN - 1
+	_, err = decryptTestData(modifiedHeader, keys)
+	assert.Error(t, err, "Modified header must be detected")
+}
+
+func TestRecipientEncryptedBackup(t *testing.T) {
+	secretPath := filepath.Join(t.TempDir(), "keys", "backup.key")
+	require.NoError(t, runKeygen(&Config{}, []string{secretPath}))
+	assert.Error(t, runKeygen(&Config{}, []string{secretPath}), "Existing key must not be overwritten")
+	fileInfo, err := os.Stat(secretPath)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), fileInfo.Mode().Perm())
+
+	source := createSourceTree(t)
+	config := newTestConfig(t, source)
+	config.Jobs[0].Encryption = Encryption{Mode: encryptionRecipient, Recipient: secretPath + ".pub"}
+	require.NoError(t, runBackup(config, nil))
+
+	repo, err := openRepository(config.Repository)
+	require.NoError(t, err)
+	backups, err := repo.backups()
+	require.NoError(t, err)
+	a := backups[0].Archives[0]
+	assert.Equal(t, encryptionRecipient, a.Encryption)
+	assert.Equal(t, ".enc", filepath.Ext(a.File))
+	data, err := ioutil.ReadFile(repo.path(backups[0].ID, a.File))
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "key: value", "Archive content must be encrypted")
+
+	// Without the secret key the backup cannot be read
+	assert.Equal(t, errVerificationFailed, runVerify(config, nil))
+
+	config.identity = secretPath
+	require.NoError(t, runVerify(config, nil))
+	target := t.TempDir()
+	require.NoError(t, runRestore(config, []string{"--target", target, backups[0].ID}))
+	content, err := ioutil.ReadFile(filepath.Join(target, localHostAddress, source, "conf", "app.yaml"))
+	require.NoError(t, err)
+	assert.Equal(t, "key: value\n", string(content))
+
+	// Tampered archive fails verification even though it decrypts up to the damaged chunk
+	data[len(data)-20] ^= 1
+	require.NoError(t, ioutil.WriteFile(repo.path(backups[0].ID, a.File), data, 0600))
+	assert.Equal(t, errVerificationFailed, runVerify(config, nil))
+}
+
+func TestUnencryptedArchiveOfEncryptedJob(t *testing.T) {
+	source := createSourceTree(t)
+	config := newTestConfig(t, source)
+	require.NoError(t, runBackup(config, nil))
+	require.NoError(t, runVerify(config, nil))
+
+	// Plaintext archive with its manifest entry stripped of encryption looks like this one
+	passphraseFile := filepath.Join(t.TempDir(), "passphrase")
+	require.NoError(t, ioutil.WriteFile(passphraseFile, []byte("passphrase\n"), 0600))
+	config.Jobs[0].Encryption = Encryption{Mode: encryptionPassphrase, PassphraseFile: passphraseFile}
+	assert.Equal(t, errVerificationFailed, runVerify(config, nil))
+	repo, err := openRepository(config.Repository)
+	require.NoError(t, err)
+	backups, err := repo.backups()
+	require.NoError(t, err)
+	assert.Error(t, runRestore(config, []string{"--target", t.TempDir(), backups[0].ID}))
+}
+
+func TestEncryptedBackupKeysChecksums(t *testing.T) {
+	source := createSourceTree(t)
+	config := newTestConfig(t, source)
+	passphraseFile := filepath.Join(t.TempDir(), "passphrase")
+	require.NoError(t, ioutil.WriteFile(passphraseFile, []byte("passphrase\n"), 0600))
+	config.Jobs[0].Encryption = Encryption{Mode: encryptionPassphrase, PassphraseFile: passphraseFile}
+	require.NoError(t, runBackup(config, nil))
+	require.NoError(t, runBackup(config, []string{"--type", backupIncremental, "--checksum"}))
+
+	repo, err := openRepository(config.Repository)
+	require.NoError(t, err)
+	backups, err := repo.backups()
+	require.NoError(t, err)
+	require.Len(t, backups, 2)
+	a := backups[0].Archives[0]
+	assert.Equal(t, checksumKeyed, a.Checksum)
+	plain := sha256.Sum256([]byte("key: value\n"))
+	manifestData, err := ioutil.ReadFile(repo.path(backups[0].ID, manifestFileName))
+	require.NoError(t, err)
+	assert.NotContains(t, string(manifestData), hex.EncodeToString(plain[:]), "Manifest must not reveal checksums of the content")
+
+	// Keyed checksums of unchanged files match across backups, so nothing is stored again
+	for _, entry := range backups[1].Archives[0].storedEntries() {
+		assert.NotEqual(t, entryFile, entry.Type, "Unchanged file %s must not be stored again", entry.Path)
+	}
+	assert.NoError(t, runVerify(config, []string{"--restore-test"}))
+}
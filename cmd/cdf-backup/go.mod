@@ -1,3 +1,13 @@
 module github.com/hardboiledalex/go-tools/cmd/cdf-backup
 
 go 1.15
+
+require (
+	github.com/hardboiledalex/go-tools v0.0.0
+	github.com/melbahja/goph v1.1.0
+	github.com/stretchr/testify v1.6.1
+	golang.org/x/crypto v0.0.0-20201221181555-eec23a3978ad
+	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c
+)
+
+replace github.com/hardboiledalex/go-tools => ../..
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"github.com/hardboiledalex/go-tools/lib/logging"
+	"github.com/hardboiledalex/go-tools/lib/ssh"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Policies applied when a hook fails
+// Abort fails the job and skips the remaining hooks, after a failed pre hook neither the backup nor the post hooks run.
+// Continue only logs the failure. Run-post fails the job and skips the backup, but the post hooks still run
+const (
+	hookAbort    = "abort"
+	hookContinue = "continue"
+	hookRunPost  = "run-post"
+)
+
+const defaultHookTimeout = 10 * time.Minute
+
+// Commands run around each backup of a job, e.g. to dump a database or pause a service
+// Post hooks run after every attempted backup, whether it succeeded or not
+type Hooks struct {
+	Pre  []Hook `yaml:"pre"`
+	Post []Hook `yaml:"post"`
+}
+
+// Shell command run on the listed hosts of the job one after another, on all its sources if no hosts are listed
+// Address localhost runs the command on the machine making the backup
+type Hook struct {
+	Name      string        `yaml:"name"`
+	Command   string        `yaml:"command"`
+	Hosts     []string      `yaml:"hosts"`
+	Timeout   time.Duration `yaml:"timeout"`
+	OnFailure string        `yaml:"onFailure"`
+}
+
+func (hooks Hooks) check(job Job, field string, errs *fieldErrors) {
+	for i, hook := range hooks.Pre {
+		hook.check(job, fmt.Sprintf("%s.pre[%d]", field, i), errs)
+	}
+	for i, hook := range hooks.Post {
+		hook.check(job, fmt.Sprintf("%s.post[%d]", field, i), errs)
+	}
+}
+
+func (hook Hook) check(job Job, field string, errs *fieldErrors) {
+	if strings.TrimSpace(hook.Command) == "" {
+		errs.add(field+".command", "no command")
+	}
+	if hook.Timeout < 0 {
+		errs.add(field+".timeout", "timeout must not be negative")
+	}
+	switch hook.OnFailure {
+	case "", hookAbort, hookContinue, hookRunPost:
+	default:
+		errs.add(field+".onFailure", "unknown failure policy %q, expected %s, %s or %s", hook.OnFailure, hookAbort, hookContinue, hookRunPost)
+	}
+	for i, address := range hook.Hosts {
+		if _, found := job.hookHost(address); !found {
+			errs.add(fmt.Sprintf("%s.hosts[%d]", field, i), "host %s is not a source of the job", address)
+		}
+	}
+}
+
+func (hook Hook) label() string {
+	if hook.Name != "" {
+		return hook.Name
+	}
+	return hook.Command
+}
+
+func (hook Hook) policy() string {
+	if hook.OnFailure == "" {
+		return hookAbort
+	}
+	return hook.OnFailure
+}
+
+func (hook Hook) timeout() time.Duration {
+	if hook.Timeout == 0 {
+		return defaultHookTimeout
+	}
+	return hook.Timeout
+}
+
+// Returns source of the job with the address, localhost is accepted for every job
+func (job Job) hookHost(address string) (Host, bool) {
+	for _, host := range job.sources() {
+		if host.Address == address {
+			return host, true
+		}
+	}
+	if (Host{Address: address}).isLocal() {
+		return Host{Address: localHostAddress}, true
+	}
+	return Host{}, false
+}
+
+// Hosts the hook runs on
+func (hook Hook) targets(job Job) []Host {
+	if len(hook.Hosts) == 0 {
+		return job.sources()
+	}
+	var hosts []Host
+	for _, address := range hook.Hosts {
+		host, _ := job.hookHost(address)
+		hosts = append(hosts, host)
+	}
+	return hosts
+}
+
+// Runs the backup between the pre and post hooks of the job
+// Returns error of the backup, or of the hooks whose policy fails the job
+func runWithHooks(job Job, backup func() error) error {
+	if len(job.Hooks.Pre) == 0 && len(job.Hooks.Post) == 0 {
+		return backup()
+	}
+	pool := connections{}
+	defer pool.closeAll()
+
+	runPost, err := runHooks(pool, job, "pre", job.Hooks.Pre)
+	if err == nil {
+		err = backup()
+	} else {
+		logging.LogErrorf("Skipping backup of job %s", job.Name)
+	}
+	if !runPost {
+		logging.LogWarnf("Skipping post hooks of job %s", job.Name)
+		return err
+	}
+	_, postErr := runHooks(pool, job, "post", job.Hooks.Post)
+	if err == nil {
+		err = postErr
+	}
+	return err
+}
+
+// Runs the hooks in order on their hosts, output of each command is written to the log, of failed ones as warnings
+// Returns whether the post hooks should run and error if a hook failed with a policy failing the job
+func runHooks(pool connections, job Job, phase string, hooks []Hook) (bool, error) {
+	var failure error
+	for _, hook := range hooks {
+		for _, host := range hook.targets(job) {
+			err := runHook(pool, host, hook)
+			if err == nil {
+				continue
+			}
+			err = fmt.Errorf("%s hook %s failed on %s: %v", phase, hook.label(), host.Address, err)
+			switch hook.policy() {
+			case hookContinue:
+				logging.LogWarnf("%v, continuing", err)
+			case hookRunPost:
+				logging.LogError(err)
+				if failure == nil {
+					failure = err
+				}
+				if phase == "pre" {
+					return true, failure
+				}
+			default:
+				logging.LogError(err)
+				if failure == nil {
+					failure = err
+				}
+				return false, failure
+			}
+		}
+	}
+	return true, failure
+}
+
+func runHook(pool connections, host Host, hook Hook) error {
+	client, err := pool.get(host)
+	if err != nil {
+		return err
+	}
+	logging.LogInfof("Running hook %s on %s", hook.label(), host.Address)
+	started := time.Now()
+	output, err := ssh.RunCommandWithTimeout(client, hook.Command, hook.timeout())
+	// Output of a failed hook explains the failure, so it is shown even when the log level hides INFO
+	logOutput := logging.LogInfof
+	if err != nil {
+		logOutput = logging.LogWarnf
+	}
+	for _, line := range strings.Split(output, "\n") {
+		if line != "" {
+			logOutput("[%s@%s] %s", hook.label(), host.Address, line)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	logging.LogDebugf("Hook %s on %s finished in %v", hook.label(), host.Address, time.Since(started).Round(time.Millisecond))
+	return nil
+}
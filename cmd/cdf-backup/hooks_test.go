@@ -0,0 +1,110 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Number of backups in the repository, zero if it was never created
+func countBackups(t *testing.T, config *Config) int {
+	repo, err := openRepository(config.Repository)
+	if err != nil {
+		return 0
+	}
+	ids, err := repo.ids()
+	require.NoError(t, err)
+	return len(ids)
+}
+
+func TestHooksRunAroundBackup(t *testing.T) {
+	config := newTestConfig(t, createSourceTree(t))
+	journal := filepath.Join(t.TempDir(), "journal")
+	config.Jobs[0].Hooks = Hooks{
+		Pre:  []Hook{{Name: "dump", Command: "echo pre >> " + journal}},
+		Post: []Hook{{Command: "echo post >> " + journal, Hosts: []string{localHostAddress}}},
+	}
+	require.NoError(t, config.validate())
+	require.NoError(t, runBackup(config, nil))
+
+	content, err := ioutil.ReadFile(journal)
+	require.NoError(t, err)
+	assert.Equal(t, "pre\npost\n", string(content))
+	assert.Equal(t, 1, countBackups(t, config))
+}
+
+func TestHookFailurePolicies(t *testing.T) {
+	for _, test := range []struct {
+		policy   string
+		backups  int
+		post     bool
+		jobFails bool
+	}{
+		{hookAbort, 0, false, true},
+		{"", 0, false, true},
+		{hookContinue, 1, true, false},
+		{hookRunPost, 0, true, true},
+	} {
+		config := newTestConfig(t, createSourceTree(t))
+		marker := filepath.Join(t.TempDir(), "post")
+		config.Jobs[0].Hooks = Hooks{
+			Pre:  []Hook{{Command: "echo failing; exit 1", OnFailure: test.policy}},
+			Post: []Hook{{Command: "touch " + marker}},
+		}
+		err := runBackup(config, nil)
+		assert.Equal(t, test.jobFails, err != nil, "Policy %q", test.policy)
+		assert.Equal(t, test.backups, countBackups(t, config), "Policy %q", test.policy)
+		if test.post {
+			assert.FileExists(t, marker, "Policy %q must run post hooks", test.policy)
+		} else {
+			assert.NoFileExists(t, marker, "Policy %q must skip post hooks", test.policy)
+		}
+	}
+}
+
+func TestHooksAfterFailedBackup(t *testing.T) {
+	config := newTestConfig(t, createSourceTree(t))
+	config.Jobs[0].Paths = append(config.Jobs[0].Paths, filepath.Join(t.TempDir(), "missing"))
+	marker := filepath.Join(t.TempDir(), "post")
+	config.Jobs[0].Hooks.Post = []Hook{{Command: "touch " + marker}}
+
+	assert.Error(t, runBackup(config, nil))
+	assert.FileExists(t, marker, "Post hooks must run after a failed backup to resume services")
+}
+
+func TestHookTimeout(t *testing.T) {
+	config := newTestConfig(t, createSourceTree(t))
+	config.Jobs[0].Hooks.Pre = []Hook{{Command: "sleep 5", Timeout: 200 * time.Millisecond}}
+
+	started := time.Now()
+	assert.Error(t, runBackup(config, nil))
+	assert.Less(t, int64(time.Since(started)), int64(3*time.Second), "Hook must be stopped at its timeout")
+	assert.Equal(t, 0, countBackups(t, config))
+}
+
+func TestValidateHooks(t *testing.T) {
+	job := Job{Name: "cdf", Paths: []string{"/etc"}, Hosts: []Host{{Address: "node1"}}}
+	for _, test := range []struct {
+		hook  Hook
+		error string
+	}{
+		{Hook{Command: "true"}, ""},
+		{Hook{Command: "true", Hosts: []string{"node1", localHostAddress}}, ""},
+		{Hook{Command: " "}, "no command"},
+		{Hook{Command: "true", OnFailure: "retry"}, "unknown failure policy"},
+		{Hook{Command: "true", Hosts: []string{"node2"}}, "not a source"},
+		{Hook{Command: "true", Timeout: -time.Second}, "negative"},
+	} {
+		job.Hooks = Hooks{Post: []Hook{test.hook}}
+		err := (&Config{Jobs: []Job{job}}).validate()
+		if test.error == "" {
+			assert.NoError(t, err)
+		} else if assert.Error(t, err) {
+			assert.True(t, strings.Contains(err.Error(), test.error), "Unexpected error %v", err)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"github.com/hardboiledalex/go-tools/lib/logging"
+	"github.com/hardboiledalex/go-tools/lib/ssh"
+	"github.com/hardboiledalex/go-tools/lib/utils"
+	"fmt"
+	"github.com/melbahja/goph"
+	cryptossh "golang.org/x/crypto/ssh"
+	"strings"
+	"time"
+)
+
+const (
+	localHostAddress = "localhost"
+	defaultUser      = "root"
+	defaultPort      = 22
+	connectTimeout   = 30 * time.Second
+)
+
+// Local machine is accessed directly without SSH
+func (host Host) isLocal() bool {
+	switch strings.ToLower(host.Address) {
+	case "", localHostAddress, "127.0.0.1", "::1":
+		return true
+	}
+	return strings.EqualFold(host.Address, utils.CurrentHostname) || strings.EqualFold(host.Address, utils.GetCurrentFQDN())
+}
+
+// Connects to the host with its key, known hosts are checked unless in development mode
+// Returns nil client for the local machine and error if happened
+func connect(host Host) (*goph.Client, error) {
+	if host.isLocal() {
+		return nil, nil
+	}
+	user := host.User
+	if user == "" {
+		user = defaultUser
+	}
+	port := host.Port
+	if port == 0 {
+		port = defaultPort
+	}
+	key := host.Key
+	if key == "" {
+		key = ssh.PrivateKey
+	}
+
+	auth, err := goph.Key(key, "")
+	if err != nil {
+		return nil, fmt.Errorf("cannot load key %s: %v", key, err)
+	}
+	callback := cryptossh.InsecureIgnoreHostKey()
+	if !utils.DevMode {
+		if callback, err = goph.DefaultKnownHosts(); err != nil {
+			return nil, fmt.Errorf("cannot load known hosts: %v", err)
+		}
+	}
+
+	logging.LogDebugf("Connecting to %s@%s:%d", user, host.Address, port)
+	client, err := goph.NewConn(&goph.Config{
+		User:     user,
+		Addr:     host.Address,
+		Port:     port,
+		Auth:     auth,
+		Timeout:  connectTimeout,
+		Callback: callback,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to %s: %v", host.Address, err)
+	}
+	return client, nil
+}
+
+// Clients opened on demand and shared by all operations on the same host
+type connections map[string]*goph.Client
+
+func (pool connections) get(host Host) (*goph.Client, error) {
+	if client, found := pool[host.Address]; found {
+		return client, nil
+	}
+	client, err := connect(host)
+	if err != nil {
+		return nil, err
+	}
+	pool[host.Address] = client
+	return client, nil
+}
+
+func (pool connections) closeAll() {
+	for address, client := range pool {
+		ssh.SafeCloseClient(client)
+		delete(pool, address)
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"github.com/hardboiledalex/go-tools/lib/ssh"
+	"fmt"
+	"github.com/melbahja/goph"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Types of backups, incremental stores changes since the previous backup of the job,
+// differential stores changes since the last full backup
+const (
+	backupFull         = "full"
+	backupIncremental  = "incremental"
+	backupDifferential = "differential"
+)
+
+func validateBackupType(backupType string) error {
+	switch backupType {
+	case backupFull, backupIncremental, backupDifferential:
+		return nil
+	}
+	return newUsageError("unknown backup type %q, expected %s, %s or %s", backupType, backupFull, backupIncremental, backupDifferential)
+}
+
+// Type of the backup, manifests written before backup types existed describe full backups
+func (m *manifest) backupType() string {
+	if m.Type == "" {
+		return backupFull
+	}
+	return m.Type
+}
+
+// Returns the backup the new backup of the job is based on, nil if there is none and a full backup has to be made
+func findBase(repo *repository, job string, backupType string) (*manifest, error) {
+	if backupType == backupFull {
+		return nil, nil
+	}
+	backups, err := repo.backups()
+	if err != nil {
+		return nil, err
+	}
+	for i := len(backups) - 1; i >= 0; i-- {
+		if backups[i].Job != job {
+			continue
+		}
+		if backupType == backupIncremental || backups[i].backupType() == backupFull {
+			return backups[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// Reports whether entry checksums of all archives are made the given way, only then they can be compared with new ones
+func (m *manifest) hasChecksum(checksum string) bool {
+	for _, a := range m.Archives {
+		if a.Checksum != checksum {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns archive of the host and path or nil
+func (m *manifest) findArchive(host string, archivePath string) *archive {
+	for i := range m.Archives {
+		if m.Archives[i].Host == host && m.Archives[i].Path == archivePath {
+			return &m.Archives[i]
+		}
+	}
+	return nil
+}
+
+// Entries whose content is stored in the archive itself rather than in one of its bases
+func (a archive) storedEntries() []fileEntry {
+	var entries []fileEntry
+	for _, entry := range a.Entries {
+		if !entry.Inherited {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// Changes of a directory since the reference archive
+type changeSet struct {
+	// Paths to pack, always including the directory itself, other directories and all non-regular entries
+	files []string
+	// Unchanged regular files described by the reference entries
+	inherited []fileEntry
+	// Paths of the reference which are gone or changed their type
+	deleted []string
+}
+
+// Compares the directory against the entries of the reference archive
+// Regular file is unchanged if its size, modification time, mode and owner match, with verifyContent also its checksum
+// made with the key of the reference entries. Checksums are computed together after the walk, not a command per file.
+// Returns changes and error if happened
+func findChanges(client *goph.Client, directory string, exclude []string, reference *archive, verifyContent bool, key *jobKey) (*changeSet, error) {
+	referenceEntries := make(map[string]fileEntry, len(reference.Entries))
+	for _, entry := range reference.Entries {
+		referenceEntries[entry.Path] = entry
+	}
+
+	changes := &changeSet{}
+	current := make(map[string]string)
+	// Files whose metadata match, by the walked path, their content is compared once the walk is done
+	candidates := make(map[string]fileEntry)
+	var candidatePaths []string
+	root := path.Clean(directory)
+	err := ssh.Walk(client, root, func(walkedPath string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relativePath := relativeTo(root, walkedPath)
+		if relativePath != "." {
+			if ssh.MatchesAnyPattern(exclude, relativePath) {
+				if fileInfo.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
+
+		currentType := fileInfoType(fileInfo)
+		current[relativePath] = currentType
+		if currentType == entryFile {
+			entry, found := referenceEntries[relativePath]
+			if found && entry.Type == entryFile && entry.Size == fileInfo.Size() &&
+				sameModTime(entry.ModTime, fileInfo.ModTime()) && entry.Mode == fileModeString(fileInfo.Mode()) && sameOwner(entry, fileInfo) {
+				if verifyContent {
+					candidates[walkedPath] = entry
+					candidatePaths = append(candidatePaths, walkedPath)
+					return nil
+				}
+				entry.Inherited = true
+				changes.inherited = append(changes.inherited, entry)
+				return nil
+			}
+		}
+		changes.files = append(changes.files, relativePath)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(candidatePaths) > 0 {
+		checksums, err := ssh.Checksums(client, candidatePaths)
+		if err != nil {
+			return nil, err
+		}
+		for _, walkedPath := range candidatePaths {
+			entry := candidates[walkedPath]
+			if key.keyChecksum(checksums[walkedPath]) == entry.SHA256 {
+				entry.Inherited = true
+				changes.inherited = append(changes.inherited, entry)
+			} else {
+				changes.files = append(changes.files, entry.Path)
+			}
+		}
+	}
+
+	for _, entry := range reference.Entries {
+		entryType := entry.Type
+		if entryType == entryHardlink {
+			entryType = entryFile
+		}
+		if currentType, found := current[entry.Path]; !found || currentType != entryType {
+			changes.deleted = append(changes.deleted, entry.Path)
+		}
+	}
+	return changes, nil
+}
+
+// Returns slash-separated path of the walked entry relative to the cleaned root, "." for the root itself
+func relativeTo(root string, walkedPath string) string {
+	if walkedPath == root {
+		return "."
+	}
+	return strings.TrimPrefix(walkedPath, strings.TrimSuffix(root, "/")+"/")
+}
+
+// Archives keep whole seconds, GNU tar truncates the modification time while archive/tar rounds it
+func sameModTime(archived time.Time, modified time.Time) bool {
+	return archived.Equal(modified.Truncate(time.Second)) || archived.Equal(modified.Round(time.Second))
+}
+
+// File whose owner is not known counts as changed, so its owner is archived again
+func sameOwner(entry fileEntry, fileInfo os.FileInfo) bool {
+	uid, gid, known := ssh.FileOwner(fileInfo)
+	return known && entry.UID == uid && entry.GID == gid
+}
+
+// Entry type of the walked file, hard links cannot be told apart and count as regular files
+func fileInfoType(fileInfo os.FileInfo) string {
+	switch mode := fileInfo.Mode(); {
+	case mode.IsRegular():
+		return entryFile
+	case mode.IsDir():
+		return entryDir
+	case mode&os.ModeSymlink != 0:
+		return entrySymlink
+	}
+	return entryOther
+}
+
+// Formats the permission bits like the mode of the manifest entries
+func fileModeString(mode os.FileMode) string {
+	bits := mode.Perm()
+	if mode&os.ModeSetuid != 0 {
+		bits |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		bits |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		bits |= 01000
+	}
+	return fmt.Sprintf("%04o", uint32(bits))
+}
+
+// Returns the archives needed to restore the archive, the self-contained one first and the archive itself last
+func (repo *repository) archiveChain(m *manifest, a archive) ([]*manifest, []archive, error) {
+	manifests := []*manifest{m}
+	archives := []archive{a}
+	for a.Base != "" {
+		base, err := repo.load(a.Base)
+		if err != nil {
+			return nil, nil, fmt.Errorf("base %s of %s is not available: %v", a.Base, m.ID, err)
+		}
+		baseArchive := base.findArchive(a.Host, a.Path)
+		if baseArchive == nil {
+			return nil, nil, fmt.Errorf("base %s of %s has no archive of %s:%s", base.ID, m.ID, a.Host, a.Path)
+		}
+		if len(manifests) > maximumChainLength {
+			return nil, nil, fmt.Errorf("backup chain of %s is too long or circular", m.ID)
+		}
+		m, a = base, *baseArchive
+		manifests = append(manifests, m)
+		archives = append(archives, a)
+	}
+	for i, j := 0, len(archives)-1; i < j; i, j = i+1, j-1 {
+		manifests[i], manifests[j] = manifests[j], manifests[i]
+		archives[i], archives[j] = archives[j], archives[i]
+	}
+	return manifests, archives, nil
+}
+
+// Bound of the chain length which protects restore from cycles in damaged manifests
+const maximumChainLength = 10000
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func entryPaths(entries []fileEntry) []string {
+	var paths []string
+	for _, entry := range entries {
+		paths = append(paths, entry.Path)
+	}
+	return paths
+}
+
+func TestIncrementalBackup(t *testing.T) {
+	source := createSourceTree(t)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(source, "stable.txt"), []byte("unchanged"), 0644))
+	config := newTestConfig(t, source)
+	require.NoError(t, runBackup(config, []string{"--type", backupIncremental}))
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(source, "conf", "app.yaml"), []byte("key: changed value\n"), 0600))
+	require.NoError(t, os.Remove(filepath.Join(source, "conf", "nested", "extra.yaml")))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(source, "new.yaml"), []byte("new: true\n"), 0644))
+	require.NoError(t, runBackup(config, []string{"--type", backupIncremental}))
+
+	require.NoError(t, os.Remove(filepath.Join(source, "new.yaml")))
+	require.NoError(t, runBackup(config, []string{"--type", backupIncremental, "--checksum"}))
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(source, "stable.txt"), []byte("changed at last"), 0644))
+	require.NoError(t, runBackup(config, []string{"--type", backupDifferential}))
+
+	repo, err := openRepository(config.Repository)
+	require.NoError(t, err)
+	backups, err := repo.backups()
+	require.NoError(t, err)
+	require.Len(t, backups, 4)
+	full, first, second, differential := backups[0], backups[1], backups[2], backups[3]
+	assert.Equal(t, backupFull, full.backupType(), "Incremental backup without a base must be full")
+	assert.Equal(t, backupIncremental, first.Type)
+	assert.Equal(t, full.ID, first.Base)
+	assert.Equal(t, first.ID, second.Base)
+	assert.Equal(t, backupDifferential, differential.Type)
+	assert.Equal(t, full.ID, differential.Base, "Differential backup must be based on the full backup")
+
+	// Only changed files are stored, the manifest still describes the whole tree
+	a := first.Archives[0]
+	assert.Equal(t, full.ID, a.Base)
+	assert.Equal(t, []string{"conf/nested/extra.yaml"}, a.Deleted)
+	stored := entryPaths(a.storedEntries())
+	assert.Contains(t, stored, "conf/app.yaml")
+	assert.Contains(t, stored, "new.yaml")
+	assert.NotContains(t, stored, "stable.txt")
+	assert.NotContains(t, stored, "conf/app.tmp", "Excluded file must not be stored")
+	assert.Contains(t, entryPaths(a.Entries), "stable.txt")
+	assert.Equal(t, 3, first.files())
+	assert.Equal(t, []string{"new.yaml"}, second.Archives[0].Deleted)
+	assert.NotContains(t, entryPaths(second.Archives[0].storedEntries()), "conf/app.yaml")
+	differentialStored := entryPaths(differential.Archives[0].storedEntries())
+	assert.Contains(t, differentialStored, "conf/app.yaml", "Differential backup stores all changes since the full backup")
+	assert.Contains(t, differentialStored, "stable.txt")
+	assert.NoError(t, runVerify(config, nil))
+
+	restore := func(id string) string {
+		target := t.TempDir()
+		require.NoError(t, runRestore(config, []string{"--target", target, id}))
+		return filepath.Join(target, localHostAddress, source)
+	}
+	readRestored := func(restored string, name string) string {
+		content, err := ioutil.ReadFile(filepath.Join(restored, name))
+		require.NoError(t, err)
+		return string(content)
+	}
+
+	restored := restore(first.ID)
+	assert.Equal(t, "key: changed value\n", readRestored(restored, "conf/app.yaml"))
+	assert.Equal(t, "unchanged", readRestored(restored, "stable.txt"))
+	assert.Equal(t, "new: true\n", readRestored(restored, "new.yaml"))
+	assert.NoFileExists(t, filepath.Join(restored, "conf", "nested", "extra.yaml"))
+	assert.DirExists(t, filepath.Join(restored, "conf", "nested"))
+
+	restored = restore(second.ID)
+	assert.NoFileExists(t, filepath.Join(restored, "new.yaml"))
+	assert.Equal(t, "key: changed value\n", readRestored(restored, "conf/app.yaml"))
+
+	restored = restore(differential.ID)
+	assert.Equal(t, "changed at last", readRestored(restored, "stable.txt"))
+	assert.NoFileExists(t, filepath.Join(restored, "new.yaml"))
+	link, err := os.Readlink(filepath.Join(restored, "current.yaml"))
+	require.NoError(t, err)
+	assert.Equal(t, "conf/app.yaml", link)
+
+	// Base of a kept backup is kept even though no rule selects it
+	require.NoError(t, runPrune(config, []string{"--keep-last", "1"}))
+	remaining, err := repo.ids()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{full.ID, differential.ID}, remaining)
+	assert.NoError(t, runVerify(config, nil))
+
+	// Backup whose base is gone cannot be restored and fails verification
+	require.NoError(t, repo.remove(full.ID))
+	assert.Equal(t, errVerificationFailed, runVerify(config, nil))
+	assert.Error(t, runRestore(config, []string{"--target", t.TempDir(), differential.ID}))
+}
+
+func TestIncrementalBackupStoresChownedFile(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("changing the owner needs root")
+	}
+	source := createSourceTree(t)
+	config := newTestConfig(t, source)
+	require.NoError(t, runBackup(config, []string{"--type", backupIncremental}))
+
+	// Only the owner changes, size, modification time and mode stay the same
+	require.NoError(t, os.Chown(filepath.Join(source, "conf", "app.yaml"), 1234, 1234))
+	require.NoError(t, runBackup(config, []string{"--type", backupIncremental}))
+
+	repo, err := openRepository(config.Repository)
+	require.NoError(t, err)
+	backups, err := repo.backups()
+	require.NoError(t, err)
+	require.Len(t, backups, 2)
+	for _, entry := range backups[1].Archives[0].storedEntries() {
+		if entry.Path == "conf/app.yaml" {
+			assert.Equal(t, []int{1234, 1234}, []int{entry.UID, entry.GID})
+			return
+		}
+	}
+	t.Error("Chowned file must be stored again with its new owner")
+}
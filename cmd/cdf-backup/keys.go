@@ -0,0 +1,231 @@
+package main
+
+import (
+	"github.com/hardboiledalex/go-tools/lib/utils"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/curve25519"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Environment variable with the passphrase for jobs without a passphrase file
+const passphraseEnvironment = "CDF_BACKUP_PASSPHRASE"
+
+// Encryption of the archives of a job
+// Mode passphrase derives keys from the passphrase read from PassphraseFile, the environment or the prompt.
+// Mode recipient encrypts for the public key in the Recipient file, restore needs the secret key in the Identity file.
+// Entry checksums and chunk IDs of recipient jobs are keyed by the public key, as every backup needs the same key
+// without the secret one, so they do not protect against confirming guessed contents by anyone having the public key
+type Encryption struct {
+	Mode           string `yaml:"mode"`
+	PassphraseFile string `yaml:"passphraseFile"`
+	Recipient      string `yaml:"recipient"`
+	Identity       string `yaml:"identity"`
+}
+
+func (encryption Encryption) check(field string, errs *fieldErrors) {
+	switch encryption.Mode {
+	case "", encryptionPassphrase:
+	case encryptionRecipient:
+		if encryption.Recipient == "" {
+			errs.add(field+".recipient", "recipient encryption needs the recipient public key file")
+		}
+	default:
+		errs.add(field+".mode", "unknown encryption mode %q, expected %s or %s", encryption.Mode, encryptionPassphrase, encryptionRecipient)
+	}
+}
+
+// Supplies passphrases and secret keys of the jobs, each is read or asked for at most once per run
+type keyStore struct {
+	config      *Config
+	passphrases map[string]string
+	identities  map[string][]byte
+	jobKeys     map[string]*jobKey
+}
+
+func newKeyStore(config *Config) *keyStore {
+	return &keyStore{config: config, passphrases: make(map[string]string), identities: make(map[string][]byte), jobKeys: make(map[string]*jobKey)}
+}
+
+func (keys *keyStore) encryption(job string) Encryption {
+	if configured := keys.config.findJob(job); configured != nil {
+		return configured.Encryption
+	}
+	return Encryption{}
+}
+
+// Returns passphrase of the job, a prompted passphrase is asked twice if confirm is set
+func (keys *keyStore) passphrase(job string, confirm bool) (string, error) {
+	if passphrase, found := keys.passphrases[job]; found {
+		return passphrase, nil
+	}
+
+	var passphrase string
+	if passphraseFile := keys.encryption(job).PassphraseFile; passphraseFile != "" {
+		data, err := ioutil.ReadFile(passphraseFile)
+		if err != nil {
+			return "", fmt.Errorf("cannot read passphrase: %v", err)
+		}
+		passphrase = strings.TrimRight(string(data), "\r\n")
+	} else if environment := os.Getenv(passphraseEnvironment); environment != "" {
+		passphrase = environment
+	} else {
+		prompted, err := utils.PromptPassword(fmt.Sprintf("Enter passphrase of backup job %s", job))
+		if err != nil {
+			return "", err
+		}
+		if confirm {
+			repeated, err := utils.PromptPassword("Repeat the passphrase")
+			if err != nil {
+				return "", err
+			}
+			if repeated != prompted {
+				return "", errors.New("passphrases do not match")
+			}
+		}
+		passphrase = prompted
+	}
+	if passphrase == "" {
+		return "", fmt.Errorf("empty passphrase for job %s", job)
+	}
+	keys.passphrases[job] = passphrase
+	return passphrase, nil
+}
+
+// Returns secret key of the job from its identity file or the one given by --identity
+func (keys *keyStore) identity(job string) ([]byte, error) {
+	if secret, found := keys.identities[job]; found {
+		return secret, nil
+	}
+	identityPath := keys.config.identity
+	if identityPath == "" {
+		identityPath = keys.encryption(job).Identity
+	}
+	if identityPath == "" {
+		return nil, fmt.Errorf("archives of job %s are encrypted for a recipient, give its secret key with --identity", job)
+	}
+	secret, err := readKeyFile(identityPath, secretKeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+	keys.identities[job] = secret
+	return secret, nil
+}
+
+// Returns key of the job encrypted with the mode, nil if the mode is empty
+// Recipient key comes from the configured public key, or from the secret key where only that is given.
+// Opening chunks of a recipient job asks for the secret key either way
+func (keys *keyStore) jobKey(job string, mode string, confirm bool) (*jobKey, error) {
+	if key, found := keys.jobKeys[job]; found || mode == "" {
+		return key, nil
+	}
+
+	var key *jobKey
+	switch mode {
+	case encryptionPassphrase:
+		passphrase, err := keys.passphrase(job, confirm)
+		if err != nil {
+			return nil, err
+		}
+		if key, err = newPassphraseJobKey(job, passphrase); err != nil {
+			return nil, err
+		}
+	case encryptionRecipient:
+		var recipient []byte
+		var err error
+		if recipientPath := keys.encryption(job).Recipient; recipientPath != "" {
+			recipient, err = readKeyFile(recipientPath, publicKeyPrefix)
+		} else if secret, identityErr := keys.identity(job); identityErr == nil {
+			recipient, err = curve25519.X25519(secret, curve25519.Basepoint)
+		} else {
+			err = identityErr
+		}
+		if err != nil {
+			return nil, err
+		}
+		identity := func() ([]byte, error) { return keys.identity(job) }
+		if key, err = newRecipientJobKey(job, recipient, identity); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown encryption mode %q of job %s", mode, job)
+	}
+	keys.jobKeys[job] = key
+	return key, nil
+}
+
+// Returns key of the entry checksums of the archive, nil if they are plain SHA-256
+func (keys *keyStore) checksumKey(job string, a archive) (*jobKey, error) {
+	switch a.Checksum {
+	case "":
+		return nil, nil
+	case checksumKeyed:
+		return keys.jobKey(job, a.Encryption, false)
+	}
+	return nil, fmt.Errorf("unsupported checksum %q of archive %s", a.Checksum, a.File)
+}
+
+// Creates key for a new archive of the job, nil if the job is not encrypted
+func (keys *keyStore) newArchiveKey(job Job) (*archiveKey, error) {
+	switch job.Encryption.Mode {
+	case encryptionPassphrase:
+		passphrase, err := keys.passphrase(job.Name, true)
+		if err != nil {
+			return nil, err
+		}
+		return newPassphraseKey(passphrase)
+	case encryptionRecipient:
+		recipient, err := readKeyFile(job.Encryption.Recipient, publicKeyPrefix)
+		if err != nil {
+			return nil, err
+		}
+		return newRecipientKey(recipient)
+	}
+	return nil, nil
+}
+
+// Writes new key pair for recipient encryption: the secret key to the given path, the public key next to it with .pub
+func runKeygen(config *Config, args []string) error {
+	flags := newFlagSet("keygen", "SECRET-KEY-PATH")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return newUsageError("keygen: expected exactly one path")
+	}
+	secretPath := flags.Arg(0)
+	publicPath := secretPath + ".pub"
+
+	secret, public, err := generateRecipientKeyPair()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(secretPath), 0700); err != nil {
+		return err
+	}
+	if err := writeNewFile(secretPath, encodeKey(secretKeyPrefix, secret), 0600); err != nil {
+		return err
+	}
+	if err := writeNewFile(publicPath, encodeKey(publicKeyPrefix, public), 0644); err != nil {
+		return err
+	}
+	fmt.Printf("Secret key written to %s, keep it outside of the backup repository\n", secretPath)
+	fmt.Printf("Public key written to %s, set it as recipient of the jobs\n", publicPath)
+	return nil
+}
+
+// Writes the file, refusing to overwrite an existing one
+func writeNewFile(filePath string, data []byte, mode os.FileMode) error {
+	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"github.com/hardboiledalex/go-tools/lib/utils"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Prints backups of all repositories from the oldest, optionally only those of one job
+func runList(config *Config, args []string) error {
+	flags := newFlagSet("list", "")
+	job := flags.String("job", "", "list only backups of this job")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return newUsageError("list: unexpected arguments %v", flags.Args())
+	}
+
+	repos, err := openRepositories(config)
+	if err != nil {
+		return err
+	}
+	var backups []*manifest
+	for _, repo := range repos {
+		repoBackups, err := repo.backups()
+		if err != nil {
+			return err
+		}
+		backups = append(backups, repoBackups...)
+	}
+	sort.SliceStable(backups, func(i, j int) bool {
+		return backups[i].Started.Before(backups[j].Started)
+	})
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "ID\tJOB\tTYPE\tSTARTED\tDURATION\tHOSTS\tFILES\tSIZE")
+	for _, m := range backups {
+		if *job != "" && m.Job != *job {
+			continue
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%s\n", m.ID, m.Job, m.backupType(), m.Started.Local().Format(time.RFC3339),
+			m.Finished.Sub(m.Started).Round(time.Second), strings.Join(m.Hosts, ","), m.files(), utils.BytesToString(int(m.size())))
+	}
+	return writer.Flush()
+}
@@ -1,7 +1,181 @@
 package main
 
-import "fmt"
+import (
+	"github.com/hardboiledalex/go-tools/lib/logging"
+	"github.com/hardboiledalex/go-tools/lib/utils"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// Version of the tool, set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+const defaultConfigPath = "/etc/cdf-backup/config.yaml"
+
+// Exit codes of the tool
+const (
+	exitOK                 = 0
+	exitFailure            = 1
+	exitUsage              = 2
+	exitVerificationFailed = 3
+)
+
+// Returned by commands which completed but found broken backups
+var errVerificationFailed = errors.New("verification failed")
+
+// Wrong command line or configuration, reported with the usage exit code
+type usageError struct {
+	message string
+}
+
+func (err *usageError) Error() string {
+	return err.message
+}
+
+func newUsageError(format string, params ...interface{}) error {
+	return &usageError{message: fmt.Sprintf(format, params...)}
+}
+
+type command struct {
+	name    string
+	summary string
+	run     func(config *Config, args []string) error
+}
+
+var commands = []command{
+	{"backup", "Back up the configured jobs into their repositories", runBackup},
+	{"restore", "Restore a backup to its hosts or into a local directory", runRestore},
+	{"list", "List backups in the repositories", runList},
+	{"verify", "Check that backups are complete and readable", runVerify},
+	{"prune", "Remove backups according to the retention rules", runPrune},
+	{"check", "Check consistency of the repositories and their chunk stores", runCheck},
+	{"gc", "Remove chunks no backup refers to", runGC},
+	{"keygen", "Generate key pair for recipient encryption", runKeygen},
+	{"config", "Check the configuration file: config validate [file]", runConfig},
+	{"version", "Print the version", runVersion},
+}
 
 func main() {
-	fmt.Print("CDF backup")
+	os.Exit(run(os.Args[1:]))
+}
+
+// Parses common flags, loads the configuration and runs the command
+// Returns the exit code
+func run(args []string) int {
+	flags := flag.NewFlagSet("cdf-backup", flag.ContinueOnError)
+	configPath := flags.String("config", defaultConfigPath, "path to the configuration file")
+	repositoryPath := flags.String("repository", "", "path to the backup repository, overrides the repositories of the configuration and its jobs")
+	identityPath := flags.String("identity", "", "secret key to decrypt archives encrypted for a recipient")
+	flags.StringVar(&logging.CurrentLogLevelString, "log-level", "INFO", "log level: TRACE, DEBUG, INFO, WARN or ERROR")
+	flags.BoolVar(&utils.DevMode, "dev", false, "development mode, accepts unknown host keys")
+	flags.Usage = func() {
+		printUsage(flags)
+	}
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return exitOK
+		}
+		return exitUsage
+	}
+	if flags.NArg() == 0 {
+		printUsage(flags)
+		return exitUsage
+	}
+
+	selected := findCommand(flags.Arg(0))
+	if selected == nil {
+		fmt.Fprintf(os.Stderr, "Unknown command %s\n\n", flags.Arg(0))
+		printUsage(flags)
+		return exitUsage
+	}
+
+	logging.InitLogging()
+	configExplicit := false
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == "config" {
+			configExplicit = true
+		}
+	})
+	// Command config reads the file itself, so it can report its problems
+	if selected.name == "config" {
+		return exitCode(selected.run(&Config{path: *configPath}, flags.Args()[1:]))
+	}
+	config, err := loadConfig(*configPath, configExplicit)
+	if err != nil {
+		logging.LogError(err)
+		return exitUsage
+	}
+	// Given repository replaces those of the jobs as well
+	if *repositoryPath != "" {
+		config.Repository = *repositoryPath
+		for i := range config.Jobs {
+			config.Jobs[i].Repository = ""
+		}
+	}
+	config.identity = *identityPath
+
+	return exitCode(selected.run(config, flags.Args()[1:]))
+}
+
+func findCommand(name string) *command {
+	for i := range commands {
+		if commands[i].name == name {
+			return &commands[i]
+		}
+	}
+	return nil
+}
+
+func exitCode(err error) int {
+	if err == nil || err == flag.ErrHelp {
+		return exitOK
+	}
+	if err == errVerificationFailed {
+		return exitVerificationFailed
+	}
+	logging.LogError(err)
+	if _, isUsage := err.(*usageError); isUsage {
+		return exitUsage
+	}
+	return exitFailure
+}
+
+func printUsage(flags *flag.FlagSet) {
+	output := flags.Output()
+	fmt.Fprintln(output, "Usage: cdf-backup [flags] <command> [command flags] [arguments]")
+	fmt.Fprintln(output, "\nCommands:")
+	for _, c := range commands {
+		fmt.Fprintf(output, "  %-10s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintln(output, "\nFlags:")
+	flags.PrintDefaults()
+	fmt.Fprintf(output, "\nExit codes: %d success, %d failure, %d wrong usage or configuration, %d verification failed\n",
+		exitOK, exitFailure, exitUsage, exitVerificationFailed)
+}
+
+// Creates flag set of a command, parse errors are reported as usage errors
+func newFlagSet(name string, arguments string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: cdf-backup %s [flags] %s\n", name, arguments)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+func parseFlags(flags *flag.FlagSet, args []string) error {
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return err
+		}
+		return newUsageError("%s: %v", flags.Name(), err)
+	}
+	return nil
+}
+
+func runVersion(config *Config, args []string) error {
+	fmt.Println("cdf-backup", version)
+	return nil
 }
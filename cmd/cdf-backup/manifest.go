@@ -0,0 +1,241 @@
+package main
+
+import (
+	"github.com/hardboiledalex/go-tools/lib/ssh"
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	manifestFileName = "manifest.json"
+	manifestVersion  = 1
+)
+
+// Description of a backup stored next to its archives
+// It is the only source of information about the backup for list, verify and restore.
+// Incremental and differential backups name the backup they are based on
+type manifest struct {
+	Version     int       `json:"version"`
+	ID          string    `json:"id"`
+	Job         string    `json:"job"`
+	Type        string    `json:"type,omitempty"`
+	Base        string    `json:"base,omitempty"`
+	ToolVersion string    `json:"toolVersion"`
+	Hosts       []string  `json:"hosts"`
+	Started     time.Time `json:"started"`
+	Finished    time.Time `json:"finished"`
+	Archives    []archive `json:"archives"`
+}
+
+// Single path of a host packed as tar archive, File is relative to the backup directory.
+// File of an archive with chunks storage is its chunk list and Size is the size of the tar stream.
+// Checksum tells how the entry checksums are made, encrypted jobs key them with the job key
+// Entries describe the whole path at the time of the backup. Archive with a base holds only the changed entries,
+// it is restored over the base archive after removing the Deleted paths
+type archive struct {
+	Host        string      `json:"host"`
+	Path        string      `json:"path"`
+	File        string      `json:"file"`
+	Compression string      `json:"compression"`
+	Encryption  string      `json:"encryption,omitempty"`
+	Storage     string      `json:"storage,omitempty"`
+	Checksum    string      `json:"checksum,omitempty"`
+	Base        string      `json:"base,omitempty"`
+	Size        int64       `json:"size"`
+	Entries     []fileEntry `json:"entries"`
+	Deleted     []string    `json:"deleted,omitempty"`
+}
+
+// Entry of an archive, Path is relative to the archived directory
+// Owner is numeric as archives are packed with numeric ownership, SHA256 is set for regular files only
+// and is HMAC-SHA256 of the file digest for archives with keyed checksums.
+// Inherited entry is unchanged since the base and its content is stored in the base archive
+type fileEntry struct {
+	Path      string    `json:"path"`
+	Type      string    `json:"type"`
+	Size      int64     `json:"size"`
+	Mode      string    `json:"mode"`
+	UID       int       `json:"uid"`
+	GID       int       `json:"gid"`
+	ModTime   time.Time `json:"mtime"`
+	Link      string    `json:"link,omitempty"`
+	SHA256    string    `json:"sha256,omitempty"`
+	Inherited bool      `json:"inherited,omitempty"`
+}
+
+// Checksum of the archives with entry checksums keyed by the job key, plain SHA-256 has no name
+// Recipient jobs key them by the public key only, see Encryption
+const checksumKeyed = "hmac-sha256"
+
+const (
+	entryFile     = "file"
+	entryDir      = "dir"
+	entrySymlink  = "symlink"
+	entryHardlink = "hardlink"
+	entryOther    = "other"
+)
+
+// Total size of the archives in bytes
+func (m *manifest) size() int64 {
+	var size int64
+	for _, a := range m.Archives {
+		size += a.Size
+	}
+	return size
+}
+
+// Number of regular files in all archives
+func (m *manifest) files() int {
+	count := 0
+	for _, a := range m.Archives {
+		for _, entry := range a.Entries {
+			if entry.Type == entryFile {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+func readManifest(manifestPath string) (*manifest, error) {
+	data, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	m := &manifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("cannot parse %s: %v", manifestPath, err)
+	}
+	if m.Version != manifestVersion {
+		return nil, fmt.Errorf("unsupported manifest version %d in %s", m.Version, manifestPath)
+	}
+	return m, nil
+}
+
+func writeManifest(manifestPath string, m *manifest) error {
+	m.Version = manifestVersion
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(manifestPath, append(data, '\n'), 0600)
+}
+
+// Reads the archive stream to its end and describes every entry with SHA-256 of regular files, keyed unless key is nil
+// Returns entries in the archive order and error if happened, damaged or truncated stream is an error
+func indexArchive(reader io.Reader, compression ssh.ArchiveCompression, key *jobKey) ([]fileEntry, error) {
+	if compression == ssh.CompressionGzip {
+		gzipReader, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, err
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+	}
+
+	var entries []fileEntry
+	tarReader := tar.NewReader(reader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		entry := fileEntry{
+			Path:    entryPath(header.Name),
+			Type:    entryType(header.Typeflag),
+			Mode:    fmt.Sprintf("%04o", header.Mode&07777),
+			UID:     header.Uid,
+			GID:     header.Gid,
+			ModTime: header.ModTime.UTC(),
+			Link:    header.Linkname,
+		}
+		if entry.Type == entryHardlink {
+			entry.Link = entryPath(header.Linkname)
+		}
+		if entry.Type == entryFile {
+			hash := sha256.New()
+			if entry.Size, err = io.Copy(hash, tarReader); err != nil {
+				return nil, err
+			}
+			entry.SHA256 = key.keyChecksum(hex.EncodeToString(hash.Sum(nil)))
+		}
+		entries = append(entries, entry)
+	}
+	// Reading the compressed stream to its end checks the trailing checksum of gzip
+	if _, err := io.Copy(ioutil.Discard, reader); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// Archives name entries relative to the packed directory as "./name"
+func entryPath(name string) string {
+	cleaned := path.Clean("/" + name)
+	if cleaned == "/" {
+		return "."
+	}
+	return strings.TrimPrefix(cleaned, "/")
+}
+
+func entryType(typeflag byte) string {
+	switch typeflag {
+	case tar.TypeReg, tar.TypeRegA:
+		return entryFile
+	case tar.TypeDir:
+		return entryDir
+	case tar.TypeSymlink:
+		return entrySymlink
+	case tar.TypeLink:
+		return entryHardlink
+	}
+	return entryOther
+}
+
+const (
+	compressionGzip = "gzip"
+	compressionNone = "none"
+)
+
+// Converts compression name of the configuration, empty name means gzip
+func parseCompression(name string) (ssh.ArchiveCompression, error) {
+	switch name {
+	case "", compressionGzip:
+		return ssh.CompressionGzip, nil
+	case compressionNone:
+		return ssh.CompressionNone, nil
+	}
+	return 0, fmt.Errorf("unknown compression %q, expected %s or %s", name, compressionGzip, compressionNone)
+}
+
+func compressionName(compression ssh.ArchiveCompression) string {
+	if compression == ssh.CompressionNone {
+		return compressionNone
+	}
+	return compressionGzip
+}
+
+func archiveExtension(compression ssh.ArchiveCompression, encrypted bool, chunked bool) string {
+	if chunked {
+		return chunkListExtension
+	}
+	extension := ".tar"
+	if compression == ssh.CompressionGzip {
+		extension += ".gz"
+	}
+	if encrypted {
+		extension += ".enc"
+	}
+	return extension
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"github.com/hardboiledalex/go-tools/lib/logging"
+	"fmt"
+	"time"
+)
+
+// Applies retention of the jobs to their backups in all repositories, flags override the configured rules of every job
+// A backup is removed only after it passed verification, broken backups are kept for investigation.
+// Chunks left unreferenced by the removed backups are collected afterwards
+func runPrune(config *Config, args []string) error {
+	flags := newFlagSet("prune", "")
+	job := flags.String("job", "", "prune only backups of this job")
+	dryRun := flags.Bool("dry-run", false, "only print which backups would be removed")
+	var override Retention
+	flags.IntVar(&override.KeepLast, "keep-last", 0, "number of newest backups to keep")
+	flags.IntVar(&override.KeepDaily, "keep-daily", 0, "number of days to keep the newest backup of")
+	flags.IntVar(&override.KeepWeekly, "keep-weekly", 0, "number of weeks to keep the newest backup of")
+	flags.IntVar(&override.KeepMonthly, "keep-monthly", 0, "number of months to keep the newest backup of")
+	flags.IntVar(&override.KeepYearly, "keep-yearly", 0, "number of years to keep the newest backup of")
+	flags.Var(&override.MaxAge, "max-age", "remove backups older than this, e.g. 90d")
+	flags.Var(&override.MaxTotalSize, "max-size", "remove the oldest backups while a job takes more than this, e.g. 500GB")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return newUsageError("prune: unexpected arguments %v", flags.Args())
+	}
+	if err := override.validate(); err != nil {
+		return newUsageError("prune: %v", err)
+	}
+	configured := false
+	for _, configuredJob := range config.Jobs {
+		configured = configured || !configuredJob.Retention.isEmpty()
+	}
+	if override.isEmpty() && !configured {
+		return newUsageError("prune: no retention rules configured or given")
+	}
+
+	repos, err := openRepositories(config)
+	if err != nil {
+		return err
+	}
+	keys := newKeyStore(config)
+	now := time.Now()
+	failed := 0
+	for _, repo := range repos {
+		repoFailed, err := pruneRepository(repo, config, keys, *job, override, *dryRun, now)
+		if err != nil {
+			return err
+		}
+		failed += repoFailed
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d backups could not be removed", failed)
+	}
+	return nil
+}
+
+// Applies the retention to the backups in the repository and removes chunks the removed backups left unreferenced
+// Returns number of backups which could not be removed and error if happened
+func pruneRepository(repo *repository, config *Config, keys *keyStore, job string, override Retention, dryRun bool, now time.Time) (int, error) {
+	unlock, err := repo.lock(!dryRun)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+	backups, err := repo.backups()
+	if err != nil {
+		return 0, err
+	}
+
+	groups := groupByJob(backups)
+	failed := 0
+	removed := 0
+	for _, jobName := range sortedJobs(groups) {
+		if job != "" && jobName != job {
+			continue
+		}
+		var policy Retention
+		if jobConfig := config.findJob(jobName); jobConfig != nil {
+			policy = jobConfig.Retention
+		}
+		policy = policy.merge(override)
+		if policy.isEmpty() {
+			logging.LogWarnf("No retention for job %s, its backups are kept", jobName)
+			continue
+		}
+
+		for _, decision := range policy.apply(groups[jobName], now) {
+			id := decision.backup.ID
+			if decision.keep {
+				logging.LogDebugf("Keeping %s: %s", id, decision.reason)
+				continue
+			}
+			if err := verifyBackup(repo, keys, id, false).err(); err != nil {
+				logging.LogWarnf("Keeping %s, it failed verification: %v", id, err)
+				continue
+			}
+			if dryRun {
+				logging.LogInfof("Would remove %s: %s", id, decision.reason)
+				continue
+			}
+			if err := repo.remove(id); err != nil {
+				logging.LogErrorf("Cannot remove %s: %v", id, err)
+				failed++
+				continue
+			}
+			logging.LogInfof("Removed %s: %s", id, decision.reason)
+			removed++
+		}
+	}
+	if removed > 0 {
+		if err := removeUnreferencedChunks(repo, now.Add(-chunkGracePeriod), false); err != nil {
+			return failed, err
+		}
+	}
+	return failed, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+// Writes a backup with the given creation time and no archives
+func createTestBackup(t *testing.T, repo *repository, job string, created time.Time) string {
+	id, err := repo.create(job, created)
+	require.NoError(t, err)
+	require.NoError(t, writeManifest(repo.partialPath(id, manifestFileName), &manifest{ID: id, Job: job, Started: created}))
+	require.NoError(t, repo.commit(id))
+	return id
+}
+
+func TestPruneKeepLast(t *testing.T) {
+	config := &Config{Repository: t.TempDir()}
+	repo, err := openRepository(config.Repository)
+	require.NoError(t, err)
+	now := time.Now().UTC()
+	var ids []string
+	for i := 3; i >= 0; i-- {
+		ids = append(ids, createTestBackup(t, repo, "cdf", now.Add(-time.Duration(i)*time.Hour)))
+	}
+	other := createTestBackup(t, repo, "other", now.Add(-48*time.Hour))
+
+	require.NoError(t, runPrune(config, []string{"--keep-last", "2", "--dry-run"}))
+	remaining, err := repo.ids()
+	require.NoError(t, err)
+	assert.Len(t, remaining, 5, "Dry run must not remove anything")
+
+	require.NoError(t, runPrune(config, []string{"--keep-last", "2"}))
+	remaining, err = repo.ids()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{ids[2], ids[3], other}, remaining, "Newest backups of every job must be kept")
+
+	_, isUsage := runPrune(config, nil).(*usageError)
+	assert.True(t, isUsage, "Prune without retention must be a usage error")
+}
+
+func TestPruneKeepsBrokenBackups(t *testing.T) {
+	config := &Config{Repository: t.TempDir(), Jobs: []Job{{Name: "cdf", Retention: Retention{KeepLast: 1}}}}
+	repo, err := openRepository(config.Repository)
+	require.NoError(t, err)
+	now := time.Now().UTC()
+
+	// Manifest refers to an archive which is missing, so the backup does not verify
+	broken, err := repo.create("cdf", now.Add(-2*time.Hour))
+	require.NoError(t, err)
+	require.NoError(t, writeManifest(repo.partialPath(broken, manifestFileName), &manifest{
+		ID: broken, Job: "cdf", Started: now.Add(-2 * time.Hour),
+		Archives: []archive{{Host: localHostAddress, Path: "/etc", File: "localhost/00.tar.gz"}},
+	}))
+	require.NoError(t, repo.commit(broken))
+	expired := createTestBackup(t, repo, "cdf", now.Add(-time.Hour))
+	newest := createTestBackup(t, repo, "cdf", now)
+
+	require.NoError(t, runPrune(config, nil))
+	remaining, err := repo.ids()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{broken, newest}, remaining, "Backup failing verification must never be pruned")
+	assert.NotContains(t, remaining, expired)
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"github.com/hardboiledalex/go-tools/lib/logging"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Backups being written are kept under this suffix until complete
+const partialSuffix = ".partial"
+
+// File in the repository root locked by the commands changing the repository
+const lockFileName = "lock"
+
+// Directory with one subdirectory per backup named by the backup ID
+type repository struct {
+	root string
+}
+
+// Opens existing repository
+// Returns repository and error if happened
+func openRepository(root string) (*repository, error) {
+	if root == "" {
+		return nil, newUsageError("repository is not configured, set it in the configuration or with --repository")
+	}
+	fileInfo, err := os.Stat(root)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open repository: %v", err)
+	}
+	if !fileInfo.IsDir() {
+		return nil, fmt.Errorf("repository %s is not a directory", root)
+	}
+	return &repository{root: root}, nil
+}
+
+// Opens the repository, creating its directory if missing
+// Returns repository and error if happened
+func createRepository(root string) (*repository, error) {
+	if root == "" {
+		return nil, newUsageError("repository is not configured, set it in the configuration or with --repository")
+	}
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, fmt.Errorf("cannot create repository: %v", err)
+	}
+	return openRepository(root)
+}
+
+// Opens the repositories of the configuration, those of jobs never backed up may be missing and are left out
+// Returns repositories and error if happened, also if none of them exists
+func openRepositories(config *Config) ([]*repository, error) {
+	var repos []*repository
+	var missing error
+	for _, root := range config.repositories() {
+		repo, err := openRepository(root)
+		if err != nil {
+			if _, statErr := os.Stat(root); root == "" || !os.IsNotExist(statErr) {
+				return nil, err
+			}
+			logging.LogDebugf("Skipping repository %s, it does not exist", root)
+			if missing == nil {
+				missing = err
+			}
+			continue
+		}
+		repos = append(repos, repo)
+	}
+	if len(repos) == 0 {
+		return nil, missing
+	}
+	return repos, nil
+}
+
+// Returns the repository holding the backup
+// If none holds it, the first one is returned, so loading the backup from it reports the problem
+func findBackup(repos []*repository, id string) *repository {
+	for _, repo := range repos {
+		if _, err := os.Stat(repo.path(id)); err == nil {
+			return repo
+		}
+	}
+	return repos[0]
+}
+
+// Locks the repository until the returned function is called, waiting for the lock if another process holds it
+// Backups hold the lock shared so they run in parallel, removal of backups and chunks holds it exclusively
+// so it never removes a chunk or a base a running backup refers to
+func (repo *repository) lock(exclusive bool) (func(), error) {
+	file, err := os.OpenFile(filepath.Join(repo.root, lockFileName), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("cannot lock repository: %v", err)
+	}
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	err = syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		logging.LogInfof("Waiting for another process using repository %s", repo.root)
+		err = syscall.Flock(int(file.Fd()), how)
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("cannot lock repository: %v", err)
+	}
+	return func() { file.Close() }, nil
+}
+
+// Path inside the backup directory
+func (repo *repository) path(id string, elements ...string) string {
+	return filepath.Join(append([]string{repo.root, id}, elements...)...)
+}
+
+// IDs of all complete backups sorted by name
+func (repo *repository) ids() ([]string, error) {
+	entries, err := ioutil.ReadDir(repo.root)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, entry := range entries {
+		if entry.IsDir() && entry.Name() != chunkDirectory && !strings.HasSuffix(entry.Name(), partialSuffix) {
+			ids = append(ids, entry.Name())
+		}
+	}
+	return ids, nil
+}
+
+// Reads manifest of the backup
+// Returns manifest and error if happened
+func (repo *repository) load(id string) (*manifest, error) {
+	if id == "" || id != filepath.Base(id) || strings.HasSuffix(id, partialSuffix) {
+		return nil, newUsageError("invalid backup ID %q", id)
+	}
+	if _, err := os.Stat(repo.path(id)); err != nil {
+		if os.IsNotExist(err) {
+			return nil, newUsageError("backup %s does not exist", id)
+		}
+		return nil, err
+	}
+	return readManifest(repo.path(id, manifestFileName))
+}
+
+// Manifests of all readable backups sorted from the oldest, unreadable ones are skipped with a warning
+func (repo *repository) backups() ([]*manifest, error) {
+	ids, err := repo.ids()
+	if err != nil {
+		return nil, err
+	}
+	var backups []*manifest
+	for _, id := range ids {
+		m, err := repo.load(id)
+		if err != nil {
+			logging.LogWarnf("Skipping backup %s: %v", id, err)
+			continue
+		}
+		backups = append(backups, m)
+	}
+	sort.SliceStable(backups, func(i, j int) bool {
+		return backups[i].Started.Before(backups[j].Started)
+	})
+	return backups, nil
+}
+
+// Creates the directory of a new backup, the backup is not visible until committed
+// Returns the backup ID and error if happened
+func (repo *repository) create(job string, created time.Time) (string, error) {
+	base := job + "-" + created.UTC().Format("20060102T150405Z")
+	for attempt := 0; ; attempt++ {
+		id := base
+		if attempt > 0 {
+			id = fmt.Sprintf("%s.%d", base, attempt)
+		}
+		if _, err := os.Stat(repo.path(id)); err == nil {
+			continue
+		}
+		err := os.Mkdir(repo.path(id+partialSuffix), 0700)
+		if err == nil {
+			return id, nil
+		}
+		if !os.IsExist(err) {
+			return "", err
+		}
+	}
+}
+
+// Path inside the directory of a backup being written
+func (repo *repository) partialPath(id string, elements ...string) string {
+	return repo.path(id+partialSuffix, elements...)
+}
+
+// Makes the written backup visible
+func (repo *repository) commit(id string) error {
+	return os.Rename(repo.partialPath(id), repo.path(id))
+}
+
+// Removes the backup being written
+func (repo *repository) discard(id string) {
+	if err := os.RemoveAll(repo.partialPath(id)); err != nil {
+		logging.LogWarnf("Cannot remove incomplete backup %s: %v", id, err)
+	}
+}
+
+// Removes complete backup, it is renamed first so a partly removed backup is never listed
+func (repo *repository) remove(id string) error {
+	if err := os.Rename(repo.path(id), repo.partialPath(id)); err != nil {
+		return err
+	}
+	return os.RemoveAll(repo.partialPath(id))
+}
+
+// Opens archive of the backup, decrypting it transparently if it is encrypted or joining its chunks if it is chunked
+// Manifest is not authenticated, so an archive of a job configured with encryption must be encrypted
+// Returns stream of the tar archive and error if happened, damaged or tampered archive fails on read
+func (repo *repository) openArchive(m *manifest, a archive, keys *keyStore) (io.ReadCloser, error) {
+	if mode := keys.encryption(m.Job).Mode; mode != "" && a.Encryption == "" {
+		return nil, fmt.Errorf("archive %s is not encrypted although job %s uses %s encryption, it may have been replaced", a.File, m.Job, mode)
+	}
+	if a.Storage == storageChunks {
+		key, err := keys.jobKey(m.Job, a.Encryption, false)
+		if err != nil {
+			return nil, err
+		}
+		return repo.openChunkedArchive(m, a, key)
+	}
+	file, err := os.Open(repo.path(m.ID, a.File))
+	if err != nil {
+		return nil, err
+	}
+	if a.Encryption == "" {
+		return file, nil
+	}
+	reader, err := newDecryptReader(file, m.Job, keys)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return archiveReader{Reader: reader, file: file}, nil
+}
+
+type archiveReader struct {
+	io.Reader
+	file *os.File
+}
+
+func (reader archiveReader) Close() error {
+	return reader.file.Close()
+}
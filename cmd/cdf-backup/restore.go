@@ -0,0 +1,435 @@
+package main
+
+import (
+	"github.com/hardboiledalex/go-tools/lib/logging"
+	"github.com/hardboiledalex/go-tools/lib/ssh"
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"github.com/melbahja/goph"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+)
+
+// Policies for entries which already exist at the restore target
+const (
+	conflictOverwrite = "overwrite"
+	conflictSkip      = "skip"
+	conflictKeepNewer = "keep-newer"
+	conflictRename    = "rename"
+)
+
+// Restored entry in conflict is written under its name with this suffix when the policy is rename
+const renamedSuffix = ".restored"
+
+// Actions of the restore plan
+const (
+	actionRestore   = "restore"
+	actionOverwrite = "overwrite"
+	actionRename    = "rename"
+	actionSkip      = "skip"
+	actionDelete    = "delete"
+)
+
+type restoreOptions struct {
+	include  []string
+	conflict string
+}
+
+// Entry to restore, link is the position in the archive chain of the archive holding its content
+type restoreItem struct {
+	entry  fileEntry
+	link   int
+	name   string
+	action string
+	reason string
+}
+
+// What restore of an archive does, removals happen before any entry is extracted
+type restorePlan struct {
+	items    []restoreItem
+	removals []string
+}
+
+// Restores the backup to the original paths of its hosts, under an alternate root or host,
+// or under the local --target directory where every archive goes to <target>/<host>/<original path>.
+// Incremental and differential archives are merged with their bases, so every entry is extracted once.
+// Ownership and modes are restored when the extracting user, local or the one of the connection, is root
+func runRestore(config *Config, args []string) error {
+	flags := newFlagSet("restore", "BACKUP-ID")
+	target := flags.String("target", "", "restore into this local directory instead of the original hosts")
+	root := flags.String("root", "", "restore under this directory of the host instead of the original paths")
+	toHost := flags.String("host", "", "restore to this host instead of the original one")
+	sourceHost := flags.String("source-host", "", "restore only archives of this host")
+	var options restoreOptions
+	flags.Var((*stringList)(&options.include), "include", "restore only entries matching the pattern, may be repeated")
+	flags.StringVar(&options.conflict, "conflict", conflictOverwrite, "what to do with existing entries: overwrite, skip, keep-newer or rename")
+	dryRun := flags.Bool("dry-run", false, "only list what would be restored")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return newUsageError("restore: expected exactly one backup ID")
+	}
+	switch options.conflict {
+	case conflictOverwrite, conflictSkip, conflictKeepNewer, conflictRename:
+	default:
+		return newUsageError("restore: unknown conflict policy %q", options.conflict)
+	}
+	if *target != "" && (*root != "" || *toHost != "") {
+		return newUsageError("restore: --target cannot be combined with --root or --host")
+	}
+	if *root != "" && !path.IsAbs(*root) {
+		return newUsageError("restore: root %s is not absolute", *root)
+	}
+	for _, pattern := range options.include {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return newUsageError("restore: invalid pattern %q", pattern)
+		}
+	}
+
+	repos, err := openRepositories(config)
+	if err != nil {
+		return err
+	}
+	repo := findBackup(repos, flags.Arg(0))
+	m, err := repo.load(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	var selected []archive
+	for _, a := range m.Archives {
+		if *sourceHost == "" || a.Host == *sourceHost {
+			selected = append(selected, a)
+		}
+	}
+	if len(selected) == 0 {
+		return newUsageError("restore: backup %s has no archives of host %s", m.ID, *sourceHost)
+	}
+	if *toHost != "" && len(m.Hosts) > 1 && *sourceHost == "" {
+		return newUsageError("restore: backup %s has several hosts, select one with --source-host", m.ID)
+	}
+
+	keys := newKeyStore(config)
+	pool := make(connections)
+	defer pool.closeAll()
+	for _, a := range selected {
+		var client *goph.Client
+		host := a.Host
+		directory := a.Path
+		if *target != "" {
+			host = localHostAddress
+			directory = filepath.Join(*target, a.Host, a.Path)
+		} else {
+			if *toHost != "" {
+				host = *toHost
+			}
+			if *root != "" {
+				directory = path.Join(*root, a.Path)
+			}
+			if client, err = pool.get(config.findHost(m.Job, host)); err != nil {
+				return err
+			}
+		}
+		if client == nil && os.Geteuid() != 0 {
+			logging.LogWarnf("Not running as root, ownership of the restored entries is not preserved")
+		}
+
+		manifests, archives, err := repo.archiveChain(m, a)
+		if err != nil {
+			return err
+		}
+		existing, err := listExisting(client, directory)
+		if err != nil {
+			return fmt.Errorf("cannot list %s:%s: %v", host, directory, err)
+		}
+		plan, err := planRestore(archives, existing, options)
+		if err != nil {
+			return err
+		}
+		if *dryRun {
+			if err := printRestorePlan(host, directory, plan); err != nil {
+				return err
+			}
+			continue
+		}
+
+		logging.LogInfof("Restoring %s:%s to %s:%s", a.Host, a.Path, host, directory)
+		for _, removal := range plan.removals {
+			if err := ssh.RemoveAll(client, path.Join(directory, removal)); err != nil {
+				return err
+			}
+		}
+		if err := extractPlan(client, repo, keys, manifests, archives, plan, directory); err != nil {
+			return err
+		}
+	}
+	if !*dryRun {
+		logging.LogSuccessf("Backup %s restored", m.ID)
+	}
+	return nil
+}
+
+// Lists entries under the directory by their slash-separated relative path, missing directory has none
+func listExisting(client *goph.Client, directory string) (map[string]os.FileInfo, error) {
+	existing := make(map[string]os.FileInfo)
+	root := path.Clean(directory)
+	err := ssh.Walk(client, root, func(walkedPath string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			if walkedPath == root && os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		existing[relativeTo(root, walkedPath)] = fileInfo
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return existing, nil
+	}
+	return existing, err
+}
+
+// Reports whether the entry is selected by the patterns, a directory selects everything below it
+// Absolute patterns are matched against the original path of the entry, the others as exclude patterns of jobs
+func includes(patterns []string, archivePath string, entryPath string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for current := entryPath; current != "."; current = path.Dir(current) {
+		for _, pattern := range patterns {
+			if path.IsAbs(pattern) {
+				if matched, _ := path.Match(path.Clean(pattern), path.Join(archivePath, current)); matched {
+					return true
+				}
+			} else if ssh.MatchesAnyPattern([]string{pattern}, current) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Selects entries of the last archive of the chain and decides what to do with each of them
+// Content of every entry comes from the newest archive of the chain storing it.
+// Directories of selected entries are restored too, so they get their modes and owners
+func planRestore(archives []archive, existing map[string]os.FileInfo, options restoreOptions) (*restorePlan, error) {
+	final := archives[len(archives)-1]
+	selected := make(map[string]bool)
+	for _, entry := range final.Entries {
+		if includes(options.include, final.Path, entry.Path) {
+			for current := entry.Path; !selected[current]; current = path.Dir(current) {
+				selected[current] = true
+				if current == "." {
+					break
+				}
+			}
+		}
+	}
+
+	links := make(map[string]int)
+	for i := len(archives) - 1; i >= 0; i-- {
+		for _, entry := range archives[i].storedEntries() {
+			if _, found := links[entry.Path]; !found && selected[entry.Path] {
+				links[entry.Path] = i
+			}
+		}
+	}
+
+	plan := &restorePlan{}
+	// Names restored entries take, so a renamed entry does not collide with another one
+	taken := make(map[string]bool)
+	skipped := make(map[string]bool)
+	renamed := make(map[string]string)
+	for _, entry := range final.Entries {
+		if !selected[entry.Path] {
+			continue
+		}
+		link, found := links[entry.Path]
+		if !found {
+			return nil, fmt.Errorf("%s of %s:%s is not stored in any archive of the chain", entry.Path, final.Host, final.Path)
+		}
+		item := restoreItem{entry: entry, link: link, name: entry.Path, action: actionRestore}
+		parent := path.Dir(entry.Path)
+		switch {
+		case entry.Path != "." && skipped[parent]:
+			item.action = actionSkip
+			item.reason = "directory skipped"
+		case entry.Path != "." && renamed[parent] != "":
+			item.name = path.Join(renamed[parent], path.Base(entry.Path))
+		default:
+			current, exists := existing[entry.Path]
+			if exists && !(entry.Type == entryDir && current.IsDir()) {
+				resolveConflict(&item, current, options.conflict, existing, taken)
+				if item.action == actionOverwrite && (current.IsDir() || entry.Type == entryDir) {
+					plan.removals = append(plan.removals, entry.Path)
+				}
+			}
+		}
+		switch {
+		case item.action == actionSkip && entry.Type == entryDir:
+			skipped[entry.Path] = true
+		case item.action == actionRename && entry.Type == entryDir:
+			renamed[entry.Path] = item.name
+		}
+		taken[item.name] = true
+		plan.items = append(plan.items, item)
+	}
+
+	// Overwriting restore brings the target to the state of the backup, including entries deleted in the chain
+	if options.conflict == conflictOverwrite {
+		for _, a := range archives[1:] {
+			for _, deleted := range a.Deleted {
+				if _, exists := existing[deleted]; exists && !selected[deleted] && includes(options.include, final.Path, deleted) {
+					plan.removals = append(plan.removals, deleted)
+					plan.items = append(plan.items, restoreItem{name: deleted, action: actionDelete})
+				}
+			}
+		}
+	}
+	return plan, nil
+}
+
+func resolveConflict(item *restoreItem, current os.FileInfo, policy string, existing map[string]os.FileInfo, taken map[string]bool) {
+	switch policy {
+	case conflictSkip:
+		item.action = actionSkip
+		item.reason = "exists"
+	case conflictKeepNewer:
+		if current.ModTime().After(item.entry.ModTime) {
+			item.action = actionSkip
+			item.reason = "existing is newer"
+		} else {
+			item.action = actionOverwrite
+		}
+	case conflictRename:
+		item.action = actionRename
+		item.name = item.entry.Path + renamedSuffix
+		for i := 1; existing[item.name] != nil || taken[item.name]; i++ {
+			item.name = fmt.Sprintf("%s%s.%d", item.entry.Path, renamedSuffix, i)
+		}
+	default:
+		item.action = actionOverwrite
+	}
+}
+
+func printRestorePlan(host string, directory string, plan *restorePlan) error {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, item := range plan.items {
+		name := path.Join(directory, item.name)
+		switch {
+		case item.action == actionRename:
+			fmt.Fprintf(writer, "%s\t%s:%s\tfrom %s\n", item.action, host, name, item.entry.Path)
+		case item.reason != "":
+			fmt.Fprintf(writer, "%s\t%s:%s\t%s\n", item.action, host, name, item.reason)
+		default:
+			fmt.Fprintf(writer, "%s\t%s:%s\t\n", item.action, host, name)
+		}
+	}
+	return writer.Flush()
+}
+
+// Streams the planned entries from the archives of the chain into the directory as one tar archive
+func extractPlan(client *goph.Client, repo *repository, keys *keyStore, manifests []*manifest, archives []archive, plan *restorePlan, directory string) error {
+	pipeReader, pipeWriter := io.Pipe()
+	go func() {
+		pipeWriter.CloseWithError(writeRestoreStream(pipeWriter, repo, keys, manifests, archives, plan))
+	}()
+	_, err := ssh.UnpackDirectory(client, pipeReader, directory, ssh.TarOptions{Compression: ssh.CompressionNone})
+	pipeReader.CloseWithError(err)
+	return err
+}
+
+func writeRestoreStream(writer io.Writer, repo *repository, keys *keyStore, manifests []*manifest, archives []archive, plan *restorePlan) error {
+	items := make([]map[string]*restoreItem, len(archives))
+	for i := range plan.items {
+		item := &plan.items[i]
+		if item.action == actionSkip || item.action == actionDelete {
+			continue
+		}
+		if items[item.link] == nil {
+			items[item.link] = make(map[string]*restoreItem)
+		}
+		items[item.link][item.entry.Path] = item
+	}
+
+	tarWriter := tar.NewWriter(writer)
+	// Names under which the entries were written, hard links must point to them
+	written := make(map[string]string)
+	for i := range archives {
+		if len(items[i]) == 0 {
+			continue
+		}
+		if err := copyPlannedEntries(tarWriter, repo, keys, manifests[i], archives[i], items[i], written); err != nil {
+			return fmt.Errorf("%s of %s: %v", archives[i].File, manifests[i].ID, err)
+		}
+	}
+	return tarWriter.Close()
+}
+
+func copyPlannedEntries(tarWriter *tar.Writer, repo *repository, keys *keyStore, m *manifest, a archive, items map[string]*restoreItem, written map[string]string) error {
+	compression, err := parseCompression(a.Compression)
+	if err != nil {
+		return err
+	}
+	archiveReader, err := repo.openArchive(m, a, keys)
+	if err != nil {
+		return err
+	}
+	defer archiveReader.Close()
+	var reader io.Reader = archiveReader
+	if compression == ssh.CompressionGzip {
+		gzipReader, err := gzip.NewReader(reader)
+		if err != nil {
+			return err
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+	}
+
+	tarReader := tar.NewReader(reader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		item := items[entryPath(header.Name)]
+		if item == nil {
+			continue
+		}
+		if header.Typeflag == tar.TypeLink {
+			target, found := written[entryPath(header.Linkname)]
+			if !found {
+				logging.LogWarnf("Skipping %s, it is a hard link to %s which is not restored", item.entry.Path, header.Linkname)
+				continue
+			}
+			header.Linkname = archiveName(target)
+		}
+		header.Name = archiveName(item.name)
+		// Names from the extended header would override the new ones
+		delete(header.PAXRecords, "path")
+		delete(header.PAXRecords, "linkpath")
+		header.Format = tar.FormatUnknown
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tarWriter, tarReader); err != nil {
+			return err
+		}
+		written[item.entry.Path] = item.name
+	}
+}
+
+func archiveName(name string) string {
+	if name == "." {
+		return "./"
+	}
+	return "./" + strings.TrimPrefix(name, "./")
+}
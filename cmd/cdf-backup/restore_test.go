@@ -0,0 +1,150 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRestoreFilters(t *testing.T) {
+	source := createSourceTree(t)
+	config := newTestConfig(t, source)
+	require.NoError(t, runBackup(config, nil))
+	repo, err := openRepository(config.Repository)
+	require.NoError(t, err)
+	ids, err := repo.ids()
+	require.NoError(t, err)
+
+	restore := func(args ...string) string {
+		target := t.TempDir()
+		require.NoError(t, runRestore(config, append(append([]string{"--target", target}, args...), ids[0])))
+		return filepath.Join(target, localHostAddress, source)
+	}
+
+	restored := restore("--include", "conf/nested")
+	assert.FileExists(t, filepath.Join(restored, "conf", "nested", "extra.yaml"), "Directory must be restored with its content")
+	assert.NoFileExists(t, filepath.Join(restored, "conf", "app.yaml"))
+	assert.NoFileExists(t, filepath.Join(restored, "current.yaml"))
+	fileInfo, err := os.Stat(filepath.Join(restored, "conf"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0755), fileInfo.Mode().Perm(), "Parent directory must get its archived mode")
+
+	restored = restore("--include", "*.yaml")
+	assert.FileExists(t, filepath.Join(restored, "conf", "app.yaml"))
+	assert.FileExists(t, filepath.Join(restored, "conf", "nested", "extra.yaml"))
+	_, err = os.Lstat(filepath.Join(restored, "current.yaml"))
+	assert.NoError(t, err)
+
+	restored = restore("--include", filepath.Join(source, "conf", "app.*"))
+	assert.FileExists(t, filepath.Join(restored, "conf", "app.yaml"))
+	assert.NoFileExists(t, filepath.Join(restored, "conf", "nested", "extra.yaml"))
+
+	_, isUsage := runRestore(config, []string{"--target", t.TempDir(), "--root", "/srv", ids[0]}).(*usageError)
+	assert.True(t, isUsage, "Target and root cannot be combined")
+	_, isUsage = runRestore(config, []string{"--conflict", "merge", ids[0]}).(*usageError)
+	assert.True(t, isUsage, "Unknown conflict policy must be a usage error")
+}
+
+func TestRestoreConflicts(t *testing.T) {
+	source := createSourceTree(t)
+	config := newTestConfig(t, source)
+	require.NoError(t, runBackup(config, nil))
+	repo, err := openRepository(config.Repository)
+	require.NoError(t, err)
+	ids, err := repo.ids()
+	require.NoError(t, err)
+
+	root := t.TempDir()
+	restore := func(args ...string) {
+		require.NoError(t, runRestore(config, append(append([]string{"--root", root}, args...), ids[0])))
+	}
+	restore()
+	restored := filepath.Join(root, source)
+	appPath := filepath.Join(restored, "conf", "app.yaml")
+	readApp := func(name string) string {
+		content, err := ioutil.ReadFile(filepath.Join(restored, "conf", name))
+		require.NoError(t, err)
+		return string(content)
+	}
+	assert.Equal(t, "key: value\n", readApp("app.yaml"))
+
+	require.NoError(t, ioutil.WriteFile(appPath, []byte("key: local\n"), 0600))
+	future := time.Now().Add(time.Hour)
+	require.NoError(t, os.Chtimes(appPath, future, future))
+	require.NoError(t, os.Remove(filepath.Join(restored, "conf", "nested", "extra.yaml")))
+
+	restore("--conflict", conflictSkip)
+	assert.Equal(t, "key: local\n", readApp("app.yaml"), "Existing file must be skipped")
+	assert.FileExists(t, filepath.Join(restored, "conf", "nested", "extra.yaml"), "Missing file must be restored")
+
+	restore("--conflict", conflictKeepNewer)
+	assert.Equal(t, "key: local\n", readApp("app.yaml"), "Newer existing file must be kept")
+
+	restore("--conflict", conflictRename, "--include", "conf/app.yaml")
+	restore("--conflict", conflictRename, "--include", "conf/app.yaml")
+	assert.Equal(t, "key: local\n", readApp("app.yaml"))
+	assert.Equal(t, "key: value\n", readApp("app.yaml"+renamedSuffix))
+	assert.Equal(t, "key: value\n", readApp("app.yaml"+renamedSuffix+".1"), "Renamed file must not overwrite an earlier one")
+
+	restore("--dry-run")
+	assert.Equal(t, "key: local\n", readApp("app.yaml"), "Dry run must not change anything")
+
+	past := time.Now().Add(-24 * time.Hour)
+	require.NoError(t, os.Chtimes(appPath, past, past))
+	restore("--conflict", conflictKeepNewer)
+	assert.Equal(t, "key: value\n", readApp("app.yaml"), "Older existing file must be overwritten")
+	fileInfo, err := os.Stat(appPath)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), fileInfo.Mode().Perm())
+}
+
+func TestPlanRestore(t *testing.T) {
+	modified := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	full := archive{Path: "/etc/app", Entries: []fileEntry{
+		{Path: ".", Type: entryDir},
+		{Path: "conf", Type: entryDir},
+		{Path: "conf/app.yaml", Type: entryFile, ModTime: modified},
+		{Path: "old.yaml", Type: entryFile, ModTime: modified},
+	}}
+	incremental := archive{Path: "/etc/app", Deleted: []string{"old.yaml"}, Entries: []fileEntry{
+		{Path: ".", Type: entryDir},
+		{Path: "conf", Type: entryDir},
+		{Path: "new.yaml", Type: entryFile, ModTime: modified},
+		{Path: "conf/app.yaml", Type: entryFile, ModTime: modified, Inherited: true},
+	}}
+
+	directory := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(directory, "conf"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(directory, "old.yaml"), nil, 0644))
+	require.NoError(t, os.Mkdir(filepath.Join(directory, "new.yaml"), 0755))
+	existing, err := listExisting(nil, directory)
+	require.NoError(t, err)
+
+	plan, err := planRestore([]archive{full, incremental}, existing, restoreOptions{conflict: conflictOverwrite})
+	require.NoError(t, err)
+	actions := make(map[string]string)
+	links := make(map[string]int)
+	for _, item := range plan.items {
+		actions[item.name] = item.action
+		links[item.name] = item.link
+	}
+	assert.Equal(t, map[string]string{
+		".": actionRestore, "conf": actionRestore, "new.yaml": actionOverwrite, "conf/app.yaml": actionRestore, "old.yaml": actionDelete,
+	}, actions)
+	assert.Equal(t, 0, links["conf/app.yaml"], "Inherited file must come from the base archive")
+	assert.Equal(t, 1, links["new.yaml"])
+	assert.ElementsMatch(t, []string{"new.yaml", "old.yaml"}, plan.removals, "Directory in place of a file and deleted file must be removed")
+
+	plan, err = planRestore([]archive{full, incremental}, existing, restoreOptions{conflict: conflictSkip, include: []string{"*.yaml"}})
+	require.NoError(t, err)
+	assert.Empty(t, plan.removals)
+	for _, item := range plan.items {
+		if item.name == "new.yaml" {
+			assert.Equal(t, actionSkip, item.action)
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"github.com/hardboiledalex/go-tools/lib/utils"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Rules deciding which backups of a job are kept
+// A backup is kept if any keep rule selects it, no keep rules at all keep every backup.
+// Kept backups older than MaxAge are removed, then the oldest kept ones are removed while the job
+// takes more than MaxTotalSize. The newest backup of a job is never removed by MaxAge or MaxTotalSize
+type Retention struct {
+	KeepLast     int      `yaml:"keepLast"`
+	KeepDaily    int      `yaml:"keepDaily"`
+	KeepWeekly   int      `yaml:"keepWeekly"`
+	KeepMonthly  int      `yaml:"keepMonthly"`
+	KeepYearly   int      `yaml:"keepYearly"`
+	MaxAge       age      `yaml:"maxAge"`
+	MaxTotalSize byteSize `yaml:"maxTotalSize"`
+}
+
+// Decision about a single backup with the rule which made it
+type retentionDecision struct {
+	backup *manifest
+	keep   bool
+	reason string
+}
+
+func (policy Retention) isEmpty() bool {
+	return policy == Retention{}
+}
+
+func (policy Retention) hasKeepRules() bool {
+	return policy.KeepLast > 0 || policy.KeepDaily > 0 || policy.KeepWeekly > 0 || policy.KeepMonthly > 0 || policy.KeepYearly > 0
+}
+
+func (policy Retention) validate() error {
+	var errs fieldErrors
+	policy.check("", &errs)
+	return errs.err()
+}
+
+func (policy Retention) check(field string, errs *fieldErrors) {
+	for _, rule := range []struct {
+		name  string
+		value int
+	}{
+		{"keepLast", policy.KeepLast},
+		{"keepDaily", policy.KeepDaily},
+		{"keepWeekly", policy.KeepWeekly},
+		{"keepMonthly", policy.KeepMonthly},
+		{"keepYearly", policy.KeepYearly},
+	} {
+		if rule.value < 0 {
+			errs.add(joinField(field, rule.name), "must not be negative")
+		}
+	}
+}
+
+// Returns the policy with fields set in the override replacing its own
+func (policy Retention) merge(override Retention) Retention {
+	if override.KeepLast != 0 {
+		policy.KeepLast = override.KeepLast
+	}
+	if override.KeepDaily != 0 {
+		policy.KeepDaily = override.KeepDaily
+	}
+	if override.KeepWeekly != 0 {
+		policy.KeepWeekly = override.KeepWeekly
+	}
+	if override.KeepMonthly != 0 {
+		policy.KeepMonthly = override.KeepMonthly
+	}
+	if override.KeepYearly != 0 {
+		policy.KeepYearly = override.KeepYearly
+	}
+	if override.MaxAge != 0 {
+		policy.MaxAge = override.MaxAge
+	}
+	if override.MaxTotalSize != 0 {
+		policy.MaxTotalSize = override.MaxTotalSize
+	}
+	return policy
+}
+
+// Decides about backups of a single job, the backups must be sorted from the oldest
+// Returns decisions from the newest backup
+func (policy Retention) apply(backups []*manifest, now time.Time) []retentionDecision {
+	decisions := make([]retentionDecision, len(backups))
+	for i := range backups {
+		decisions[i].backup = backups[len(backups)-1-i]
+	}
+	if !policy.hasKeepRules() {
+		for i := range decisions {
+			decisions[i].keep = true
+			decisions[i].reason = "no keep rules"
+		}
+	}
+
+	keepNewest(decisions, policy.KeepLast, "last", func(t time.Time) string {
+		return strconv.FormatInt(t.UnixNano(), 10)
+	})
+	keepNewest(decisions, policy.KeepDaily, "daily", func(t time.Time) string {
+		return t.Format("2006-01-02")
+	})
+	keepNewest(decisions, policy.KeepWeekly, "weekly", func(t time.Time) string {
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-%02d", year, week)
+	})
+	keepNewest(decisions, policy.KeepMonthly, "monthly", func(t time.Time) string {
+		return t.Format("2006-01")
+	})
+	keepNewest(decisions, policy.KeepYearly, "yearly", func(t time.Time) string {
+		return t.Format("2006")
+	})
+
+	if policy.MaxAge > 0 {
+		for i := 1; i < len(decisions); i++ {
+			if decisions[i].keep && now.Sub(decisions[i].backup.Started) > time.Duration(policy.MaxAge) {
+				decisions[i].keep = false
+				decisions[i].reason = "older than " + policy.MaxAge.String()
+			}
+		}
+	}
+
+	if policy.MaxTotalSize > 0 {
+		var total int64
+		for _, decision := range decisions {
+			if decision.keep {
+				total += decision.backup.size()
+			}
+		}
+		for i := len(decisions) - 1; i > 0 && total > int64(policy.MaxTotalSize); i-- {
+			if decisions[i].keep {
+				decisions[i].keep = false
+				decisions[i].reason = "total size above " + policy.MaxTotalSize.String()
+				total -= decisions[i].backup.size()
+			}
+		}
+	}
+
+	// Incremental and differential backups cannot be restored without their bases
+	positions := make(map[string]int, len(decisions))
+	for i := range decisions {
+		positions[decisions[i].backup.ID] = i
+	}
+	for i := range decisions {
+		if base, found := positions[decisions[i].backup.Base]; found && decisions[i].keep && !decisions[base].keep {
+			decisions[base].keep = true
+			decisions[base].reason = "base of " + decisions[i].backup.ID
+		}
+	}
+
+	for i := range decisions {
+		if !decisions[i].keep && decisions[i].reason == "" {
+			decisions[i].reason = "not selected by any keep rule"
+		}
+	}
+	return decisions
+}
+
+// Keeps the newest backup of each of the newest count periods, the period of a backup is given by its key
+func keepNewest(decisions []retentionDecision, count int, rule string, key func(t time.Time) string) {
+	seen := make(map[string]bool)
+	for i := range decisions {
+		if len(seen) >= count {
+			return
+		}
+		period := key(decisions[i].backup.Started.Local())
+		if seen[period] {
+			continue
+		}
+		seen[period] = true
+		if !decisions[i].keep {
+			decisions[i].keep = true
+			decisions[i].reason = "keep " + rule
+		}
+	}
+}
+
+// Groups backups by job keeping their order
+func groupByJob(backups []*manifest) map[string][]*manifest {
+	groups := make(map[string][]*manifest)
+	for _, m := range backups {
+		groups[m.Job] = append(groups[m.Job], m)
+	}
+	return groups
+}
+
+func sortedJobs(groups map[string][]*manifest) []string {
+	var jobs []string
+	for job := range groups {
+		jobs = append(jobs, job)
+	}
+	sort.Strings(jobs)
+	return jobs
+}
+
+// Duration with days and weeks accepted in addition to the units of time.ParseDuration, e.g. 30d or 12w
+type age time.Duration
+
+func parseAge(value string) (age, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if strings.HasSuffix(value, suffix) {
+			count, err := strconv.Atoi(strings.TrimSuffix(value, suffix))
+			if err != nil || count < 0 {
+				return 0, fmt.Errorf("invalid age %q", value)
+			}
+			return age(time.Duration(count) * unit), nil
+		}
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration < 0 {
+		return 0, fmt.Errorf("invalid age %q, expected e.g. 30d, 12w or 36h", value)
+	}
+	return age(duration), nil
+}
+
+func (a age) String() string {
+	duration := time.Duration(a)
+	if duration > 0 && duration%(24*time.Hour) == 0 {
+		return fmt.Sprintf("%dd", duration/(24*time.Hour))
+	}
+	return duration.String()
+}
+
+func (a *age) Set(value string) error {
+	parsed, err := parseAge(value)
+	if err != nil {
+		return err
+	}
+	*a = parsed
+	return nil
+}
+
+func (a *age) UnmarshalYAML(node *yaml.Node) error {
+	return a.Set(node.Value)
+}
+
+// Size in bytes with optional binary unit, e.g. 500GB or 1.5TiB, both GB and GiB mean 1024^3
+type byteSize int64
+
+var sizeUnits = []struct {
+	suffix     string
+	multiplier float64
+}{
+	{"TIB", 1 << 40}, {"GIB", 1 << 30}, {"MIB", 1 << 20}, {"KIB", 1 << 10},
+	{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10},
+	{"T", 1 << 40}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}, {"B", 1},
+}
+
+func parseByteSize(value string) (byteSize, error) {
+	number := strings.ToUpper(strings.TrimSpace(value))
+	multiplier := 1.0
+	for _, unit := range sizeUnits {
+		if strings.HasSuffix(number, unit.suffix) {
+			number = strings.TrimSpace(strings.TrimSuffix(number, unit.suffix))
+			multiplier = unit.multiplier
+			break
+		}
+	}
+	parsed, err := strconv.ParseFloat(number, 64)
+	if err != nil || parsed < 0 {
+		return 0, fmt.Errorf("invalid size %q, expected e.g. 500GB", value)
+	}
+	return byteSize(parsed * multiplier), nil
+}
+
+func (size byteSize) String() string {
+	return utils.BytesToString(int(size))
+}
+
+func (size *byteSize) Set(value string) error {
+	parsed, err := parseByteSize(value)
+	if err != nil {
+		return err
+	}
+	*size = parsed
+	return nil
+}
+
+func (size *byteSize) UnmarshalYAML(node *yaml.Node) error {
+	return size.Set(node.Value)
+}
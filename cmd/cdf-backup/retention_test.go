@@ -0,0 +1,104 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+// Backups of one job sorted from the oldest, started at the given times with the given archive size
+func retentionTestBackups(times []time.Time, size int64) []*manifest {
+	var backups []*manifest
+	for _, started := range times {
+		backups = append(backups, &manifest{
+			ID:       started.Format(time.RFC3339),
+			Job:      "cdf",
+			Started:  started,
+			Archives: []archive{{Size: size}},
+		})
+	}
+	return backups
+}
+
+func keptIDs(decisions []retentionDecision) []string {
+	var ids []string
+	for _, decision := range decisions {
+		if decision.keep {
+			ids = append(ids, decision.backup.ID)
+		}
+	}
+	return ids
+}
+
+func TestRetentionGrandfatherFatherSon(t *testing.T) {
+	// Two backups a day at 02:00 and 14:00 for 60 days
+	now := time.Date(2026, 3, 31, 20, 0, 0, 0, time.Local)
+	var times []time.Time
+	for day := 59; day >= 0; day-- {
+		date := now.AddDate(0, 0, -day)
+		times = append(times,
+			time.Date(date.Year(), date.Month(), date.Day(), 2, 0, 0, 0, time.Local),
+			time.Date(date.Year(), date.Month(), date.Day(), 14, 0, 0, 0, time.Local))
+	}
+	backups := retentionTestBackups(times, 1)
+
+	decisions := Retention{KeepLast: 1, KeepDaily: 3, KeepMonthly: 2}.apply(backups, now)
+	require.Len(t, decisions, len(backups))
+	assert.Equal(t, backups[len(backups)-1], decisions[0].backup, "Decisions must start from the newest backup")
+	assert.Equal(t, []string{
+		"2026-03-31T14:00:00" + zone(now),
+		"2026-03-30T14:00:00" + zone(now),
+		"2026-03-29T14:00:00" + zone(now),
+		"2026-02-28T14:00:00" + zone(now),
+	}, keptIDs(decisions), "Newest backup of the last 3 days and last 2 months must be kept")
+	for _, decision := range decisions {
+		assert.NotEmpty(t, decision.reason)
+	}
+
+	// Weekly and yearly keep the newest backup of each period
+	kept := keptIDs(Retention{KeepWeekly: 2, KeepYearly: 5}.apply(backups, now))
+	assert.Equal(t, []string{"2026-03-31T14:00:00" + zone(now), "2026-03-29T14:00:00" + zone(now)}, kept)
+}
+
+func zone(t time.Time) string {
+	return t.Format("Z07:00")
+}
+
+func TestRetentionAgeAndSize(t *testing.T) {
+	now := time.Now()
+	var times []time.Time
+	for day := 9; day >= 0; day-- {
+		times = append(times, now.Add(-time.Duration(day)*24*time.Hour-time.Hour))
+	}
+	backups := retentionTestBackups(times, 100)
+
+	// Without keep rules everything younger than the maximum age is kept
+	maxAge, err := parseAge("3d")
+	require.NoError(t, err)
+	assert.Len(t, keptIDs(Retention{MaxAge: maxAge}.apply(backups, now)), 3)
+
+	maxSize, err := parseByteSize("250B")
+	require.NoError(t, err)
+	assert.Len(t, keptIDs(Retention{MaxTotalSize: maxSize}.apply(backups, now)), 2, "Oldest backups must go until the size fits")
+
+	// The newest backup survives any limit
+	assert.Len(t, keptIDs(Retention{MaxAge: age(time.Minute), MaxTotalSize: 1}.apply(backups, now)), 1)
+}
+
+func TestParseRetentionValues(t *testing.T) {
+	for value, expected := range map[string]time.Duration{"30d": 30 * 24 * time.Hour, "2w": 14 * 24 * time.Hour, "36h": 36 * time.Hour} {
+		parsed, err := parseAge(value)
+		require.NoError(t, err)
+		assert.Equal(t, age(expected), parsed, value)
+	}
+	for value, expected := range map[string]int64{"500GB": 500 << 30, "1.5TiB": 3 << 39, "10m": 10 << 20, "4096": 4096} {
+		parsed, err := parseByteSize(value)
+		require.NoError(t, err)
+		assert.Equal(t, byteSize(expected), parsed, value)
+	}
+	_, err := parseAge("soon")
+	assert.Error(t, err)
+	_, err = parseByteSize("-1GB")
+	assert.Error(t, err)
+}
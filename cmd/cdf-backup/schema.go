@@ -0,0 +1,297 @@
+package main
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Problem of a configuration field given by its path like jobs[0].hosts[1].port
+// Line and column are known once the field is located in the document
+type fieldError struct {
+	field   string
+	message string
+	line    int
+	column  int
+}
+
+func (err *fieldError) Error() string {
+	if err.field == "" {
+		return err.message
+	}
+	return err.field + ": " + err.message
+}
+
+// All problems found in a configuration
+type fieldErrors []*fieldError
+
+func (errs *fieldErrors) add(field string, format string, params ...interface{}) {
+	*errs = append(*errs, &fieldError{field: field, message: fmt.Sprintf(format, params...)})
+}
+
+func (errs *fieldErrors) addAt(node *yaml.Node, field string, format string, params ...interface{}) {
+	*errs = append(*errs, &fieldError{field: field, message: fmt.Sprintf(format, params...), line: node.Line, column: node.Column})
+}
+
+func (errs fieldErrors) Error() string {
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Returns the errors as error, nil if there are none
+func (errs fieldErrors) err() error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// Sets position of errors without one to the field in the document, or its closest present parent
+func (errs fieldErrors) locate(root *yaml.Node) {
+	for _, err := range errs {
+		if err.line == 0 {
+			node := findField(root, err.field)
+			err.line, err.column = node.Line, node.Column
+		}
+	}
+}
+
+// Invalid configuration file with the positions of its problems
+type configError struct {
+	path   string
+	errors fieldErrors
+}
+
+func (err *configError) Error() string {
+	lines := []string{fmt.Sprintf("invalid configuration %s:", err.path)}
+	for _, fieldErr := range err.errors {
+		lines = append(lines, fmt.Sprintf("  %s:%d:%d: %v", err.path, fieldErr.line, fieldErr.column, fieldErr))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Parses and validates the configuration document, environment variables in its values are replaced first
+// Returns fieldErrors with positions of all problems found, or other error if the document is not valid YAML
+func parseConfig(data []byte, config *Config) error {
+	var document yaml.Node
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return err
+	}
+	if len(document.Content) == 0 {
+		return nil
+	}
+	root := document.Content[0]
+
+	var errs fieldErrors
+	interpolate(root, "", &errs)
+	checkSchema(root, reflect.TypeOf(*config), "", &errs)
+	if len(errs) == 0 {
+		if err := root.Decode(config); err != nil {
+			return err
+		}
+		errs = config.check()
+	}
+	errs.locate(root)
+	return errs.err()
+}
+
+// Returns node of the field, or of its closest parent present in the document
+func findField(root *yaml.Node, field string) *yaml.Node {
+	node := root
+	for _, part := range strings.Split(strings.Replace(field, "[", ".[", -1), ".") {
+		var child *yaml.Node
+		if strings.HasPrefix(part, "[") {
+			index, err := strconv.Atoi(strings.Trim(part, "[]"))
+			if err == nil && node.Kind == yaml.SequenceNode && index < len(node.Content) {
+				child = node.Content[index]
+			}
+		} else if node.Kind == yaml.MappingNode {
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == part {
+					child = node.Content[i+1]
+				}
+			}
+		}
+		if child == nil {
+			return node
+		}
+		node = child
+	}
+	return node
+}
+
+func joinField(parent string, name string) string {
+	if parent == "" {
+		return name
+	}
+	return parent + "." + name
+}
+
+// Replaces ${NAME} and ${NAME:-default} in values with environment variables, $$ stands for a literal $
+// Default is used when the variable is unset or empty. Other $ signs, e.g. $NAME in hook commands, are kept
+func interpolate(node *yaml.Node, field string, errs *fieldErrors) {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		value, err := expandVariables(node.Value)
+		if err != nil {
+			errs.addAt(node, field, "%v", err)
+			// Value is left empty, so the schema check does not report the field again
+			node.Value, node.Tag, node.Style = "", "", 0
+			return
+		}
+		if value != node.Value {
+			node.Value = value
+			// Plain value gets its type from the replaced text, so port: ${PORT} is a number
+			if node.Style&(yaml.SingleQuotedStyle|yaml.DoubleQuotedStyle|yaml.LiteralStyle|yaml.FoldedStyle) == 0 {
+				node.Tag = ""
+			}
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			interpolate(node.Content[i+1], joinField(field, node.Content[i].Value), errs)
+		}
+	case yaml.SequenceNode:
+		for i, item := range node.Content {
+			interpolate(item, fmt.Sprintf("%s[%d]", field, i), errs)
+		}
+	}
+}
+
+func expandVariables(value string) (string, error) {
+	var result strings.Builder
+	for {
+		start := strings.IndexByte(value, '$')
+		if start < 0 || start == len(value)-1 {
+			result.WriteString(value)
+			return result.String(), nil
+		}
+		result.WriteString(value[:start])
+		switch value[start+1] {
+		case '$':
+			result.WriteByte('$')
+			value = value[start+2:]
+			continue
+		case '{':
+		default:
+			result.WriteByte('$')
+			value = value[start+1:]
+			continue
+		}
+
+		end := strings.IndexByte(value[start:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated variable reference in %q", value[start:])
+		}
+		reference := value[start+2 : start+end]
+		name, fallback, hasFallback := reference, "", false
+		if separator := strings.Index(reference, ":-"); separator >= 0 {
+			name, fallback, hasFallback = reference[:separator], reference[separator+2:], true
+		}
+		if name == "" {
+			return "", fmt.Errorf("empty variable reference ${%s}", reference)
+		}
+		variable, found := os.LookupEnv(name)
+		switch {
+		case hasFallback && variable == "":
+			variable = fallback
+		case !found:
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		result.WriteString(variable)
+		value = value[start+end+1:]
+	}
+}
+
+var (
+	unmarshalerType = reflect.TypeOf((*yaml.Unmarshaler)(nil)).Elem()
+	durationType    = reflect.TypeOf(time.Duration(0))
+)
+
+// Checks the document against the configuration types
+// Unknown and repeated fields, lists or mappings where values belong and values not fitting their fields are reported
+func checkSchema(node *yaml.Node, t reflect.Type, field string, errs *fieldErrors) {
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	if node.Kind == yaml.ScalarNode && node.ShortTag() == "!!null" {
+		return
+	}
+
+	switch {
+	case reflect.PtrTo(t).Implements(unmarshalerType) || t.Kind() != reflect.Struct && t.Kind() != reflect.Slice:
+		if node.Kind != yaml.ScalarNode {
+			errs.addAt(node, field, "expected %s", describeType(t))
+			return
+		}
+		if err := node.Decode(reflect.New(t).Interface()); err != nil {
+			if _, isTypeError := err.(*yaml.TypeError); isTypeError {
+				errs.addAt(node, field, "invalid value %q, expected %s", node.Value, describeType(t))
+			} else {
+				errs.addAt(node, field, "%v", err)
+			}
+		}
+	case t.Kind() == reflect.Slice:
+		if node.Kind != yaml.SequenceNode {
+			errs.addAt(node, field, "expected a list")
+			return
+		}
+		for i, item := range node.Content {
+			checkSchema(item, t.Elem(), fmt.Sprintf("%s[%d]", field, i), errs)
+		}
+	default:
+		if node.Kind != yaml.MappingNode {
+			errs.addAt(node, field, "expected a mapping")
+			return
+		}
+		fields := make(map[string]reflect.Type)
+		for i := 0; i < t.NumField(); i++ {
+			if name := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]; name != "" && name != "-" {
+				fields[name] = t.Field(i).Type
+			}
+		}
+		seen := make(map[string]bool)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i]
+			keyField := joinField(field, key.Value)
+			fieldType, known := fields[key.Value]
+			switch {
+			case !known:
+				errs.addAt(key, keyField, "unknown field")
+			case seen[key.Value]:
+				errs.addAt(key, keyField, "defined more than once")
+			default:
+				checkSchema(node.Content[i+1], fieldType, keyField, errs)
+			}
+			seen[key.Value] = true
+		}
+	}
+}
+
+func describeType(t reflect.Type) string {
+	switch {
+	case t == durationType:
+		return "a duration like 90s or 5m"
+	case reflect.PtrTo(t).Implements(unmarshalerType):
+		return "a single value"
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return "true or false"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return "an integer"
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "a non-negative integer"
+	case reflect.Struct:
+		return "a mapping"
+	case reflect.Slice:
+		return "a list"
+	}
+	return "a single value"
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestExpandVariables(t *testing.T) {
+	require.NoError(t, os.Setenv("CDF_BACKUP_TEST_HOST", "node1"))
+	require.NoError(t, os.Setenv("CDF_BACKUP_TEST_EMPTY", ""))
+	defer os.Unsetenv("CDF_BACKUP_TEST_HOST")
+	defer os.Unsetenv("CDF_BACKUP_TEST_EMPTY")
+
+	for value, expected := range map[string]string{
+		"plain":                                          "plain",
+		"${CDF_BACKUP_TEST_HOST}.example.com":            "node1.example.com",
+		"${CDF_BACKUP_TEST_MISSING:-/var/cdf}":           "/var/cdf",
+		"${CDF_BACKUP_TEST_EMPTY:-default}":              "default",
+		"${CDF_BACKUP_TEST_EMPTY}":                       "",
+		"echo $$HOME $PATH $(date) 100$":                 "echo $HOME $PATH $(date) 100$",
+		"$${CDF_BACKUP_TEST_HOST}":                       "${CDF_BACKUP_TEST_HOST}",
+		"${CDF_BACKUP_TEST_HOST}${CDF_BACKUP_TEST_HOST}": "node1node1",
+	} {
+		expanded, err := expandVariables(value)
+		if assert.NoError(t, err, value) {
+			assert.Equal(t, expected, expanded, value)
+		}
+	}
+	for _, value := range []string{"${CDF_BACKUP_TEST_MISSING}", "${CDF_BACKUP_TEST_HOST", "${}"} {
+		_, err := expandVariables(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestParseConfigInterpolation(t *testing.T) {
+	require.NoError(t, os.Setenv("CDF_BACKUP_TEST_PORT", "2222"))
+	defer os.Unsetenv("CDF_BACKUP_TEST_PORT")
+
+	config := &Config{}
+	require.NoError(t, parseConfig([]byte(`
+repository: ${CDF_BACKUP_TEST_ROOT:-/var/backups/cdf}
+jobs:
+  - name: cdf
+    hosts:
+      - address: node1
+        port: ${CDF_BACKUP_TEST_PORT}
+    paths: [/opt/cfg]
+    hooks:
+      pre:
+        - command: etcdctl snapshot save /tmp/etcd-$$(date +%s).db
+          timeout: 5m
+`), config))
+	assert.Equal(t, "/var/backups/cdf", config.Repository)
+	assert.Equal(t, uint(2222), config.Jobs[0].Hosts[0].Port, "Interpolated plain value must be typed by its content")
+	assert.Equal(t, "etcdctl snapshot save /tmp/etcd-$(date +%s).db", config.Jobs[0].Hooks.Pre[0].Command)
+	assert.Equal(t, 5*time.Minute, config.Jobs[0].Hooks.Pre[0].Timeout)
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	document := `repository: /var/backups/cdf
+jobs:
+  - name: cdf
+    hosts:
+      - address: node1
+        adress: node2
+        port: twenty
+    paths: [/opt/cfg]
+    retention:
+      maxAge: soon
+  - name: cdf
+    paths: relative
+  - name: other
+    paths: [relative, /etc]
+    exclude:
+      - ${CDF_BACKUP_TEST_MISSING}
+    compression: zstd
+    retention:
+      keepLast: -1
+`
+	err := parseConfig([]byte(document), &Config{})
+	require.Error(t, err)
+	errs, isFieldErrors := err.(fieldErrors)
+	require.True(t, isFieldErrors, "Unexpected error %v", err)
+
+	// Interpolation and schema problems are reported, semantic checks need a well formed document
+	var reported []string
+	for _, fieldErr := range errs {
+		reported = append(reported, fmt.Sprintf("%d:%d %s", fieldErr.line, fieldErr.column, fieldErr.field))
+	}
+	assert.Equal(t, []string{
+		"16:9 jobs[2].exclude[0]",
+		"6:9 jobs[0].hosts[0].adress",
+		"7:15 jobs[0].hosts[0].port",
+		"10:15 jobs[0].retention.maxAge",
+		"12:12 jobs[1].paths",
+	}, reported)
+
+	// Fixed document is checked for meaning, fields missing in the document point at their parent
+	document = `jobs:
+  - name: cdf
+    paths: [/opt/cfg]
+  - name: cdf
+  - name: other
+    paths: [relative, /etc]
+    compression: zstd
+    retention:
+      keepLast: -1
+`
+	err = parseConfig([]byte(document), &Config{})
+	require.Error(t, err)
+	reported = nil
+	for _, fieldErr := range err.(fieldErrors) {
+		reported = append(reported, fmt.Sprintf("%d:%d %s", fieldErr.line, fieldErr.column, fieldErr.field))
+	}
+	assert.Equal(t, []string{
+		"4:11 jobs[1].name",
+		"4:5 jobs[1].paths",
+		"6:13 jobs[2].paths[0]",
+		"7:18 jobs[2].compression",
+		"9:17 jobs[2].retention.keepLast",
+	}, reported)
+}
+
+func TestConfigValidateCommand(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, ioutil.WriteFile(configPath, []byte("jobs:\n  - name: cdf\n    paths: [/etc]\n"), 0600))
+	assert.NoError(t, runConfig(&Config{path: configPath}, []string{"validate"}))
+	assert.NoError(t, runConfig(&Config{path: defaultConfigPath}, []string{"validate", configPath}))
+
+	require.NoError(t, ioutil.WriteFile(configPath, []byte("jobs:\n  - name: cdf\n    path: [/etc]\n"), 0600))
+	assert.Equal(t, exitUsage, exitCode(runConfig(&Config{}, []string{"validate", configPath})))
+	_, err := loadConfig(configPath, true)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), configPath+":3:5: jobs[0].path: unknown field")
+
+	assert.Equal(t, exitUsage, exitCode(runConfig(&Config{}, []string{"validate", filepath.Join(t.TempDir(), "missing.yaml")})))
+	assert.Equal(t, exitUsage, exitCode(runConfig(&Config{}, nil)))
+}
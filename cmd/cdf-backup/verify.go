@@ -0,0 +1,310 @@
+package main
+
+import (
+	"github.com/hardboiledalex/go-tools/lib/logging"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// Result of verify for all checked backups, printed with --json
+type verifyReport struct {
+	Backups []backupResult `json:"backups"`
+	Passed  int            `json:"passed"`
+	Failed  int            `json:"failed"`
+}
+
+type backupResult struct {
+	ID       string          `json:"id"`
+	Job      string          `json:"job,omitempty"`
+	Type     string          `json:"type,omitempty"`
+	Passed   bool            `json:"passed"`
+	Error    string          `json:"error,omitempty"`
+	Archives []archiveResult `json:"archives,omitempty"`
+}
+
+// Result of one archive, Checked counts entries whose content was read from the archive itself
+type archiveResult struct {
+	Host          string `json:"host"`
+	Path          string `json:"path"`
+	File          string `json:"file"`
+	Entries       int    `json:"entries"`
+	Checked       int    `json:"checked"`
+	RestoreTested bool   `json:"restoreTested"`
+	Passed        bool   `json:"passed"`
+	Error         string `json:"error,omitempty"`
+}
+
+func (result backupResult) err() error {
+	if result.Passed {
+		return nil
+	}
+	return errors.New(result.Error)
+}
+
+// Checks the given backups or all backups of the repositories
+// Every backup is reported as passed or failed, in human form or as JSON with --json, which leaves standard output to the report.
+// The command fails with the verification exit code if any backup failed
+func runVerify(config *Config, args []string) error {
+	flags := newFlagSet("verify", "[BACKUP-ID...]")
+	restoreTest := flags.Bool("restore-test", false, "restore every archive into a temporary directory and compare it with the manifest")
+	jsonReport := flags.Bool("json", false, "print the report as JSON")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	// Standard output carries only the report, log messages and passphrase prompts go to standard error
+	if *jsonReport {
+		defer logging.SetConsoleOutput(logging.ConsoleOutput())
+		logging.SetConsoleOutput(os.Stderr)
+	}
+
+	repos, err := openRepositories(config)
+	if err != nil {
+		return err
+	}
+	ids := flags.Args()
+	// Repository of each backup, backups given by ID are looked up in all repositories
+	backupRepos := make(map[string]*repository)
+	if len(ids) == 0 {
+		for _, repo := range repos {
+			repoIDs, err := repo.ids()
+			if err != nil {
+				return err
+			}
+			for _, id := range repoIDs {
+				backupRepos[id] = repo
+			}
+			ids = append(ids, repoIDs...)
+		}
+	} else {
+		for _, id := range ids {
+			backupRepos[id] = findBackup(repos, id)
+		}
+	}
+
+	keys := newKeyStore(config)
+	report := verifyReport{Backups: []backupResult{}}
+	for _, id := range ids {
+		result := verifyBackup(backupRepos[id], keys, id, *restoreTest)
+		report.Backups = append(report.Backups, result)
+		if result.Passed {
+			report.Passed++
+		} else {
+			report.Failed++
+		}
+		if !*jsonReport {
+			logBackupResult(result)
+		}
+	}
+
+	if *jsonReport {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+	} else if report.Failed > 0 {
+		logging.LogErrorf("%d of %d backups failed verification", report.Failed, len(ids))
+	}
+	if report.Failed > 0 {
+		return errVerificationFailed
+	}
+	return nil
+}
+
+func logBackupResult(result backupResult) {
+	if result.Passed {
+		logging.LogSuccessf("PASS %s", result.ID)
+	} else {
+		logging.LogErrorf("FAIL %s: %s", result.ID, result.Error)
+	}
+	for _, a := range result.Archives {
+		status := "ok"
+		if !a.Passed {
+			status = a.Error
+		} else if a.RestoreTested {
+			status = "ok, restore test passed"
+		}
+		logging.LogInfof("  %s:%s %s, %d entries, %d read: %s", a.Host, a.Path, a.File, a.Entries, a.Checked, status)
+	}
+}
+
+// Checks that the manifest is readable and every archive is complete and matches the manifest checksums
+// Bases of incremental and differential archives must be present, their archives are verified with their own backups.
+// With restoreTest every archive is also restored into a temporary directory and compared with the manifest
+func verifyBackup(repo *repository, keys *keyStore, id string, restoreTest bool) backupResult {
+	result := backupResult{ID: id}
+	m, err := repo.load(id)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.Job = m.Job
+	result.Type = m.backupType()
+	result.Passed = true
+	for _, a := range m.Archives {
+		archiveResult := archiveResult{Host: a.Host, Path: a.Path, File: a.File, Entries: len(a.Entries), Checked: len(a.storedEntries())}
+		err := verifyArchive(repo, keys, m, a)
+		if err == nil && restoreTest {
+			archiveResult.RestoreTested = true
+			err = restoreTestArchive(repo, keys, m, a)
+		}
+		archiveResult.Passed = err == nil
+		if err != nil {
+			archiveResult.Error = err.Error()
+			if result.Passed {
+				result.Passed = false
+				result.Error = fmt.Sprintf("%s: %v", a.File, err)
+			}
+		}
+		result.Archives = append(result.Archives, archiveResult)
+	}
+	return result
+}
+
+func verifyArchive(repo *repository, keys *keyStore, m *manifest, a archive) error {
+	if _, _, err := repo.archiveChain(m, a); err != nil {
+		return err
+	}
+	compression, err := parseCompression(a.Compression)
+	if err != nil {
+		return err
+	}
+	if a.Storage != storageChunks {
+		fileInfo, err := os.Stat(repo.path(m.ID, a.File))
+		if err != nil {
+			return err
+		}
+		if fileInfo.Size() != a.Size {
+			return fmt.Errorf("size is %d bytes, manifest records %d, the archive is truncated or damaged", fileInfo.Size(), a.Size)
+		}
+	}
+
+	checksumKey, err := keys.checksumKey(m.Job, a)
+	if err != nil {
+		return err
+	}
+	reader, err := repo.openArchive(m, a, keys)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	entries, err := indexArchive(reader, compression, checksumKey)
+	if err != nil {
+		return err
+	}
+	return compareEntries(a.storedEntries(), entries)
+}
+
+// Checks that the archive holds exactly the entries recorded in the manifest with the same content
+func compareEntries(expected []fileEntry, actual []fileEntry) error {
+	if len(actual) != len(expected) {
+		return fmt.Errorf("archive has %d entries, manifest records %d", len(actual), len(expected))
+	}
+	for i := range expected {
+		if actual[i].Path != expected[i].Path || actual[i].Type != expected[i].Type {
+			return fmt.Errorf("entry %d is %s %s, manifest records %s %s", i+1, actual[i].Type, actual[i].Path, expected[i].Type, expected[i].Path)
+		}
+		if actual[i].Size != expected[i].Size || actual[i].SHA256 != expected[i].SHA256 {
+			return fmt.Errorf("%s does not match its checksum in the manifest", expected[i].Path)
+		}
+	}
+	return nil
+}
+
+// Restores the archive with its bases into a temporary directory and compares the result with the manifest
+func restoreTestArchive(repo *repository, keys *keyStore, m *manifest, a archive) error {
+	directory, err := ioutil.TempDir("", "cdf-backup-verify-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(directory)
+
+	checksumKey, err := keys.checksumKey(m.Job, a)
+	if err != nil {
+		return err
+	}
+	manifests, archives, err := repo.archiveChain(m, a)
+	if err != nil {
+		return err
+	}
+	plan, err := planRestore(archives, nil, restoreOptions{conflict: conflictOverwrite})
+	if err != nil {
+		return err
+	}
+	if err := extractPlan(nil, repo, keys, manifests, archives, plan, directory); err != nil {
+		return fmt.Errorf("restore test failed: %v", err)
+	}
+	if err := compareRestored(directory, a.Entries, checksumKey); err != nil {
+		return fmt.Errorf("restore test failed: %v", err)
+	}
+	return nil
+}
+
+// Compares the restored directory with the manifest entries by type, size, permissions, link target and checksum
+// Checksums are keyed with the key unless it is nil
+func compareRestored(directory string, entries []fileEntry, key *jobKey) error {
+	existing, err := listExisting(nil, directory)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		fileInfo, found := existing[entry.Path]
+		if !found {
+			return fmt.Errorf("%s is missing", entry.Path)
+		}
+		delete(existing, entry.Path)
+		expectedType := entry.Type
+		if expectedType == entryHardlink {
+			expectedType = entryFile
+		}
+		if actualType := fileInfoType(fileInfo); actualType != expectedType {
+			return fmt.Errorf("%s is %s, manifest records %s", entry.Path, actualType, entry.Type)
+		}
+		if expectedType != entrySymlink {
+			if mode, err := strconv.ParseUint(entry.Mode, 8, 32); err == nil && os.FileMode(mode).Perm() != fileInfo.Mode().Perm() {
+				return fmt.Errorf("%s has mode %04o, manifest records %s", entry.Path, fileInfo.Mode().Perm(), entry.Mode)
+			}
+		}
+		entryFilePath := filepath.Join(directory, filepath.FromSlash(entry.Path))
+		switch expectedType {
+		case entrySymlink:
+			link, err := os.Readlink(entryFilePath)
+			if err != nil {
+				return err
+			}
+			if link != entry.Link {
+				return fmt.Errorf("%s points to %s, manifest records %s", entry.Path, link, entry.Link)
+			}
+		case entryFile:
+			if entry.Type == entryFile && (fileInfo.Size() != entry.Size || key.keyChecksum(fileChecksum(entryFilePath)) != entry.SHA256) {
+				return fmt.Errorf("%s does not match its checksum in the manifest", entry.Path)
+			}
+		}
+	}
+	for extra := range existing {
+		return fmt.Errorf("%s is restored but not recorded in the manifest", extra)
+	}
+	return nil
+}
+
+// Returns hex SHA-256 of the local file, empty if it cannot be read
+func fileChecksum(filePath string) string {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
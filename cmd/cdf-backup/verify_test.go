@@ -0,0 +1,83 @@
+package main
+
+import (
+	"github.com/hardboiledalex/go-tools/lib/logging"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// Runs verify with --json and returns its exit error and the parsed report
+func verifyJSON(t *testing.T, config *Config, args ...string) (error, verifyReport) {
+	reader, writer, err := os.Pipe()
+	require.NoError(t, err)
+	// Console messages share standard output with the report unless verify moves them away
+	stdout, console := os.Stdout, logging.ConsoleOutput()
+	os.Stdout = writer
+	logging.SetConsoleOutput(writer)
+	verifyErr := runVerify(config, append([]string{"--json"}, args...))
+	os.Stdout = stdout
+	logging.SetConsoleOutput(console)
+	require.NoError(t, writer.Close())
+	output, err := ioutil.ReadAll(reader)
+	require.NoError(t, err)
+
+	var report verifyReport
+	require.NoError(t, json.Unmarshal(output, &report), "Output must be JSON: %s", output)
+	return verifyErr, report
+}
+
+func TestVerifyReport(t *testing.T) {
+	source := createSourceTree(t)
+	config := newTestConfig(t, source)
+	require.NoError(t, runBackup(config, nil))
+	require.NoError(t, runBackup(config, []string{"--type", backupIncremental}))
+	repo, err := openRepository(config.Repository)
+	require.NoError(t, err)
+	backups, err := repo.backups()
+	require.NoError(t, err)
+	require.Len(t, backups, 2)
+
+	require.NoError(t, runVerify(config, []string{"--restore-test"}))
+	err, report := verifyJSON(t, config, "--restore-test")
+	require.NoError(t, err)
+	assert.Equal(t, 2, report.Passed)
+	assert.Equal(t, 0, report.Failed)
+	require.Len(t, report.Backups, 2)
+	incremental := report.Backups[1]
+	assert.Equal(t, backups[1].ID, incremental.ID)
+	assert.Equal(t, backupIncremental, incremental.Type)
+	require.Len(t, incremental.Archives, 1)
+	assert.True(t, incremental.Archives[0].RestoreTested)
+	assert.True(t, incremental.Archives[0].Checked < incremental.Archives[0].Entries, "Unchanged files are read from the base")
+
+	// Mode is not part of the archive checksums, only the restore test notices the difference
+	m := backups[1]
+	for i := range m.Archives[0].Entries {
+		if m.Archives[0].Entries[i].Path == "conf/app.yaml" {
+			m.Archives[0].Entries[i].Mode = "0640"
+		}
+	}
+	require.NoError(t, writeManifest(repo.path(m.ID, manifestFileName), m))
+	require.NoError(t, runVerify(config, []string{m.ID}))
+	err, report = verifyJSON(t, config, "--restore-test", m.ID)
+	assert.Equal(t, errVerificationFailed, err)
+	require.Len(t, report.Backups, 1)
+	assert.False(t, report.Backups[0].Passed)
+	assert.Contains(t, report.Backups[0].Error, "conf/app.yaml has mode 0600")
+
+	// Truncated archive of the base fails the base itself
+	a := backups[0].Archives[0]
+	data, err := ioutil.ReadFile(repo.path(backups[0].ID, a.File))
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(repo.path(backups[0].ID, a.File), data[:len(data)/2], 0600))
+	err, report = verifyJSON(t, config)
+	assert.Equal(t, errVerificationFailed, err)
+	assert.Equal(t, 1, report.Failed)
+	assert.False(t, report.Backups[0].Passed)
+	assert.Contains(t, report.Backups[0].Error, "truncated")
+	assert.Equal(t, errVerificationFailed, runVerify(config, []string{"--restore-test", m.ID}), "Restore test needs readable base")
+}
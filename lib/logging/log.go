@@ -10,6 +10,7 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -38,6 +39,9 @@ var (
 	currentLogLevel       LogLevel
 	currentLogLevelStr    string // log level string; internal to logging package only
 	CurrentLogLevelString string // log level from CLI params
+	statusLine            string // line kept at the bottom of the console
+	consoleMutex          sync.Mutex
+	consoleOutput         = os.Stdout // file console messages and the status line are printed to
 )
 
 func checkFolderExistsAndIsWritable(folderPath string) bool {
@@ -136,8 +140,10 @@ func getCallerFileAndLine() (string, int, bool) {
 
 func Log(level LogLevel, msgs ...interface{}) {
 	if consoleMessage, logMessage, ok := GetMessages(level, msgs); ok {
-		fmt.Println(consoleMessage)
-		fileLogger.Println(logMessage)
+		printConsoleMessage(consoleMessage)
+		if fileLogger != nil {
+			fileLogger.Println(logMessage)
+		}
 	}
 }
 
@@ -160,7 +166,7 @@ func LogErrorf(format string, params ...interface{})   { Logf(ERROR, format, par
 
 func LogMessageDirect(consoleMessage string, logMessage string) {
 	if consoleMessage != "" {
-		fmt.Println(consoleMessage)
+		printConsoleMessage(consoleMessage)
 	}
 	if fileLogger != nil && logMessage != "" {
 		fileLogger.Println(logMessage)
@@ -188,6 +194,53 @@ func LogMessagesDirect(consoleMessages []string, logMessages []string) {
 	}
 }
 
+// Prints console messages and the status line to the file instead of standard output,
+// e.g. to standard error when standard output carries a report for other programs
+func SetConsoleOutput(file *os.File) {
+	consoleMutex.Lock()
+	defer consoleMutex.Unlock()
+	consoleOutput = file
+}
+
+// Returns the file console messages are printed to
+func ConsoleOutput() *os.File {
+	consoleMutex.Lock()
+	defer consoleMutex.Unlock()
+	return consoleOutput
+}
+
+// Sets the line which stays below all console messages, e.g. progress of a running transfer
+// Messages logged while the status line is shown are printed above it
+func SetStatusLine(line string) {
+	consoleMutex.Lock()
+	defer consoleMutex.Unlock()
+	clearStatusLine()
+	statusLine = line
+	fmt.Fprint(consoleOutput, statusLine)
+}
+
+// Removes the status line from the console
+func ClearStatusLine() {
+	consoleMutex.Lock()
+	defer consoleMutex.Unlock()
+	clearStatusLine()
+	statusLine = ""
+}
+
+func clearStatusLine() {
+	if statusLine != "" {
+		fmt.Fprint(consoleOutput, "\r\033[K")
+	}
+}
+
+func printConsoleMessage(message string) {
+	consoleMutex.Lock()
+	defer consoleMutex.Unlock()
+	clearStatusLine()
+	fmt.Fprintln(consoleOutput, message)
+	fmt.Fprint(consoleOutput, statusLine)
+}
+
 // returns coloured message for console, plain for logFile
 func GetMessages(level LogLevel, msgs ...interface{}) (string, string, bool) {
 
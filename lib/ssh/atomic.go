@@ -0,0 +1,133 @@
+package ssh
+
+import (
+	"github.com/hardboiledalex/go-tools/lib/utils"
+	"github.com/hardboiledalex/go-tools/lib/logging"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// File written to a temporary sibling and renamed into place on Close
+// Readers never see a half-written target, and a failed write leaves the previous content intact
+type atomicFile struct {
+	fs            fileSystem
+	file          io.WriteCloser
+	path          string
+	temporaryPath string
+	fsync         bool
+	uid           int
+	gid           int
+	chown         bool
+}
+
+// Creates the file atomically with the given permissions, size is the final size if known and negative otherwise
+// Ownership from options.Owner is resolved before anything is written, so a wrong owner fails fast
+func createAtomically(fs fileSystem, name string, mode os.FileMode, size int64, options TransferOptions) (*atomicFile, error) {
+	atomic := &atomicFile{fs: fs, path: name, fsync: options.Fsync}
+	if options.Owner != "" {
+		uid, gid, err := fs.LookupOwner(options.Owner)
+		if err != nil {
+			return nil, err
+		}
+		atomic.uid, atomic.gid, atomic.chown = uid, gid, true
+	}
+
+	suffix, err := utils.RandomHex(4)
+	if err != nil {
+		return nil, err
+	}
+	atomic.temporaryPath = temporarySiblingPath(fs, name, suffix)
+	atomic.file, err = createWithSize(fs, atomic.temporaryPath, mode, size)
+	if err != nil {
+		return nil, err
+	}
+	return atomic, nil
+}
+
+func (atomic *atomicFile) Write(p []byte) (int, error) {
+	return atomic.file.Write(p)
+}
+
+// Keeps concurrent writes of SFTP file when used with io.Copy
+func (atomic *atomicFile) ReadFrom(reader io.Reader) (int64, error) {
+	if readerFrom, ok := atomic.file.(io.ReaderFrom); ok {
+		return readerFrom.ReadFrom(reader)
+	}
+	return io.Copy(struct{ io.Writer }{atomic.file}, reader)
+}
+
+func (atomic *atomicFile) throttleSending(throttle throttle) bool {
+	deferred, ok := atomic.file.(deferredWriter)
+	return ok && deferred.throttleSending(throttle)
+}
+
+// Flushes the temporary file, applies ownership and renames it into place
+// The temporary file is removed if any step fails
+func (atomic *atomicFile) Close() error {
+	err := atomic.commit()
+	if err != nil {
+		atomic.removeTemporary()
+	}
+	return err
+}
+
+// Discards everything written so far, the target is left untouched
+func (atomic *atomicFile) Abort() error {
+	// Files which send their content on Close, like the SCP one, are discarded without sending
+	if aborter, ok := atomic.file.(interface{ Abort() error }); ok {
+		aborter.Abort()
+	} else {
+		atomic.file.Close()
+	}
+	return atomic.removeTemporary()
+}
+
+func (atomic *atomicFile) commit() error {
+	if err := atomic.file.Close(); err != nil {
+		return err
+	}
+	if atomic.fsync {
+		if err := atomic.fs.Sync(atomic.temporaryPath); err != nil {
+			return err
+		}
+	}
+	if atomic.chown {
+		if err := atomic.fs.Chown(atomic.temporaryPath, atomic.uid, atomic.gid); err != nil {
+			return fmt.Errorf("cannot change owner of %s: %v", atomic.path, err)
+		}
+	}
+	return atomic.fs.Rename(atomic.temporaryPath, atomic.path)
+}
+
+func (atomic *atomicFile) removeTemporary() error {
+	err := atomic.fs.Remove(atomic.temporaryPath)
+	if err != nil && !os.IsNotExist(err) {
+		logging.LogWarnf("Cannot remove temporary file %s: %v", atomic.temporaryPath, err)
+		return err
+	}
+	return nil
+}
+
+// Hidden file in the same directory, so the rename never crosses file systems
+func temporarySiblingPath(fs fileSystem, name string, suffix string) string {
+	return hiddenSiblingPath(fs, name, ".tmp-"+suffix)
+}
+
+// Partial content of a resumable transfer, the name is the same for every attempt so the next one finds it
+func partialSiblingPath(fs fileSystem, name string) string {
+	return hiddenSiblingPath(fs, name, ".partial")
+}
+
+func hiddenSiblingPath(fs fileSystem, name string, extension string) string {
+	var directory, base string
+	if _, isLocal := fs.(localFileSystem); isLocal {
+		directory, base = filepath.Split(name)
+	} else {
+		directory, base = path.Split(name)
+	}
+	return fs.Join(directory, "."+strings.TrimPrefix(base, ".")+extension)
+}
@@ -3,14 +3,23 @@ package ssh
 import (
 	"github.com/hardboiledalex/go-tools/lib/utils"
 	"github.com/hardboiledalex/go-tools/lib/logging"
+	"bytes"
 	"fmt"
 	"github.com/melbahja/goph"
+	"golang.org/x/crypto/ssh"
+	"io"
 	"os"
+	"os/exec"
 	"strings"
+	"syscall"
+	"time"
 )
 
 const maximumAttemptsNumber = 3
 
+// Time to read output left in the pipe after a local command exited
+const outputDrainTimeout = 100 * time.Millisecond
+
 func ConnectInteractive(username string, hostname string) *goph.Client {
 	logging.LogInfof("\nConnecting to %s...\n", hostname)
 	for i := 0; i < maximumAttemptsNumber; i++ {
@@ -54,9 +63,107 @@ func GetClient(username string, hostname string) *goph.Client {
 
 func SafeCloseClient(client *goph.Client) {
 	if client != nil {
-		err := client.Close()
+		err := ReleaseSFTPSession(client)
+		if err != nil {
+			logging.LogError(err)
+		}
+		err = client.Close()
 		if err != nil {
 			logging.LogError(err)
 		}
 	}
 }
+
+// Runs shell command on the remote machine, or locally if client is nil
+// Returns combined output without the trailing newline and error if happened
+func RunCommand(client *goph.Client, command string) (string, error) {
+	if client == nil {
+		logging.LogDebugf("Running command %s locally", command)
+		return utils.ExecShellWithOutput(command)
+	}
+	logging.LogDebugf("Running command %s on %s", command, client.RemoteAddr())
+	out, err := client.Run(command)
+	return strings.TrimSuffix(string(out), "\n"), err
+}
+
+// Runs shell command like RunCommand, the command is killed if it does not finish within the timeout
+// Remote command is signalled and its session closed, servers ignoring signals may let it run on.
+// Local command is killed together with the processes it started, unless they left its process group
+// Zero timeout waits for the command indefinitely
+// Returns combined output without the trailing newline and error if happened
+func RunCommandWithTimeout(client *goph.Client, command string, timeout time.Duration) (string, error) {
+	if timeout <= 0 {
+		return RunCommand(client, command)
+	}
+	if client == nil {
+		logging.LogDebugf("Running command %s locally with timeout %v", command, timeout)
+		return runLocalCommandWithTimeout(command, timeout)
+	}
+
+	logging.LogDebugf("Running command %s on %s with timeout %v", command, client.RemoteAddr(), timeout)
+	session, err := client.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+
+	type commandResult struct {
+		out []byte
+		err error
+	}
+	finished := make(chan commandResult, 1)
+	go func() {
+		out, err := session.CombinedOutput(command)
+		finished <- commandResult{out, err}
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case result := <-finished:
+		return strings.TrimSuffix(string(result.out), "\n"), result.err
+	case <-timer.C:
+		session.Signal(ssh.SIGKILL)
+		session.Close()
+		result := <-finished
+		return strings.TrimSuffix(string(result.out), "\n"), fmt.Errorf("command timed out after %v", timeout)
+	}
+}
+
+// Output is written into a pipe rather than collected by exec, so Wait does not block
+// until background processes holding the output exit
+// Command runs in its own process group, at the timeout the whole group is killed
+func runLocalCommandWithTimeout(command string, timeout time.Duration) (string, error) {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdout = writer
+	cmd.Stderr = writer
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	err = cmd.Start()
+	writer.Close()
+	if err != nil {
+		return "", err
+	}
+	timer := time.AfterFunc(timeout, func() {
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	})
+	var output bytes.Buffer
+	copied := make(chan struct{})
+	go func() {
+		io.Copy(&output, reader)
+		close(copied)
+	}()
+
+	err = cmd.Wait()
+	timedOut := !timer.Stop()
+	reader.SetReadDeadline(time.Now().Add(outputDrainTimeout))
+	<-copied
+	if timedOut {
+		err = fmt.Errorf("command timed out after %v", timeout)
+	}
+	return strings.TrimSuffix(output.String(), "\n"), err
+}
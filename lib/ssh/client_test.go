@@ -0,0 +1,49 @@
+package ssh
+
+import (
+	"github.com/melbahja/goph"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunCommandWithTimeout(t *testing.T) {
+	clients := map[string]*goph.Client{"local": nil, "remote": newTestServer(t).connect(t)}
+
+	for name, client := range clients {
+		output, err := RunCommandWithTimeout(client, "echo out; echo err >&2", time.Minute)
+		require.NoError(t, err, name)
+		assert.Contains(t, output, "out", name)
+		assert.Contains(t, output, "err", "Standard error of %s command must be captured", name)
+
+		// Failed command returns its output together with the error
+		output, err = RunCommandWithTimeout(client, "echo broken; exit 3", time.Minute)
+		assert.Error(t, err, name)
+		assert.Equal(t, "broken", output, name)
+
+		started := time.Now()
+		_, err = RunCommandWithTimeout(client, "echo started; sleep 2", 200*time.Millisecond)
+		require.Error(t, err, name)
+		assert.Contains(t, err.Error(), "timed out", name)
+		assert.Less(t, int64(time.Since(started)), int64(time.Second), "%s command must be stopped at the timeout", name)
+	}
+}
+
+func TestLocalCommandTimeoutKillsBackgroundProcesses(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "pid")
+	_, err := RunCommandWithTimeout(nil, "sleep 30 & echo $! > "+pidFile+"; wait", 200*time.Millisecond)
+	require.Error(t, err)
+
+	data, err := ioutil.ReadFile(pidFile)
+	require.NoError(t, err)
+	pid := strings.TrimSpace(string(data))
+	// Killed process may stay a zombie until it is reaped
+	assert.Eventually(t, func() bool {
+		stat, err := ioutil.ReadFile(filepath.Join("/proc", pid, "stat"))
+		return err != nil || strings.Contains(string(stat), ") Z ")
+	}, time.Second, 10*time.Millisecond, "Background process of the command must be killed at the timeout")
+}
@@ -0,0 +1,318 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"github.com/hardboiledalex/go-tools/lib/logging"
+	"github.com/melbahja/goph"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Maximum number of symlinks resolved in one path, same as ELOOP limit on Linux
+const maximumSymlinkDepth = 40
+
+// Options of the recursive directory transfer, TransferOptions apply to every file
+// Include and Exclude are path.Match patterns checked against the slash-separated path relative
+// to the transferred directory and against the base name. Excluded directories are skipped entirely,
+// Include applies to files and symlinks only. Empty Include means everything is included.
+type DirectoryTransferOptions struct {
+	TransferOptions
+	FollowSymlinks  bool
+	Include         []string
+	Exclude         []string
+	ContinueOnError bool
+}
+
+type TransferFailure struct {
+	Path string
+	Err  error
+}
+
+func (failure TransferFailure) Error() string {
+	return fmt.Sprintf("%s: %v", failure.Path, failure.Err)
+}
+
+type DirectoryTransferResult struct {
+	Files       int
+	Directories int
+	Symlinks    int
+	Bytes       int64
+	Failures    []TransferFailure
+}
+
+// Uploads local directory tree to the remote machine
+// Returns transfer statistics and error if happened. With ContinueOnError the error reports the number
+// of failed entries and the result lists all of them
+func UploadDirectory(client *goph.Client, localDirectory string, remoteDirectory string, options DirectoryTransferOptions) (*DirectoryTransferResult, error) {
+	target, err := openFileSystemWithProtocol(client, options.Protocol)
+	if err != nil {
+		return nil, err
+	}
+	defer target.Close()
+
+	return copyDirectory(localFileSystem{}, localDirectory, target, remoteDirectory, options)
+}
+
+// Downloads directory tree from the remote machine to the local directory
+// Returns transfer statistics and error if happened. With ContinueOnError the error reports the number
+// of failed entries and the result lists all of them
+func DownloadDirectory(client *goph.Client, remoteDirectory string, localDirectory string, options DirectoryTransferOptions) (*DirectoryTransferResult, error) {
+	source, err := openFileSystemWithProtocol(client, options.Protocol)
+	if err != nil {
+		return nil, err
+	}
+	defer source.Close()
+
+	return copyDirectory(source, remoteDirectory, localFileSystem{}, localDirectory, options)
+}
+
+type directoryCopier struct {
+	source  fileSystem
+	target  fileSystem
+	options DirectoryTransferOptions
+	result  *DirectoryTransferResult
+	// Source directories being copied with symlinks resolved, a followed symlink to one of them is a cycle
+	ancestors map[string]bool
+}
+
+func copyDirectory(source fileSystem, sourceDirectory string, target fileSystem, targetDirectory string, options DirectoryTransferOptions) (*DirectoryTransferResult, error) {
+	if err := validatePatterns(options.Include); err != nil {
+		return nil, err
+	}
+	if err := validatePatterns(options.Exclude); err != nil {
+		return nil, err
+	}
+
+	fileInfo, err := source.Stat(sourceDirectory)
+	if err != nil {
+		return nil, err
+	}
+	if !fileInfo.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", sourceDirectory)
+	}
+
+	resolvedDirectory := sourceDirectory
+	if options.FollowSymlinks {
+		if resolvedDirectory, err = resolveSymlinks(source, sourceDirectory); err != nil {
+			return nil, err
+		}
+	}
+	copier := &directoryCopier{source, target, options, &DirectoryTransferResult{}, make(map[string]bool)}
+	err = copier.copyDirectory(sourceDirectory, targetDirectory, "", fileInfo, resolvedDirectory)
+	if err != nil {
+		return copier.result, err
+	}
+
+	if len(copier.result.Failures) > 0 {
+		for _, failure := range copier.result.Failures {
+			logging.LogErrorf("Failed to transfer %s", failure.Error())
+		}
+		return copier.result, fmt.Errorf("%d entries failed to transfer", len(copier.result.Failures))
+	}
+	return copier.result, nil
+}
+
+// Records failure of a single entry
+// Returns the error back if the transfer has to stop
+func (copier *directoryCopier) fail(relativePath string, err error) error {
+	failure := TransferFailure{relativePath, err}
+	if !copier.options.ContinueOnError {
+		return failure
+	}
+	copier.result.Failures = append(copier.result.Failures, failure)
+	return nil
+}
+
+// Resolved path is the source path with symlinks resolved, it identifies the directory in symlink cycle detection
+func (copier *directoryCopier) copyDirectory(sourcePath string, targetPath string, relativePath string, fileInfo os.FileInfo, resolvedPath string) error {
+	copier.ancestors[resolvedPath] = true
+	defer delete(copier.ancestors, resolvedPath)
+
+	// Directory stays writable until its content is copied, read-only source mode is applied at the end
+	if err := copier.target.MkdirAll(targetPath, 0700); err != nil {
+		return copier.fail(relativePath, err)
+	}
+	copier.result.Directories++
+
+	entries, err := copier.source.ReadDir(sourcePath)
+	if err != nil {
+		return copier.fail(relativePath, err)
+	}
+
+	for _, entry := range entries {
+		entryRelativePath := path.Join(relativePath, entry.Name())
+		if matchesAnyPattern(copier.options.Exclude, entryRelativePath) {
+			logging.LogTracef("Skipping excluded %s", entryRelativePath)
+			continue
+		}
+		entrySourcePath := copier.source.Join(sourcePath, entry.Name())
+		entryTargetPath := copier.target.Join(targetPath, entry.Name())
+		entryResolvedPath := copier.source.Join(resolvedPath, entry.Name())
+		if err := copier.copyEntry(entrySourcePath, entryTargetPath, entryRelativePath, entry, entryResolvedPath); err != nil {
+			return err
+		}
+	}
+
+	// Directory times change while its content is written, so they are restored at the very end
+	if err := copier.target.Chmod(targetPath, fileInfo.Mode().Perm()); err != nil {
+		return copier.fail(relativePath, err)
+	}
+	if err := copier.target.Chtimes(targetPath, fileInfo.ModTime(), fileInfo.ModTime()); err != nil {
+		return copier.fail(relativePath, err)
+	}
+	return nil
+}
+
+func (copier *directoryCopier) copyEntry(sourcePath string, targetPath string, relativePath string, fileInfo os.FileInfo, resolvedPath string) error {
+	if fileInfo.Mode()&os.ModeSymlink != 0 {
+		if !copier.options.FollowSymlinks {
+			if !copier.isIncluded(relativePath) {
+				return nil
+			}
+			return copier.copySymlink(sourcePath, targetPath, relativePath)
+		}
+
+		linkTargetInfo, err := copier.source.Stat(sourcePath)
+		if err != nil {
+			return copier.fail(relativePath, err)
+		}
+		if linkTargetInfo.IsDir() {
+			linkResolvedPath, err := resolveSymlinks(copier.source, resolvedPath)
+			if err != nil {
+				return copier.fail(relativePath, err)
+			}
+			if copier.ancestors[linkResolvedPath] {
+				return copier.fail(relativePath, fmt.Errorf("symbolic link cycle, %s is already being copied", linkResolvedPath))
+			}
+			return copier.copyDirectory(sourcePath, targetPath, relativePath, linkTargetInfo, linkResolvedPath)
+		}
+		fileInfo = linkTargetInfo
+	}
+
+	if fileInfo.IsDir() {
+		return copier.copyDirectory(sourcePath, targetPath, relativePath, fileInfo, resolvedPath)
+	}
+	if !fileInfo.Mode().IsRegular() {
+		logging.LogWarnf("Skipping %s: not a regular file", relativePath)
+		return nil
+	}
+	if !copier.isIncluded(relativePath) {
+		return nil
+	}
+	return copier.copyFile(sourcePath, targetPath, relativePath, fileInfo)
+}
+
+func (copier *directoryCopier) copyFile(sourcePath string, targetPath string, relativePath string, fileInfo os.FileInfo) error {
+	logging.LogTracef("Transferring %s", relativePath)
+	written, err := transferFile(copier.source, sourcePath, copier.target, targetPath, copier.options.TransferOptions)
+	if err != nil {
+		return copier.fail(relativePath, err)
+	}
+	if err := copier.target.Chtimes(targetPath, fileInfo.ModTime(), fileInfo.ModTime()); err != nil {
+		return copier.fail(relativePath, err)
+	}
+	copier.result.Files++
+	copier.result.Bytes += written
+	return nil
+}
+
+func (copier *directoryCopier) copySymlink(sourcePath string, targetPath string, relativePath string) error {
+	linkTarget, err := copier.source.Readlink(sourcePath)
+	if err != nil {
+		return copier.fail(relativePath, err)
+	}
+	if _, err := copier.target.Lstat(targetPath); err == nil {
+		if err := copier.target.Remove(targetPath); err != nil {
+			return copier.fail(relativePath, err)
+		}
+	}
+	if err := copier.target.Symlink(linkTarget, targetPath); err != nil {
+		return copier.fail(relativePath, err)
+	}
+	copier.result.Symlinks++
+	return nil
+}
+
+func (copier *directoryCopier) isIncluded(relativePath string) bool {
+	return len(copier.options.Include) == 0 || matchesAnyPattern(copier.options.Include, relativePath)
+}
+
+// Reports whether the slash-separated relative path or its base name matches any of the patterns
+// Same rules as Include and Exclude of the directory transfer and Exclude of TarOptions
+func MatchesAnyPattern(patterns []string, relativePath string) bool {
+	return matchesAnyPattern(patterns, relativePath)
+}
+
+// Checks slash-separated relative path and its base name against the patterns
+func matchesAnyPattern(patterns []string, relativePath string) bool {
+	baseName := path.Base(relativePath)
+	for _, pattern := range patterns {
+		pattern = strings.TrimSuffix(pattern, "/")
+		if matched, _ := path.Match(pattern, relativePath); matched {
+			return true
+		}
+		if matched, _ := path.Match(pattern, baseName); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolves symlinks in every element of the path the way filepath.EvalSymlinks does, on any file system
+// Relative path stays relative
+func resolveSymlinks(fs fileSystem, name string) (string, error) {
+	resolved := ""
+	if path.IsAbs(filepath.ToSlash(name)) {
+		resolved = "/"
+	}
+	remaining := strings.Split(filepath.ToSlash(name), "/")
+	links := 0
+	for len(remaining) > 0 {
+		element := remaining[0]
+		remaining = remaining[1:]
+		if element == "" || element == "." {
+			continue
+		}
+		candidate := path.Join(resolved, element)
+		if element == ".." {
+			resolved = candidate
+			continue
+		}
+		fileInfo, err := fs.Lstat(candidate)
+		if err != nil {
+			return "", err
+		}
+		if fileInfo.Mode()&os.ModeSymlink == 0 {
+			resolved = candidate
+			continue
+		}
+		if links++; links > maximumSymlinkDepth {
+			return "", &os.PathError{Op: "resolve", Path: name, Err: errors.New("too many levels of symbolic links")}
+		}
+		linkTarget, err := fs.Readlink(candidate)
+		if err != nil {
+			return "", err
+		}
+		linkTarget = filepath.ToSlash(linkTarget)
+		if path.IsAbs(linkTarget) {
+			resolved = "/"
+		}
+		remaining = append(strings.Split(linkTarget, "/"), remaining...)
+	}
+	if resolved == "" {
+		return ".", nil
+	}
+	return resolved, nil
+}
+
+func validatePatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %v", pattern, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package ssh
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func createTestTree(t *testing.T, root string) time.Time {
+	modTime := time.Date(2020, 12, 1, 10, 30, 0, 0, time.UTC)
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "conf", "nested"), 0750))
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "logs"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, "conf", "app.yaml"), []byte("key: value\n"), 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, "conf", "nested", "extra.yaml"), []byte("nested: true\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, "conf", "app.tmp"), []byte("temporary"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, "logs", "app.log"), []byte("log line\n"), 0644))
+	require.NoError(t, os.Symlink("conf/app.yaml", filepath.Join(root, "current.yaml")))
+	require.NoError(t, os.Chtimes(filepath.Join(root, "conf", "app.yaml"), modTime, modTime))
+	require.NoError(t, os.Chtimes(filepath.Join(root, "conf"), modTime, modTime))
+	return modTime
+}
+
+func TestUploadDirectory(t *testing.T) {
+	client := newTestServer(t).connect(t)
+	source := filepath.Join(t.TempDir(), "source")
+	target := filepath.Join(t.TempDir(), "target")
+	modTime := createTestTree(t, source)
+
+	result, err := UploadDirectory(client, source, target, DirectoryTransferOptions{Exclude: []string{"logs", "*.tmp"}})
+	require.NoError(t, err)
+	assert.Equal(t, 2, result.Files)
+	assert.Equal(t, 1, result.Symlinks)
+
+	// Modes and modification times must be preserved for files and directories
+	fileInfo, err := os.Stat(filepath.Join(target, "conf", "app.yaml"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), fileInfo.Mode().Perm())
+	assert.True(t, modTime.Equal(fileInfo.ModTime()), "File modification time must be preserved")
+	directoryInfo, err := os.Stat(filepath.Join(target, "conf"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0750), directoryInfo.Mode().Perm())
+	assert.True(t, modTime.Equal(directoryInfo.ModTime()), "Directory modification time must be preserved")
+
+	// Symlinks are copied as links by default
+	linkTarget, err := os.Readlink(filepath.Join(target, "current.yaml"))
+	require.NoError(t, err)
+	assert.Equal(t, "conf/app.yaml", linkTarget)
+
+	// Excluded entries must not be transferred
+	assert.NoFileExists(t, filepath.Join(target, "conf", "app.tmp"))
+	assert.NoDirExists(t, filepath.Join(target, "logs"))
+}
+
+func TestDownloadDirectoryContinueOnError(t *testing.T) {
+	client := newTestServer(t).connect(t)
+	source := filepath.Join(t.TempDir(), "source")
+	target := filepath.Join(t.TempDir(), "target")
+	createTestTree(t, source)
+	require.NoError(t, os.Symlink("missing", filepath.Join(source, "broken")))
+
+	// Followed symlinks are copied as regular files, the broken one is reported at the end
+	options := DirectoryTransferOptions{FollowSymlinks: true, ContinueOnError: true, Include: []string{"*.yaml", "broken"}}
+	result, err := DownloadDirectory(client, source, target, options)
+	require.Error(t, err)
+	require.Len(t, result.Failures, 1)
+	assert.Equal(t, "broken", result.Failures[0].Path)
+	assert.Equal(t, 3, result.Files)
+
+	fileInfo, err := os.Lstat(filepath.Join(target, "current.yaml"))
+	require.NoError(t, err)
+	assert.True(t, fileInfo.Mode().IsRegular(), "Followed symlink must be copied as a regular file")
+	assert.NoFileExists(t, filepath.Join(target, "logs", "app.log"))
+
+	// Without ContinueOnError the transfer stops at the first failure
+	_, err = DownloadDirectory(client, source, filepath.Join(t.TempDir(), "target"), DirectoryTransferOptions{FollowSymlinks: true})
+	assert.Error(t, err)
+}
+
+func TestDownloadReadOnlyDirectory(t *testing.T) {
+	client := newTestServer(t).connect(t)
+	source := filepath.Join(t.TempDir(), "source")
+	target := filepath.Join(t.TempDir(), "target")
+	createTestTree(t, source)
+	require.NoError(t, os.Chmod(filepath.Join(source, "conf"), 0555))
+	defer os.Chmod(filepath.Join(source, "conf"), 0755)
+	defer os.Chmod(filepath.Join(target, "conf"), 0755)
+
+	_, err := DownloadDirectory(client, source, target, DirectoryTransferOptions{})
+	require.NoError(t, err)
+	assert.FileExists(t, filepath.Join(target, "conf", "nested", "extra.yaml"))
+	directoryInfo, err := os.Stat(filepath.Join(target, "conf"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0555), directoryInfo.Mode().Perm(), "Read-only mode must be applied after the content")
+}
+
+func TestDownloadDirectorySymlinkCycle(t *testing.T) {
+	client := newTestServer(t).connect(t)
+	source := filepath.Join(t.TempDir(), "source")
+	target := filepath.Join(t.TempDir(), "target")
+	createTestTree(t, source)
+	require.NoError(t, os.Symlink("..", filepath.Join(source, "conf", "nested", "parent")))
+	require.NoError(t, os.Symlink("../logs", filepath.Join(source, "conf", "logs")))
+
+	options := DirectoryTransferOptions{FollowSymlinks: true, ContinueOnError: true}
+	result, err := DownloadDirectory(client, source, target, options)
+	require.Error(t, err)
+	require.Len(t, result.Failures, 1, "Cycle must be reported once instead of copying nested copies")
+	assert.Equal(t, "conf/nested/parent", result.Failures[0].Path)
+	assert.Contains(t, result.Failures[0].Err.Error(), "cycle")
+	assert.FileExists(t, filepath.Join(target, "conf", "logs", "app.log"), "Symlink to a directory outside the chain is not a cycle")
+	assert.NoDirExists(t, filepath.Join(target, "conf", "nested", "parent"))
+}
@@ -0,0 +1,328 @@
+package ssh
+
+import (
+	"github.com/melbahja/goph"
+	"github.com/pkg/sftp"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// File operations below mirror the functions of the os package with the same names
+// They work on the remote machine over SFTP (SCP if SFTP is disabled), or on the local one if client is nil.
+// Errors are *os.PathError (*os.LinkError for Rename and Symlink), so os.IsNotExist and alike work for both
+
+func Stat(client *goph.Client, name string) (os.FileInfo, error) {
+	if client == nil {
+		return os.Stat(name)
+	}
+	fs, err := openFileSystem(client)
+	if err != nil {
+		return nil, err
+	}
+	defer fs.Close()
+
+	fileInfo, err := fs.Stat(name)
+	return fileInfo, pathError("stat", name, err)
+}
+
+// Returns information about the symlink itself instead of its target
+func Lstat(client *goph.Client, name string) (os.FileInfo, error) {
+	if client == nil {
+		return os.Lstat(name)
+	}
+	fs, err := openFileSystem(client)
+	if err != nil {
+		return nil, err
+	}
+	defer fs.Close()
+
+	fileInfo, err := fs.Lstat(name)
+	return fileInfo, pathError("lstat", name, err)
+}
+
+// Returns directory entries sorted by name
+func ReadDir(client *goph.Client, name string) ([]os.FileInfo, error) {
+	fs, err := openFileSystem(client)
+	if err != nil {
+		return nil, err
+	}
+	defer fs.Close()
+
+	entries, err := fs.ReadDir(name)
+	if err != nil {
+		return nil, pathError("readdir", name, err)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// Creates directory with all missing parents, existing directory is not an error
+func MkdirAll(client *goph.Client, name string, perm os.FileMode) error {
+	fs, err := openFileSystem(client)
+	if err != nil {
+		return err
+	}
+	defer fs.Close()
+
+	return pathError("mkdir", name, fs.MkdirAll(name, perm))
+}
+
+// Removes file or empty directory
+func Remove(client *goph.Client, name string) error {
+	fs, err := openFileSystem(client)
+	if err != nil {
+		return err
+	}
+	defer fs.Close()
+
+	return pathError("remove", name, fs.Remove(name))
+}
+
+// Removes the entry and everything it contains, missing entry is not an error
+func RemoveAll(client *goph.Client, name string) error {
+	if client == nil {
+		return os.RemoveAll(name)
+	}
+	fs, err := openFileSystem(client)
+	if err != nil {
+		return err
+	}
+	defer fs.Close()
+
+	return pathError("removeall", name, removeAll(fs, name))
+}
+
+// Renames the entry replacing an existing target
+func Rename(client *goph.Client, oldname string, newname string) error {
+	fs, err := openFileSystem(client)
+	if err != nil {
+		return err
+	}
+	defer fs.Close()
+
+	return linkError("rename", oldname, newname, fs.Rename(oldname, newname))
+}
+
+func Chmod(client *goph.Client, name string, mode os.FileMode) error {
+	fs, err := openFileSystem(client)
+	if err != nil {
+		return err
+	}
+	defer fs.Close()
+
+	return pathError("chmod", name, fs.Chmod(name, mode))
+}
+
+// Changes numeric owner and group, see LookupOwner to resolve names
+func Chown(client *goph.Client, name string, uid int, gid int) error {
+	if client == nil {
+		return os.Chown(name, uid, gid)
+	}
+	fs, err := openFileSystem(client)
+	if err != nil {
+		return err
+	}
+	defer fs.Close()
+
+	return pathError("chown", name, fs.Chown(name, uid, gid))
+}
+
+// Resolves owner in the form user[:group] to numeric ids on the target machine
+func LookupOwner(client *goph.Client, owner string) (int, int, error) {
+	fs, err := openFileSystem(client)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer fs.Close()
+
+	return fs.LookupOwner(owner)
+}
+
+// Returns numeric owner and group of file info returned by the functions above
+// Reports false if the file system does not tell the owner
+func FileOwner(fileInfo os.FileInfo) (int, int, bool) {
+	switch sys := fileInfo.Sys().(type) {
+	case *syscall.Stat_t:
+		return int(sys.Uid), int(sys.Gid), true
+	case *sftp.FileStat:
+		return int(sys.UID), int(sys.GID), true
+	}
+	if fileInfo, ok := fileInfo.(*scpFileInfo); ok {
+		return fileInfo.uid, fileInfo.gid, true
+	}
+	return 0, 0, false
+}
+
+// Returns SHA-256 of the file content as hex string
+// Remote checksum is computed by sha256sum on the remote machine when available, so the file is not transferred
+func Checksum(client *goph.Client, name string) (string, error) {
+	fs, err := openFileSystem(client)
+	if err != nil {
+		return "", err
+	}
+	defer fs.Close()
+
+	checksum, err := fs.Checksum(name)
+	return checksum, pathError("checksum", name, err)
+}
+
+// Returns SHA-256 of the content of each file by its name, like Checksum
+// Remote checksums are computed by few sha256sum commands for all the files rather than one per file
+func Checksums(client *goph.Client, names []string) (map[string]string, error) {
+	fs, err := openFileSystem(client)
+	if err != nil {
+		return nil, err
+	}
+	defer fs.Close()
+
+	checksums := make(map[string]string, len(names))
+	if client != nil {
+		checksums = remoteChecksums(client, names)
+	}
+	for _, name := range names {
+		if _, found := checksums[name]; found {
+			continue
+		}
+		checksum, err := fs.Checksum(name)
+		if err != nil {
+			return nil, pathError("checksum", name, err)
+		}
+		checksums[name] = checksum
+	}
+	return checksums, nil
+}
+
+// Creates newname as a symbolic link to oldname
+func Symlink(client *goph.Client, oldname string, newname string) error {
+	fs, err := openFileSystem(client)
+	if err != nil {
+		return err
+	}
+	defer fs.Close()
+
+	return linkError("symlink", oldname, newname, fs.Symlink(oldname, newname))
+}
+
+// Returns the destination of the symbolic link
+func Readlink(client *goph.Client, name string) (string, error) {
+	fs, err := openFileSystem(client)
+	if err != nil {
+		return "", err
+	}
+	defer fs.Close()
+
+	destination, err := fs.Readlink(name)
+	return destination, pathError("readlink", name, err)
+}
+
+// Returns names of all entries matching the pattern, see filepath.Glob for the syntax
+// I/O errors are ignored, the only possible error is filepath.ErrBadPattern
+func Glob(client *goph.Client, pattern string) ([]string, error) {
+	if client == nil {
+		return filepath.Glob(pattern)
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, filepath.ErrBadPattern
+	}
+	fs, err := openFileSystem(client)
+	if err != nil {
+		return nil, err
+	}
+	defer fs.Close()
+
+	return glob(fs, pattern), nil
+}
+
+// Walks the file tree rooted at root calling walkFn for every entry, see filepath.Walk
+func Walk(client *goph.Client, root string, walkFn filepath.WalkFunc) error {
+	if client == nil {
+		return filepath.Walk(root, walkFn)
+	}
+	fs, err := openFileSystem(client)
+	if err != nil {
+		return err
+	}
+	defer fs.Close()
+
+	return walkFileSystem(fs, root, walkFn)
+}
+
+// Slash-separated counterpart of filepath.Glob for the remote file system
+func glob(fs fileSystem, pattern string) []string {
+	if !hasGlobMeta(pattern) {
+		if _, err := fs.Lstat(pattern); err != nil {
+			return nil
+		}
+		return []string{pattern}
+	}
+
+	directory, filePattern := path.Split(pattern)
+	directory = strings.TrimSuffix(directory, "/")
+	if directory == "" && strings.HasPrefix(pattern, "/") {
+		directory = "/"
+	}
+	if !hasGlobMeta(directory) {
+		return globDirectory(fs, directory, filePattern, nil)
+	}
+
+	var matches []string
+	for _, matchedDirectory := range glob(fs, directory) {
+		matches = globDirectory(fs, matchedDirectory, filePattern, matches)
+	}
+	return matches
+}
+
+func globDirectory(fs fileSystem, directory string, pattern string, matches []string) []string {
+	listedDirectory := directory
+	if listedDirectory == "" {
+		listedDirectory = "."
+	}
+	fileInfo, err := fs.Stat(listedDirectory)
+	if err != nil || !fileInfo.IsDir() {
+		return matches
+	}
+	entries, err := fs.ReadDir(listedDirectory)
+	if err != nil {
+		return matches
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if matched, _ := path.Match(pattern, entry.Name()); matched {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		matches = append(matches, path.Join(directory, name))
+	}
+	return matches
+}
+
+func hasGlobMeta(pattern string) bool {
+	return strings.ContainsAny(pattern, `*?[\`)
+}
+
+func pathError(operation string, name string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, isPathError := err.(*os.PathError); isPathError {
+		return err
+	}
+	return &os.PathError{Op: operation, Path: name, Err: err}
+}
+
+func linkError(operation string, oldname string, newname string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, isLinkError := err.(*os.LinkError); isLinkError {
+		return err
+	}
+	return &os.LinkError{Op: operation, Old: oldname, New: newname, Err: err}
+}
@@ -0,0 +1,132 @@
+package ssh
+
+import (
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileOperations(t *testing.T) {
+	client := newTestServer(t).connect(t)
+	root := filepath.Join(t.TempDir(), "root")
+	createTestTree(t, root)
+
+	// Missing entries must be recognisable with os.IsNotExist like local ones
+	_, err := Stat(client, filepath.Join(root, "missing"))
+	assert.True(t, os.IsNotExist(err), "Remote Stat of a missing file must return not-exist error, got %v", err)
+	_, err = Stat(nil, filepath.Join(root, "missing"))
+	assert.True(t, os.IsNotExist(err))
+
+	fileInfo, err := Lstat(client, filepath.Join(root, "current.yaml"))
+	require.NoError(t, err)
+	assert.True(t, fileInfo.Mode()&os.ModeSymlink != 0, "Lstat must not follow symlinks")
+	destination, err := Readlink(client, filepath.Join(root, "current.yaml"))
+	require.NoError(t, err)
+	assert.Equal(t, "conf/app.yaml", destination)
+
+	// Owner must be told the same way remotely and locally
+	for _, name := range []string{"remote", "local"} {
+		fileClient := client
+		if name == "local" {
+			fileClient = nil
+		}
+		fileInfo, err := Stat(fileClient, filepath.Join(root, "conf", "app.yaml"))
+		require.NoError(t, err)
+		uid, gid, known := FileOwner(fileInfo)
+		assert.True(t, known, name)
+		assert.Equal(t, []int{os.Getuid(), os.Getgid()}, []int{uid, gid}, name)
+	}
+
+	// Checksum must be the same whether computed remotely or locally
+	checksum, err := Checksum(client, filepath.Join(root, "conf", "app.yaml"))
+	require.NoError(t, err)
+	assert.Equal(t, "0ddd3d77338ca222ab064e214bbec3a4547e9d33801912eaacc7b4b4e27e1a91", checksum)
+	localChecksum, err := Checksum(nil, filepath.Join(root, "conf", "app.yaml"))
+	require.NoError(t, err)
+	assert.Equal(t, localChecksum, checksum)
+	_, err = Checksum(client, filepath.Join(root, "missing"))
+	assert.True(t, os.IsNotExist(err), "Checksum of a missing file must return not-exist error, got %v", err)
+
+	// Checksums of many files, also with names sha256sum escapes, must match the single ones
+	oddName := filepath.Join(root, "conf", "odd\\name\nwith newline")
+	require.NoError(t, ioutil.WriteFile(oddName, []byte("odd"), 0644))
+	checksumNames := []string{filepath.Join(root, "conf", "app.yaml"), oddName}
+	checksums, err := Checksums(client, checksumNames)
+	require.NoError(t, err)
+	assert.Equal(t, checksum, checksums[checksumNames[0]])
+	oddChecksum, err := Checksum(nil, oddName)
+	require.NoError(t, err)
+	assert.Equal(t, oddChecksum, checksums[oddName])
+	assert.Equal(t, checksums, remoteChecksums(client, checksumNames), "All checksums must come from sha256sum")
+	_, err = Checksums(client, append(checksumNames, filepath.Join(root, "missing")))
+	assert.True(t, os.IsNotExist(err), "Checksums with a missing file must return not-exist error, got %v", err)
+	require.NoError(t, os.Remove(oddName))
+
+	entries, err := ReadDir(client, filepath.Join(root, "conf"))
+	require.NoError(t, err)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	assert.Equal(t, []string{"app.tmp", "app.yaml", "nested"}, names)
+
+	// Glob must give the same result remotely and locally
+	pattern := filepath.Join(root, "*", "*.yaml")
+	remoteMatches, err := Glob(client, pattern)
+	require.NoError(t, err)
+	localMatches, err := Glob(nil, pattern)
+	require.NoError(t, err)
+	assert.Equal(t, localMatches, remoteMatches)
+	assert.Equal(t, []string{filepath.Join(root, "conf", "app.yaml")}, remoteMatches)
+
+	var walked []string
+	err = Walk(client, root, func(walkedPath string, fileInfo os.FileInfo, err error) error {
+		if fileInfo.IsDir() && fileInfo.Name() == "logs" {
+			return filepath.SkipDir
+		}
+		relativePath, _ := filepath.Rel(root, walkedPath)
+		walked = append(walked, relativePath)
+		return err
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{".", "conf", "conf/app.tmp", "conf/app.yaml", "conf/nested", "conf/nested/extra.yaml", "current.yaml"}, walked)
+
+	// Rename replaces an existing target
+	require.NoError(t, MkdirAll(client, filepath.Join(root, "new", "deep"), 0700))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, "new", "deep", "a"), []byte("a"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, "new", "deep", "b"), []byte("b"), 0644))
+	require.NoError(t, Rename(client, filepath.Join(root, "new", "deep", "a"), filepath.Join(root, "new", "deep", "b")))
+	data, err := ioutil.ReadFile(filepath.Join(root, "new", "deep", "b"))
+	require.NoError(t, err)
+	assert.Equal(t, "a", string(data))
+
+	assert.Error(t, Remove(client, filepath.Join(root, "new")), "Remove of non-empty directory must fail")
+	require.NoError(t, RemoveAll(client, filepath.Join(root, "new")))
+	assert.NoDirExists(t, filepath.Join(root, "new"))
+	assert.NoError(t, RemoveAll(client, filepath.Join(root, "new")), "RemoveAll of a missing entry must succeed")
+}
+
+func TestRenameWithoutPosixRename(t *testing.T) {
+	require.NoError(t, sftp.SetSFTPExtensions("hardlink@openssh.com", "statvfs@openssh.com"))
+	defer sftp.SetSFTPExtensions("hardlink@openssh.com", "posix-rename@openssh.com", "statvfs@openssh.com")
+	client := newTestServer(t).connect(t)
+	directory := t.TempDir()
+	source, target := filepath.Join(directory, "source"), filepath.Join(directory, "target")
+	require.NoError(t, ioutil.WriteFile(source, []byte("new"), 0644))
+	require.NoError(t, ioutil.WriteFile(target, []byte("old"), 0644))
+
+	require.NoError(t, Rename(client, source, target))
+	data, err := ioutil.ReadFile(target)
+	require.NoError(t, err)
+	assert.Equal(t, "new", string(data))
+
+	// Failed rename must not remove the target
+	assert.Error(t, Rename(client, filepath.Join(directory, "missing"), target))
+	data, err = ioutil.ReadFile(target)
+	require.NoError(t, err)
+	assert.Equal(t, "new", string(data))
+}
@@ -0,0 +1,461 @@
+package ssh
+
+import (
+	"github.com/hardboiledalex/go-tools/lib/utils"
+	"github.com/hardboiledalex/go-tools/lib/logging"
+	"github.com/hardboiledalex/go-tools/lib/vfs"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/melbahja/goph"
+	"github.com/pkg/sftp"
+	"io"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// File operations shared by the local machine and the remote machine over SFTP or SCP
+// On top of vfs.FileSystem it has operations which the remote machine does more efficiently itself
+type fileSystem interface {
+	vfs.FileSystem
+	LookupOwner(owner string) (int, int, error)
+	Sync(name string) error
+	Checksum(name string) (string, error)
+	Close() error
+}
+
+// File systems writing new files more efficiently when their size is known in advance
+type sizedCreator interface {
+	CreateWithSize(name string, mode os.FileMode, size int64) (io.WriteCloser, error)
+}
+
+// Creates or truncates the file which will get size bytes, negative size means unknown
+func createWithSize(fs fileSystem, name string, mode os.FileMode, size int64) (io.WriteCloser, error) {
+	if creator, ok := fs.(sizedCreator); ok && size >= 0 {
+		return creator.CreateWithSize(name, mode, size)
+	}
+	return fs.Create(name, mode)
+}
+
+// Returns file system of the machine the client points to, local file system if client is nil
+// The returned file system must be closed by the caller, SFTP session itself stays cached
+func openFileSystem(client *goph.Client) (fileSystem, error) {
+	return openFileSystemWithProtocol(client, ProtocolAuto)
+}
+
+// Same as openFileSystem with explicit transfer protocol for the remote machine
+// ProtocolAuto prefers SFTP and falls back to SCP when the server refuses the SFTP subsystem,
+// the refusal is remembered for the client until its SFTP session is released
+func openFileSystemWithProtocol(client *goph.Client, protocol TransferProtocol) (fileSystem, error) {
+	if client == nil {
+		return localFileSystem{}, nil
+	}
+	if protocol == ProtocolSCP || (protocol == ProtocolAuto && isSFTPUnavailable(client)) {
+		return scpFileSystem{client}, nil
+	}
+	sftpClient, err := getSFTPClient(client)
+	if err == nil {
+		return sftpFileSystem{sftpClient, client}, nil
+	}
+	if protocol == ProtocolAuto && isSubsystemRefused(err) {
+		logging.LogWarnf("SFTP subsystem is not available on %s, falling back to SCP", client.RemoteAddr())
+		markSFTPUnavailable(client)
+		return scpFileSystem{client}, nil
+	}
+	return nil, err
+}
+
+// Local machine with the operations of vfs.LocalFileSystem
+type localFileSystem struct {
+	vfs.LocalFileSystem
+}
+
+func (localFileSystem) Checksum(name string) (string, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	return readerChecksum(file)
+}
+
+func (localFileSystem) LookupOwner(owner string) (int, int, error) {
+	return parseOwner(owner, func(name string) (string, string, error) {
+		owner, err := user.Lookup(name)
+		if _, isUnknown := err.(user.UnknownUserError); isUnknown {
+			owner, err = user.LookupId(name)
+		}
+		if err != nil {
+			return "", "", err
+		}
+		return owner.Uid, owner.Gid, nil
+	}, func(name string) (string, error) {
+		group, err := user.LookupGroup(name)
+		if err != nil {
+			return "", err
+		}
+		return group.Gid, nil
+	})
+}
+
+func (localFileSystem) Sync(name string) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return file.Sync()
+}
+
+func (localFileSystem) Close() error {
+	return nil
+}
+
+type sftpFileSystem struct {
+	client    *sftp.Client
+	sshClient *goph.Client
+}
+
+func (fs sftpFileSystem) Open(name string) (vfs.ReadSeekCloser, error) {
+	return fs.client.Open(name)
+}
+
+func (fs sftpFileSystem) Append(name string) (io.WriteCloser, error) {
+	file, err := fs.client.OpenFile(name, os.O_WRONLY)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(0, io.SeekEnd); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// Prefers sha256sum on the remote machine, so the file does not have to travel over the network
+func (fs sftpFileSystem) Checksum(name string) (string, error) {
+	if checksum, found := remoteChecksum(fs.sshClient, name); found {
+		return checksum, nil
+	}
+	logging.LogTracef("sha256sum is not available for %s, reading the file over SFTP", name)
+
+	file, err := fs.client.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	return readerChecksum(file)
+}
+
+func (fs sftpFileSystem) Create(name string, mode os.FileMode) (io.WriteCloser, error) {
+	file, err := fs.client.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := file.Chmod(mode); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+func (fs sftpFileSystem) Stat(name string) (os.FileInfo, error) {
+	return fs.client.Stat(name)
+}
+
+func (fs sftpFileSystem) Lstat(name string) (os.FileInfo, error) {
+	return fs.client.Lstat(name)
+}
+
+func (fs sftpFileSystem) ReadDir(name string) ([]os.FileInfo, error) {
+	return fs.client.ReadDir(name)
+}
+
+func (fs sftpFileSystem) Readlink(name string) (string, error) {
+	return fs.client.ReadLink(name)
+}
+
+func (fs sftpFileSystem) Symlink(oldname string, newname string) error {
+	return fs.client.Symlink(oldname, newname)
+}
+
+func (fs sftpFileSystem) Remove(name string) error {
+	return fs.client.Remove(name)
+}
+
+// Replaces an existing target atomically when the server supports posix-rename extension
+// Other servers may refuse to replace the target, it is then removed and the rename repeated.
+// Target is kept if the rename failed for another reason, e.g. a missing or not permitted source
+func (fs sftpFileSystem) Rename(oldname string, newname string) error {
+	if _, supported := fs.client.HasExtension("posix-rename@openssh.com"); supported {
+		return fs.client.PosixRename(oldname, newname)
+	}
+	err := fs.client.Rename(oldname, newname)
+	if err == nil || os.IsNotExist(err) || os.IsPermission(err) {
+		return err
+	}
+	if _, statErr := fs.client.Lstat(oldname); statErr != nil {
+		return err
+	}
+	if _, statErr := fs.client.Lstat(newname); statErr != nil {
+		return err
+	}
+	logging.LogTracef("Rename of %s failed, removing existing %s: %v", oldname, newname, err)
+	if err := fs.client.Remove(newname); err != nil {
+		return err
+	}
+	return fs.client.Rename(oldname, newname)
+}
+
+func (fs sftpFileSystem) Chmod(name string, mode os.FileMode) error {
+	return fs.client.Chmod(name, mode)
+}
+
+func (fs sftpFileSystem) Chown(name string, uid int, gid int) error {
+	return fs.client.Chown(name, uid, gid)
+}
+
+func (fs sftpFileSystem) LookupOwner(owner string) (int, int, error) {
+	return lookupRemoteOwner(fs.sshClient, owner)
+}
+
+func (fs sftpFileSystem) Sync(name string) error {
+	return syncRemote(fs.sshClient, name)
+}
+
+func (fs sftpFileSystem) Join(elements ...string) string {
+	return path.Join(elements...)
+}
+
+// The SFTP session is shared with other callers and stays open until the SSH client is closed
+func (fs sftpFileSystem) Close() error {
+	return nil
+}
+
+// SFTP has no notion of the mode for new directories, so the permissions are set afterwards
+func (fs sftpFileSystem) MkdirAll(name string, mode os.FileMode) error {
+	if fileInfo, err := fs.client.Stat(name); err == nil && fileInfo.IsDir() {
+		return nil
+	}
+	if err := fs.client.MkdirAll(name); err != nil {
+		return err
+	}
+	return fs.client.Chmod(name, mode)
+}
+
+func (fs sftpFileSystem) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return fs.client.Chtimes(name, atime, mtime)
+}
+
+func isSHA256Hex(checksum string) bool {
+	if len(checksum) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(checksum)
+	return err == nil
+}
+
+// Runs sha256sum on the remote machine
+// Returns the checksum and false if the command is not available or failed
+func remoteChecksum(client *goph.Client, name string) (string, bool) {
+	output, err := RunCommand(client, "sha256sum -- "+utils.QuoteShellArgument(name))
+	if err != nil {
+		return "", false
+	}
+	// sha256sum escapes the line with a leading backslash if the file name has special characters
+	if fields := strings.Fields(output); len(fields) > 0 && isSHA256Hex(strings.TrimPrefix(fields[0], "\\")) {
+		return strings.TrimPrefix(fields[0], "\\"), true
+	}
+	return "", false
+}
+
+// Length of file names passed to a single sha256sum command, shells limit the length of the command
+const checksumCommandLength = 32 * 1024
+
+// Runs sha256sum on the remote machine with as many files per command as the length allows
+// Files sha256sum could not read, or all of them if it is not available, are missing from the result
+func remoteChecksums(client *goph.Client, names []string) map[string]string {
+	checksums := make(map[string]string, len(names))
+	for start := 0; start < len(names); {
+		var command strings.Builder
+		command.WriteString("sha256sum --")
+		end := start
+		for end < len(names) && (end == start || command.Len() < checksumCommandLength) {
+			command.WriteString(" " + utils.QuoteShellArgument(names[end]))
+			end++
+		}
+		command.WriteString(" 2>/dev/null")
+		output, _ := RunCommand(client, command.String())
+		for _, line := range strings.Split(output, "\n") {
+			if name, checksum, ok := parseChecksumLine(line); ok {
+				checksums[name] = checksum
+			}
+		}
+		start = end
+	}
+	return checksums
+}
+
+// Parses line of sha256sum output, the name is escaped if the line starts with a backslash
+func parseChecksumLine(line string) (string, string, bool) {
+	escaped := strings.HasPrefix(line, "\\")
+	line = strings.TrimPrefix(line, "\\")
+	length := sha256.Size * 2
+	if len(line) < length+2 || !isSHA256Hex(line[:length]) || line[length] != ' ' {
+		return "", "", false
+	}
+	name := line[length+2:]
+	if escaped {
+		name = strings.NewReplacer("\\\\", "\\", "\\n", "\n", "\\r", "\r").Replace(name)
+	}
+	return name, line[:length], true
+}
+
+// Names are resolved on the remote machine, since its user database may differ from the local one
+func lookupRemoteOwner(client *goph.Client, owner string) (int, int, error) {
+	return parseOwner(owner, func(name string) (string, string, error) {
+		quotedName := utils.QuoteShellArgument(name)
+		output, err := RunCommand(client, fmt.Sprintf("id -u -- %s && id -g -- %s", quotedName, quotedName))
+		if err != nil {
+			return "", "", fmt.Errorf("unknown user %s: %s", name, output)
+		}
+		ids := strings.Fields(output)
+		if len(ids) != 2 {
+			return "", "", fmt.Errorf("cannot resolve user %s: %s", name, output)
+		}
+		return ids[0], ids[1], nil
+	}, func(name string) (string, error) {
+		output, err := RunCommand(client, "getent group -- "+utils.QuoteShellArgument(name))
+		if err != nil {
+			return "", fmt.Errorf("unknown group %s", name)
+		}
+		fields := strings.Split(output, ":")
+		if len(fields) < 3 {
+			return "", fmt.Errorf("cannot resolve group %s: %s", name, output)
+		}
+		return fields[2], nil
+	})
+}
+
+// SFTP of this version has no fsync extension, so sync(1) is run on the remote machine
+// Older sync without file arguments flushes all file systems instead
+func syncRemote(client *goph.Client, name string) error {
+	_, err := RunCommand(client, "sync -- "+utils.QuoteShellArgument(name))
+	if err == nil {
+		return nil
+	}
+	output, err := RunCommand(client, "sync")
+	if err != nil {
+		return fmt.Errorf("cannot sync %s: %v %s", name, err, output)
+	}
+	return nil
+}
+
+// Walks the file tree rooted at root calling walkFn for every entry, like filepath.Walk
+// Entries are visited in lexical order, symlinks are reported but not followed
+func walkFileSystem(fs fileSystem, root string, walkFn filepath.WalkFunc) error {
+	fileInfo, err := fs.Lstat(root)
+	if err != nil {
+		err = walkFn(root, nil, err)
+	} else {
+		err = walkFileSystemEntry(fs, root, fileInfo, walkFn)
+	}
+	if err == filepath.SkipDir {
+		return nil
+	}
+	return err
+}
+
+func walkFileSystemEntry(fs fileSystem, name string, fileInfo os.FileInfo, walkFn filepath.WalkFunc) error {
+	if !fileInfo.IsDir() {
+		return walkFn(name, fileInfo, nil)
+	}
+
+	entries, err := fs.ReadDir(name)
+	err = walkFn(name, fileInfo, err)
+	if err != nil || entries == nil {
+		return err
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	for _, entry := range entries {
+		err = walkFileSystemEntry(fs, fs.Join(name, entry.Name()), entry, walkFn)
+		if err != nil && !(err == filepath.SkipDir && entry.IsDir()) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Removes the entry and everything it contains, missing entry is not an error
+func removeAll(fs fileSystem, name string) error {
+	fileInfo, err := fs.Lstat(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if fileInfo.IsDir() {
+		entries, err := fs.ReadDir(name)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := removeAll(fs, fs.Join(name, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return fs.Remove(name)
+}
+
+// Parses owner in the form user[:group] where user and group are names or numeric ids
+// Without group the primary group of the user is used
+func parseOwner(owner string, lookupUser func(name string) (string, string, error), lookupGroup func(name string) (string, error)) (int, int, error) {
+	userName, groupName := owner, ""
+	if separator := strings.Index(owner, ":"); separator >= 0 {
+		userName, groupName = owner[:separator], owner[separator+1:]
+	}
+	if userName == "" {
+		return 0, 0, fmt.Errorf("invalid owner %q: user is missing", owner)
+	}
+
+	uid, uidErr := strconv.Atoi(userName)
+	gid := -1
+	if uidErr != nil || groupName == "" {
+		uidString, gidString, err := lookupUser(userName)
+		if err != nil {
+			return 0, 0, err
+		}
+		if uid, err = strconv.Atoi(uidString); err != nil {
+			return 0, 0, fmt.Errorf("invalid uid of %s: %s", userName, uidString)
+		}
+		if gid, err = strconv.Atoi(gidString); err != nil {
+			return 0, 0, fmt.Errorf("invalid gid of %s: %s", userName, gidString)
+		}
+	}
+
+	if groupName != "" {
+		var err error
+		if gid, err = strconv.Atoi(groupName); err != nil {
+			gidString, err := lookupGroup(groupName)
+			if err != nil {
+				return 0, 0, err
+			}
+			if gid, err = strconv.Atoi(gidString); err != nil {
+				return 0, 0, fmt.Errorf("invalid gid of %s: %s", groupName, gidString)
+			}
+		}
+	}
+	return uid, gid, nil
+}
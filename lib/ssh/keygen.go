@@ -89,17 +89,20 @@ func SaveKeyPair(keyPair *KeyPair) {
 
 // Propagates key pair to the remote host
 func PropagateKeyPair(client *goph.Client, keyPair *KeyPair, privateKeyPath string, publicKeyPath string) {
-	err := UploadBinaryFileFromMemory(client, privateKeyPath, &BinaryFile{Data: keyPair.GetPrivateKey(), Mode: 0600})
+	err := propagateKeyPair(client, keyPair, privateKeyPath, publicKeyPath)
 	if err != nil {
 		logging.LogError(err.Error())
 		os.Exit(1)
 	}
+}
 
-	err = UploadBinaryFileFromMemory(client, publicKeyPath, &BinaryFile{Data: keyPair.GetPublicKey(), Mode: 0644})
+func propagateKeyPair(client *goph.Client, keyPair *KeyPair, privateKeyPath string, publicKeyPath string) error {
+	err := UploadBinaryFileFromMemory(client, privateKeyPath, &BinaryFile{Data: keyPair.GetPrivateKey(), Mode: 0600})
 	if err != nil {
-		logging.LogError(err.Error())
-		os.Exit(1)
+		return err
 	}
+
+	return UploadBinaryFileFromMemory(client, publicKeyPath, &BinaryFile{Data: keyPair.GetPublicKey(), Mode: 0644})
 }
 
 // Creates RSA private key of a specified byte size
@@ -7,13 +7,16 @@ import (
 	"fmt"
 	"github.com/melbahja/goph"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
 	"net"
 	"os"
 	"strings"
+	"time"
 )
 
 const (
-	defaultSSHPort = 22
+	defaultSSHPort       = 22
+	hostKeyLookupTimeout = 10 * time.Second
 )
 
 // Adds remote host to the local known_hosts file
@@ -53,20 +56,49 @@ func AddHostToRemoteKnownHosts(client *goph.Client, hostname string, remoteKnown
 	ssh.Dial("tcp", fmt.Sprintf("%s:%d", hostname, defaultSSHPort), sshConfig)
 }
 
+// Adds remote host to the remote known_hosts file
+// Unlike AddHostToRemoteKnownHosts returns an error if the host key could not be obtained or stored
+func addHostToRemoteKnownHostsWithError(client *goph.Client, hostname string, port uint, remoteKnownHostsPath string) error {
+	var callbackCalled bool
+	var callbackErr error
+	callback := addRemoteKnownHostCallback(client, remoteKnownHostsPath)
+	sshConfig := &ssh.ClientConfig{
+		HostKeyCallback: func(dialAddr string, addr net.Addr, publicKey ssh.PublicKey) error {
+			callbackCalled = true
+			callbackErr = callback(dialAddr, addr, publicKey)
+			return callbackErr
+		},
+		Timeout: hostKeyLookupTimeout,
+	}
+	sshClient, err := ssh.Dial("tcp", net.JoinHostPort(hostname, fmt.Sprint(port)), sshConfig)
+	if err == nil {
+		sshClient.Close()
+	}
+	if !callbackCalled {
+		return fmt.Errorf("cannot obtain host key of %s: %v", hostname, err)
+	}
+	return callbackErr
+}
+
 func addRemoteKnownHostCallback(client *goph.Client, remoteKnownHostsPath string) ssh.HostKeyCallback {
 	return func(dialAddr string, addr net.Addr, publicKey ssh.PublicKey) error {
-		remoteKnownHostsFile := DownloadTextFileToMemory(client, remoteKnownHostsPath)
-		knownHostsFileString := strings.Join(remoteKnownHostsFile.Strings[:], "\n")
-		newKnownHostLine := fmt.Sprintf("%s %s %s", strings.Split(dialAddr, ":")[0], publicKey.Type(), base64.StdEncoding.EncodeToString(publicKey.Marshal()))
-		if !strings.Contains(knownHostsFileString, newKnownHostLine) {
-			knownHostsFileString += "\n" + newKnownHostLine + "\n"
-			err := UploadTextFileFromMemory(client, remoteKnownHostsPath, &TextFile{
-				Strings: strings.Split(knownHostsFileString, "\n"),
-				Mode:    remoteKnownHostsFile.Mode,
-			})
+		remoteKnownHostsFile, err := ReadTextFile(client, remoteKnownHostsPath)
+		if os.IsNotExist(err) {
+			remoteKnownHostsFile, err = &TextFile{Mode: 0644, TrailingNewline: true}, nil
+		}
+		if err != nil {
+			logging.LogErrorf("Cannot read %s: %v", remoteKnownHostsPath, err)
 			return err
 		}
 
+		// Hosts on other than the default port are written as [host]:port, the way ssh looks them up
+		newKnownHostLine := fmt.Sprintf("%s %s %s", knownhosts.Normalize(dialAddr), publicKey.Type(), base64.StdEncoding.EncodeToString(publicKey.Marshal()))
+		if utils.FindStringInArray(newKnownHostLine, remoteKnownHostsFile.Strings) < 0 {
+			remoteKnownHostsFile.Strings = append(remoteKnownHostsFile.Strings, newKnownHostLine)
+			remoteKnownHostsFile.TrailingNewline = true
+			return WriteTextFile(client, remoteKnownHostsPath, remoteKnownHostsFile)
+		}
+
 		return nil
 	}
 }
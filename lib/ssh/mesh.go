@@ -0,0 +1,286 @@
+package ssh
+
+import (
+	"github.com/hardboiledalex/go-tools/lib/utils"
+	"github.com/hardboiledalex/go-tools/lib/logging"
+	"bytes"
+	"fmt"
+	"github.com/melbahja/goph"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	authorizedKeysName    = "authorized_keys"
+	knownHostsName        = "known_hosts"
+	meshConnectTimeoutSec = 10
+)
+
+// Cluster node taking part in the trust mesh
+// Client is nil for the local host, as returned by GetClient. Zero port means the default SSH port
+type MeshNode struct {
+	Hostname string
+	Username string
+	Port     uint
+	Client   *goph.Client
+}
+
+func (node MeshNode) port() uint {
+	if node.Port == 0 {
+		return defaultSSHPort
+	}
+	return node.Port
+}
+
+// Result of checking every directed pair of the trust mesh
+// Error for (from, to) is nil when 'from' could connect to 'to' without a password
+type ConnectivityMatrix struct {
+	Hostnames []string
+	errors    [][]error
+}
+
+func newConnectivityMatrix(nodes []MeshNode) *ConnectivityMatrix {
+	matrix := &ConnectivityMatrix{
+		Hostnames: make([]string, len(nodes)),
+		errors:    make([][]error, len(nodes)),
+	}
+	for i, node := range nodes {
+		matrix.Hostnames[i] = node.Hostname
+		matrix.errors[i] = make([]error, len(nodes))
+	}
+	return matrix
+}
+
+// Returns connection error from one node to another, nil if the connection succeeded
+func (matrix *ConnectivityMatrix) Error(from string, to string) error {
+	fromIndex := findHostnameIndex(matrix.Hostnames, from)
+	toIndex := findHostnameIndex(matrix.Hostnames, to)
+	if fromIndex < 0 || toIndex < 0 {
+		return fmt.Errorf("host pair %s -> %s is not a part of the trust mesh", from, to)
+	}
+	return matrix.errors[fromIndex][toIndex]
+}
+
+// Checks if one node can connect to another
+func (matrix *ConnectivityMatrix) IsReachable(from string, to string) bool {
+	return matrix.Error(from, to) == nil
+}
+
+// Checks if every node can connect to every other node
+func (matrix *ConnectivityMatrix) IsComplete() bool {
+	for _, row := range matrix.errors {
+		for _, err := range row {
+			if err != nil {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Renders the matrix as a table: rows are source nodes, columns are target nodes
+func (matrix *ConnectivityMatrix) String() string {
+	header := "from \\ to"
+	width := len(header)
+	for _, hostname := range matrix.Hostnames {
+		if len(hostname) > width {
+			width = len(hostname)
+		}
+	}
+
+	var result strings.Builder
+	result.WriteString(fmt.Sprintf("%-*s", width, header))
+	for _, hostname := range matrix.Hostnames {
+		result.WriteString(fmt.Sprintf("  %-*s", width, hostname))
+	}
+	for i, from := range matrix.Hostnames {
+		result.WriteString("\n")
+		result.WriteString(fmt.Sprintf("%-*s", width, from))
+		for j := range matrix.Hostnames {
+			status := "OK"
+			if i == j {
+				status = "-"
+			} else if matrix.errors[i][j] != nil {
+				status = "FAIL"
+			}
+			result.WriteString(fmt.Sprintf("  %-*s", width, status))
+		}
+	}
+	return result.String()
+}
+
+// Returns index of the hostname in the list ignoring case, -1 if not found
+func findHostnameIndex(hostnames []string, hostname string) int {
+	for i, h := range hostnames {
+		if strings.EqualFold(h, hostname) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Sets up passwordless SSH between every pair of nodes
+// Distributes the key pair to each node, authorizes its public key, fills known_hosts with all peers
+// and then verifies every directed pair by connecting from one node to another
+// Returns an error if the setup of some node failed, otherwise the connectivity matrix
+func SetupTrustMesh(nodes []MeshNode, keyPair *KeyPair) (*ConnectivityMatrix, error) {
+	if duplicates := findDuplicateHostnames(nodes); len(duplicates) > 0 {
+		return nil, fmt.Errorf("duplicate hosts in the trust mesh: %s", strings.Join(duplicates, ", "))
+	}
+
+	for _, node := range nodes {
+		logging.LogInfof("Setting up trust for %s...", node.Hostname)
+		if err := setupMeshNode(node, nodes, keyPair); err != nil {
+			return nil, fmt.Errorf("cannot set up trust for %s: %v", node.Hostname, err)
+		}
+	}
+
+	logging.LogInfo("Verifying connectivity between nodes...")
+	return VerifyTrustMesh(nodes), nil
+}
+
+// Connects from every node to every other node using the propagated key
+// Nodes are checked concurrently, each node checks its peers one by one
+func VerifyTrustMesh(nodes []MeshNode) *ConnectivityMatrix {
+	matrix := newConnectivityMatrix(nodes)
+	var waitGroup sync.WaitGroup
+	for i := range nodes {
+		waitGroup.Add(1)
+		go func(i int) {
+			defer waitGroup.Done()
+			for j := range nodes {
+				if i != j {
+					matrix.errors[i][j] = verifyMeshConnection(nodes[i], nodes[j])
+				}
+			}
+		}(i)
+	}
+	waitGroup.Wait()
+
+	for i, from := range nodes {
+		for j, to := range nodes {
+			if err := matrix.errors[i][j]; err != nil {
+				logging.LogErrorf("%s cannot connect to %s: %v", from.Hostname, to.Hostname, err)
+			}
+		}
+	}
+	return matrix
+}
+
+func setupMeshNode(node MeshNode, nodes []MeshNode, keyPair *KeyPair) error {
+	sshDirectory, err := getSSHDirectory(node.Client)
+	if err != nil {
+		return err
+	}
+
+	err = MkdirAll(node.Client, sshDirectory, 0700)
+	if err != nil {
+		return err
+	}
+
+	privateKeyPath := joinPath(node.Client, sshDirectory, sshKeyName)
+	err = propagateKeyPair(node.Client, keyPair, privateKeyPath, privateKeyPath+".pub")
+	if err != nil {
+		return err
+	}
+
+	err = authorizePublicKey(node.Client, joinPath(node.Client, sshDirectory, authorizedKeysName), keyPair.GetPublicKey())
+	if err != nil {
+		return err
+	}
+
+	knownHostsPath := joinPath(node.Client, sshDirectory, knownHostsName)
+	for _, peer := range nodes {
+		if strings.EqualFold(peer.Hostname, node.Hostname) {
+			continue
+		}
+		logging.LogDebugf("Adding %s to %s", peer.Hostname, knownHostsPath)
+		if err := addHostToRemoteKnownHostsWithError(node.Client, peer.Hostname, peer.port(), knownHostsPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Appends public key to authorized_keys unless it is already there
+func authorizePublicKey(client *goph.Client, authorizedKeysPath string, publicKey []byte) error {
+	authorizedKeysFile, err := ReadTextFile(client, authorizedKeysPath)
+	if os.IsNotExist(err) {
+		authorizedKeysFile, err = &TextFile{Mode: 0600}, nil
+	}
+	if err != nil {
+		return err
+	}
+
+	newKey := string(bytes.TrimSpace(publicKey))
+	for _, line := range authorizedKeysFile.Strings {
+		if strings.TrimSpace(line) == newKey {
+			return nil
+		}
+	}
+
+	authorizedKeysFile.Strings = append(authorizedKeysFile.Strings, newKey)
+	authorizedKeysFile.TrailingNewline = true
+	return WriteTextFile(client, authorizedKeysPath, authorizedKeysFile)
+}
+
+func verifyMeshConnection(from MeshNode, to MeshNode) error {
+	sshDirectory, err := getSSHDirectory(from.Client)
+	if err != nil {
+		return err
+	}
+
+	destination := to.Hostname
+	if to.Username != "" {
+		destination = to.Username + "@" + to.Hostname
+	}
+	// Known hosts are given explicitly, ssh would otherwise look them up in the home directory from passwd
+	command := fmt.Sprintf("ssh -i %s -o UserKnownHostsFile=%s -o BatchMode=yes -o StrictHostKeyChecking=yes -o ConnectTimeout=%d -p %d %s true",
+		utils.QuoteShellArgument(joinPath(from.Client, sshDirectory, sshKeyName)),
+		utils.QuoteShellArgument(joinPath(from.Client, sshDirectory, knownHostsName)),
+		meshConnectTimeoutSec,
+		to.port(),
+		utils.QuoteShellArgument(destination))
+	output, err := RunCommand(from.Client, command)
+	if err != nil {
+		if output != "" {
+			return fmt.Errorf("%v: %s", err, output)
+		}
+		return err
+	}
+	return nil
+}
+
+// Returns path to the .ssh directory of the connected user
+func getSSHDirectory(client *goph.Client) (string, error) {
+	if client == nil {
+		return keyPath, nil
+	}
+	home, err := RunCommand(client, "echo $HOME")
+	if err != nil {
+		return "", err
+	}
+	if home == "" {
+		return "", fmt.Errorf("cannot resolve home directory on %s", client.RemoteAddr())
+	}
+	return path.Join(home, ".ssh"), nil
+}
+
+// Joins path elements using separator of the machine the client points to
+func joinPath(client *goph.Client, elements ...string) string {
+	if client == nil {
+		return filepath.Join(elements...)
+	}
+	return path.Join(elements...)
+}
+
+func findDuplicateHostnames(nodes []MeshNode) []string {
+	var hostnames []string
+	for _, node := range nodes {
+		hostnames = append(hostnames, strings.ToLower(node.Hostname))
+	}
+	return utils.FindStringDuplicates(hostnames)
+}
@@ -0,0 +1,91 @@
+package ssh
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Creates a mesh node served by its own test server, commands on the node see home as HOME
+// Loopback addresses other than 127.0.0.1 serve as further hosts
+func newTestMeshNode(t *testing.T, hostname string) (MeshNode, string) {
+	home := t.TempDir()
+	server := newTestServerAt(t, hostname+":0")
+	server.environment = []string{"HOME=" + home}
+	_, portString, _ := net.SplitHostPort(server.listener.Addr().String())
+	port, _ := strconv.Atoi(portString)
+	return MeshNode{Hostname: hostname, Port: uint(port), Client: server.connect(t)}, home
+}
+
+func TestSetupTrustMesh(t *testing.T) {
+	if _, err := exec.LookPath("ssh"); err != nil {
+		t.Skip("ssh client is not installed")
+	}
+	first, firstHome := newTestMeshNode(t, "127.0.0.1")
+	second, secondHome := newTestMeshNode(t, "127.0.0.2")
+	keyPair := GenerateKeyPair()
+
+	matrix, err := SetupTrustMesh([]MeshNode{first, second}, keyPair)
+	require.NoError(t, err)
+	assert.True(t, matrix.IsComplete(), "Every node must reach every other node:\n%s", matrix)
+
+	for _, home := range []string{firstHome, secondHome} {
+		privateKey, err := ioutil.ReadFile(filepath.Join(home, ".ssh", sshKeyName))
+		require.NoError(t, err)
+		assert.Equal(t, keyPair.GetPrivateKey(), privateKey)
+		authorizedKeys, err := ioutil.ReadFile(filepath.Join(home, ".ssh", authorizedKeysName))
+		require.NoError(t, err)
+		assert.Contains(t, string(authorizedKeys), strings.TrimSpace(string(keyPair.GetPublicKey())))
+	}
+	knownHosts, err := ioutil.ReadFile(filepath.Join(firstHome, ".ssh", knownHostsName))
+	require.NoError(t, err)
+	assert.Contains(t, string(knownHosts), "[127.0.0.2]:"+strconv.Itoa(int(second.Port))+" ", "Peer on other than the default port must be written with its port")
+	assert.NotContains(t, string(knownHosts), "[127.0.0.1]", "Node must not trust itself")
+
+	// Repeated setup must not duplicate entries
+	_, err = SetupTrustMesh([]MeshNode{first, second}, keyPair)
+	require.NoError(t, err)
+	authorizedKeys, err := ioutil.ReadFile(filepath.Join(secondHome, ".ssh", authorizedKeysName))
+	require.NoError(t, err)
+	assert.Equal(t, 1, strings.Count(string(authorizedKeys), "ssh-rsa"))
+}
+
+func TestSetupTrustMeshRejectsDuplicates(t *testing.T) {
+	node, _ := newTestMeshNode(t, "127.0.0.1")
+	node.Hostname = "node1"
+	duplicate := node
+	duplicate.Hostname = "NODE1"
+	_, err := SetupTrustMesh([]MeshNode{node, duplicate}, GenerateKeyPair())
+	assert.Error(t, err)
+}
+
+func TestVerifyTrustMeshReportsFailures(t *testing.T) {
+	node, _ := newTestMeshNode(t, "127.0.0.1")
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	_, portString, _ := net.SplitHostPort(listener.Addr().String())
+	port, _ := strconv.Atoi(portString)
+	listener.Close()
+	unreachable := MeshNode{Hostname: "127.0.0.2", Port: uint(port), Client: node.Client}
+
+	matrix := VerifyTrustMesh([]MeshNode{node, unreachable})
+	assert.False(t, matrix.IsComplete())
+	assert.Error(t, matrix.Error("127.0.0.1", "127.0.0.2"))
+	assert.Error(t, matrix.Error("127.0.0.1", "node3"), "Pair outside the mesh must be reported")
+}
+
+func TestConnectivityMatrixString(t *testing.T) {
+	matrix := newConnectivityMatrix([]MeshNode{{Hostname: "node1"}, {Hostname: "node2"}})
+	matrix.errors[1][0] = assert.AnError
+
+	assert.Equal(t, "from \\ to  node1      node2    \nnode1      -          OK       \nnode2      FAIL       -        ", matrix.String())
+	assert.True(t, matrix.IsReachable("NODE1", "node2"), "Hostnames must be matched ignoring case")
+	assert.False(t, matrix.IsReachable("node2", "node1"))
+	assert.False(t, matrix.IsComplete())
+}
@@ -0,0 +1,234 @@
+package ssh
+
+import (
+	"github.com/hardboiledalex/go-tools/lib/utils"
+	"github.com/hardboiledalex/go-tools/lib/logging"
+	"fmt"
+	"github.com/melbahja/goph"
+	"github.com/pkg/sftp"
+	"io"
+	"os"
+	"path"
+	"sync"
+)
+
+const (
+	defaultParallelWorkers   = 4
+	defaultParallelChunkSize = 64 * 1024 * 1024
+	// Each worker reads into a buffer of this size, ReadAt splits it into concurrent SFTP requests
+	parallelReadBufferSize = 4 * 1024 * 1024
+)
+
+// Options of the parallel download, TransferOptions apply except Resume and Verify
+// Workers is the number of byte ranges fetched at the same time, ChunkSize is the size of a single range.
+// The assembled file is always verified against SHA-256 of the remote file
+type ParallelDownloadOptions struct {
+	TransferOptions
+	Workers   int
+	ChunkSize int64
+}
+
+// Downloads a single large file fetching several byte ranges concurrently
+// One SFTP stream over a high-latency link is bound by the window size, parallel ranges are not.
+// Falls back to the sequential download when SFTP is not available
+// Returns an error if happened, the target is replaced only by a complete and verified file
+func DownloadFileParallel(client *goph.Client, remotePath string, localPath string, options ParallelDownloadOptions) error {
+	if options.Workers <= 0 {
+		options.Workers = defaultParallelWorkers
+	}
+	if options.ChunkSize <= 0 {
+		options.ChunkSize = defaultParallelChunkSize
+	}
+
+	source, err := openFileSystemWithProtocol(client, options.Protocol)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	sftpSource, isSFTP := source.(sftpFileSystem)
+	if !isSFTP {
+		logging.LogDebugf("Parallel download of %s needs SFTP, downloading sequentially", remotePath)
+		options.Verify = true
+		_, err := transferFile(source, remotePath, localFileSystem{}, localPath, options.TransferOptions)
+		return err
+	}
+
+	fileInfo, err := sftpSource.Stat(remotePath)
+	if err != nil {
+		return err
+	}
+	if !fileInfo.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", remotePath)
+	}
+
+	suffix, err := utils.RandomHex(4)
+	if err != nil {
+		return err
+	}
+	temporaryPath := temporarySiblingPath(localFileSystem{}, localPath, suffix)
+	if err := downloadRanges(sftpSource, remotePath, temporaryPath, fileInfo, options); err != nil {
+		os.Remove(temporaryPath)
+		return err
+	}
+	if err := commitParallelDownload(sftpSource, remotePath, temporaryPath, localPath, options); err != nil {
+		os.Remove(temporaryPath)
+		return err
+	}
+	return nil
+}
+
+// Writes all ranges of the remote file into the pre-allocated temporary file
+func downloadRanges(source sftpFileSystem, remotePath string, temporaryPath string, fileInfo os.FileInfo, options ParallelDownloadOptions) error {
+	target, err := os.OpenFile(temporaryPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fileInfo.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+
+	size := fileInfo.Size()
+	if err := target.Truncate(size); err != nil {
+		return fmt.Errorf("cannot allocate %s for %s: %v", utils.BytesToString(int(size)), temporaryPath, err)
+	}
+
+	chunks := (size + options.ChunkSize - 1) / options.ChunkSize
+	workers := options.Workers
+	if int64(workers) > chunks {
+		workers = int(chunks)
+	}
+	logging.LogDebugf("Downloading %s in %d chunks with %d workers", remotePath, chunks, workers)
+
+	downloader := &rangeDownloader{
+		source:   source.client,
+		path:     remotePath,
+		target:   target,
+		tracker:  newProgressTracker(options.Progress, path.Base(remotePath), 0, size),
+		throttle: newThrottle(options.RateLimiter),
+		offsets:  make(chan int64),
+		stop:     make(chan struct{}),
+	}
+	var waitGroup sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			downloader.work(size, options.ChunkSize)
+		}()
+	}
+
+	downloader.feed(size, options.ChunkSize)
+	waitGroup.Wait()
+
+	if downloader.err != nil {
+		return downloader.err
+	}
+	downloader.tracker.finish()
+	if options.Fsync {
+		if err := target.Sync(); err != nil {
+			return err
+		}
+	}
+	return target.Close()
+}
+
+// Verifies the assembled file and moves it into place with the requested ownership
+func commitParallelDownload(source sftpFileSystem, remotePath string, temporaryPath string, localPath string, options ParallelDownloadOptions) error {
+	if err := verifyTransfer(source, remotePath, localFileSystem{}, temporaryPath); err != nil {
+		return err
+	}
+	if options.Owner != "" {
+		uid, gid, err := localFileSystem{}.LookupOwner(options.Owner)
+		if err != nil {
+			return err
+		}
+		if err := os.Lchown(temporaryPath, uid, gid); err != nil {
+			return fmt.Errorf("cannot change owner of %s: %v", localPath, err)
+		}
+	}
+	return os.Rename(temporaryPath, localPath)
+}
+
+// Workers take chunk offsets from the channel, the first error stops all of them
+type rangeDownloader struct {
+	source   *sftp.Client
+	path     string
+	target   *os.File
+	tracker  *progressTracker
+	throttle throttle
+	offsets  chan int64
+	stop     chan struct{}
+	stopOnce sync.Once
+	err      error
+}
+
+// Hands out chunk offsets until all are taken or a worker failed
+func (downloader *rangeDownloader) feed(size int64, chunkSize int64) {
+	defer close(downloader.offsets)
+	for offset := int64(0); offset < size; offset += chunkSize {
+		select {
+		case downloader.offsets <- offset:
+		case <-downloader.stop:
+			return
+		}
+	}
+}
+
+func (downloader *rangeDownloader) work(size int64, chunkSize int64) {
+	// Every worker has its own handle, so the requests of different ranges do not queue behind each other
+	file, err := downloader.source.Open(downloader.path)
+	if err != nil {
+		downloader.fail(err)
+		return
+	}
+	defer file.Close()
+
+	buffer := make([]byte, parallelReadBufferSize)
+	for offset := range downloader.offsets {
+		end := offset + chunkSize
+		if end > size {
+			end = size
+		}
+		if err := downloader.copyRange(file, buffer, offset, end); err != nil {
+			downloader.fail(err)
+			return
+		}
+	}
+}
+
+func (downloader *rangeDownloader) copyRange(file *sftp.File, buffer []byte, offset int64, end int64) error {
+	for offset < end {
+		select {
+		case <-downloader.stop:
+			return nil
+		default:
+		}
+		length := end - offset
+		if length > int64(len(buffer)) {
+			length = int64(len(buffer))
+		}
+		downloader.throttle.wait(int(length))
+		n, err := file.ReadAt(buffer[:length], offset)
+		if err == io.EOF && int64(n) == length {
+			err = nil
+		}
+		if err != nil {
+			if err == io.EOF {
+				return fmt.Errorf("%s became shorter during the download", downloader.path)
+			}
+			return err
+		}
+		if _, err := downloader.target.WriteAt(buffer[:n], offset); err != nil {
+			return err
+		}
+		downloader.tracker.add(n)
+		offset += int64(n)
+	}
+	return nil
+}
+
+func (downloader *rangeDownloader) fail(err error) {
+	downloader.stopOnce.Do(func() {
+		downloader.err = err
+		close(downloader.stop)
+	})
+}
@@ -0,0 +1,46 @@
+package ssh
+
+import (
+	"bytes"
+	"crypto/rand"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDownloadFileParallel(t *testing.T) {
+	client := newTestServer(t).connect(t)
+	directory := t.TempDir()
+
+	// Size not divisible by the chunk size, so the last range is shorter than the others
+	data := make([]byte, 5*1024*1024+123)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	remotePath := filepath.Join(directory, "archive.bin")
+	require.NoError(t, ioutil.WriteFile(remotePath, data, 0640))
+
+	var lastProgress TransferProgress
+	localPath := filepath.Join(directory, "local.bin")
+	options := ParallelDownloadOptions{Workers: 3, ChunkSize: 1024 * 1024}
+	options.Progress = func(progress TransferProgress) { lastProgress = progress }
+	require.NoError(t, DownloadFileParallel(client, remotePath, localPath, options))
+
+	localData, err := ioutil.ReadFile(localPath)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(data, localData), "Assembled file must match the remote file")
+	fileInfo, err := os.Stat(localPath)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), fileInfo.Mode().Perm())
+	assert.True(t, lastProgress.Finished)
+	assert.Equal(t, int64(len(data)), lastProgress.Done)
+
+	// Missing source must leave neither the target nor temporary files behind
+	err = DownloadFileParallel(client, filepath.Join(directory, "missing"), filepath.Join(directory, "missing.bin"), options)
+	assert.True(t, os.IsNotExist(err), "Missing source must return not-exist error, got %v", err)
+	entries, err := ioutil.ReadDir(directory)
+	require.NoError(t, err)
+	assert.Len(t, entries, 2)
+}
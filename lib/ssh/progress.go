@@ -0,0 +1,233 @@
+package ssh
+
+import (
+	"github.com/hardboiledalex/go-tools/lib/utils"
+	"github.com/hardboiledalex/go-tools/lib/logging"
+	"fmt"
+	"golang.org/x/term"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	progressInterval      = 200 * time.Millisecond
+	progressRateSmoothing = 0.3
+	progressBarWidth      = 30
+)
+
+// State of a running transfer passed to ProgressFunc
+// Total is -1 when the size is not known in advance, ETA is -1 when it cannot be estimated yet
+type TransferProgress struct {
+	Name     string
+	Done     int64
+	Total    int64
+	Rate     float64
+	ETA      time.Duration
+	Finished bool
+}
+
+// Percentage of the transfer done, -1 when the total size is not known
+func (progress TransferProgress) Percent() float64 {
+	if progress.Total < 0 {
+		return -1
+	}
+	if progress.Total == 0 {
+		return 100
+	}
+	return float64(progress.Done) * 100 / float64(progress.Total)
+}
+
+// Called periodically while the transfer runs and once after it finished
+type ProgressFunc func(progress TransferProgress)
+
+// Tracks transferred bytes and reports them to ProgressFunc not more often than progressInterval
+type progressTracker struct {
+	callback       ProgressFunc
+	progress       TransferProgress
+	mutex          sync.Mutex
+	lastReportTime time.Time
+	lastReportDone int64
+}
+
+func newProgressTracker(callback ProgressFunc, name string, done int64, total int64) *progressTracker {
+	if callback == nil {
+		return nil
+	}
+	return &progressTracker{
+		callback:       callback,
+		progress:       TransferProgress{Name: name, Done: done, Total: total, ETA: -1},
+		lastReportTime: time.Now(),
+		lastReportDone: done,
+	}
+}
+
+func (tracker *progressTracker) add(n int) {
+	if tracker == nil || n <= 0 {
+		return
+	}
+	tracker.mutex.Lock()
+	tracker.progress.Done += int64(n)
+	now := time.Now()
+	elapsed := now.Sub(tracker.lastReportTime)
+	if elapsed < progressInterval {
+		tracker.mutex.Unlock()
+		return
+	}
+	tracker.updateRate(now, elapsed)
+	progress := tracker.progress
+	tracker.mutex.Unlock()
+
+	tracker.callback(progress)
+}
+
+func (tracker *progressTracker) finish() {
+	if tracker == nil {
+		return
+	}
+	tracker.mutex.Lock()
+	now := time.Now()
+	tracker.updateRate(now, now.Sub(tracker.lastReportTime))
+	tracker.progress.Finished = true
+	tracker.progress.ETA = 0
+	progress := tracker.progress
+	tracker.mutex.Unlock()
+
+	tracker.callback(progress)
+}
+
+// Rate is smoothed with exponential moving average, so short stalls do not make ETA jump
+func (tracker *progressTracker) updateRate(now time.Time, elapsed time.Duration) {
+	if elapsed > 0 {
+		currentRate := float64(tracker.progress.Done-tracker.lastReportDone) / elapsed.Seconds()
+		if tracker.progress.Rate == 0 {
+			tracker.progress.Rate = currentRate
+		} else {
+			tracker.progress.Rate = progressRateSmoothing*currentRate + (1-progressRateSmoothing)*tracker.progress.Rate
+		}
+	}
+	tracker.lastReportTime = now
+	tracker.lastReportDone = tracker.progress.Done
+
+	tracker.progress.ETA = -1
+	if tracker.progress.Total >= 0 && tracker.progress.Rate > 0 {
+		remaining := tracker.progress.Total - tracker.progress.Done
+		if remaining < 0 {
+			remaining = 0
+		}
+		tracker.progress.ETA = time.Duration(float64(remaining) / tracker.progress.Rate * float64(time.Second))
+	}
+}
+
+type progressReader struct {
+	reader   io.Reader
+	tracker  *progressTracker
+	throttle throttle
+}
+
+func (reader progressReader) Read(p []byte) (int, error) {
+	n, err := reader.reader.Read(p)
+	reader.throttle.wait(n)
+	reader.tracker.add(n)
+	return n, err
+}
+
+type progressWriter struct {
+	writer   io.Writer
+	tracker  *progressTracker
+	throttle throttle
+}
+
+func (writer progressWriter) Write(p []byte) (int, error) {
+	writer.throttle.wait(len(p))
+	n, err := writer.writer.Write(p)
+	writer.tracker.add(n)
+	return n, err
+}
+
+// Writer which sends the data on Close and applies the throttle there instead of to the writes
+// Returns whether the throttle was taken over
+type deferredWriter interface {
+	throttleSending(throttle throttle) bool
+}
+
+// Copies data reporting progress to the tracker and keeping the rate within the throttle
+// The side doing SFTP keeps its concurrent WriteTo or ReadFrom, so the other side is wrapped.
+// The copy is wrapped even without limits, so a limit set while it runs still applies
+// Writers sending the data later than it is written, like the spooling SCP one, take over the throttle
+func copyWithProgress(target io.Writer, source io.Reader, tracker *progressTracker, throttle throttle) (int64, error) {
+	if deferred, ok := target.(deferredWriter); ok && deferred.throttleSending(throttle) {
+		throttle = nil
+	}
+	if _, ok := source.(io.WriterTo); ok {
+		return io.Copy(progressWriter{target, tracker, throttle}, source)
+	}
+	return io.Copy(target, progressReader{source, tracker, throttle})
+}
+
+// Returns ProgressFunc drawing a progress bar in the console status line
+// Log messages printed during the transfer appear above the bar. If the output is not a terminal,
+// a log message is written on every 10% of the transfer instead
+func NewConsoleProgress() ProgressFunc {
+	if !term.IsTerminal(int(os.Stdout.Fd())) {
+		return newLogProgress()
+	}
+	return func(progress TransferProgress) {
+		if progress.Finished {
+			logging.ClearStatusLine()
+			logging.LogInfof("%s: %s transferred in average %s/s", progress.Name,
+				utils.BytesToString(int(progress.Done)), utils.BytesToString(int(progress.Rate)))
+			return
+		}
+		logging.SetStatusLine(FormatProgress(progress))
+	}
+}
+
+func newLogProgress() ProgressFunc {
+	var mutex sync.Mutex
+	reportedSteps := make(map[string]int)
+	return func(progress TransferProgress) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		step := int(progress.Percent()) / 10
+		if progress.Finished {
+			delete(reportedSteps, progress.Name)
+		} else if lastStep, reported := reportedSteps[progress.Name]; reported && step <= lastStep {
+			return
+		} else {
+			reportedSteps[progress.Name] = step
+		}
+		logging.LogInfo(FormatProgress(progress))
+	}
+}
+
+// Formats progress as a single line: name, bar, percentage, amount, rate and ETA
+func FormatProgress(progress TransferProgress) string {
+	var result strings.Builder
+	result.WriteString(progress.Name)
+	if percent := progress.Percent(); percent >= 0 {
+		filled := int(percent) * progressBarWidth / 100
+		if filled > progressBarWidth {
+			filled = progressBarWidth
+		}
+		result.WriteString(fmt.Sprintf(" [%s%s] %3.0f%% %s/%s", strings.Repeat("=", filled), strings.Repeat(" ", progressBarWidth-filled),
+			percent, utils.BytesToString(int(progress.Done)), utils.BytesToString(int(progress.Total))))
+	} else {
+		result.WriteString(" " + utils.BytesToString(int(progress.Done)))
+	}
+	result.WriteString(fmt.Sprintf(" %s/s", utils.BytesToString(int(progress.Rate))))
+	if progress.ETA >= 0 && !progress.Finished {
+		result.WriteString(" ETA " + formatDuration(progress.ETA))
+	}
+	return result.String()
+}
+
+func formatDuration(duration time.Duration) string {
+	seconds := int64(duration.Round(time.Second) / time.Second)
+	if seconds >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", seconds/3600, seconds/60%60, seconds%60)
+	}
+	return fmt.Sprintf("%d:%02d", seconds/60, seconds%60)
+}
@@ -0,0 +1,127 @@
+package ssh
+
+import (
+	"sync"
+	"time"
+)
+
+// Longest single sleep of a throttled transfer, so rate changes take effect quickly
+const maximumThrottleSleep = 100 * time.Millisecond
+
+// Budget shared by all transfers of the process, unlimited by default
+var globalRateLimiter = NewRateLimiter(0)
+
+// Token bucket limiting the number of bytes per second
+// A single limiter may be shared by any number of parallel transfers, which then split its budget.
+// The rate can be changed at any time, including while transfers are running
+type RateLimiter struct {
+	mutex      sync.Mutex
+	rate       int64
+	tokens     float64
+	lastRefill time.Time
+}
+
+// Creates limiter with the given rate in bytes per second, zero or negative rate means unlimited
+func NewRateLimiter(bytesPerSecond int64) *RateLimiter {
+	return &RateLimiter{rate: bytesPerSecond, lastRefill: time.Now()}
+}
+
+// Changes the rate in bytes per second, zero or negative rate means unlimited
+func (limiter *RateLimiter) SetRate(bytesPerSecond int64) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	limiter.refill(time.Now())
+	limiter.rate = bytesPerSecond
+	if limiter.tokens > limiter.burst() {
+		limiter.tokens = limiter.burst()
+	}
+}
+
+// Returns the rate in bytes per second, zero means unlimited
+func (limiter *RateLimiter) Rate() int64 {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	if limiter.rate < 0 {
+		return 0
+	}
+	return limiter.rate
+}
+
+// Blocks until n bytes fit into the budget, returns immediately for nil or unlimited limiter
+func (limiter *RateLimiter) wait(n int) {
+	if limiter == nil {
+		return
+	}
+	remaining := float64(n)
+	for remaining > 0 {
+		limiter.mutex.Lock()
+		if limiter.rate <= 0 {
+			limiter.mutex.Unlock()
+			return
+		}
+		now := time.Now()
+		limiter.refill(now)
+		// Requests larger than the bucket are taken in parts, otherwise they would never fit
+		chunk := remaining
+		if chunk > limiter.burst() {
+			chunk = limiter.burst()
+		}
+		if limiter.tokens >= chunk {
+			limiter.tokens -= chunk
+			remaining -= chunk
+			limiter.mutex.Unlock()
+			continue
+		}
+		sleep := time.Duration((chunk - limiter.tokens) / float64(limiter.rate) * float64(time.Second))
+		limiter.mutex.Unlock()
+
+		if sleep > maximumThrottleSleep {
+			sleep = maximumThrottleSleep
+		}
+		time.Sleep(sleep)
+	}
+}
+
+// Adds tokens for the time passed since the last refill, the bucket holds one second of the rate
+func (limiter *RateLimiter) refill(now time.Time) {
+	if limiter.rate > 0 {
+		limiter.tokens += now.Sub(limiter.lastRefill).Seconds() * float64(limiter.rate)
+		if limiter.tokens > limiter.burst() {
+			limiter.tokens = limiter.burst()
+		}
+	}
+	limiter.lastRefill = now
+}
+
+func (limiter *RateLimiter) burst() float64 {
+	if limiter.rate < 1 {
+		return 1
+	}
+	return float64(limiter.rate)
+}
+
+// Sets the budget in bytes per second shared by all transfers of the process, zero means unlimited
+// Applies to running transfers as well
+func SetGlobalRateLimit(bytesPerSecond int64) {
+	globalRateLimiter.SetRate(bytesPerSecond)
+}
+
+// Returns the global budget in bytes per second, zero means unlimited
+func GlobalRateLimit() int64 {
+	return globalRateLimiter.Rate()
+}
+
+// Limiters applied to a single transfer: the global one and the optional one of the transfer
+type throttle []*RateLimiter
+
+func newThrottle(limiter *RateLimiter) throttle {
+	return throttle{globalRateLimiter, limiter}
+}
+
+func (throttle throttle) wait(n int) {
+	for _, limiter := range throttle {
+		limiter.wait(n)
+	}
+}
@@ -0,0 +1,79 @@
+package ssh
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limiter := NewRateLimiter(100 * 1024)
+
+	// Two parallel consumers share the budget, so together they need about a second for 100 KB
+	start := time.Now()
+	var waitGroup sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			for j := 0; j < 10; j++ {
+				limiter.wait(5 * 1024)
+			}
+		}()
+	}
+	waitGroup.Wait()
+	elapsed := time.Since(start)
+	assert.True(t, elapsed > 800*time.Millisecond && elapsed < 2*time.Second, "Shared budget must be respected, took %v", elapsed)
+
+	// Lifting the limit must release a consumer which is already waiting
+	limiter.SetRate(1)
+	done := make(chan struct{})
+	go func() {
+		limiter.wait(1024)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	limiter.SetRate(0)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Waiting consumer must continue after the limit was removed")
+	}
+}
+
+func TestThrottledUpload(t *testing.T) {
+	client := newTestServer(t).connect(t)
+	remotePath := filepath.Join(t.TempDir(), "throttled.bin")
+	data := make([]byte, 256*1024)
+
+	start := time.Now()
+	_, err := UploadWithOptions(client, bytes.NewReader(data), remotePath, 0644, TransferOptions{RateLimiter: NewRateLimiter(512 * 1024)})
+	require.NoError(t, err)
+	elapsed := time.Since(start)
+	assert.True(t, elapsed > 400*time.Millisecond, "Upload must be limited to the given rate, took %v", elapsed)
+
+	// Spooled SCP upload is limited while sending, not while writing the local spool
+	start = time.Now()
+	options := TransferOptions{Protocol: ProtocolSCP, RateLimiter: NewRateLimiter(512 * 1024)}
+	_, err = UploadWithOptions(client, bytes.NewReader(data), remotePath, 0644, options)
+	require.NoError(t, err)
+	elapsed = time.Since(start)
+	assert.True(t, elapsed > 400*time.Millisecond, "SCP upload must be limited to the given rate, took %v", elapsed)
+	writer := &scpWriter{}
+	assert.True(t, writer.throttleSending(newThrottle(options.RateLimiter)))
+	assert.Equal(t, options.RateLimiter, writer.throttle[1])
+
+	// Global limit applies to transfers without their own limiter
+	SetGlobalRateLimit(512 * 1024)
+	defer SetGlobalRateLimit(0)
+	assert.Equal(t, int64(512*1024), GlobalRateLimit())
+	start = time.Now()
+	_, err = Upload(client, bytes.NewReader(data), remotePath, 0644)
+	require.NoError(t, err)
+	elapsed = time.Since(start)
+	assert.True(t, elapsed > 400*time.Millisecond, "Upload must be limited by the global rate, took %v", elapsed)
+}
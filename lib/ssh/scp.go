@@ -0,0 +1,725 @@
+package ssh
+
+import (
+	"github.com/hardboiledalex/go-tools/lib/utils"
+	"github.com/hardboiledalex/go-tools/lib/logging"
+	"github.com/hardboiledalex/go-tools/lib/vfs"
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/melbahja/goph"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Output format of find used for Stat, Lstat and ReadDir: depth, type, permissions, size, mtime, owner ids and name
+const scpFindFormat = `%d %y %m %s %T@ %U %G %f\0`
+
+// File system of the remote machine for servers without SFTP subsystem
+// File content travels with the scp source and sink protocols over an exec session,
+// metadata operations run GNU coreutils and findutils commands on the remote machine
+type scpFileSystem struct {
+	client *goph.Client
+}
+
+// Reading starts lazily, so Seek right after Open resumes the download from the offset
+func (fs scpFileSystem) Open(name string) (vfs.ReadSeekCloser, error) {
+	fileInfo, err := fs.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if fileInfo.IsDir() {
+		return nil, &os.PathError{Op: "open", Path: name, Err: errors.New("is a directory")}
+	}
+	return &scpReader{fs: fs, name: name}, nil
+}
+
+// Scp sink needs the size in advance, so the content is spooled to a local temporary file
+// and sent when the file is closed. CreateWithSize streams the content when the size is known
+func (fs scpFileSystem) Create(name string, mode os.FileMode) (io.WriteCloser, error) {
+	if strings.Contains(path.Base(name), "\n") {
+		return nil, &os.PathError{Op: "create", Path: name, Err: errors.New("file name with a newline cannot be sent over SCP")}
+	}
+	spool, err := ioutil.TempFile("", "scp-upload-")
+	if err != nil {
+		return nil, err
+	}
+	return &scpWriter{fs: fs, name: name, mode: mode, spool: spool}, nil
+}
+
+// Streams the content straight to the scp sink, exactly size bytes must be written before Close
+func (fs scpFileSystem) CreateWithSize(name string, mode os.FileMode, size int64) (io.WriteCloser, error) {
+	if strings.Contains(path.Base(name), "\n") {
+		return nil, &os.PathError{Op: "create", Path: name, Err: errors.New("file name with a newline cannot be sent over SCP")}
+	}
+	process, err := startRemoteProcess(fs.client, "scp -t -- "+utils.QuoteShellArgument(name))
+	if err != nil {
+		return nil, err
+	}
+	if err := sendSCPHeader(process, name, mode, size); err != nil {
+		process.kill()
+		return nil, &os.PathError{Op: "create", Path: name, Err: err}
+	}
+	return &scpStreamWriter{fs: fs, name: name, mode: mode, process: process, remaining: size}, nil
+}
+
+func (fs scpFileSystem) Append(name string) (io.WriteCloser, error) {
+	quotedName := utils.QuoteShellArgument(remotePathArgument(name))
+	process, err := startRemoteProcess(fs.client, fmt.Sprintf("ls -d -- %s >/dev/null && cat >> %s", quotedName, quotedName))
+	if err != nil {
+		return nil, err
+	}
+	return &scpAppender{process: process, name: name}, nil
+}
+
+func (fs scpFileSystem) Stat(name string) (os.FileInfo, error) {
+	entries, err := fs.find("stat", name, true, 0)
+	if err != nil {
+		return nil, err
+	}
+	// find -H reports a broken symlink as a symlink instead of failing
+	if len(entries) != 1 || entries[0].Mode()&os.ModeSymlink != 0 {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return entries[0], nil
+}
+
+func (fs scpFileSystem) Lstat(name string) (os.FileInfo, error) {
+	entries, err := fs.find("lstat", name, false, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) != 1 {
+		return nil, &os.PathError{Op: "lstat", Path: name, Err: os.ErrNotExist}
+	}
+	return entries[0], nil
+}
+
+func (fs scpFileSystem) ReadDir(name string) ([]os.FileInfo, error) {
+	entries, err := fs.find("readdir", name, true, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 || !entries[0].IsDir() {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	return entries[1:], nil
+}
+
+func (fs scpFileSystem) Readlink(name string) (string, error) {
+	output, err := fs.run("readlink", name, "readlink -- "+utils.QuoteShellArgument(name))
+	return strings.TrimSuffix(output, "\n"), err
+}
+
+func (fs scpFileSystem) Symlink(oldname string, newname string) error {
+	_, err := fs.run("symlink", newname, fmt.Sprintf("ln -s -- %s %s",
+		utils.QuoteShellArgument(oldname), utils.QuoteShellArgument(newname)))
+	return err
+}
+
+func (fs scpFileSystem) MkdirAll(name string, mode os.FileMode) error {
+	if fileInfo, err := fs.Stat(name); err == nil && fileInfo.IsDir() {
+		return nil
+	}
+	quotedName := utils.QuoteShellArgument(name)
+	_, err := fs.run("mkdir", name, fmt.Sprintf("mkdir -p -- %s && chmod %04o -- %s", quotedName, fileModeToUnix(mode), quotedName))
+	return err
+}
+
+// Removes file or empty directory like os.Remove
+func (fs scpFileSystem) Remove(name string) error {
+	_, err := fs.run("remove", name, "rm -d -- "+utils.QuoteShellArgument(name))
+	return err
+}
+
+func (fs scpFileSystem) Rename(oldname string, newname string) error {
+	_, err := fs.run("rename", oldname, fmt.Sprintf("mv -f -T -- %s %s",
+		utils.QuoteShellArgument(oldname), utils.QuoteShellArgument(newname)))
+	return err
+}
+
+func (fs scpFileSystem) Chmod(name string, mode os.FileMode) error {
+	_, err := fs.run("chmod", name, fmt.Sprintf("chmod %04o -- %s", fileModeToUnix(mode), utils.QuoteShellArgument(name)))
+	return err
+}
+
+func (fs scpFileSystem) Chown(name string, uid int, gid int) error {
+	_, err := fs.run("chown", name, fmt.Sprintf("chown -h %d:%d -- %s", uid, gid, utils.QuoteShellArgument(name)))
+	return err
+}
+
+func (fs scpFileSystem) LookupOwner(owner string) (int, int, error) {
+	return lookupRemoteOwner(fs.client, owner)
+}
+
+func (fs scpFileSystem) Sync(name string) error {
+	return syncRemote(fs.client, name)
+}
+
+// Touch creates missing files, so the existence is checked by ls first to fail like os.Chtimes
+func (fs scpFileSystem) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	quotedName := utils.QuoteShellArgument(name)
+	_, err := fs.run("chtimes", name, fmt.Sprintf("ls -d -- %s >/dev/null && touch -c -a -d @%d.%09d -- %s && touch -c -m -d @%d.%09d -- %s",
+		quotedName, atime.Unix(), atime.Nanosecond(), quotedName, mtime.Unix(), mtime.Nanosecond(), quotedName))
+	return err
+}
+
+func (fs scpFileSystem) Checksum(name string) (string, error) {
+	if checksum, found := remoteChecksum(fs.client, name); found {
+		return checksum, nil
+	}
+	logging.LogTracef("sha256sum is not available for %s, reading the file over SCP", name)
+
+	file, err := fs.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	return readerChecksum(file)
+}
+
+func (fs scpFileSystem) Join(elements ...string) string {
+	return path.Join(elements...)
+}
+
+func (fs scpFileSystem) Close() error {
+	return nil
+}
+
+// Runs the command on the remote machine with LC_ALL=C, so error messages can be recognised
+// Returns standard output and error of the operation on the file if the command failed
+func (fs scpFileSystem) run(operation string, name string, command string) (string, error) {
+	logging.LogTracef("Running command %s on %s", command, fs.client.RemoteAddr())
+	session, err := fs.client.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+
+	var stdout, stderr bytes.Buffer
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+	if err := session.Run("LC_ALL=C; export LC_ALL; " + command); err != nil {
+		return stdout.String(), &os.PathError{Op: operation, Path: name, Err: remoteCommandError(err, stderr.String())}
+	}
+	return stdout.String(), nil
+}
+
+// Lists the entry and its children up to maxDepth with find
+// With followArgument the entry itself is resolved if it is a symlink, children are never followed
+func (fs scpFileSystem) find(operation string, name string, followArgument bool, maxDepth int) ([]os.FileInfo, error) {
+	options := ""
+	if followArgument {
+		options = "-H "
+	}
+	output, err := fs.run(operation, name, fmt.Sprintf("find %s%s -maxdepth %d -printf '%s'",
+		options, utils.QuoteShellArgument(remotePathArgument(name)), maxDepth, scpFindFormat))
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []os.FileInfo
+	for _, line := range strings.Split(output, "\x00") {
+		if line == "" {
+			continue
+		}
+		fileInfo, err := parseFindEntry(line)
+		if err != nil {
+			return nil, &os.PathError{Op: operation, Path: name, Err: err}
+		}
+		entries = append(entries, fileInfo)
+	}
+	return entries, nil
+}
+
+// Find treats arguments starting with a dash as expressions, so such relative paths get ./ prefix
+func remotePathArgument(name string) string {
+	if strings.HasPrefix(name, "-") {
+		return "./" + name
+	}
+	return name
+}
+
+// Maps messages of coreutils to the errors of the os package, so os.IsNotExist and alike work
+func remoteCommandError(err error, stderr string) error {
+	message := strings.TrimSpace(stderr)
+	switch {
+	case strings.Contains(message, "No such file or directory"):
+		return os.ErrNotExist
+	case strings.Contains(message, "Permission denied"):
+		return os.ErrPermission
+	case strings.Contains(message, "File exists"):
+		return os.ErrExist
+	case message != "":
+		return errors.New(message)
+	}
+	return err
+}
+
+type scpFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+	uid     int
+	gid     int
+}
+
+func (fileInfo *scpFileInfo) Name() string {
+	return fileInfo.name
+}
+
+func (fileInfo *scpFileInfo) Size() int64 {
+	return fileInfo.size
+}
+
+func (fileInfo *scpFileInfo) Mode() os.FileMode {
+	return fileInfo.mode
+}
+
+func (fileInfo *scpFileInfo) ModTime() time.Time {
+	return fileInfo.modTime
+}
+
+func (fileInfo *scpFileInfo) IsDir() bool {
+	return fileInfo.mode.IsDir()
+}
+
+func (fileInfo *scpFileInfo) Sys() interface{} {
+	return nil
+}
+
+// Parses single entry printed with scpFindFormat
+func parseFindEntry(line string) (os.FileInfo, error) {
+	fields := strings.SplitN(line, " ", 8)
+	if len(fields) != 8 || len(fields[1]) != 1 {
+		return nil, fmt.Errorf("unexpected find output %q", line)
+	}
+	permissions, err := strconv.ParseUint(fields[2], 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("unexpected permissions in find output %q", line)
+	}
+	size, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("unexpected size in find output %q", line)
+	}
+	modTime, err := parseFindTime(fields[4])
+	if err != nil {
+		return nil, fmt.Errorf("unexpected modification time in find output %q", line)
+	}
+	uid, err := strconv.Atoi(fields[5])
+	if err != nil {
+		return nil, fmt.Errorf("unexpected owner in find output %q", line)
+	}
+	gid, err := strconv.Atoi(fields[6])
+	if err != nil {
+		return nil, fmt.Errorf("unexpected group in find output %q", line)
+	}
+
+	mode := unixToFileMode(uint32(permissions))
+	switch fields[1] {
+	case "d":
+		mode |= os.ModeDir
+	case "l":
+		mode |= os.ModeSymlink
+	case "p":
+		mode |= os.ModeNamedPipe
+	case "s":
+		mode |= os.ModeSocket
+	case "c":
+		mode |= os.ModeDevice | os.ModeCharDevice
+	case "b":
+		mode |= os.ModeDevice
+	}
+	return &scpFileInfo{fields[7], size, mode, modTime, uid, gid}, nil
+}
+
+// Parses seconds since epoch with optional fraction as printed by %T@
+func parseFindTime(value string) (time.Time, error) {
+	seconds, fraction := value, ""
+	if separator := strings.Index(value, "."); separator >= 0 {
+		seconds, fraction = value[:separator], value[separator+1:]
+	}
+	unixSeconds, err := strconv.ParseInt(seconds, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var nanoseconds int64
+	if fraction != "" {
+		fraction = (fraction + "000000000")[:9]
+		if nanoseconds, err = strconv.ParseInt(fraction, 10, 64); err != nil {
+			return time.Time{}, err
+		}
+	}
+	return time.Unix(unixSeconds, nanoseconds), nil
+}
+
+func unixToFileMode(mode uint32) os.FileMode {
+	fileMode := os.FileMode(mode & 0777)
+	if mode&04000 != 0 {
+		fileMode |= os.ModeSetuid
+	}
+	if mode&02000 != 0 {
+		fileMode |= os.ModeSetgid
+	}
+	if mode&01000 != 0 {
+		fileMode |= os.ModeSticky
+	}
+	return fileMode
+}
+
+func fileModeToUnix(mode os.FileMode) uint32 {
+	unixMode := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		unixMode |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		unixMode |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		unixMode |= 01000
+	}
+	return unixMode
+}
+
+// Command running on the remote machine with streamed standard input and output
+type remoteProcess struct {
+	session *ssh.Session
+	stdin   io.WriteCloser
+	stdout  *bufio.Reader
+	stderr  bytes.Buffer
+}
+
+func startRemoteProcess(client *goph.Client, command string) (*remoteProcess, error) {
+	logging.LogTracef("Starting command %s on %s", command, client.RemoteAddr())
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	process := &remoteProcess{session: session}
+	if process.stdin, err = session.StdinPipe(); err != nil {
+		session.Close()
+		return nil, err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	process.stdout = bufio.NewReader(stdout)
+	session.Stderr = &process.stderr
+	if err := session.Start("LC_ALL=C; export LC_ALL; " + command); err != nil {
+		session.Close()
+		return nil, err
+	}
+	return process, nil
+}
+
+// Closes standard input and waits for the command to exit
+// Returns error with the message the command printed if it failed
+func (process *remoteProcess) wait() error {
+	process.stdin.Close()
+	err := process.session.Wait()
+	process.session.Close()
+	if err != nil {
+		return remoteCommandError(err, process.stderr.String())
+	}
+	return nil
+}
+
+// Stops the command without waiting for its result
+func (process *remoteProcess) kill() {
+	process.stdin.Close()
+	process.session.Close()
+}
+
+// Reads acknowledgement of the scp protocol: zero byte, or a warning or error followed by the message
+func readSCPAck(reader *bufio.Reader) error {
+	code, err := reader.ReadByte()
+	if err != nil {
+		return err
+	}
+	if code == 0 {
+		return nil
+	}
+	message, _ := reader.ReadString('\n')
+	message = strings.TrimSpace(message)
+	if code == 1 || code == 2 {
+		return remoteCommandError(errors.New(message), message)
+	}
+	return fmt.Errorf("unexpected scp response %q", string(code)+message)
+}
+
+// Receives the file with the scp source protocol, or with tail when reading starts from an offset
+type scpReader struct {
+	fs      scpFileSystem
+	name    string
+	offset  int64
+	process *remoteProcess
+	reader  io.Reader
+	done    bool
+}
+
+func (reader *scpReader) Seek(offset int64, whence int) (int64, error) {
+	if whence == io.SeekCurrent && offset == 0 {
+		return reader.offset, nil
+	}
+	if reader.process != nil {
+		return 0, errors.New("scp stream cannot seek after reading started")
+	}
+	if whence != io.SeekStart || offset < 0 {
+		return 0, errors.New("scp stream supports seeking from the start only")
+	}
+	reader.offset = offset
+	return offset, nil
+}
+
+func (reader *scpReader) Read(p []byte) (int, error) {
+	if reader.done {
+		return 0, io.EOF
+	}
+	if reader.process == nil {
+		if err := reader.start(); err != nil {
+			return 0, &os.PathError{Op: "read", Path: reader.name, Err: err}
+		}
+	}
+	n, err := reader.reader.Read(p)
+	reader.offset += int64(n)
+	if err == io.EOF {
+		reader.done = true
+		if err := reader.finish(); err != nil {
+			return n, &os.PathError{Op: "read", Path: reader.name, Err: err}
+		}
+	}
+	return n, err
+}
+
+func (reader *scpReader) start() error {
+	quotedName := utils.QuoteShellArgument(reader.name)
+	if reader.offset > 0 {
+		process, err := startRemoteProcess(reader.fs.client, fmt.Sprintf("tail -c +%d -- %s", reader.offset+1, quotedName))
+		if err != nil {
+			return err
+		}
+		// Tail does not read its input, closing it lets the server finish the session right after the output
+		process.stdin.Close()
+		reader.process, reader.reader = process, process.stdout
+		return nil
+	}
+
+	process, err := startRemoteProcess(reader.fs.client, "scp -f -- "+quotedName)
+	if err != nil {
+		return err
+	}
+	reader.process = process
+	size, err := receiveSCPHeader(process)
+	if err != nil {
+		process.kill()
+		return err
+	}
+	reader.reader = io.LimitReader(process.stdout, size)
+	return nil
+}
+
+// Starts the transfer and reads the file header in the form "C0644 size name"
+// Returns the size of the file and error if happened
+func receiveSCPHeader(process *remoteProcess) (int64, error) {
+	if _, err := process.stdin.Write([]byte{0}); err != nil {
+		return 0, err
+	}
+	code, err := process.stdout.Peek(1)
+	if err != nil {
+		return 0, err
+	}
+	if code[0] != 'C' {
+		return 0, readSCPAck(process.stdout)
+	}
+	header, err := process.stdout.ReadString('\n')
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.SplitN(strings.TrimSuffix(header, "\n"), " ", 3)
+	if len(fields) != 3 {
+		return 0, fmt.Errorf("unexpected scp header %q", header)
+	}
+	size, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected scp header %q", header)
+	}
+	if _, err := process.stdin.Write([]byte{0}); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// Confirms the received file to the scp source and waits for the command to exit
+func (reader *scpReader) finish() error {
+	if _, isLimited := reader.reader.(*io.LimitedReader); isLimited {
+		if err := readSCPAck(reader.process.stdout); err != nil {
+			reader.process.kill()
+			return err
+		}
+		if _, err := reader.process.stdin.Write([]byte{0}); err != nil {
+			reader.process.kill()
+			return err
+		}
+	}
+	return reader.process.wait()
+}
+
+func (reader *scpReader) Close() error {
+	if reader.process != nil && !reader.done {
+		reader.process.kill()
+	}
+	reader.done = true
+	return nil
+}
+
+// Collects written data in a local spool file and sends it with the scp sink protocol on Close
+type scpWriter struct {
+	fs       scpFileSystem
+	name     string
+	mode     os.FileMode
+	spool    *os.File
+	throttle throttle
+}
+
+func (writer *scpWriter) Write(p []byte) (int, error) {
+	return writer.spool.Write(p)
+}
+
+// Writes to the local spool are not limited, the throttle applies when the content is sent
+func (writer *scpWriter) throttleSending(throttle throttle) bool {
+	writer.throttle = throttle
+	return true
+}
+
+func (writer *scpWriter) Close() error {
+	defer writer.Abort()
+
+	size, err := writer.spool.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := writer.spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := sendSCPFile(writer.fs.client, writer.name, writer.mode, writer.spool, size, writer.throttle); err != nil {
+		return &os.PathError{Op: "write", Path: writer.name, Err: err}
+	}
+	// Scp applies umask of the remote user, permissions are set explicitly to match the SFTP path
+	return writer.fs.Chmod(writer.name, writer.mode)
+}
+
+// Removes the spool file without sending anything
+func (writer *scpWriter) Abort() error {
+	writer.spool.Close()
+	return os.Remove(writer.spool.Name())
+}
+
+// Sends content of the given size to the remote file with the scp sink protocol, keeping the rate within the throttle
+func sendSCPFile(client *goph.Client, name string, mode os.FileMode, content io.Reader, size int64, throttle throttle) error {
+	process, err := startRemoteProcess(client, "scp -t -- "+utils.QuoteShellArgument(name))
+	if err != nil {
+		return err
+	}
+	if err := sendSCPContent(process, name, mode, content, size, throttle); err != nil {
+		process.kill()
+		return err
+	}
+	return process.wait()
+}
+
+func sendSCPContent(process *remoteProcess, name string, mode os.FileMode, content io.Reader, size int64, throttle throttle) error {
+	if err := sendSCPHeader(process, name, mode, size); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(process.stdin, progressReader{content, nil, throttle}, size); err != nil {
+		return err
+	}
+	return finishSCPContent(process)
+}
+
+// Announces the file in the form "C0644 size name", its content follows
+func sendSCPHeader(process *remoteProcess, name string, mode os.FileMode, size int64) error {
+	if err := readSCPAck(process.stdout); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(process.stdin, "C%04o %d %s\n", fileModeToUnix(mode), size, path.Base(name)); err != nil {
+		return err
+	}
+	return readSCPAck(process.stdout)
+}
+
+// Marks the end of the content and waits for the sink to confirm it
+func finishSCPContent(process *remoteProcess) error {
+	if _, err := process.stdin.Write([]byte{0}); err != nil {
+		return err
+	}
+	return readSCPAck(process.stdout)
+}
+
+// Sends written data to the scp sink as it comes, the size is announced in advance
+type scpStreamWriter struct {
+	fs        scpFileSystem
+	name      string
+	mode      os.FileMode
+	process   *remoteProcess
+	remaining int64
+}
+
+func (writer *scpStreamWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > writer.remaining {
+		return 0, &os.PathError{Op: "write", Path: writer.name, Err: errors.New("more data than the announced size")}
+	}
+	n, err := writer.process.stdin.Write(p)
+	writer.remaining -= int64(n)
+	return n, err
+}
+
+func (writer *scpStreamWriter) Close() error {
+	if writer.remaining != 0 {
+		writer.process.kill()
+		return &os.PathError{Op: "write", Path: writer.name, Err: fmt.Errorf("%d bytes of the announced size missing", writer.remaining)}
+	}
+	if err := finishSCPContent(writer.process); err != nil {
+		writer.process.kill()
+		return &os.PathError{Op: "write", Path: writer.name, Err: err}
+	}
+	if err := writer.process.wait(); err != nil {
+		return &os.PathError{Op: "write", Path: writer.name, Err: err}
+	}
+	// Scp applies umask of the remote user, permissions are set explicitly to match the SFTP path
+	return writer.fs.Chmod(writer.name, writer.mode)
+}
+
+// Stops the sink, the remote file may keep the data sent so far
+func (writer *scpStreamWriter) Abort() error {
+	writer.process.kill()
+	return nil
+}
+
+// Appends data to the remote file through cat running on the remote machine
+type scpAppender struct {
+	process *remoteProcess
+	name    string
+}
+
+func (appender *scpAppender) Write(p []byte) (int, error) {
+	return appender.process.stdin.Write(p)
+}
+
+func (appender *scpAppender) Close() error {
+	if err := appender.process.wait(); err != nil {
+		return &os.PathError{Op: "append", Path: appender.name, Err: err}
+	}
+	return nil
+}
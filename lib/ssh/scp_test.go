@@ -0,0 +1,128 @@
+package ssh
+
+import (
+	"bytes"
+	"crypto/rand"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSCPFallback(t *testing.T) {
+	server := newTestServer(t)
+	server.disableSFTP = true
+	client := server.connect(t)
+	directory := t.TempDir()
+
+	data := make([]byte, 3*1024*1024+5)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+
+	// Transfers must fall back to SCP and keep the same behaviour and permissions as over SFTP
+	remotePath := filepath.Join(directory, "remote.bin")
+	written, err := Upload(client, bytes.NewReader(data), remotePath, 0640)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)), written)
+	fileInfo, err := os.Stat(remotePath)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), fileInfo.Mode().Perm(), "Uploaded file must get the requested permissions")
+	fileInfo, err = Stat(client, remotePath)
+	require.NoError(t, err)
+	uid, gid, known := FileOwner(fileInfo)
+	assert.True(t, known, "Owner must be parsed from find output")
+	assert.Equal(t, []int{os.Getuid(), os.Getgid()}, []int{uid, gid})
+
+	var downloaded bytes.Buffer
+	_, err = DownloadWithOptions(client, remotePath, &downloaded, TransferOptions{Verify: true})
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(data, downloaded.Bytes()), "Downloaded data must match the uploaded data")
+
+	// Resumed download continues from the size of the partial file
+	localPath := filepath.Join(directory, "local.bin")
+	require.NoError(t, ioutil.WriteFile(filepath.Join(directory, ".local.bin.partial"), data[:1024*1024], 0600))
+	require.NoError(t, DownloadFileWithOptions(client, remotePath, localPath, TransferOptions{Resume: true}))
+	localData, err := ioutil.ReadFile(localPath)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(data, localData), "Resumed download must match the remote file")
+
+	// Metadata operations must work without SFTP as well
+	_, err = Stat(client, filepath.Join(directory, "missing"))
+	assert.True(t, os.IsNotExist(err), "Stat of a missing file must return not-exist error, got %v", err)
+	binaryFile, err := DownloadBinaryFileToMemory(client, remotePath)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), binaryFile.Mode.Perm())
+
+	source := filepath.Join(directory, "source")
+	target := filepath.Join(directory, "target")
+	modTime := createTestTree(t, source)
+	result, err := UploadDirectory(client, source, target, DirectoryTransferOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, 4, result.Files)
+	assert.Equal(t, 1, result.Symlinks)
+
+	fileInfo, err = os.Stat(filepath.Join(target, "conf", "app.yaml"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), fileInfo.Mode().Perm())
+	assert.True(t, modTime.Equal(fileInfo.ModTime()), "File modification time must be preserved")
+	directoryInfo, err := os.Stat(filepath.Join(target, "conf"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0750), directoryInfo.Mode().Perm())
+	linkTarget, err := os.Readlink(filepath.Join(target, "current.yaml"))
+	require.NoError(t, err)
+	assert.Equal(t, "conf/app.yaml", linkTarget)
+
+	// Explicit SFTP must fail instead of falling back
+	_, err = DownloadWithOptions(client, remotePath, ioutil.Discard, TransferOptions{Protocol: ProtocolSFTP})
+	assert.Error(t, err)
+}
+
+func TestSCPExplicitProtocol(t *testing.T) {
+	client := newTestServer(t).connect(t)
+	source := filepath.Join(t.TempDir(), "source")
+	target := filepath.Join(t.TempDir(), "target")
+	createTestTree(t, source)
+
+	// SCP selected explicitly must produce the same tree as SFTP
+	options := DirectoryTransferOptions{TransferOptions: TransferOptions{Protocol: ProtocolSCP}}
+	result, err := DownloadDirectory(client, source, target, options)
+	require.NoError(t, err)
+	assert.Equal(t, 4, result.Files)
+
+	plan, err := Sync(SyncEndpoint{client, source}, SyncEndpoint{nil, target}, SyncOptions{TransferOptions: options.TransferOptions})
+	require.NoError(t, err)
+	assert.Empty(t, plan.Changes, "Tree downloaded over SCP must be in sync with the source")
+}
+
+func TestSCPUploadWithKnownSize(t *testing.T) {
+	server := newTestServer(t)
+	server.disableSFTP = true
+	client := server.connect(t)
+	directory := t.TempDir()
+
+	data := make([]byte, 2*1024*1024+3)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	localPath := filepath.Join(directory, "local.bin")
+	require.NoError(t, ioutil.WriteFile(localPath, data, 0640))
+
+	// File of known size must be streamed, a missing spool directory proves it is not spooled
+	temporaryDirectory := os.Getenv("TMPDIR")
+	defer os.Setenv("TMPDIR", temporaryDirectory)
+	os.Setenv("TMPDIR", filepath.Join(directory, "missing"))
+
+	remotePath := filepath.Join(directory, "remote.bin")
+	require.NoError(t, UploadFileWithOptions(client, localPath, remotePath, TransferOptions{Verify: true}))
+	remoteData, err := ioutil.ReadFile(remotePath)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(data, remoteData), "Streamed upload must match the local file")
+	fileInfo, err := os.Stat(remotePath)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), fileInfo.Mode().Perm())
+
+	// Stream of unknown size still needs the spool
+	_, err = Upload(client, bytes.NewReader(data), remotePath, 0640)
+	assert.Error(t, err)
+}
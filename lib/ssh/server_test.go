@@ -0,0 +1,173 @@
+package ssh
+
+import (
+	"crypto/rand"
+	"crypto/ed25519"
+	"encoding/binary"
+	"github.com/melbahja/goph"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// In-process SSH server serving the local filesystem over SFTP and running exec requests with sh
+type testServer struct {
+	listener    net.Listener
+	config      *ssh.ServerConfig
+	disableSFTP bool
+	// Delay of the reply to the SFTP subsystem request, simulates a slow host
+	sftpDelay time.Duration
+	// Environment of the commands run by exec requests, e.g. HOME, the environment of the test if empty
+	environment []string
+	waitGroup   sync.WaitGroup
+}
+
+func newTestServer(tb testing.TB) *testServer {
+	return newTestServerAt(tb, "127.0.0.1:0")
+}
+
+// Starts the server listening on the address, the host key is ed25519 as current ssh clients refuse ssh-rsa
+func newTestServerAt(tb testing.TB, address string) *testServer {
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	server := &testServer{listener: listener, config: config}
+	go server.serve()
+	tb.Cleanup(server.close)
+	return server
+}
+
+// Opens a new client connection to the server, closed together with the test
+func (server *testServer) connect(tb testing.TB) *goph.Client {
+	host, portString, _ := net.SplitHostPort(server.listener.Addr().String())
+	port, _ := strconv.Atoi(portString)
+	client, err := goph.NewConn(&goph.Config{
+		User:     "test",
+		Addr:     host,
+		Port:     uint(port),
+		Callback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { SafeCloseClient(client) })
+	return client
+}
+
+func (server *testServer) close() {
+	server.listener.Close()
+	server.waitGroup.Wait()
+}
+
+func (server *testServer) serve() {
+	for {
+		conn, err := server.listener.Accept()
+		if err != nil {
+			return
+		}
+		server.waitGroup.Add(1)
+		go func() {
+			defer server.waitGroup.Done()
+			server.handleConnection(conn)
+		}()
+	}
+}
+
+func (server *testServer) handleConnection(conn net.Conn) {
+	serverConn, channels, requests, err := ssh.NewServerConn(conn, server.config)
+	if err != nil {
+		return
+	}
+	defer serverConn.Close()
+	go ssh.DiscardRequests(requests)
+
+	var waitGroup sync.WaitGroup
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			server.handleSession(channel, channelRequests)
+		}()
+	}
+	waitGroup.Wait()
+}
+
+func (server *testServer) handleSession(channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+	for request := range requests {
+		switch request.Type {
+		case "subsystem":
+			if server.disableSFTP || string(request.Payload[4:]) != "sftp" {
+				request.Reply(false, nil)
+				continue
+			}
+			time.Sleep(server.sftpDelay)
+			request.Reply(true, nil)
+			sftpServer, err := sftp.NewServer(channel)
+			if err != nil {
+				return
+			}
+			sftpServer.Serve()
+			sendExitStatus(channel, 0)
+			return
+		case "exec":
+			request.Reply(true, nil)
+			command := string(request.Payload[4:])
+			cmd := exec.Command("sh", "-c", command)
+			if len(server.environment) > 0 {
+				cmd.Env = append(os.Environ(), server.environment...)
+			}
+			cmd.Stdin = channel
+			cmd.Stdout = channel
+			cmd.Stderr = channel.Stderr()
+			exitStatus := 0
+			if err := cmd.Run(); err != nil {
+				exitStatus = 1
+				if exitErr, ok := err.(*exec.ExitError); ok {
+					exitStatus = exitErr.ExitCode()
+				}
+			}
+			channel.CloseWrite()
+			sendExitStatus(channel, exitStatus)
+			return
+		default:
+			if request.WantReply {
+				request.Reply(request.Type == "env", nil)
+			}
+		}
+	}
+}
+
+func sendExitStatus(channel ssh.Channel, status int) {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(status))
+	channel.SendRequest("exit-status", false, payload)
+}
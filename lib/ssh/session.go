@@ -0,0 +1,110 @@
+package ssh
+
+import (
+	"github.com/hardboiledalex/go-tools/lib/logging"
+	"github.com/melbahja/goph"
+	"github.com/pkg/sftp"
+	"strings"
+	"sync"
+)
+
+// Number of SFTP read or write requests kept in flight per file
+// Together with the packet size it bounds memory used by a single streaming transfer
+const maxConcurrentRequestsPerFile = 64
+
+// SFTP sessions shared by all operations on the same SSH client
+// The map is guarded by the global lock, each session by its own, so a slow handshake with one host
+// does not stall the others
+var sftpSessions = struct {
+	sync.Mutex
+	sessions    map[*goph.Client]*sftpSession
+	unavailable map[*goph.Client]bool
+}{sessions: make(map[*goph.Client]*sftpSession), unavailable: make(map[*goph.Client]bool)}
+
+type sftpSession struct {
+	sync.Mutex
+	client *sftp.Client
+}
+
+// Returns SFTP session bound to the SSH client, the session is opened on the first use
+// The session is safe for concurrent use and must not be closed by the caller,
+// it is closed by SafeCloseClient or ReleaseSFTPSession
+func getSFTPClient(client *goph.Client) (*sftp.Client, error) {
+	sftpSessions.Lock()
+	session, found := sftpSessions.sessions[client]
+	if !found {
+		session = &sftpSession{}
+		sftpSessions.sessions[client] = session
+	}
+	sftpSessions.Unlock()
+
+	session.Lock()
+	defer session.Unlock()
+	if session.client != nil {
+		return session.client, nil
+	}
+
+	sftpClient, err := newSFTPClient(client)
+	if err != nil {
+		return nil, err
+	}
+	session.client = sftpClient
+	logging.LogTracef("Opened SFTP session to %s", client.RemoteAddr())
+
+	// A session broken by the server or the network is forgotten, so the next call opens a new one
+	go func() {
+		err := sftpClient.Wait()
+		session.Lock()
+		defer session.Unlock()
+		if session.client == sftpClient {
+			logging.LogTracef("SFTP session to %s ended: %v", client.RemoteAddr(), err)
+			session.client = nil
+		}
+	}()
+	return sftpClient, nil
+}
+
+// Closes SFTP session bound to the SSH client if there is one
+// Should be called before the SSH client is closed other than by SafeCloseClient
+func ReleaseSFTPSession(client *goph.Client) error {
+	sftpSessions.Lock()
+	session, found := sftpSessions.sessions[client]
+	delete(sftpSessions.sessions, client)
+	delete(sftpSessions.unavailable, client)
+	sftpSessions.Unlock()
+
+	if !found {
+		return nil
+	}
+	session.Lock()
+	sftpClient := session.client
+	session.client = nil
+	session.Unlock()
+	if sftpClient == nil {
+		return nil
+	}
+	return sftpClient.Close()
+}
+
+func newSFTPClient(client *goph.Client) (*sftp.Client, error) {
+	return sftp.NewClient(client.Client, sftp.MaxConcurrentRequestsPerFile(maxConcurrentRequestsPerFile))
+}
+
+// Servers with disabled SFTP subsystem reject the subsystem request, other errors are not a reason to fall back
+func isSubsystemRefused(err error) bool {
+	return strings.Contains(err.Error(), "subsystem request failed")
+}
+
+func isSFTPUnavailable(client *goph.Client) bool {
+	sftpSessions.Lock()
+	defer sftpSessions.Unlock()
+
+	return sftpSessions.unavailable[client]
+}
+
+func markSFTPUnavailable(client *goph.Client) {
+	sftpSessions.Lock()
+	defer sftpSessions.Unlock()
+
+	sftpSessions.unavailable[client] = true
+}
@@ -0,0 +1,109 @@
+package ssh
+
+import (
+	"github.com/melbahja/goph"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSFTPSessionCache(t *testing.T) {
+	client := newTestServer(t).connect(t)
+
+	// The same session must be returned for the same client
+	first, err := getSFTPClient(client)
+	require.NoError(t, err)
+	second, err := getSFTPClient(client)
+	require.NoError(t, err)
+	assert.Same(t, first, second, "SFTP session must be reused for the same client")
+
+	// Concurrent transfers must share the session without errors
+	directory := t.TempDir()
+	var waitGroup sync.WaitGroup
+	errors := make([]error, 8)
+	for i := range errors {
+		waitGroup.Add(1)
+		go func(i int) {
+			defer waitGroup.Done()
+			uploadPath := filepath.Join(directory, string(rune('a'+i)))
+			errors[i] = UploadBinaryFileFromMemory(client, uploadPath, &BinaryFile{Data: []byte(uploadPath), Mode: 0644})
+			if errors[i] == nil {
+				_, errors[i] = DownloadBinaryFileToMemory(client, uploadPath)
+			}
+		}(i)
+	}
+	waitGroup.Wait()
+	for _, err := range errors {
+		assert.NoError(t, err)
+	}
+
+	// Released session must be replaced by a new one on the next use
+	require.NoError(t, ReleaseSFTPSession(client))
+	third, err := getSFTPClient(client)
+	require.NoError(t, err)
+	assert.NotSame(t, first, third, "Released SFTP session must not be reused")
+}
+
+func TestSFTPSessionSlowHostDoesNotBlockOthers(t *testing.T) {
+	slowServer := newTestServer(t)
+	slowServer.sftpDelay = time.Second
+	slowClient := slowServer.connect(t)
+	fastClient := newTestServer(t).connect(t)
+
+	opened := make(chan error, 1)
+	go func() {
+		_, err := getSFTPClient(slowClient)
+		opened <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	started := time.Now()
+	_, err := getSFTPClient(fastClient)
+	require.NoError(t, err)
+	assert.Less(t, int64(time.Since(started)), int64(500*time.Millisecond), "Session of another host must not wait for the slow handshake")
+	assert.NoError(t, <-opened)
+}
+
+func prepareDownloadBenchmark(b *testing.B) (*goph.Client, string) {
+	client := newTestServer(b).connect(b)
+	downloadPath := filepath.Join(b.TempDir(), "known_hosts")
+	if err := ioutil.WriteFile(downloadPath, make([]byte, 4096), 0644); err != nil {
+		b.Fatal(err)
+	}
+	return client, downloadPath
+}
+
+// Small file download with the SFTP session opened and closed on every call, as it was done before caching
+func BenchmarkDownloadNewSessionPerCall(b *testing.B) {
+	client, downloadPath := prepareDownloadBenchmark(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sftpClient, err := newSFTPClient(client)
+		if err != nil {
+			b.Fatal(err)
+		}
+		file, err := sftpClient.Open(downloadPath)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := ioutil.ReadAll(file); err != nil {
+			b.Fatal(err)
+		}
+		file.Close()
+		sftpClient.Close()
+	}
+}
+
+// Small file download through the cached SFTP session
+func BenchmarkDownloadCachedSession(b *testing.B) {
+	client, downloadPath := prepareDownloadBenchmark(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := DownloadBinaryFileToMemory(client, downloadPath); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,434 @@
+package ssh
+
+import (
+	"github.com/hardboiledalex/go-tools/lib/logging"
+	"fmt"
+	"github.com/melbahja/goph"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Directory tree on the local machine (nil Client) or on the remote one
+type SyncEndpoint struct {
+	Client *goph.Client
+	Path   string
+}
+
+func (endpoint SyncEndpoint) String() string {
+	if endpoint.Client == nil {
+		return endpoint.Path
+	}
+	return fmt.Sprintf("%s:%s", endpoint.Client.RemoteAddr(), endpoint.Path)
+}
+
+// Options of the directory synchronisation
+// Files are compared by size and modification time. With Checksum files of equal size are compared
+// by SHA-256 instead of modification time. Delete removes target entries missing in the source,
+// excluded entries are never deleted. DryRun only plans and logs the changes.
+// Include and Exclude have the same meaning as in DirectoryTransferOptions
+type SyncOptions struct {
+	TransferOptions
+	Checksum bool
+	Delete   bool
+	DryRun   bool
+	Include  []string
+	Exclude  []string
+}
+
+type SyncAction int
+
+const (
+	SyncCreateDirectory SyncAction = iota
+	SyncCopy
+	SyncUpdateTimes
+	SyncSymlink
+	SyncDelete
+	SyncChmod
+)
+
+func (action SyncAction) String() string {
+	switch action {
+	case SyncCreateDirectory:
+		return "mkdir"
+	case SyncCopy:
+		return "copy"
+	case SyncUpdateTimes:
+		return "touch"
+	case SyncSymlink:
+		return "link"
+	case SyncDelete:
+		return "delete"
+	case SyncChmod:
+		return "chmod"
+	default:
+		return "unknown"
+	}
+}
+
+// Single change of the target tree, Path is slash-separated and relative to the synchronised directory
+type SyncChange struct {
+	Action SyncAction
+	Path   string
+	Reason string
+	Size   int64
+}
+
+func (change SyncChange) String() string {
+	return fmt.Sprintf("%-6s %s (%s)", change.Action, change.Path, change.Reason)
+}
+
+type SyncPlan struct {
+	Changes []SyncChange
+}
+
+// Total size of the files to be copied
+func (plan *SyncPlan) Bytes() int64 {
+	var total int64
+	for _, change := range plan.Changes {
+		if change.Action == SyncCopy {
+			total += change.Size
+		}
+	}
+	return total
+}
+
+func (plan *SyncPlan) String() string {
+	var result strings.Builder
+	for _, change := range plan.Changes {
+		result.WriteString(change.String())
+		result.WriteString("\n")
+	}
+	return result.String()
+}
+
+// Makes the target tree equal to the source one copying only what changed
+// Returns the plan of changes, in dry-run mode nothing is applied, and error if happened
+func Sync(source SyncEndpoint, target SyncEndpoint, options SyncOptions) (*SyncPlan, error) {
+	if err := validatePatterns(options.Include); err != nil {
+		return nil, err
+	}
+	if err := validatePatterns(options.Exclude); err != nil {
+		return nil, err
+	}
+
+	sourceFileSystem, err := openFileSystemWithProtocol(source.Client, options.Protocol)
+	if err != nil {
+		return nil, err
+	}
+	defer sourceFileSystem.Close()
+
+	targetFileSystem, err := openFileSystemWithProtocol(target.Client, options.Protocol)
+	if err != nil {
+		return nil, err
+	}
+	defer targetFileSystem.Close()
+
+	synchroniser := &synchroniser{
+		source:     sourceFileSystem,
+		sourceRoot: source.Path,
+		target:     targetFileSystem,
+		targetRoot: target.Path,
+		options:    options,
+	}
+
+	plan, err := synchroniser.plan()
+	if err != nil {
+		return nil, err
+	}
+
+	logging.LogInfof("Synchronising %s to %s: %d changes, %d bytes to copy", source, target, len(plan.Changes), plan.Bytes())
+	if options.DryRun {
+		for _, change := range plan.Changes {
+			logging.LogInfo(change.String())
+		}
+		return plan, nil
+	}
+	return plan, synchroniser.apply(plan)
+}
+
+type synchroniser struct {
+	source      fileSystem
+	sourceRoot  string
+	target      fileSystem
+	targetRoot  string
+	options     SyncOptions
+	sourceFiles map[string]os.FileInfo
+	targetFiles map[string]os.FileInfo
+}
+
+// Lists the tree by slash-separated relative paths, excluded entries are left out
+func (synchroniser *synchroniser) list(fs fileSystem, root string) (map[string]os.FileInfo, error) {
+	entries := make(map[string]os.FileInfo)
+	err := walkFileSystem(fs, root, func(entryPath string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			if entryPath == root && os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		relativePath, err := relativeSlashPath(root, entryPath)
+		if err != nil {
+			return err
+		}
+		if relativePath != "." && matchesAnyPattern(synchroniser.options.Exclude, relativePath) {
+			if fileInfo.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		entries[relativePath] = fileInfo
+		return nil
+	})
+	return entries, err
+}
+
+func (synchroniser *synchroniser) plan() (*SyncPlan, error) {
+	sourceFiles, err := synchroniser.list(synchroniser.source, synchroniser.sourceRoot)
+	if err != nil {
+		return nil, err
+	}
+	if root, found := sourceFiles["."]; !found || !root.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", synchroniser.sourceRoot)
+	}
+	targetFiles, err := synchroniser.list(synchroniser.target, synchroniser.targetRoot)
+	if err != nil {
+		return nil, err
+	}
+	synchroniser.sourceFiles = sourceFiles
+	synchroniser.targetFiles = targetFiles
+
+	plan := &SyncPlan{}
+	deleted := make(map[string]bool)
+	for _, relativePath := range sortedKeys(sourceFiles) {
+		sourceInfo := sourceFiles[relativePath]
+		if !sourceInfo.IsDir() && !isSyncIncluded(synchroniser.options.Include, relativePath) {
+			continue
+		}
+		targetInfo, exists := targetFiles[relativePath]
+		if exists && fileType(sourceInfo) != fileType(targetInfo) {
+			plan.Changes = append(plan.Changes, SyncChange{SyncDelete, relativePath, "type changed", 0})
+			deleted[relativePath] = true
+			exists = false
+		}
+
+		change, err := synchroniser.compare(relativePath, sourceInfo, targetInfo, exists)
+		if err != nil {
+			return nil, err
+		}
+		if change != nil {
+			plan.Changes = append(plan.Changes, *change)
+		}
+	}
+
+	if synchroniser.options.Delete {
+		for _, relativePath := range sortedKeys(targetFiles) {
+			if _, found := sourceFiles[relativePath]; found || isUnderDeleted(deleted, relativePath) {
+				continue
+			}
+			plan.Changes = append(plan.Changes, SyncChange{SyncDelete, relativePath, "missing in source", 0})
+			deleted[relativePath] = true
+		}
+	}
+	return plan, nil
+}
+
+func (synchroniser *synchroniser) compare(relativePath string, sourceInfo os.FileInfo, targetInfo os.FileInfo, exists bool) (*SyncChange, error) {
+	switch {
+	case sourceInfo.IsDir():
+		if !exists {
+			return &SyncChange{SyncCreateDirectory, relativePath, "new", 0}, nil
+		}
+		if sourceInfo.Mode().Perm() != targetInfo.Mode().Perm() {
+			return &SyncChange{SyncChmod, relativePath, "mode changed", 0}, nil
+		}
+		return nil, nil
+	case sourceInfo.Mode()&os.ModeSymlink != 0:
+		sourceLink, err := synchroniser.source.Readlink(synchroniser.sourcePath(relativePath))
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			return &SyncChange{SyncSymlink, relativePath, "new", 0}, nil
+		}
+		targetLink, err := synchroniser.target.Readlink(synchroniser.targetPath(relativePath))
+		if err != nil {
+			return nil, err
+		}
+		if sourceLink != targetLink {
+			return &SyncChange{SyncSymlink, relativePath, "link target changed", 0}, nil
+		}
+		return nil, nil
+	case !sourceInfo.Mode().IsRegular():
+		logging.LogWarnf("Skipping %s: not a regular file", relativePath)
+		return nil, nil
+	}
+
+	size := sourceInfo.Size()
+	if !exists {
+		return &SyncChange{SyncCopy, relativePath, "new", size}, nil
+	}
+	if sourceInfo.Size() != targetInfo.Size() {
+		return &SyncChange{SyncCopy, relativePath, "size changed", size}, nil
+	}
+	// SFTP keeps modification time with one second precision
+	timesEqual := sourceInfo.ModTime().Unix() == targetInfo.ModTime().Unix()
+	modeEqual := sourceInfo.Mode().Perm() == targetInfo.Mode().Perm()
+	if !synchroniser.options.Checksum {
+		if !timesEqual {
+			return &SyncChange{SyncCopy, relativePath, "modification time changed", size}, nil
+		}
+		if !modeEqual {
+			return &SyncChange{SyncChmod, relativePath, "mode changed", 0}, nil
+		}
+		return nil, nil
+	}
+
+	sourceChecksum, err := synchroniser.source.Checksum(synchroniser.sourcePath(relativePath))
+	if err != nil {
+		return nil, err
+	}
+	targetChecksum, err := synchroniser.target.Checksum(synchroniser.targetPath(relativePath))
+	if err != nil {
+		return nil, err
+	}
+	if sourceChecksum != targetChecksum {
+		return &SyncChange{SyncCopy, relativePath, "content changed", size}, nil
+	}
+	if !modeEqual {
+		return &SyncChange{SyncChmod, relativePath, "mode changed", 0}, nil
+	}
+	if !timesEqual {
+		return &SyncChange{SyncUpdateTimes, relativePath, "modification time changed", 0}, nil
+	}
+	return nil, nil
+}
+
+func (synchroniser *synchroniser) apply(plan *SyncPlan) error {
+	// Deletions go first, so an entry which changed its type can be created again
+	changes := append([]SyncChange{}, plan.Changes...)
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].Action == SyncDelete && changes[j].Action != SyncDelete
+	})
+
+	// Read-only target directories are made writable for the changes inside, the final pass applies their mode again
+	writable := make(map[string]bool)
+	for _, change := range changes {
+		parent := path.Dir(change.Path)
+		targetInfo, found := synchroniser.targetFiles[parent]
+		if change.Path == "." || !found || !targetInfo.IsDir() || targetInfo.Mode().Perm()&0200 != 0 || writable[parent] {
+			continue
+		}
+		if _, found := synchroniser.sourceFiles[parent]; !found {
+			continue
+		}
+		if err := synchroniser.target.Chmod(synchroniser.targetPath(parent), targetInfo.Mode().Perm()|0700); err != nil {
+			return err
+		}
+		writable[parent] = true
+	}
+
+	for _, change := range changes {
+		logging.LogDebug(change.String())
+		if err := synchroniser.applyChange(change); err != nil {
+			return fmt.Errorf("cannot %s %s: %v", change.Action, change.Path, err)
+		}
+	}
+
+	// Directory times change while entries are created inside and a read-only mode would prevent creating them,
+	// so both are applied at the end, to nested directories before their parents
+	paths := sortedKeys(synchroniser.sourceFiles)
+	for i := len(paths) - 1; i >= 0; i-- {
+		sourceInfo := synchroniser.sourceFiles[paths[i]]
+		if sourceInfo.IsDir() {
+			targetPath := synchroniser.targetPath(paths[i])
+			if err := synchroniser.target.Chmod(targetPath, sourceInfo.Mode().Perm()); err != nil {
+				return err
+			}
+			if err := synchroniser.target.Chtimes(targetPath, sourceInfo.ModTime(), sourceInfo.ModTime()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (synchroniser *synchroniser) applyChange(change SyncChange) error {
+	sourcePath := synchroniser.sourcePath(change.Path)
+	targetPath := synchroniser.targetPath(change.Path)
+	sourceInfo := synchroniser.sourceFiles[change.Path]
+
+	switch change.Action {
+	case SyncDelete:
+		return removeAll(synchroniser.target, targetPath)
+	case SyncCreateDirectory:
+		// Mode and times of directories are applied after their content
+		return synchroniser.target.MkdirAll(targetPath, 0700)
+	case SyncSymlink:
+		linkTarget, err := synchroniser.source.Readlink(sourcePath)
+		if err != nil {
+			return err
+		}
+		if err := removeAll(synchroniser.target, targetPath); err != nil {
+			return err
+		}
+		// Times of the link itself cannot be set over SFTP, so they are left as is
+		return synchroniser.target.Symlink(linkTarget, targetPath)
+	case SyncChmod:
+		if sourceInfo.IsDir() {
+			return nil
+		}
+		if err := synchroniser.target.Chmod(targetPath, sourceInfo.Mode().Perm()); err != nil {
+			return err
+		}
+	case SyncCopy:
+		if _, err := transferFile(synchroniser.source, sourcePath, synchroniser.target, targetPath, synchroniser.options.TransferOptions); err != nil {
+			return err
+		}
+	}
+	return synchroniser.target.Chtimes(targetPath, sourceInfo.ModTime(), sourceInfo.ModTime())
+}
+
+func (synchroniser *synchroniser) sourcePath(relativePath string) string {
+	return synchroniser.source.Join(synchroniser.sourceRoot, relativePath)
+}
+
+func (synchroniser *synchroniser) targetPath(relativePath string) string {
+	return synchroniser.target.Join(synchroniser.targetRoot, relativePath)
+}
+
+func isSyncIncluded(include []string, relativePath string) bool {
+	return len(include) == 0 || matchesAnyPattern(include, relativePath)
+}
+
+func isUnderDeleted(deleted map[string]bool, relativePath string) bool {
+	for parent := path.Dir(relativePath); parent != "." && parent != "/"; parent = path.Dir(parent) {
+		if deleted[parent] {
+			return true
+		}
+	}
+	return false
+}
+
+func fileType(fileInfo os.FileInfo) os.FileMode {
+	return fileInfo.Mode() & os.ModeType
+}
+
+func relativeSlashPath(root string, entryPath string) (string, error) {
+	relativePath, err := filepath.Rel(filepath.FromSlash(root), filepath.FromSlash(entryPath))
+	if err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(relativePath), nil
+}
+
+func sortedKeys(files map[string]os.FileInfo) []string {
+	keys := make([]string, 0, len(files))
+	for key := range files {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
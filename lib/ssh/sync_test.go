@@ -0,0 +1,102 @@
+package ssh
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSync(t *testing.T) {
+	client := newTestServer(t).connect(t)
+	source := filepath.Join(t.TempDir(), "source")
+	target := filepath.Join(t.TempDir(), "target")
+	createTestTree(t, source)
+	sourceEndpoint := SyncEndpoint{Path: source}
+	targetEndpoint := SyncEndpoint{Client: client, Path: target}
+
+	// Dry run must plan the changes without touching the target
+	plan, err := Sync(sourceEndpoint, targetEndpoint, SyncOptions{DryRun: true, Exclude: []string{"*.tmp"}})
+	require.NoError(t, err)
+	assert.NotEmpty(t, plan.Changes)
+	assert.NoDirExists(t, target)
+
+	plan, err = Sync(sourceEndpoint, targetEndpoint, SyncOptions{Exclude: []string{"*.tmp"}})
+	require.NoError(t, err)
+	assert.FileExists(t, filepath.Join(target, "conf", "nested", "extra.yaml"))
+	assert.NoFileExists(t, filepath.Join(target, "conf", "app.tmp"))
+
+	// Nothing must be copied when trees are equal
+	plan, err = Sync(sourceEndpoint, targetEndpoint, SyncOptions{Exclude: []string{"*.tmp"}})
+	require.NoError(t, err)
+	assert.Empty(t, plan.Changes, "Synchronised trees must not have changes, got:\n%s", plan)
+
+	// Only changed file is copied, extra target files are deleted but excluded ones are kept
+	later := time.Now().Add(time.Hour)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(source, "logs", "app.log"), []byte("new log line\n"), 0644))
+	require.NoError(t, os.Chtimes(filepath.Join(source, "logs", "app.log"), later, later))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(target, "obsolete.yaml"), []byte("old"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(target, "keep.tmp"), []byte("keep"), 0644))
+	plan, err = Sync(sourceEndpoint, targetEndpoint, SyncOptions{Delete: true, Checksum: true, Exclude: []string{"*.tmp"}})
+	require.NoError(t, err)
+	assert.Equal(t, []SyncChange{
+		{SyncCopy, "logs/app.log", "size changed", 13},
+		{SyncDelete, "obsolete.yaml", "missing in source", 0},
+	}, plan.Changes)
+	assert.NoFileExists(t, filepath.Join(target, "obsolete.yaml"))
+	assert.FileExists(t, filepath.Join(target, "keep.tmp"))
+	data, err := ioutil.ReadFile(filepath.Join(target, "logs", "app.log"))
+	require.NoError(t, err)
+	assert.Equal(t, "new log line\n", string(data))
+
+	// Changed mode alone is synchronised too, for directories after their content
+	require.NoError(t, os.Chmod(filepath.Join(source, "logs", "app.log"), 0640))
+	require.NoError(t, os.Chmod(filepath.Join(source, "conf", "nested"), 0700))
+	plan, err = Sync(sourceEndpoint, targetEndpoint, SyncOptions{Exclude: []string{"*.tmp"}})
+	require.NoError(t, err)
+	assert.Equal(t, []SyncChange{
+		{SyncChmod, "conf/nested", "mode changed", 0},
+		{SyncChmod, "logs/app.log", "mode changed", 0},
+	}, plan.Changes)
+	for name, mode := range map[string]os.FileMode{"logs/app.log": 0640, "conf/nested": 0700} {
+		fileInfo, err := os.Stat(filepath.Join(target, name))
+		require.NoError(t, err)
+		assert.Equal(t, mode, fileInfo.Mode().Perm(), name)
+	}
+}
+
+func TestSyncReadOnlyDirectory(t *testing.T) {
+	if os.Getuid() == 0 {
+		t.Skip("read-only directories are writable for root")
+	}
+	client := newTestServer(t).connect(t)
+	source := filepath.Join(t.TempDir(), "source")
+	target := filepath.Join(t.TempDir(), "target")
+	createTestTree(t, source)
+	require.NoError(t, os.Chmod(filepath.Join(source, "conf"), 0555))
+	defer os.Chmod(filepath.Join(source, "conf"), 0755)
+	defer os.Chmod(filepath.Join(target, "conf"), 0755)
+	sourceEndpoint := SyncEndpoint{Path: source}
+	targetEndpoint := SyncEndpoint{Client: client, Path: target}
+
+	_, err := Sync(sourceEndpoint, targetEndpoint, SyncOptions{})
+	require.NoError(t, err)
+	assert.FileExists(t, filepath.Join(target, "conf", "nested", "extra.yaml"))
+	directoryInfo, err := os.Stat(filepath.Join(target, "conf"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0555), directoryInfo.Mode().Perm(), "Read-only mode must be applied after the content")
+
+	// Changes inside the read-only directory of an earlier sync must be applied as well
+	require.NoError(t, os.Chmod(filepath.Join(source, "conf"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(source, "conf", "new.yaml"), []byte("new"), 0644))
+	require.NoError(t, os.Chmod(filepath.Join(source, "conf"), 0555))
+	_, err = Sync(sourceEndpoint, targetEndpoint, SyncOptions{})
+	require.NoError(t, err)
+	assert.FileExists(t, filepath.Join(target, "conf", "new.yaml"))
+	directoryInfo, err = os.Stat(filepath.Join(target, "conf"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0555), directoryInfo.Mode().Perm())
+}
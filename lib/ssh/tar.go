@@ -0,0 +1,515 @@
+package ssh
+
+import (
+	"github.com/hardboiledalex/go-tools/lib/utils"
+	"github.com/hardboiledalex/go-tools/lib/logging"
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"github.com/melbahja/goph"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+type ArchiveCompression int
+
+const (
+	CompressionGzip ArchiveCompression = iota
+	CompressionNone
+)
+
+// Options of the directory streaming as tar archive
+// Exclude has the same meaning as in DirectoryTransferOptions and applies when the directory is packed.
+// Progress reports the bytes of the archive stream, its total size is not known in advance.
+// RateLimiter limits the bandwidth of the archive stream on top of the global limit, local packing is not limited.
+// Files limits packing to the listed slash-separated paths relative to the directory, "." being the directory itself.
+// Listed directories are packed without their content and Exclude does not apply
+type TarOptions struct {
+	Compression ArchiveCompression
+	Exclude     []string
+	Files       []string
+	Progress    ProgressFunc
+	RateLimiter *RateLimiter
+}
+
+// Downloads the directory tree as a single tar stream and extracts it into the local directory
+// Many small files go much faster this way than one by one over SFTP. Modes, modification times and
+// symlinks are preserved, numeric ownership is restored when running as root
+// Returns an error if happened
+func DownloadDirectoryTar(client *goph.Client, remoteDirectory string, localDirectory string, options TarOptions) error {
+	localOptions := options
+	localOptions.Progress = nil
+	return pipeDirectory(func(writer io.Writer) error {
+		_, err := PackDirectory(client, remoteDirectory, writer, options)
+		return err
+	}, func(reader io.Reader) error {
+		_, err := UnpackDirectory(nil, reader, localDirectory, localOptions)
+		return err
+	})
+}
+
+// Uploads the local directory tree as a single tar stream extracted on the remote machine
+// Preserves the same attributes as DownloadDirectoryTar, ownership is restored when the remote user is root
+// Returns an error if happened
+func UploadDirectoryTar(client *goph.Client, localDirectory string, remoteDirectory string, options TarOptions) error {
+	localOptions := options
+	localOptions.Progress = nil
+	return pipeDirectory(func(writer io.Writer) error {
+		_, err := PackDirectory(nil, localDirectory, writer, localOptions)
+		return err
+	}, func(reader io.Reader) error {
+		_, err := UnpackDirectory(client, reader, remoteDirectory, options)
+		return err
+	})
+}
+
+// Connects packing and unpacking through a pipe, failure of either side stops the other one
+func pipeDirectory(pack func(writer io.Writer) error, unpack func(reader io.Reader) error) error {
+	pipeReader, pipeWriter := io.Pipe()
+	packResult := make(chan error, 1)
+	go func() {
+		err := pack(pipeWriter)
+		pipeWriter.CloseWithError(err)
+		packResult <- err
+	}()
+
+	unpackErr := unpack(pipeReader)
+	pipeReader.CloseWithError(unpackErr)
+	packErr := <-packResult
+	if packErr != nil {
+		return packErr
+	}
+	return unpackErr
+}
+
+// Writes the directory tree as tar archive to the writer, runs tar on the remote machine or packs locally if client is nil
+// Archive entries are relative to the directory and keep modes, modification times, numeric ownership and symlinks
+// Returns number of bytes written and error if happened
+func PackDirectory(client *goph.Client, directory string, writer io.Writer, options TarOptions) (int64, error) {
+	if err := validatePatterns(options.Exclude); err != nil {
+		return 0, err
+	}
+	if options.Files != nil {
+		files := make([]string, len(options.Files))
+		for i, name := range options.Files {
+			files[i] = path.Clean(name)
+			if path.IsAbs(files[i]) || files[i] == ".." || strings.HasPrefix(files[i], "../") {
+				return 0, fmt.Errorf("path %s is outside of %s", name, directory)
+			}
+		}
+		options.Files = files
+	}
+	tracker := newProgressTracker(options.Progress, filepath.Base(directory)+".tar", 0, -1)
+
+	var written int64
+	var err error
+	if client != nil {
+		written, err = packRemoteDirectory(client, directory, writer, options, tracker)
+	} else {
+		written, err = packLocalDirectory(directory, writer, options, tracker)
+	}
+	if err != nil {
+		return written, err
+	}
+	tracker.finish()
+	logging.LogDebugf("Packed %s into %s archive", directory, utils.BytesToString(int(written)))
+	return written, nil
+}
+
+// Extracts tar archive from the reader into the directory, runs tar on the remote machine or extracts locally if client is nil
+// The directory is created if missing. Ownership is restored only when the extracting user is root
+// Returns number of bytes read and error if happened
+func UnpackDirectory(client *goph.Client, reader io.Reader, directory string, options TarOptions) (int64, error) {
+	tracker := newProgressTracker(options.Progress, filepath.Base(directory)+".tar", 0, -1)
+
+	var read int64
+	var err error
+	if client != nil {
+		read, err = unpackRemoteDirectory(client, reader, directory, options, tracker)
+	} else {
+		read, err = unpackLocalDirectory(reader, directory, options, tracker)
+	}
+	if err != nil {
+		return read, err
+	}
+	tracker.finish()
+	logging.LogDebugf("Extracted %s archive into %s", utils.BytesToString(int(read)), directory)
+	return read, nil
+}
+
+func packRemoteDirectory(client *goph.Client, directory string, writer io.Writer, options TarOptions, tracker *progressTracker) (int64, error) {
+	command := []string{"tar", "-C", utils.QuoteShellArgument(directory), "--numeric-owner"}
+	if options.Compression == CompressionGzip {
+		command = append(command, "-z")
+	}
+	if options.Files != nil {
+		// Names go through the input separated by NUL, so any name is safe and the command line stays short
+		command = append(command, "--no-recursion", "--null", "-T", "-", "-cf", "-")
+	} else {
+		for _, pattern := range options.Exclude {
+			command = append(command, utils.QuoteShellArgument("--exclude="+strings.TrimSuffix(pattern, "/")))
+		}
+		command = append(command, "-cf", "-", ".")
+	}
+
+	process, err := startRemoteProcess(client, strings.Join(command, " "))
+	if err != nil {
+		return 0, err
+	}
+	if options.Files != nil {
+		// Tar reads names while it writes the archive, feeding them concurrently avoids a deadlock on full pipes
+		go func() {
+			for _, name := range options.Files {
+				if name != "." {
+					name = "./" + name
+				}
+				if _, err := io.WriteString(process.stdin, name+"\x00"); err != nil {
+					break
+				}
+			}
+			process.stdin.Close()
+		}()
+	} else {
+		// Tar does not read its input, closing it lets the server finish the session right after the output
+		process.stdin.Close()
+	}
+	written, err := copyWithProgress(writer, process.stdout, tracker, newThrottle(options.RateLimiter))
+	if err != nil {
+		process.kill()
+		return written, err
+	}
+	if err := process.wait(); err != nil {
+		return written, fmt.Errorf("cannot pack %s: %v", directory, err)
+	}
+	return written, nil
+}
+
+func unpackRemoteDirectory(client *goph.Client, reader io.Reader, directory string, options TarOptions, tracker *progressTracker) (int64, error) {
+	quotedDirectory := utils.QuoteShellArgument(directory)
+	command := fmt.Sprintf("mkdir -p -- %s && tar -C %s --numeric-owner -xpf -", quotedDirectory, quotedDirectory)
+	if options.Compression == CompressionGzip {
+		command += " -z"
+	}
+
+	process, err := startRemoteProcess(client, command)
+	if err != nil {
+		return 0, err
+	}
+	read, copyErr := copyWithProgress(process.stdin, reader, tracker, newThrottle(options.RateLimiter))
+	// Failed tar stops reading its input, so its own message explains the failure better than the broken pipe
+	if err := process.wait(); err != nil {
+		return read, fmt.Errorf("cannot extract archive into %s: %v", directory, err)
+	}
+	return read, copyErr
+}
+
+func packLocalDirectory(directory string, writer io.Writer, options TarOptions, tracker *progressTracker) (int64, error) {
+	counter := &countingWriter{writer: progressWriter{writer, tracker, nil}}
+	var archiveWriter io.Writer = counter
+	var gzipWriter *gzip.Writer
+	if options.Compression == CompressionGzip {
+		gzipWriter = gzip.NewWriter(counter)
+		archiveWriter = gzipWriter
+	}
+	tarWriter := tar.NewWriter(archiveWriter)
+
+	var err error
+	if options.Files != nil {
+		err = packLocalFiles(tarWriter, directory, options.Files)
+	} else {
+		err = packLocalTree(tarWriter, directory, options.Exclude)
+	}
+	if err == nil {
+		err = tarWriter.Close()
+	}
+	if err == nil && gzipWriter != nil {
+		err = gzipWriter.Close()
+	}
+	return counter.written, err
+}
+
+func packLocalTree(tarWriter *tar.Writer, directory string, exclude []string) error {
+	return filepath.Walk(directory, func(entryPath string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relativePath, err := relativeSlashPath(directory, entryPath)
+		if err != nil {
+			return err
+		}
+		if relativePath != "." && matchesAnyPattern(exclude, relativePath) {
+			if fileInfo.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		return writeTarEntry(tarWriter, entryPath, relativePath, fileInfo)
+	})
+}
+
+func packLocalFiles(tarWriter *tar.Writer, directory string, files []string) error {
+	for _, relativePath := range files {
+		entryPath := filepath.Join(directory, filepath.FromSlash(relativePath))
+		fileInfo, err := os.Lstat(entryPath)
+		if err != nil {
+			return err
+		}
+		if err := writeTarEntry(tarWriter, entryPath, relativePath, fileInfo); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeTarEntry(tarWriter *tar.Writer, entryPath string, relativePath string, fileInfo os.FileInfo) error {
+	var linkTarget string
+	if fileInfo.Mode()&os.ModeSymlink != 0 {
+		var err error
+		if linkTarget, err = os.Readlink(entryPath); err != nil {
+			return err
+		}
+	} else if !fileInfo.IsDir() && !fileInfo.Mode().IsRegular() {
+		logging.LogWarnf("Skipping %s: not a regular file", entryPath)
+		return nil
+	}
+
+	// Header gets numeric ids from the file, names are dropped to match tar --numeric-owner
+	header, err := tar.FileInfoHeader(fileInfo, linkTarget)
+	if err != nil {
+		return err
+	}
+	header.Uname, header.Gname = "", ""
+	header.Name = "./" + relativePath
+	if relativePath == "." {
+		header.Name = "./"
+	} else if fileInfo.IsDir() {
+		header.Name += "/"
+	}
+	if err := tarWriter.WriteHeader(header); err != nil {
+		return err
+	}
+	if !fileInfo.Mode().IsRegular() {
+		return nil
+	}
+
+	file, err := os.Open(entryPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(tarWriter, file)
+	return err
+}
+
+func unpackLocalDirectory(reader io.Reader, directory string, options TarOptions, tracker *progressTracker) (int64, error) {
+	counter := &countingReader{reader: progressReader{reader, tracker, nil}}
+	var archiveReader io.Reader = counter
+	if options.Compression == CompressionGzip {
+		gzipReader, err := gzip.NewReader(counter)
+		if err != nil {
+			return counter.read, err
+		}
+		defer gzipReader.Close()
+		archiveReader = gzipReader
+	}
+
+	extractor := &tarExtractor{root: filepath.Clean(directory), restoreOwner: os.Geteuid() == 0}
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return counter.read, err
+	}
+	tarReader := tar.NewReader(archiveReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return counter.read, err
+		}
+		if err := extractor.extract(header, tarReader); err != nil {
+			return counter.read, err
+		}
+	}
+	// Remainder of the stream, like the gzip trailer, is consumed, so the writing side is not blocked
+	if _, err := io.Copy(ioutil.Discard, archiveReader); err != nil {
+		return counter.read, err
+	}
+	return counter.read, extractor.finish()
+}
+
+// Extracts tar entries into the root directory
+// Directory modes and times are applied at the end, so read-only directories can still be filled
+type tarExtractor struct {
+	root         string
+	restoreOwner bool
+	directories  []*tar.Header
+}
+
+func (extractor *tarExtractor) extract(header *tar.Header, reader io.Reader) error {
+	targetPath, err := extractor.targetPath(header.Name)
+	if err != nil {
+		return err
+	}
+	if err := extractor.checkParents(targetPath); err != nil {
+		return err
+	}
+	if targetPath != extractor.root {
+		if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
+			return err
+		}
+	}
+	mode := header.FileInfo().Mode()
+
+	switch header.Typeflag {
+	case tar.TypeDir:
+		if err := os.MkdirAll(targetPath, 0700); err != nil {
+			return err
+		}
+		extractor.directories = append(extractor.directories, header)
+		return nil
+	case tar.TypeReg, tar.TypeRegA:
+		if err := removeExisting(targetPath); err != nil {
+			return err
+		}
+		file, err := os.OpenFile(targetPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode.Perm())
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(file, reader); err != nil {
+			file.Close()
+			return err
+		}
+		if err := file.Close(); err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if err := removeExisting(targetPath); err != nil {
+			return err
+		}
+		if err := os.Symlink(header.Linkname, targetPath); err != nil {
+			return err
+		}
+		return extractor.chown(targetPath, header)
+	case tar.TypeLink:
+		linkPath, err := extractor.targetPath(header.Linkname)
+		if err != nil {
+			return err
+		}
+		if err := removeExisting(targetPath); err != nil {
+			return err
+		}
+		return os.Link(linkPath, targetPath)
+	default:
+		logging.LogWarnf("Skipping %s: unsupported entry type %c", header.Name, header.Typeflag)
+		return nil
+	}
+
+	if err := extractor.chown(targetPath, header); err != nil {
+		return err
+	}
+	// Chmod after chown, since changing the owner clears setuid and setgid bits
+	if err := os.Chmod(targetPath, mode&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+		return err
+	}
+	return os.Chtimes(targetPath, header.ModTime, header.ModTime)
+}
+
+func (extractor *tarExtractor) finish() error {
+	// Deepest directories go first, so setting times of a parent is not undone by its children
+	sort.SliceStable(extractor.directories, func(i, j int) bool {
+		return len(extractor.directories[i].Name) > len(extractor.directories[j].Name)
+	})
+	for _, header := range extractor.directories {
+		targetPath, err := extractor.targetPath(header.Name)
+		if err != nil {
+			return err
+		}
+		if err := extractor.chown(targetPath, header); err != nil {
+			return err
+		}
+		mode := header.FileInfo().Mode()
+		if err := os.Chmod(targetPath, mode&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+			return err
+		}
+		if err := os.Chtimes(targetPath, header.ModTime, header.ModTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (extractor *tarExtractor) chown(targetPath string, header *tar.Header) error {
+	if !extractor.restoreOwner {
+		return nil
+	}
+	return os.Lchown(targetPath, header.Uid, header.Gid)
+}
+
+// Resolves entry name inside the root, names escaping the root are rejected
+func (extractor *tarExtractor) targetPath(name string) (string, error) {
+	relativePath := filepath.Clean(filepath.FromSlash(name))
+	if filepath.IsAbs(relativePath) || relativePath == ".." || strings.HasPrefix(relativePath, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("archive entry %s points outside of %s", name, extractor.root)
+	}
+	return filepath.Join(extractor.root, relativePath), nil
+}
+
+// Refuses to write through a symlink extracted earlier, which could point outside of the root
+func (extractor *tarExtractor) checkParents(targetPath string) error {
+	for parent := filepath.Dir(targetPath); len(parent) > len(extractor.root); parent = filepath.Dir(parent) {
+		fileInfo, err := os.Lstat(parent)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		if fileInfo.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("archive entry %s is placed under symlink %s", targetPath, parent)
+		}
+	}
+	return nil
+}
+
+// Removes existing non-directory entry, so it can be replaced by the extracted one
+func removeExisting(name string) error {
+	fileInfo, err := os.Lstat(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if fileInfo.IsDir() {
+		return fmt.Errorf("cannot replace directory %s", name)
+	}
+	return os.Remove(name)
+}
+
+type countingWriter struct {
+	writer  io.Writer
+	written int64
+}
+
+func (counter *countingWriter) Write(p []byte) (int, error) {
+	n, err := counter.writer.Write(p)
+	counter.written += int64(n)
+	return n, err
+}
+
+type countingReader struct {
+	reader io.Reader
+	read   int64
+}
+
+func (counter *countingReader) Read(p []byte) (int, error) {
+	n, err := counter.reader.Read(p)
+	counter.read += int64(n)
+	return n, err
+}
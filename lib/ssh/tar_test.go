@@ -0,0 +1,128 @@
+package ssh
+
+import (
+	"archive/tar"
+	"bytes"
+	"github.com/melbahja/goph"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestDirectoryTarRoundTrip(t *testing.T) {
+	client := newTestServer(t).connect(t)
+	source := filepath.Join(t.TempDir(), "source")
+	remote := filepath.Join(t.TempDir(), "remote")
+	target := filepath.Join(t.TempDir(), "target")
+	modTime := createTestTree(t, source)
+	require.NoError(t, os.Chmod(filepath.Join(source, "logs"), 0500))
+	defer os.Chmod(filepath.Join(source, "logs"), 0755)
+	if os.Geteuid() == 0 {
+		require.NoError(t, os.Lchown(filepath.Join(source, "conf", "app.yaml"), 1234, 5678))
+	}
+
+	require.NoError(t, UploadDirectoryTar(client, source, remote, TarOptions{Exclude: []string{"*.tmp"}}))
+	require.NoError(t, DownloadDirectoryTar(client, remote, target, TarOptions{}))
+	defer os.Chmod(filepath.Join(remote, "logs"), 0755)
+	defer os.Chmod(filepath.Join(target, "logs"), 0755)
+
+	// Modes, times and symlinks must survive upload and download
+	fileInfo, err := os.Stat(filepath.Join(target, "conf", "app.yaml"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), fileInfo.Mode().Perm())
+	assert.True(t, modTime.Equal(fileInfo.ModTime()), "File modification time must be preserved")
+	if os.Geteuid() == 0 {
+		stat := fileInfo.Sys().(*syscall.Stat_t)
+		assert.Equal(t, uint32(1234), stat.Uid, "Ownership must be restored when running as root")
+		assert.Equal(t, uint32(5678), stat.Gid)
+	}
+
+	directoryInfo, err := os.Stat(filepath.Join(target, "conf"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0750), directoryInfo.Mode().Perm())
+	assert.True(t, modTime.Equal(directoryInfo.ModTime()), "Directory modification time must be preserved")
+	directoryInfo, err = os.Stat(filepath.Join(target, "logs"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0500), directoryInfo.Mode().Perm(), "Read-only directory must keep its mode after it was filled")
+	assert.FileExists(t, filepath.Join(target, "logs", "app.log"))
+
+	linkTarget, err := os.Readlink(filepath.Join(target, "current.yaml"))
+	require.NoError(t, err)
+	assert.Equal(t, "conf/app.yaml", linkTarget)
+	assert.NoFileExists(t, filepath.Join(target, "conf", "app.tmp"), "Excluded file must not be packed")
+}
+
+func TestUnpackDirectoryUncompressed(t *testing.T) {
+	client := newTestServer(t).connect(t)
+	source := filepath.Join(t.TempDir(), "source")
+	remote := filepath.Join(t.TempDir(), "remote")
+	createTestTree(t, source)
+
+	// Archive packed locally can be kept and extracted later on the remote machine
+	var archive bytes.Buffer
+	written, err := PackDirectory(nil, source, &archive, TarOptions{Compression: CompressionNone})
+	require.NoError(t, err)
+	assert.Equal(t, int64(archive.Len()), written)
+
+	read, err := UnpackDirectory(client, &archive, remote, TarOptions{Compression: CompressionNone})
+	require.NoError(t, err)
+	assert.Equal(t, written, read)
+	assert.FileExists(t, filepath.Join(remote, "conf", "nested", "extra.yaml"))
+}
+
+func TestPackDirectoryFiles(t *testing.T) {
+	client := newTestServer(t).connect(t)
+	source := filepath.Join(t.TempDir(), "source")
+	createTestTree(t, source)
+
+	// Only the listed entries are packed, a listed directory without its content
+	for name, packClient := range map[string]*goph.Client{"remote": client, "local": nil} {
+		var archive bytes.Buffer
+		_, err := PackDirectory(packClient, source, &archive, TarOptions{Compression: CompressionNone, Files: []string{".", "conf", "conf/app.tmp", "./current.yaml"}})
+		require.NoError(t, err, name)
+
+		var names []string
+		tarReader := tar.NewReader(&archive)
+		for {
+			header, err := tarReader.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err, name)
+			names = append(names, strings.TrimSuffix(strings.TrimPrefix(header.Name, "./"), "/"))
+		}
+		assert.Equal(t, []string{"", "conf", "conf/app.tmp", "current.yaml"}, names, name)
+	}
+
+	_, err := PackDirectory(nil, source, ioutil.Discard, TarOptions{Files: []string{"conf/../../escaped"}})
+	assert.Error(t, err, "Listed path outside of the directory must be rejected")
+}
+
+func TestUnpackDirectoryRejectsUnsafePaths(t *testing.T) {
+	for name, entries := range map[string][]tar.Header{
+		"parent directory": {{Name: "../escaped", Typeflag: tar.TypeReg, Mode: 0644}},
+		"through symlink": {
+			{Name: "link", Typeflag: tar.TypeSymlink, Linkname: os.TempDir()},
+			{Name: "link/escaped", Typeflag: tar.TypeReg, Mode: 0644},
+		},
+	} {
+		var archive bytes.Buffer
+		tarWriter := tar.NewWriter(&archive)
+		for i := range entries {
+			require.NoError(t, tarWriter.WriteHeader(&entries[i]))
+		}
+		require.NoError(t, tarWriter.Close())
+
+		directory := filepath.Join(t.TempDir(), "target")
+		_, err := UnpackDirectory(nil, &archive, directory, TarOptions{Compression: CompressionNone})
+		assert.Error(t, err, "Entry escaping the target directory must be rejected: %s", name)
+		assert.NoFileExists(t, filepath.Join(filepath.Dir(directory), "escaped"))
+		assert.NoFileExists(t, filepath.Join(os.TempDir(), "escaped"))
+	}
+}
@@ -0,0 +1,193 @@
+package ssh
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/melbahja/goph"
+	"strings"
+	"unicode/utf16"
+)
+
+type TextEncoding string
+
+const (
+	UTF8    TextEncoding = "UTF-8"
+	UTF16LE TextEncoding = "UTF-16LE"
+	UTF16BE TextEncoding = "UTF-16BE"
+)
+
+const (
+	LF   = "\n"
+	CRLF = "\r\n"
+)
+
+var (
+	utf8BOM    = []byte{0xef, 0xbb, 0xbf}
+	utf16LEBOM = []byte{0xff, 0xfe}
+	utf16BEBOM = []byte{0xfe, 0xff}
+)
+
+// Reads text file from the remote machine, or from the local one if client is nil
+// Returns an error if happened, os.IsNotExist tells a missing file apart from other failures
+func ReadTextFile(client *goph.Client, filePath string) (*TextFile, error) {
+	binaryFile, err := DownloadBinaryFileToMemory(client, filePath)
+	if err != nil {
+		return nil, pathError("open", filePath, err)
+	}
+	textFile, err := ParseTextFile(binaryFile.Data)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode %s: %v", filePath, err)
+	}
+	textFile.Mode = binaryFile.Mode
+	return textFile, nil
+}
+
+// Writes text file to the remote machine atomically, or to the local one if client is nil
+// Returns an error if happened
+func WriteTextFile(client *goph.Client, filePath string, textFile *TextFile) error {
+	data, err := textFile.Bytes()
+	if err != nil {
+		return err
+	}
+	return UploadBinaryFileFromMemory(client, filePath, &BinaryFile{Data: data, Mode: textFile.Mode})
+}
+
+// Decodes text detecting BOM, encoding, line ending and trailing newline
+// UTF-16 is recognised by its BOM only, everything else is treated as UTF-8
+func ParseTextFile(data []byte) (*TextFile, error) {
+	textFile := &TextFile{Encoding: UTF8, LineEnding: LF}
+	content := data
+	switch {
+	case bytes.HasPrefix(data, utf8BOM):
+		textFile.BOM = true
+		content = data[len(utf8BOM):]
+	case bytes.HasPrefix(data, utf16LEBOM):
+		textFile.BOM, textFile.Encoding = true, UTF16LE
+		content = data[len(utf16LEBOM):]
+	case bytes.HasPrefix(data, utf16BEBOM):
+		textFile.BOM, textFile.Encoding = true, UTF16BE
+		content = data[len(utf16BEBOM):]
+	}
+
+	text, err := decodeText(content, textFile.Encoding)
+	if err != nil {
+		return nil, err
+	}
+
+	crlfCount := strings.Count(text, CRLF)
+	if crlfCount > 0 && crlfCount >= strings.Count(text, LF)-crlfCount {
+		textFile.LineEnding = CRLF
+	}
+	if strings.HasSuffix(text, textFile.LineEnding) {
+		textFile.TrailingNewline = true
+		text = strings.TrimSuffix(text, textFile.LineEnding)
+	} else if strings.HasSuffix(text, LF) {
+		textFile.TrailingNewline = true
+		text = strings.TrimSuffix(text, LF)
+	}
+
+	textFile.Strings = make([]string, 0)
+	if text != "" || textFile.TrailingNewline {
+		textFile.Strings = strings.Split(text, LF)
+		if textFile.LineEnding == CRLF {
+			for i, line := range textFile.Strings {
+				textFile.Strings[i] = strings.TrimSuffix(line, "\r")
+			}
+		}
+	}
+
+	textFile.originalData = data
+	textFile.original = textFile.snapshot()
+	return textFile, nil
+}
+
+// Encodes the file with its encoding, line ending, trailing newline and BOM
+// Returns the original bytes if the file was parsed and nothing changed since then
+func (textFile *TextFile) Bytes() ([]byte, error) {
+	if textFile.original != nil && textFile.isUnchanged() {
+		return textFile.originalData, nil
+	}
+
+	lineEnding := textFile.LineEnding
+	if lineEnding == "" {
+		lineEnding = LF
+	}
+	text := strings.Join(textFile.Strings, lineEnding)
+	if textFile.TrailingNewline {
+		text += lineEnding
+	}
+
+	var result bytes.Buffer
+	switch textFile.Encoding {
+	case UTF8, "":
+		if textFile.BOM {
+			result.Write(utf8BOM)
+		}
+		result.WriteString(text)
+	case UTF16LE, UTF16BE:
+		if textFile.BOM {
+			if textFile.Encoding == UTF16LE {
+				result.Write(utf16LEBOM)
+			} else {
+				result.Write(utf16BEBOM)
+			}
+		}
+		for _, unit := range utf16.Encode([]rune(text)) {
+			if textFile.Encoding == UTF16LE {
+				result.WriteByte(byte(unit))
+				result.WriteByte(byte(unit >> 8))
+			} else {
+				result.WriteByte(byte(unit >> 8))
+				result.WriteByte(byte(unit))
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported text encoding %s", textFile.Encoding)
+	}
+	return result.Bytes(), nil
+}
+
+func (textFile *TextFile) snapshot() *TextFile {
+	return &TextFile{
+		Strings:         append([]string{}, textFile.Strings...),
+		Encoding:        textFile.Encoding,
+		LineEnding:      textFile.LineEnding,
+		TrailingNewline: textFile.TrailingNewline,
+		BOM:             textFile.BOM,
+	}
+}
+
+func (textFile *TextFile) isUnchanged() bool {
+	original := textFile.original
+	if original.Encoding != textFile.Encoding || original.LineEnding != textFile.LineEnding ||
+		original.TrailingNewline != textFile.TrailingNewline || original.BOM != textFile.BOM ||
+		len(original.Strings) != len(textFile.Strings) {
+		return false
+	}
+	for i, line := range textFile.Strings {
+		if line != original.Strings[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func decodeText(content []byte, encoding TextEncoding) (string, error) {
+	if encoding == UTF8 {
+		// Invalid UTF-8 is kept as is, Go strings may hold arbitrary bytes
+		return string(content), nil
+	}
+
+	if len(content)%2 != 0 {
+		return "", fmt.Errorf("odd number of bytes in %s text", encoding)
+	}
+	units := make([]uint16, len(content)/2)
+	for i := range units {
+		if encoding == UTF16LE {
+			units[i] = uint16(content[2*i]) | uint16(content[2*i+1])<<8
+		} else {
+			units[i] = uint16(content[2*i])<<8 | uint16(content[2*i+1])
+		}
+	}
+	return string(utf16.Decode(units)), nil
+}
@@ -0,0 +1,85 @@
+package ssh
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTextFileRoundTrip(t *testing.T) {
+	samples := map[string][]byte{
+		"empty":                {},
+		"LF with newline":      []byte("first\nsecond\n"),
+		"LF without newline":   []byte("first\nsecond"),
+		"CRLF":                 []byte("first\r\nsecond\r\n"),
+		"mixed endings":        []byte("first\r\nsecond\nthird\r\n"),
+		"UTF-8 BOM":            append([]byte{0xef, 0xbb, 0xbf}, []byte("héllo\n")...),
+		"UTF-16LE BOM":         {0xff, 0xfe, 'h', 0, 'i', 0, '\r', 0, '\n', 0},
+		"invalid UTF-8":        {0xff, 'a', '\n'},
+		"single empty line":    []byte("\n"),
+		"lone carriage return": []byte("a\rb\n"),
+	}
+
+	// Unchanged files must be encoded back byte-identical
+	for name, data := range samples {
+		textFile, err := ParseTextFile(data)
+		require.NoError(t, err, name)
+		encoded, err := textFile.Bytes()
+		require.NoError(t, err, name)
+		assert.Equal(t, data, encoded, "%s must round-trip unchanged", name)
+	}
+
+	// Detected format must be kept when lines change
+	textFile, err := ParseTextFile([]byte{0xff, 0xfe, 'h', 0, 'i', 0, '\r', 0, '\n', 0})
+	require.NoError(t, err)
+	assert.Equal(t, UTF16LE, textFile.Encoding)
+	assert.Equal(t, CRLF, textFile.LineEnding)
+	assert.True(t, textFile.BOM)
+	assert.True(t, textFile.TrailingNewline)
+	assert.Equal(t, []string{"hi"}, textFile.Strings)
+	textFile.Strings = append(textFile.Strings, "yo")
+	encoded, err := textFile.Bytes()
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0xff, 0xfe, 'h', 0, 'i', 0, '\r', 0, '\n', 0, 'y', 0, 'o', 0, '\r', 0, '\n', 0}, encoded)
+
+	// Struct literals without format keep the old behaviour of joining lines with "\n"
+	encoded, err = (&TextFile{Strings: []string{"a", "b"}}).Bytes()
+	require.NoError(t, err)
+	assert.Equal(t, "a\nb", string(encoded))
+}
+
+func TestReadTextFileErrors(t *testing.T) {
+	client := newTestServer(t).connect(t)
+	directory := t.TempDir()
+
+	_, err := ReadTextFile(client, filepath.Join(directory, "missing"))
+	assert.True(t, os.IsNotExist(err), "Missing file must be reported as not existing, got %v", err)
+
+	_, err = ReadTextFile(client, directory)
+	require.Error(t, err)
+	assert.False(t, os.IsNotExist(err), "Unreadable file must not look like a missing one")
+
+	// Known hosts must not be overwritten if they cannot be read
+	knownHostsPath := filepath.Join(directory, "known_hosts")
+	require.NoError(t, os.Mkdir(knownHostsPath, 0700))
+	callback := addRemoteKnownHostCallback(client, knownHostsPath)
+	assert.Error(t, callback("peer:22", nil, nil))
+	fileInfo, err := os.Stat(knownHostsPath)
+	require.NoError(t, err)
+	assert.True(t, fileInfo.IsDir())
+
+	// Existing CRLF file must keep its line endings when a line is appended
+	textPath := filepath.Join(directory, "hosts")
+	require.NoError(t, ioutil.WriteFile(textPath, []byte("a\r\nb"), 0640))
+	textFile, err := ReadTextFile(client, textPath)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), textFile.Mode)
+	textFile.Strings = append(textFile.Strings, "c")
+	require.NoError(t, WriteTextFile(client, textPath, textFile))
+	data, err := ioutil.ReadFile(textPath)
+	require.NoError(t, err)
+	assert.Equal(t, "a\r\nb\r\nc", string(data))
+}
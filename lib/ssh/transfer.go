@@ -2,10 +2,17 @@ package ssh
 
 import (
 	"github.com/hardboiledalex/go-tools/lib/utils"
+	"github.com/hardboiledalex/go-tools/lib/logging"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"github.com/melbahja/goph"
-	"github.com/pkg/sftp"
+	"io"
 	"io/ioutil"
 	"os"
+	"path"
+	"path/filepath"
 )
 
 type BinaryFile struct {
@@ -13,33 +20,42 @@ type BinaryFile struct {
 	Mode os.FileMode
 }
 
+// Text file split into lines
+// Files read with ReadTextFile remember encoding, line ending, trailing newline and BOM, so they are
+// written back byte-identical when nothing changed. Zero values mean UTF-8 with "\n" and no trailing newline
 type TextFile struct {
-	Strings []string
-	Mode    os.FileMode
+	Strings         []string
+	Mode            os.FileMode
+	Encoding        TextEncoding
+	LineEnding      string
+	TrailingNewline bool
+	BOM             bool
+	original        *TextFile
+	originalData    []byte
 }
 
 // Downloads binary file from the remote machine to memory
 // Returns file data in bytes, original file permissions and error if happened
 func DownloadBinaryFileToMemory(client *goph.Client, downloadPath string) (*BinaryFile, error) {
 	if client != nil {
-		sftpClient, err := sftp.NewClient(client.Client)
+		fs, err := openFileSystem(client)
 		if err != nil {
 			return nil, err
 		}
-		defer sftpClient.Close()
+		defer fs.Close()
 
-		remoteFile, err := sftpClient.Open(downloadPath)
+		fileInfo, err := fs.Stat(downloadPath)
 		if err != nil {
 			return nil, err
 		}
-		defer remoteFile.Close()
 
-		fileInfo, err := remoteFile.Stat()
+		remoteFile, err := fs.Open(downloadPath)
 		if err != nil {
 			return nil, err
 		}
+		defer remoteFile.Close()
 
-		data, err := ioutil.ReadAll(remoteFile)
+		data, err := ioutil.ReadAll(progressReader{remoteFile, nil, newThrottle(nil)})
 		if err != nil {
 			return nil, err
 		}
@@ -59,45 +75,345 @@ func DownloadBinaryFileToMemory(client *goph.Client, downloadPath string) (*Bina
 }
 
 // Uploads binary file from memory to the remote machine
+// The file is written to a temporary sibling and renamed into place
 // Returns an error if happened
 func UploadBinaryFileFromMemory(client *goph.Client, uploadPath string, binaryFile *BinaryFile) error {
-	if client != nil {
-		sftpClient, err := sftp.NewClient(client.Client)
-		if err != nil {
-			return err
-		}
-		defer sftpClient.Close()
-
-		file, err := sftpClient.Create(uploadPath)
-		if err != nil {
-			return err
-		}
-		defer file.Close()
-
-		err = file.Chmod(binaryFile.Mode)
-		if err != nil {
-			return err
-		}
+	return UploadBinaryFileFromMemoryWithOptions(client, uploadPath, binaryFile, TransferOptions{})
+}
 
-		_, err = file.Write(binaryFile.Data)
-		return err
-	} else {
-		return ioutil.WriteFile(uploadPath, binaryFile.Data, binaryFile.Mode)
-	}
+// Uploads binary file from memory to the remote machine, see TransferOptions for fsync and ownership
+// Returns an error if happened
+func UploadBinaryFileFromMemoryWithOptions(client *goph.Client, uploadPath string, binaryFile *BinaryFile, options TransferOptions) error {
+	_, err := UploadWithOptions(client, bytes.NewReader(binaryFile.Data), uploadPath, binaryFile.Mode, options)
+	return err
 }
 
 // Downloads text file from the remote machine to memory
 // Returns an empty structure if some error happened during download
+//
+// Deprecated: errors are swallowed and the last element is empty for files ending with a newline,
+// use ReadTextFile instead
 func DownloadTextFileToMemory(client *goph.Client, downloadPath string) *TextFile {
 	binaryFile, err := DownloadBinaryFileToMemory(client, downloadPath)
 	if err != nil {
-		return &TextFile{make([]string, 0), 0644}
+		return &TextFile{Strings: make([]string, 0), Mode: 0644}
 	}
-	return &TextFile{utils.BytesToStrings(binaryFile.Data), binaryFile.Mode}
+	return &TextFile{Strings: utils.BytesToStrings(binaryFile.Data), Mode: binaryFile.Mode}
 }
 
 // Uploads text file from memory to the remote machine
 // Returns an error if happened
 func UploadTextFileFromMemory(client *goph.Client, uploadPath string, textFile *TextFile) error {
-	return UploadBinaryFileFromMemory(client, uploadPath, &BinaryFile{utils.StringsToBytes(textFile.Strings), textFile.Mode})
+	return WriteTextFile(client, uploadPath, textFile)
+}
+
+// Streams file from the remote machine to the writer
+// Returns number of bytes written and error if happened
+func Download(client *goph.Client, remotePath string, writer io.Writer) (int64, error) {
+	return DownloadWithOptions(client, remotePath, writer, TransferOptions{})
+}
+
+// Streams data from the reader to a file on the remote machine, the file gets the given permissions
+// Returns number of bytes read and error if happened
+func Upload(client *goph.Client, reader io.Reader, remotePath string, mode os.FileMode) (int64, error) {
+	return UploadWithOptions(client, reader, remotePath, mode, TransferOptions{})
+}
+
+// Streams file from the remote machine to the writer
+// Resume and Verify options are not applicable to streams and ignored
+// Returns number of bytes written and error if happened
+func DownloadWithOptions(client *goph.Client, remotePath string, writer io.Writer, options TransferOptions) (int64, error) {
+	source, err := openFileSystemWithProtocol(client, options.Protocol)
+	if err != nil {
+		return 0, err
+	}
+	defer source.Close()
+
+	sourceFile, err := source.Open(remotePath)
+	if err != nil {
+		return 0, err
+	}
+	defer sourceFile.Close()
+
+	total := int64(-1)
+	if options.Progress != nil {
+		if fileInfo, err := source.Stat(remotePath); err == nil {
+			total = fileInfo.Size()
+		}
+	}
+	tracker := newProgressTracker(options.Progress, path.Base(remotePath), 0, total)
+	written, err := copyWithProgress(writer, sourceFile, tracker, newThrottle(options.RateLimiter))
+	if err != nil {
+		return written, err
+	}
+	tracker.finish()
+	return written, nil
+}
+
+// Streams data from the reader to a file on the remote machine, the file gets the given permissions
+// Resume and Verify options are not applicable to streams and ignored
+// Returns number of bytes read and error if happened
+func UploadWithOptions(client *goph.Client, reader io.Reader, remotePath string, mode os.FileMode, options TransferOptions) (int64, error) {
+	target, err := openFileSystemWithProtocol(client, options.Protocol)
+	if err != nil {
+		return 0, err
+	}
+	defer target.Close()
+
+	targetFile, err := createAtomically(target, remotePath, mode, -1, options)
+	if err != nil {
+		return 0, err
+	}
+
+	tracker := newProgressTracker(options.Progress, path.Base(remotePath), 0, -1)
+	read, err := copyWithProgress(targetFile, reader, tracker, newThrottle(options.RateLimiter))
+	if err != nil {
+		targetFile.Abort()
+		return read, err
+	}
+	if err := targetFile.Close(); err != nil {
+		return read, err
+	}
+	tracker.finish()
+	return read, nil
+}
+
+// Options of the file transfer
+// Resume writes to a hidden .<name>.partial sibling kept when the transfer fails, the next attempt continues
+// from its size and renames it over the target once complete. The resumed file is always verified. Verify compares SHA-256 of source and target after the transfer.
+// Progress is called while the transfer runs, see NewConsoleProgress for a ready-made console renderer.
+// Fsync flushes the written file to disk before it replaces the target. Owner sets ownership of the target
+// in the form user[:group] with names or numeric ids, names are resolved on the target machine.
+// Protocol selects the transport for the remote machine, SFTP with fallback to SCP by default.
+// RateLimiter limits the bandwidth of the transfer on top of the global limit, see SetGlobalRateLimit.
+// The same limiter may be passed to several transfers to share its budget
+type TransferOptions struct {
+	Resume      bool
+	Verify      bool
+	Progress    ProgressFunc
+	Fsync       bool
+	Owner       string
+	Protocol    TransferProtocol
+	RateLimiter *RateLimiter
+}
+
+// Transport used for file operations on the remote machine
+// SCP needs scp, find and GNU coreutils on the remote machine and is meant for servers with disabled SFTP
+type TransferProtocol int
+
+const (
+	ProtocolAuto TransferProtocol = iota
+	ProtocolSFTP
+	ProtocolSCP
+)
+
+func (protocol TransferProtocol) String() string {
+	switch protocol {
+	case ProtocolAuto:
+		return "auto"
+	case ProtocolSFTP:
+		return "sftp"
+	case ProtocolSCP:
+		return "scp"
+	default:
+		return "unknown"
+	}
+}
+
+// Returned when the target file does not match the source after the transfer
+type ChecksumMismatchError struct {
+	Source         string
+	Target         string
+	SourceChecksum string
+	TargetChecksum string
+}
+
+func (err *ChecksumMismatchError) Error() string {
+	return fmt.Sprintf("checksum mismatch after transfer of %s to %s: source SHA-256 %s, target SHA-256 %s",
+		err.Source, err.Target, err.SourceChecksum, err.TargetChecksum)
+}
+
+// Downloads file from the remote machine to the local file keeping original permissions
+// Returns an error if happened
+func DownloadFile(client *goph.Client, remotePath string, localPath string) error {
+	return DownloadFileWithOptions(client, remotePath, localPath, TransferOptions{})
+}
+
+// Uploads local file to the remote machine keeping original permissions
+// Returns an error if happened
+func UploadFile(client *goph.Client, localPath string, remotePath string) error {
+	return UploadFileWithOptions(client, localPath, remotePath, TransferOptions{})
+}
+
+// Downloads file from the remote machine to the local file keeping original permissions
+// Returns an error if happened, *ChecksumMismatchError if verification failed
+func DownloadFileWithOptions(client *goph.Client, remotePath string, localPath string, options TransferOptions) error {
+	source, err := openFileSystemWithProtocol(client, options.Protocol)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	_, err = transferFile(source, remotePath, localFileSystem{}, localPath, options)
+	return err
+}
+
+// Uploads local file to the remote machine keeping original permissions
+// Returns an error if happened, *ChecksumMismatchError if verification failed
+func UploadFileWithOptions(client *goph.Client, localPath string, remotePath string, options TransferOptions) error {
+	target, err := openFileSystemWithProtocol(client, options.Protocol)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+
+	_, err = transferFile(localFileSystem{}, localPath, target, remotePath, options)
+	return err
+}
+
+// Calculates SHA-256 of the file on the remote machine, or on the local one if client is nil
+// Uses sha256sum on the remote machine when available, otherwise reads the file over SFTP
+func FileChecksum(client *goph.Client, filePath string) (string, error) {
+	fileSystem, err := openFileSystem(client)
+	if err != nil {
+		return "", err
+	}
+	defer fileSystem.Close()
+
+	return fileSystem.Checksum(filePath)
+}
+
+// Copies single file between file systems keeping its permissions
+// Returns number of bytes copied in this call and error if happened
+func transferFile(source fileSystem, sourcePath string, target fileSystem, targetPath string, options TransferOptions) (int64, error) {
+	sourceInfo, err := source.Stat(sourcePath)
+	if err != nil {
+		return 0, err
+	}
+	if !sourceInfo.Mode().IsRegular() {
+		return 0, fmt.Errorf("%s is not a regular file", sourcePath)
+	}
+
+	if options.Resume {
+		return resumeFile(source, sourcePath, sourceInfo, target, targetPath, options)
+	}
+
+	sourceFile, err := source.Open(sourcePath)
+	if err != nil {
+		return 0, err
+	}
+	defer sourceFile.Close()
+
+	targetFile, err := createAtomically(target, targetPath, sourceInfo.Mode().Perm(), sourceInfo.Size(), options)
+	if err != nil {
+		return 0, err
+	}
+	tracker := newProgressTracker(options.Progress, path.Base(filepath.ToSlash(sourcePath)), 0, sourceInfo.Size())
+	written, err := copyWithProgress(targetFile, sourceFile, tracker, newThrottle(options.RateLimiter))
+	if err != nil {
+		targetFile.Abort()
+		return written, err
+	}
+	if err := targetFile.Close(); err != nil {
+		return written, err
+	}
+	tracker.finish()
+
+	if options.Verify {
+		return written, verifyTransfer(source, sourcePath, target, targetPath)
+	}
+	return written, nil
+}
+
+// Copies the file through its partial sibling, continuing from the content a failed attempt left there
+// The partial is kept if the copy fails, verified when complete and renamed over the target, the target is never appended to
+func resumeFile(source fileSystem, sourcePath string, sourceInfo os.FileInfo, target fileSystem, targetPath string, options TransferOptions) (int64, error) {
+	var uid, gid int
+	if options.Owner != "" {
+		var err error
+		if uid, gid, err = target.LookupOwner(options.Owner); err != nil {
+			return 0, err
+		}
+	}
+
+	partialPath := partialSiblingPath(target, targetPath)
+	var offset int64
+	if partialInfo, err := target.Lstat(partialPath); err == nil && partialInfo.Mode().IsRegular() && partialInfo.Size() <= sourceInfo.Size() {
+		offset = partialInfo.Size()
+	}
+
+	sourceFile, err := source.Open(sourcePath)
+	if err != nil {
+		return 0, err
+	}
+	defer sourceFile.Close()
+
+	var partialFile io.WriteCloser
+	if offset > 0 {
+		logging.LogInfof("Resuming transfer of %s from %s", sourcePath, utils.BytesToString(int(offset)))
+		if _, err := sourceFile.Seek(offset, io.SeekStart); err != nil {
+			return 0, err
+		}
+		partialFile, err = target.Append(partialPath)
+	} else {
+		partialFile, err = createWithSize(target, partialPath, sourceInfo.Mode().Perm(), sourceInfo.Size())
+	}
+	if err != nil {
+		return 0, err
+	}
+	tracker := newProgressTracker(options.Progress, path.Base(filepath.ToSlash(sourcePath)), offset, sourceInfo.Size())
+	written, err := copyWithProgress(partialFile, sourceFile, tracker, newThrottle(options.RateLimiter))
+	if err != nil {
+		partialFile.Close()
+		return written, err
+	}
+	if err := partialFile.Close(); err != nil {
+		return written, err
+	}
+	tracker.finish()
+
+	if err := verifyTransfer(source, sourcePath, target, partialPath); err != nil {
+		// Content that does not match is useless for the next attempt
+		if mismatch, isMismatch := err.(*ChecksumMismatchError); isMismatch {
+			mismatch.Target = targetPath
+			target.Remove(partialPath)
+		}
+		return written, err
+	}
+	if options.Fsync {
+		if err := target.Sync(partialPath); err != nil {
+			return written, err
+		}
+	}
+	if options.Owner != "" {
+		if err := target.Chown(partialPath, uid, gid); err != nil {
+			return written, fmt.Errorf("cannot change owner of %s: %v", targetPath, err)
+		}
+	}
+	return written, target.Rename(partialPath, targetPath)
+}
+
+func verifyTransfer(source fileSystem, sourcePath string, target fileSystem, targetPath string) error {
+	sourceChecksum, err := source.Checksum(sourcePath)
+	if err != nil {
+		return fmt.Errorf("cannot calculate checksum of %s: %v", sourcePath, err)
+	}
+	targetChecksum, err := target.Checksum(targetPath)
+	if err != nil {
+		return fmt.Errorf("cannot calculate checksum of %s: %v", targetPath, err)
+	}
+	if sourceChecksum != targetChecksum {
+		return &ChecksumMismatchError{sourcePath, targetPath, sourceChecksum, targetChecksum}
+	}
+	logging.LogDebugf("Transfer of %s verified, SHA-256 %s", sourcePath, sourceChecksum)
+	return nil
+}
+
+// Calculates SHA-256 of the stream as a lowercase hex string
+func readerChecksum(reader io.Reader) (string, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, reader); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
 }
@@ -0,0 +1,220 @@
+package ssh
+
+import (
+	"github.com/hardboiledalex/go-tools/lib/vfs"
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStreamingTransfer(t *testing.T) {
+	client := newTestServer(t).connect(t)
+	directory := t.TempDir()
+
+	// Data larger than a single SFTP packet must survive the round trip through the streaming API
+	data := make([]byte, 5*1024*1024+17)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+
+	remotePath := filepath.Join(directory, "remote.bin")
+	written, err := Upload(client, bytes.NewReader(data), remotePath, 0640)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)), written)
+
+	fileInfo, err := os.Stat(remotePath)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), fileInfo.Mode().Perm(), "Uploaded file must get the requested permissions")
+
+	var downloaded bytes.Buffer
+	read, err := Download(client, remotePath, &downloaded)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)), read)
+	assert.True(t, bytes.Equal(data, downloaded.Bytes()), "Downloaded data must match the uploaded data")
+
+	// File variants must keep the permissions of the source file
+	localPath := filepath.Join(directory, "local.bin")
+	require.NoError(t, DownloadFile(client, remotePath, localPath))
+	localData, err := ioutil.ReadFile(localPath)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(data, localData), "Downloaded file must match the remote file")
+
+	copyPath := filepath.Join(directory, "copy.bin")
+	require.NoError(t, UploadFile(nil, localPath, copyPath))
+	fileInfo, err = os.Stat(copyPath)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), fileInfo.Mode().Perm(), "Local fallback must keep the permissions of the source file")
+}
+
+func TestResumableTransfer(t *testing.T) {
+	client := newTestServer(t).connect(t)
+	directory := t.TempDir()
+
+	data := make([]byte, 3*1024*1024)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	localPath := filepath.Join(directory, "local.bin")
+	require.NoError(t, ioutil.WriteFile(localPath, data, 0644))
+
+	// Partial content left by a failed attempt must be completed from its size, verified and renamed over the target
+	remotePath := filepath.Join(directory, "remote.bin")
+	require.NoError(t, ioutil.WriteFile(remotePath, []byte("previous version"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(directory, ".remote.bin.partial"), data[:1024*1024], 0644))
+	require.NoError(t, UploadFileWithOptions(client, localPath, remotePath, TransferOptions{Resume: true}))
+	remoteData, err := ioutil.ReadFile(remotePath)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(data, remoteData), "Resumed upload must produce the original file")
+	assert.NoFileExists(t, filepath.Join(directory, ".remote.bin.partial"))
+
+	checksum, err := FileChecksum(client, remotePath)
+	require.NoError(t, err)
+	localChecksum, err := FileChecksum(nil, localPath)
+	require.NoError(t, err)
+	assert.Equal(t, localChecksum, checksum, "Remote and local checksums of equal files must match")
+
+	// Existing smaller target is an older version, not a prefix of the source
+	downloadPath := filepath.Join(directory, "download.bin")
+	require.NoError(t, ioutil.WriteFile(downloadPath, []byte("old"), 0644))
+	require.NoError(t, DownloadFileWithOptions(client, remotePath, downloadPath, TransferOptions{Resume: true}))
+	downloadData, err := ioutil.ReadFile(downloadPath)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(data, downloadData), "Existing target must be replaced, not appended to")
+
+	// Partial content that is not a prefix of the source must be reported as a checksum mismatch and discarded
+	corrupted := append([]byte{}, data[:1024]...)
+	corrupted[0] ^= 0xff
+	partialPath := filepath.Join(directory, ".download.bin.partial")
+	require.NoError(t, ioutil.WriteFile(partialPath, corrupted, 0644))
+	err = DownloadFileWithOptions(client, remotePath, downloadPath, TransferOptions{Resume: true})
+	require.Error(t, err)
+	_, isMismatch := err.(*ChecksumMismatchError)
+	assert.True(t, isMismatch, "Corrupted resumed download must return ChecksumMismatchError, got %v", err)
+	assert.NoFileExists(t, partialPath, "Partial content failing verification must not be resumed again")
+	downloadData, err = ioutil.ReadFile(downloadPath)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(data, downloadData), "Failed verification must leave the target untouched")
+}
+
+// Local file system whose files fail to read after the given number of bytes
+type interruptedFileSystem struct {
+	localFileSystem
+	limit int64
+}
+
+func (fs interruptedFileSystem) Open(name string) (vfs.ReadSeekCloser, error) {
+	file, err := fs.localFileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &interruptedFile{file, fs.limit}, nil
+}
+
+type interruptedFile struct {
+	vfs.ReadSeekCloser
+	remaining int64
+}
+
+func (file *interruptedFile) Read(p []byte) (int, error) {
+	if file.remaining <= 0 {
+		return 0, errors.New("connection lost")
+	}
+	if int64(len(p)) > file.remaining {
+		p = p[:file.remaining]
+	}
+	n, err := file.ReadSeekCloser.Read(p)
+	file.remaining -= int64(n)
+	return n, err
+}
+
+func TestInterruptedTransferResumes(t *testing.T) {
+	client := newTestServer(t).connect(t)
+	target, err := openFileSystem(client)
+	require.NoError(t, err)
+	defer target.Close()
+	directory := t.TempDir()
+
+	data := make([]byte, 2*1024*1024)
+	_, err = rand.Read(data)
+	require.NoError(t, err)
+	localPath := filepath.Join(directory, "local.bin")
+	require.NoError(t, ioutil.WriteFile(localPath, data, 0644))
+	remotePath := filepath.Join(directory, "remote.bin")
+	require.NoError(t, ioutil.WriteFile(remotePath, []byte("previous version"), 0644))
+	partialPath := filepath.Join(directory, ".remote.bin.partial")
+
+	// Interrupted transfer keeps what arrived and leaves the target untouched
+	_, err = transferFile(interruptedFileSystem{limit: 768 * 1024}, localPath, target, remotePath, TransferOptions{Resume: true})
+	require.Error(t, err)
+	partialInfo, err := os.Stat(partialPath)
+	require.NoError(t, err)
+	assert.Equal(t, int64(768*1024), partialInfo.Size())
+	remoteData, err := ioutil.ReadFile(remotePath)
+	require.NoError(t, err)
+	assert.Equal(t, "previous version", string(remoteData))
+
+	// Next attempt sends only the rest
+	written, err := transferFile(localFileSystem{}, localPath, target, remotePath, TransferOptions{Resume: true})
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)-768*1024), written)
+	remoteData, err = ioutil.ReadFile(remotePath)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(data, remoteData), "Resumed transfer must produce the original file")
+	assert.NoFileExists(t, partialPath)
+}
+
+func TestTransferProgress(t *testing.T) {
+	client := newTestServer(t).connect(t)
+	directory := t.TempDir()
+
+	data := make([]byte, 2*1024*1024)
+	localPath := filepath.Join(directory, "local.bin")
+	require.NoError(t, ioutil.WriteFile(localPath, data, 0644))
+
+	// The last reported state must be finished and account for every byte
+	var reports []TransferProgress
+	progress := func(progress TransferProgress) { reports = append(reports, progress) }
+	err := UploadFileWithOptions(client, localPath, filepath.Join(directory, "remote.bin"), TransferOptions{Progress: progress})
+	require.NoError(t, err)
+	require.NotEmpty(t, reports)
+	last := reports[len(reports)-1]
+	assert.True(t, last.Finished)
+	assert.Equal(t, int64(len(data)), last.Done)
+	assert.Equal(t, int64(len(data)), last.Total)
+	assert.Equal(t, float64(100), last.Percent())
+	assert.Contains(t, FormatProgress(TransferProgress{Name: "file", Done: 512, Total: 1024, ETA: 90 * time.Second}), "50% 512 B/1.0KB 0 B/s ETA 1:30")
+}
+
+func TestAtomicUpload(t *testing.T) {
+	client := newTestServer(t).connect(t)
+	directory := t.TempDir()
+	uploadPath := filepath.Join(directory, "service.conf")
+	require.NoError(t, ioutil.WriteFile(uploadPath, []byte("old"), 0644))
+
+	// Unknown owner must fail before the target is touched
+	options := TransferOptions{Owner: "no-such-user-for-test"}
+	err := UploadBinaryFileFromMemoryWithOptions(client, uploadPath, &BinaryFile{Data: []byte("new"), Mode: 0600}, options)
+	require.Error(t, err)
+	data, err := ioutil.ReadFile(uploadPath)
+	require.NoError(t, err)
+	assert.Equal(t, "old", string(data))
+
+	// Successful upload replaces the target and leaves no temporary files behind
+	owner := fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid())
+	options = TransferOptions{Owner: owner, Fsync: true}
+	err = UploadBinaryFileFromMemoryWithOptions(client, uploadPath, &BinaryFile{Data: []byte("new"), Mode: 0600}, options)
+	require.NoError(t, err)
+	data, err = ioutil.ReadFile(uploadPath)
+	require.NoError(t, err)
+	assert.Equal(t, "new", string(data))
+	entries, err := ioutil.ReadDir(directory)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1, "Temporary file must be renamed into place")
+	assert.Equal(t, os.FileMode(0600), entries[0].Mode().Perm())
+}
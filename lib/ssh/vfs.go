@@ -0,0 +1,71 @@
+package ssh
+
+import (
+	"github.com/hardboiledalex/go-tools/lib/vfs"
+	"fmt"
+	"github.com/melbahja/goph"
+)
+
+// Returns file system of the remote machine over SFTP or SCP, or vfs.Local if client is nil
+// The file system stays usable until the SSH client is closed
+func OpenFileSystem(client *goph.Client, protocol TransferProtocol) (vfs.FileSystem, error) {
+	return openFileSystemWithProtocol(client, protocol)
+}
+
+// Copies single file between any two file systems keeping its permissions, see TransferOptions
+// Returns an error if happened
+func CopyFile(source vfs.FileSystem, sourcePath string, target vfs.FileSystem, targetPath string, options TransferOptions) error {
+	_, err := transferFile(asFileSystem(source), sourcePath, asFileSystem(target), targetPath, options)
+	return err
+}
+
+// Copies directory tree between any two file systems, see DirectoryTransferOptions
+// Returns transfer statistics and error if happened
+func CopyDirectory(source vfs.FileSystem, sourceDirectory string, target vfs.FileSystem, targetDirectory string, options DirectoryTransferOptions) (*DirectoryTransferResult, error) {
+	return copyDirectory(asFileSystem(source), sourceDirectory, asFileSystem(target), targetDirectory, options)
+}
+
+// Returns the file system itself if it is one of this package, otherwise wraps it
+func asFileSystem(fs vfs.FileSystem) fileSystem {
+	switch fs := fs.(type) {
+	case fileSystem:
+		return fs
+	case vfs.LocalFileSystem:
+		return localFileSystem{fs}
+	}
+	return genericFileSystem{fs}
+}
+
+// Any vfs.FileSystem with the additional operations done through the generic ones
+type genericFileSystem struct {
+	vfs.FileSystem
+}
+
+func (fs genericFileSystem) Checksum(name string) (string, error) {
+	file, err := fs.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	return readerChecksum(file)
+}
+
+// There is no user database behind a generic file system, so only numeric ids are accepted
+func (fs genericFileSystem) LookupOwner(owner string) (int, int, error) {
+	return parseOwner(owner, func(name string) (string, string, error) {
+		return "", "", fmt.Errorf("unknown user %s: only numeric ids are supported", name)
+	}, func(name string) (string, error) {
+		return "", fmt.Errorf("unknown group %s: only numeric ids are supported", name)
+	})
+}
+
+// Nothing to flush for a generic file system
+func (fs genericFileSystem) Sync(name string) error {
+	return nil
+}
+
+func (fs genericFileSystem) Close() error {
+	return nil
+}
+
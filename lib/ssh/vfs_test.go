@@ -0,0 +1,50 @@
+package ssh
+
+import (
+	"github.com/hardboiledalex/go-tools/lib/vfs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCopyDirectoryFromMemory(t *testing.T) {
+	client := newTestServer(t).connect(t)
+	modTime := time.Date(2020, 12, 1, 10, 30, 0, 0, time.UTC)
+	source := vfs.NewMemoryFileSystem()
+	require.NoError(t, source.MkdirAll("/tree/conf", 0750))
+	require.NoError(t, vfs.WriteFile(source, "/tree/conf/app.yaml", []byte("key: value\n"), 0600))
+	require.NoError(t, source.Chtimes("/tree/conf/app.yaml", modTime, modTime))
+	require.NoError(t, source.Symlink("conf/app.yaml", "/tree/current.yaml"))
+
+	// Fake tree must be copied to a real remote file system the same way as a local one
+	remote, err := OpenFileSystem(client, ProtocolAuto)
+	require.NoError(t, err)
+	target := filepath.Join(t.TempDir(), "target")
+	result, err := CopyDirectory(source, "/tree", remote, target, DirectoryTransferOptions{TransferOptions: TransferOptions{Verify: true}})
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.Files)
+	assert.Equal(t, 1, result.Symlinks)
+
+	data, err := ioutil.ReadFile(filepath.Join(target, "conf", "app.yaml"))
+	require.NoError(t, err)
+	assert.Equal(t, "key: value\n", string(data))
+	fileInfo, err := os.Stat(filepath.Join(target, "conf", "app.yaml"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), fileInfo.Mode().Perm())
+	assert.True(t, modTime.Equal(fileInfo.ModTime()))
+
+	// And back into another fake tree
+	copied := vfs.NewMemoryFileSystem()
+	require.NoError(t, CopyFile(remote, filepath.Join(target, "conf", "app.yaml"), copied, "/app.yaml", TransferOptions{Owner: "1000:1000"}))
+	copiedData, err := vfs.ReadFile(copied, "/app.yaml")
+	require.NoError(t, err)
+	assert.Equal(t, data, copiedData)
+	uid, gid, err := copied.Owner("/app.yaml")
+	require.NoError(t, err)
+	assert.Equal(t, 1000, uid)
+	assert.Equal(t, 1000, gid)
+}
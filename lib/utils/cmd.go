@@ -45,3 +45,8 @@ func ExecShellWithOutput(command string) (string, error) {
 	out, err := exec.Command("sh", "-c", command).CombinedOutput()
 	return strings.TrimSuffix(string(out[:]), "\n"), err
 }
+
+//Quote argument for safe use in a POSIX shell command line
+func QuoteShellArgument(argument string) string {
+	return "'" + strings.ReplaceAll(argument, "'", `'"'"'`) + "'"
+}
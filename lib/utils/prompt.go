@@ -3,17 +3,23 @@ package utils
 import (
 	"github.com/hardboiledalex/go-tools/lib/logging"
 	"github.com/AlecAivazis/survey/v2"
+	"fmt"
 	"github.com/gookit/color"
 	"os"
 	"strings"
 )
 
+// Prompts are shown where the console messages of logging are printed
+func promptStdio() survey.AskOpt {
+	return survey.WithStdio(os.Stdin, logging.ConsoleOutput(), os.Stderr)
+}
+
 func PromptInput(message string) (string, error) {
 	output := ""
 	prompt := &survey.Input{
 		Message: message,
 	}
-	err := survey.AskOne(prompt, &output)
+	err := survey.AskOne(prompt, &output, promptStdio())
 	return output, err
 }
 
@@ -31,7 +37,7 @@ func PromptPassword(message string) (string, error) {
 	prompt := &survey.Password{
 		Message: message,
 	}
-	err := survey.AskOne(prompt, &password)
+	err := survey.AskOne(prompt, &password, promptStdio())
 	return password, err
 }
 
@@ -44,7 +50,7 @@ func PromptPasswordFailFast(message string) string {
 		}
 		trimmedPassword := strings.TrimSpace(password)
 		if trimmedPassword == "" {
-			color.Red.Println("Password cannot be empty. Please, try again.")
+			fmt.Fprintln(logging.ConsoleOutput(), color.Red.Sprint("Password cannot be empty. Please, try again."))
 			continue
 		}
 		return trimmedPassword
@@ -56,7 +62,7 @@ func PromptConfirm(message string) (bool, error) {
 	prompt := &survey.Confirm{
 		Message: message,
 	}
-	err := survey.AskOne(prompt, &output)
+	err := survey.AskOne(prompt, &output, promptStdio())
 	return output, err
 }
 
@@ -75,7 +81,7 @@ func PromptSelect(message string, inputOptions []string) (string, error) {
 		Message: message,
 		Options: inputOptions,
 	}
-	err := survey.AskOne(prompt, &output)
+	err := survey.AskOne(prompt, &output, promptStdio())
 	return output, err
 }
 
@@ -94,7 +100,7 @@ func PromptMultiSelect(message string, inputOptions []string) ([]string, error)
 		Message: message,
 		Options: inputOptions,
 	}
-	err := survey.AskOne(prompt, &outputOptions)
+	err := survey.AskOne(prompt, &outputOptions, promptStdio())
 	return outputOptions, err
 }
 
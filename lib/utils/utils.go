@@ -3,6 +3,7 @@ package utils
 import (
 	"archive/tar"
 	"github.com/hardboiledalex/go-tools/lib/logging"
+	"github.com/hardboiledalex/go-tools/lib/vfs"
 	"bufio"
 	"compress/gzip"
 	"crypto/rand"
@@ -59,21 +60,28 @@ func GetDirectories(dir string) []string {
 }
 
 func GetTarFilesInDir(dir string) []string {
-	file, err := os.Open(dir)
+	tarFiles, err := GetTarFilesInDirFS(vfs.Local, dir)
 	if err != nil {
 		logging.LogErrorf("Failed to open directory: %s", dir)
 		os.Exit(1)
 	}
-	defer CloseFile(file)
+	return tarFiles
+}
+
+// Returns names of tar archives in the directory of the given file system and error if happened
+func GetTarFilesInDirFS(fs vfs.FileSystem, dir string) ([]string, error) {
+	list, err := fs.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
 
 	var tarFiles []string
-	list, _ := file.Readdir(0)
 	for _, file := range list {
 		if ContainsOneOfStrings(file.Name(), ".tar", ".tar.gz", ".tgz") {
 			tarFiles = append(tarFiles, file.Name())
 		}
 	}
-	return tarFiles
+	return tarFiles, nil
 }
 
 func GetFilesInDirByPrefix(dir string, prefix string) ([]string, error) {
@@ -126,14 +134,7 @@ func GetDirContentAsStrings(dir string) []string {
 }
 
 func GetDirContent(dir string) []os.FileInfo {
-	file, err := os.Open(dir)
-	if err != nil {
-		logging.LogErrorf("Failed to open directory: %s", dir)
-		os.Exit(1)
-	}
-	defer CloseFile(file)
-
-	list, err := file.Readdir(0)
+	list, err := GetDirContentFS(vfs.Local, dir)
 	if err != nil {
 		logging.LogErrorf("Cannot retrieve content of %s\n", dir)
 		os.Exit(1)
@@ -141,6 +142,11 @@ func GetDirContent(dir string) []os.FileInfo {
 	return list
 }
 
+// Returns entries of the directory in the given file system and error if happened
+func GetDirContentFS(fs vfs.FileSystem, dir string) ([]os.FileInfo, error) {
+	return fs.ReadDir(dir)
+}
+
 func FindStringInArray(str string, arr []string) int {
 	for i, s := range arr {
 		if s == str {
@@ -362,13 +368,22 @@ func ResolveHostnameByIp(ipAddress string) string {
 
 // ReadFileToString reads all file content to string
 func ReadFileToString(filePath string) string {
-	fileBytes, err := ioutil.ReadFile(filePath)
+	content, err := ReadFileToStringFS(vfs.Local, filePath)
 	if err != nil {
 		logging.LogErrorf("Failed to read file: %s", filePath)
 		os.Exit(1)
 	}
 
-	return string(fileBytes[:])
+	return content
+}
+
+// ReadFileToStringFS reads all file content from the given file system to string
+func ReadFileToStringFS(fs vfs.FileSystem, filePath string) (string, error) {
+	fileBytes, err := vfs.ReadFile(fs, filePath)
+	if err != nil {
+		return "", err
+	}
+	return string(fileBytes), nil
 }
 
 func FileExists(path string) bool {
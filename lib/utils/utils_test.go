@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"github.com/hardboiledalex/go-tools/lib/vfs"
 	"fmt"
 	"github.com/stretchr/testify/assert"
 	"testing"
@@ -90,3 +91,26 @@ func TestIsAnyOfStringsInArray(t *testing.T) {
 	result = IsAnyOfStringsInArray(array, nonexistentElement, nonexistentElement)
 	assert.False(t, result, fmt.Sprintf("String \"%s\" must not contain an element \"%s\"", array, nonexistentElement))
 }
+
+func TestFileSystemVariants(t *testing.T) {
+	fs := vfs.NewMemoryFileSystem()
+	assert.NoError(t, fs.MkdirAll("/backups", 0755))
+	assert.NoError(t, vfs.WriteFile(fs, "/backups/first.tar.gz", []byte("archive"), 0644))
+	assert.NoError(t, vfs.WriteFile(fs, "/backups/notes.txt", []byte("notes"), 0644))
+
+	// Functions accepting file system must work on a fake tree the same way as on the local one
+	tarFiles, err := GetTarFilesInDirFS(fs, "/backups")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"first.tar.gz"}, tarFiles)
+
+	content, err := GetDirContentFS(fs, "/backups")
+	assert.NoError(t, err)
+	assert.Len(t, content, 2)
+
+	text, err := ReadFileToStringFS(fs, "/backups/notes.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "notes", text)
+
+	_, err = ReadFileToStringFS(fs, "/backups/missing.txt")
+	assert.Error(t, err, "Missing file must be reported as error instead of exiting")
+}
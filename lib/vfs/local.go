@@ -0,0 +1,83 @@
+package vfs
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// File system of the local machine, a thin wrapper around the os package
+type LocalFileSystem struct{}
+
+// Local file system ready to use
+var Local FileSystem = LocalFileSystem{}
+
+func (LocalFileSystem) Open(name string) (ReadSeekCloser, error) {
+	return os.Open(name)
+}
+
+func (LocalFileSystem) Create(name string, mode os.FileMode) (io.WriteCloser, error) {
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return nil, err
+	}
+	if err := file.Chmod(mode); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+func (LocalFileSystem) Append(name string) (io.WriteCloser, error) {
+	return os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0)
+}
+
+func (LocalFileSystem) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (LocalFileSystem) Lstat(name string) (os.FileInfo, error) {
+	return os.Lstat(name)
+}
+
+func (LocalFileSystem) ReadDir(name string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(name)
+}
+
+func (LocalFileSystem) Readlink(name string) (string, error) {
+	return os.Readlink(name)
+}
+
+func (LocalFileSystem) Symlink(oldname string, newname string) error {
+	return os.Symlink(oldname, newname)
+}
+
+func (LocalFileSystem) MkdirAll(name string, mode os.FileMode) error {
+	return os.MkdirAll(name, mode)
+}
+
+func (LocalFileSystem) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (LocalFileSystem) Rename(oldname string, newname string) error {
+	return os.Rename(oldname, newname)
+}
+
+func (LocalFileSystem) Chmod(name string, mode os.FileMode) error {
+	return os.Chmod(name, mode)
+}
+
+func (LocalFileSystem) Chown(name string, uid int, gid int) error {
+	return os.Chown(name, uid, gid)
+}
+
+func (LocalFileSystem) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return os.Chtimes(name, atime, mtime)
+}
+
+func (LocalFileSystem) Join(elements ...string) string {
+	return filepath.Join(elements...)
+}
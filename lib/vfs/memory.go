@@ -0,0 +1,509 @@
+package vfs
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Maximum number of symlinks resolved along one path, same as ELOOP limit on Linux
+const maximumSymlinkDepth = 40
+
+// File system kept entirely in memory, meant for tests
+// Paths are slash-separated, relative ones are resolved from the root. Symlinks, permissions,
+// ownership and modification times are stored but permissions are not enforced. Safe for concurrent use
+type MemoryFileSystem struct {
+	mutex sync.Mutex
+	nodes map[string]*memoryNode
+}
+
+type memoryNode struct {
+	mode    os.FileMode
+	data    []byte
+	target  string
+	modTime time.Time
+	uid     int
+	gid     int
+}
+
+// Creates empty file system with the root directory only
+func NewMemoryFileSystem() *MemoryFileSystem {
+	return &MemoryFileSystem{nodes: map[string]*memoryNode{
+		"/": {mode: os.ModeDir | 0755, modTime: time.Now()},
+	}}
+}
+
+func (fs *MemoryFileSystem) Open(name string) (ReadSeekCloser, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	_, node, err := fs.lookup("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if node.mode.IsDir() {
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+	}
+	// Reader gets a copy, so writes after Open do not change what is read
+	return memoryReader{bytes.NewReader(append([]byte(nil), node.data...))}, nil
+}
+
+func (fs *MemoryFileSystem) Create(name string, mode os.FileMode) (io.WriteCloser, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	resolved, err := fs.resolve("create", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if node, found := fs.nodes[resolved]; found {
+		if node.mode.IsDir() {
+			return nil, &os.PathError{Op: "create", Path: name, Err: syscall.EISDIR}
+		}
+		node.data = nil
+		node.mode = mode & permissionBits
+		node.modTime = time.Now()
+		return &memoryWriter{fs: fs, node: node, name: name}, nil
+	}
+	if err := fs.checkParent("create", name, resolved); err != nil {
+		return nil, err
+	}
+	node := &memoryNode{mode: mode & permissionBits, modTime: time.Now()}
+	fs.nodes[resolved] = node
+	return &memoryWriter{fs: fs, node: node, name: name}, nil
+}
+
+func (fs *MemoryFileSystem) Append(name string) (io.WriteCloser, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	_, node, err := fs.lookup("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if node.mode.IsDir() {
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+	}
+	return &memoryWriter{fs: fs, node: node, name: name}, nil
+}
+
+func (fs *MemoryFileSystem) Stat(name string) (os.FileInfo, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	_, node, err := fs.lookup("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return newMemoryFileInfo(name, node), nil
+}
+
+func (fs *MemoryFileSystem) Lstat(name string) (os.FileInfo, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	_, node, err := fs.lookup("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+	return newMemoryFileInfo(name, node), nil
+}
+
+// Returns directory entries sorted by name
+func (fs *MemoryFileSystem) ReadDir(name string) ([]os.FileInfo, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	resolved, node, err := fs.lookup("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if !node.mode.IsDir() {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: syscall.ENOTDIR}
+	}
+	var entries []os.FileInfo
+	for _, child := range fs.children(resolved) {
+		entries = append(entries, newMemoryFileInfo(child, fs.nodes[child]))
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+func (fs *MemoryFileSystem) Readlink(name string) (string, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	_, node, err := fs.lookup("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	if node.mode&os.ModeSymlink == 0 {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: syscall.EINVAL}
+	}
+	return node.target, nil
+}
+
+func (fs *MemoryFileSystem) Symlink(oldname string, newname string) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	resolved, err := fs.resolve("symlink", newname, false)
+	if err == nil {
+		if _, found := fs.nodes[resolved]; found {
+			err = os.ErrExist
+		} else {
+			err = fs.checkParent("symlink", newname, resolved)
+		}
+	}
+	if err != nil {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: underlyingError(err)}
+	}
+	fs.nodes[resolved] = &memoryNode{mode: os.ModeSymlink | 0777, target: oldname, modTime: time.Now()}
+	return nil
+}
+
+func (fs *MemoryFileSystem) MkdirAll(name string, mode os.FileMode) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	current := "/"
+	for _, element := range splitPath(name) {
+		next, err := fs.resolve("mkdir", path.Join(current, element), true)
+		if err != nil {
+			return err
+		}
+		node, found := fs.nodes[next]
+		if !found {
+			node = &memoryNode{mode: os.ModeDir | mode&permissionBits, modTime: time.Now()}
+			fs.nodes[next] = node
+			fs.touch(path.Dir(next))
+		}
+		if !node.mode.IsDir() {
+			return &os.PathError{Op: "mkdir", Path: name, Err: syscall.ENOTDIR}
+		}
+		current = next
+	}
+	return nil
+}
+
+// Removes file, symlink or empty directory
+func (fs *MemoryFileSystem) Remove(name string) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	resolved, node, err := fs.lookup("remove", name, false)
+	if err != nil {
+		return err
+	}
+	if resolved == "/" {
+		return &os.PathError{Op: "remove", Path: name, Err: syscall.EBUSY}
+	}
+	if node.mode.IsDir() && len(fs.children(resolved)) > 0 {
+		return &os.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+	}
+	delete(fs.nodes, resolved)
+	fs.touch(path.Dir(resolved))
+	return nil
+}
+
+// Renames the entry with everything it contains, an existing target file or empty directory is replaced
+func (fs *MemoryFileSystem) Rename(oldname string, newname string) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	if err := fs.rename(oldname, newname); err != nil {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: underlyingError(err)}
+	}
+	return nil
+}
+
+func (fs *MemoryFileSystem) rename(oldname string, newname string) error {
+	oldPath, node, err := fs.lookup("rename", oldname, false)
+	if err != nil {
+		return err
+	}
+	newPath, err := fs.resolve("rename", newname, false)
+	if err != nil {
+		return err
+	}
+	if oldPath == newPath {
+		return nil
+	}
+	if oldPath == "/" || strings.HasPrefix(newPath, oldPath+"/") {
+		return syscall.EINVAL
+	}
+	if err := fs.checkParent("rename", newname, newPath); err != nil {
+		return err
+	}
+	if existing, found := fs.nodes[newPath]; found {
+		switch {
+		case existing.mode.IsDir() && !node.mode.IsDir():
+			return syscall.EISDIR
+		case !existing.mode.IsDir() && node.mode.IsDir():
+			return syscall.ENOTDIR
+		case existing.mode.IsDir() && len(fs.children(newPath)) > 0:
+			return syscall.ENOTEMPTY
+		}
+	}
+
+	for _, descendant := range fs.descendants(oldPath) {
+		fs.nodes[newPath+strings.TrimPrefix(descendant, oldPath)] = fs.nodes[descendant]
+		delete(fs.nodes, descendant)
+	}
+	fs.nodes[newPath] = node
+	delete(fs.nodes, oldPath)
+	fs.touch(path.Dir(oldPath))
+	fs.touch(path.Dir(newPath))
+	return nil
+}
+
+func (fs *MemoryFileSystem) Chmod(name string, mode os.FileMode) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	_, node, err := fs.lookup("chmod", name, true)
+	if err != nil {
+		return err
+	}
+	node.mode = node.mode&os.ModeType | mode&permissionBits
+	return nil
+}
+
+// Follows symlinks like os.Chown
+func (fs *MemoryFileSystem) Chown(name string, uid int, gid int) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	_, node, err := fs.lookup("chown", name, true)
+	if err != nil {
+		return err
+	}
+	if uid >= 0 {
+		node.uid = uid
+	}
+	if gid >= 0 {
+		node.gid = gid
+	}
+	return nil
+}
+
+func (fs *MemoryFileSystem) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	_, node, err := fs.lookup("chtimes", name, true)
+	if err != nil {
+		return err
+	}
+	node.modTime = mtime
+	return nil
+}
+
+func (fs *MemoryFileSystem) Join(elements ...string) string {
+	return path.Join(elements...)
+}
+
+// Returns numeric owner and group of the entry, symlinks are not followed
+func (fs *MemoryFileSystem) Owner(name string) (int, int, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	_, node, err := fs.lookup("owner", name, false)
+	if err != nil {
+		return 0, 0, err
+	}
+	return node.uid, node.gid, nil
+}
+
+// Permissions together with setuid, setgid and sticky bits
+const permissionBits = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// Resolves the path and returns its node, missing entry is os.ErrNotExist
+func (fs *MemoryFileSystem) lookup(operation string, name string, followLast bool) (string, *memoryNode, error) {
+	resolved, err := fs.resolve(operation, name, followLast)
+	if err != nil {
+		return "", nil, err
+	}
+	node, found := fs.nodes[resolved]
+	if !found {
+		return "", nil, &os.PathError{Op: operation, Path: name, Err: os.ErrNotExist}
+	}
+	return resolved, node, nil
+}
+
+// Resolves symlinks along the path, the last element only with followLast
+// The last element does not have to exist, so the result can be used to create it
+func (fs *MemoryFileSystem) resolve(operation string, name string, followLast bool) (string, error) {
+	elements := splitPath(name)
+	current := "/"
+	for depth := 0; len(elements) > 0; {
+		next := path.Join(current, elements[0])
+		elements = elements[1:]
+		node, found := fs.nodes[next]
+		if !found {
+			if len(elements) > 0 {
+				return "", &os.PathError{Op: operation, Path: name, Err: os.ErrNotExist}
+			}
+			return next, nil
+		}
+		if node.mode&os.ModeSymlink != 0 && (len(elements) > 0 || followLast) {
+			if depth++; depth > maximumSymlinkDepth {
+				return "", &os.PathError{Op: operation, Path: name, Err: syscall.ELOOP}
+			}
+			target := node.target
+			if !path.IsAbs(target) {
+				target = path.Join(current, target)
+			}
+			elements = append(splitPath(target), elements...)
+			current = "/"
+			continue
+		}
+		if !node.mode.IsDir() && len(elements) > 0 {
+			return "", &os.PathError{Op: operation, Path: name, Err: syscall.ENOTDIR}
+		}
+		current = next
+	}
+	return current, nil
+}
+
+func (fs *MemoryFileSystem) checkParent(operation string, name string, resolved string) error {
+	parent, found := fs.nodes[path.Dir(resolved)]
+	if !found {
+		return &os.PathError{Op: operation, Path: name, Err: os.ErrNotExist}
+	}
+	if !parent.mode.IsDir() {
+		return &os.PathError{Op: operation, Path: name, Err: syscall.ENOTDIR}
+	}
+	fs.touch(path.Dir(resolved))
+	return nil
+}
+
+// Directory modification time changes when its entries are added or removed
+func (fs *MemoryFileSystem) touch(directory string) {
+	if node, found := fs.nodes[directory]; found {
+		node.modTime = time.Now()
+	}
+}
+
+func (fs *MemoryFileSystem) children(directory string) []string {
+	var children []string
+	for _, descendant := range fs.descendants(directory) {
+		if path.Dir(descendant) == directory {
+			children = append(children, descendant)
+		}
+	}
+	return children
+}
+
+func (fs *MemoryFileSystem) descendants(directory string) []string {
+	prefix := strings.TrimSuffix(directory, "/") + "/"
+	var descendants []string
+	for name := range fs.nodes {
+		if name != "/" && strings.HasPrefix(name, prefix) {
+			descendants = append(descendants, name)
+		}
+	}
+	return descendants
+}
+
+func splitPath(name string) []string {
+	var elements []string
+	for _, element := range strings.Split(path.Clean("/"+name), "/") {
+		if element != "" {
+			elements = append(elements, element)
+		}
+	}
+	return elements
+}
+
+// Unwraps *os.PathError, so the operation is not reported twice inside *os.LinkError
+func underlyingError(err error) error {
+	if pathError, ok := err.(*os.PathError); ok {
+		return pathError.Err
+	}
+	return err
+}
+
+type memoryReader struct {
+	*bytes.Reader
+}
+
+func (memoryReader) Close() error {
+	return nil
+}
+
+type memoryWriter struct {
+	fs     *MemoryFileSystem
+	node   *memoryNode
+	name   string
+	closed bool
+}
+
+func (writer *memoryWriter) Write(p []byte) (int, error) {
+	writer.fs.mutex.Lock()
+	defer writer.fs.mutex.Unlock()
+
+	if writer.closed {
+		return 0, &os.PathError{Op: "write", Path: writer.name, Err: os.ErrClosed}
+	}
+	writer.node.data = append(writer.node.data, p...)
+	writer.node.modTime = time.Now()
+	return len(p), nil
+}
+
+func (writer *memoryWriter) Close() error {
+	writer.fs.mutex.Lock()
+	defer writer.fs.mutex.Unlock()
+
+	if writer.closed {
+		return &os.PathError{Op: "close", Path: writer.name, Err: os.ErrClosed}
+	}
+	writer.closed = true
+	return nil
+}
+
+type memoryFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func newMemoryFileInfo(name string, node *memoryNode) *memoryFileInfo {
+	base := path.Base(path.Clean("/" + name))
+	size := int64(len(node.data))
+	if node.mode&os.ModeSymlink != 0 {
+		size = int64(len(node.target))
+	}
+	return &memoryFileInfo{base, size, node.mode, node.modTime}
+}
+
+func (fileInfo *memoryFileInfo) Name() string {
+	return fileInfo.name
+}
+
+func (fileInfo *memoryFileInfo) Size() int64 {
+	return fileInfo.size
+}
+
+func (fileInfo *memoryFileInfo) Mode() os.FileMode {
+	return fileInfo.mode
+}
+
+func (fileInfo *memoryFileInfo) ModTime() time.Time {
+	return fileInfo.modTime
+}
+
+func (fileInfo *memoryFileInfo) IsDir() bool {
+	return fileInfo.mode.IsDir()
+}
+
+func (fileInfo *memoryFileInfo) Sys() interface{} {
+	return nil
+}
@@ -0,0 +1,65 @@
+package vfs
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"testing"
+)
+
+func TestMemoryFileSystem(t *testing.T) {
+	fs := NewMemoryFileSystem()
+	require.NoError(t, fs.MkdirAll("/opt/app/conf", 0750))
+	require.NoError(t, WriteFile(fs, "/opt/app/conf/app.yaml", []byte("key: value\n"), 0600))
+	require.NoError(t, fs.Symlink("conf/app.yaml", "/opt/app/current.yaml"))
+
+	// Files are read back through symlinks, Lstat reports the link itself
+	data, err := ReadFile(fs, "/opt/app/current.yaml")
+	require.NoError(t, err)
+	assert.Equal(t, "key: value\n", string(data))
+	fileInfo, err := fs.Lstat("/opt/app/current.yaml")
+	require.NoError(t, err)
+	assert.True(t, fileInfo.Mode()&os.ModeSymlink != 0)
+	fileInfo, err = fs.Stat("/opt/app/current.yaml")
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), fileInfo.Mode())
+	assert.Equal(t, int64(11), fileInfo.Size())
+
+	// Errors must be recognisable like the ones of the os package
+	_, err = fs.Stat("/opt/missing")
+	assert.True(t, os.IsNotExist(err))
+	assert.True(t, os.IsExist(fs.Symlink("x", "/opt/app/current.yaml")))
+	assert.Error(t, fs.Remove("/opt/app"), "Directory with entries must not be removed")
+	_, err = fs.Create("/opt/missing/file", 0644)
+	assert.True(t, os.IsNotExist(err), "File cannot be created in a missing directory")
+
+	appender, err := fs.Append("/opt/app/conf/app.yaml")
+	require.NoError(t, err)
+	_, err = appender.Write([]byte("other: value\n"))
+	require.NoError(t, err)
+	require.NoError(t, appender.Close())
+
+	// Renamed directory takes its content along
+	require.NoError(t, fs.Rename("/opt/app", "/opt/service"))
+	entries, err := fs.ReadDir("/opt/service")
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, "conf", entries[0].Name())
+	assert.Equal(t, "current.yaml", entries[1].Name())
+	data, err = ReadFile(fs, "/opt/service/conf/app.yaml")
+	require.NoError(t, err)
+	assert.Equal(t, "key: value\nother: value\n", string(data))
+	assert.False(t, Exists(fs, "/opt/app"))
+
+	require.NoError(t, fs.Chown("/opt/service/conf/app.yaml", 1000, 1001))
+	uid, gid, err := fs.Owner("/opt/service/conf/app.yaml")
+	require.NoError(t, err)
+	assert.Equal(t, 1000, uid)
+	assert.Equal(t, 1001, gid)
+
+	// Chown follows symlinks like os.Chown
+	require.NoError(t, fs.Chown("/opt/service/current.yaml", 1002, 1003))
+	uid, gid, err = fs.Owner("/opt/service/conf/app.yaml")
+	require.NoError(t, err)
+	assert.Equal(t, []int{1002, 1003}, []int{uid, gid})
+}
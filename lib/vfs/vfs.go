@@ -0,0 +1,70 @@
+// Package vfs defines file system interface shared by the local machine, remote machines and in-memory trees
+// Code written against FileSystem can run on real files in production and on a fake tree in tests
+package vfs
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// File operations mirroring the functions of the os package with the same names
+// Errors are *os.PathError (*os.LinkError for Rename and Symlink), so os.IsNotExist and alike work for all implementations.
+// Paths are native for the local implementation and slash-separated for the others, Join builds them correctly
+type FileSystem interface {
+	Open(name string) (ReadSeekCloser, error)
+	// Creates or truncates the file and sets its permissions
+	Create(name string, mode os.FileMode) (io.WriteCloser, error)
+	// Opens an existing file for writing at its end
+	Append(name string) (io.WriteCloser, error)
+	Stat(name string) (os.FileInfo, error)
+	Lstat(name string) (os.FileInfo, error)
+	ReadDir(name string) ([]os.FileInfo, error)
+	Readlink(name string) (string, error)
+	Symlink(oldname string, newname string) error
+	MkdirAll(name string, mode os.FileMode) error
+	Remove(name string) error
+	Rename(oldname string, newname string) error
+	Chmod(name string, mode os.FileMode) error
+	Chown(name string, uid int, gid int) error
+	Chtimes(name string, atime time.Time, mtime time.Time) error
+	Join(elements ...string) string
+}
+
+type ReadSeekCloser interface {
+	io.Reader
+	io.Seeker
+	io.Closer
+}
+
+// Reads the whole file
+func ReadFile(fs FileSystem, name string) ([]byte, error) {
+	file, err := fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return ioutil.ReadAll(file)
+}
+
+// Writes data to the file creating it with the given permissions or truncating it
+func WriteFile(fs FileSystem, name string, data []byte, mode os.FileMode) error {
+	file, err := fs.Create(name, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, bytes.NewReader(data)); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Checks whether the entry exists, symlinks are not followed
+func Exists(fs FileSystem, name string) bool {
+	_, err := fs.Lstat(name)
+	return err == nil
+}